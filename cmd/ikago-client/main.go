@@ -1,50 +1,28 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
-	"github.com/sparrc/go-ping"
 	"github.com/xtaci/kcp-go"
-	"github.com/zhxie/ikago/internal/addr"
+	"github.com/zhxie/ikago/internal/client"
 	"github.com/zhxie/ikago/internal/config"
-	"github.com/zhxie/ikago/internal/crypto"
-	"github.com/zhxie/ikago/internal/exec"
 	"github.com/zhxie/ikago/internal/log"
 	"github.com/zhxie/ikago/internal/pcap"
-	"github.com/zhxie/ikago/internal/stat"
-	"io"
-	"math"
-	"math/rand"
-	"net"
-	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"strings"
-	"sync"
 	"syscall"
-	"time"
 )
 
-type natIndicator struct {
-	srcHardwareAddr net.HardwareAddr
-	conn            *pcap.RawConn
-}
-
 const name string = "IkaGo-client"
 
-const pingDeadline = 2 * time.Second
-
 var (
 	version     = ""
 	build       = ""
 	commit      = ""
 	versionInfo string
-	startTime   time.Time
 )
 
 var (
@@ -61,6 +39,20 @@ type natIndicator struct {
 	argVerbose        = flag.Bool("v", false, "Print verbose messages.")
 	argLog            = flag.String("log", "", "Log.")
 	argMTU            = flag.Int("mtu", pcap.MaxEthernetMTU, "MTU.")
+	argObfs           = flag.String("obfs", "plain", "Method of obfuscation.")
+	argFingerprint    = flag.String("fingerprint", "", "TCP fingerprint.")
+	argFlows          = flag.Int("flows", 1, "Number of parallel flows.")
+	argStripe         = flag.String("stripe", "", "Method of striping packets across flows.")
+	argFEC            = flag.Int("fec", 0, "Group size of FEC.")
+	argFECParity      = flag.Float64("fec-parity", 0.3, "Parity ratio of FEC.")
+	argDup            = flag.Int("dup", 1, "Times of sending packets.")
+	argDupDelay       = flag.Int("dup-delay", 0, "Delay between duplicated packets in milliseconds.")
+	argDupPorts       = flag.String("dup-ports", "", "Ports of packets to duplicate.")
+	argHop            = flag.String("hop", "", "Port range of server for hopping.")
+	argHopInterval    = flag.Int("hop-interval", 0, "Interval of hopping in seconds.")
+	argKeepalive      = flag.Int("keepalive", 0, "Interval of heartbeats in seconds.")
+	argKeepaliveMiss  = flag.Int("keepalive-misses", 3, "Misses of heartbeats before reconnecting.")
+	argRoam           = flag.Bool("roam", false, "Enable roaming.")
 	argKCP            = flag.Bool("kcp", false, "Enable KCP.")
 	argKCPMTU         = flag.Int("kcp-mtu", kcp.IKCP_MTU_DEF, "KCP tuning option mtu.")
 	argKCPSendWindow  = flag.Int("kcp-sndwnd", kcp.IKCP_WND_SND, "KCP tuning option sndwnd.")
@@ -72,43 +64,20 @@ type natIndicator struct {
 	argKCPInterval    = flag.Int("kcp-interval", kcp.IKCP_INTERVAL, "KCP tuning option interval.")
 	argKCPResend      = flag.Int("kcp-resend", 0, "KCP tuning option resend.")
 	argKCPNC          = flag.Int("kcp-nc", 0, "KCP tuning option nc.")
-	argPublish        = flag.String("publish", "", "ARP publishing address.")
+	argHost           = flag.String("host", "", "Host in HTTP header.")
+	argPath           = flag.String("path", "/", "Path in HTTP request.")
+	argSNI            = flag.String("sni", "", "Server name indication in TLS.")
+	argPin            = flag.String("pin", "", "Pin of server certificate in TLS.")
+	argALPN           = flag.String("alpn", "ikago", "Application protocol in QUIC.")
+	argPublish        = flag.String("publish", "", "ARP and NDP publishing addresses.")
+	argTun            = flag.String("tun", "", "TUN device for listening.")
 	argFragment       = flag.Int("fragment", pcap.MaxEthernetMTU, "Fragmentation size for listening.")
 	argUpPort         = flag.Int("p", 0, "Port for routing upstream.")
+	argReplay         = flag.String("replay", "", "Pcap file for replaying.")
+	argReplayOutput   = flag.String("replay-output", "", "Pcap file for packets sent in replaying.")
+	argCapture        = flag.String("capture", "", "Directory for capturing packets.")
 	argSources        = flag.String("r", "", "Sources.")
-	argServer         = flag.String("s", "", "Server.")
-)
-
-var (
-	publishIP  *net.IPAddr
-	fragment   int
-	upPort     uint16
-	sources    []*net.IPAddr
-	serverIP   net.IP
-	serverPort uint16
-	listenDevs []*pcap.Device
-	upDev      *pcap.Device
-	gatewayDev *pcap.Device
-	mode       string
-	crypt      crypto.Crypt
-	mtu        int
-	isKCP      bool
-	kcpConfig  *config.KCPConfig
-)
-
-var (
-	isClosed    bool
-	listenConns []*pcap.RawConn
-	upConn      net.Conn
-	c           chan pcap.ConnPacket
-	natLock     sync.RWMutex
-	nat         map[string]*natIndicator
-	pingTime    int64
-	pingSeq     int
-	pinger      *ping.Pinger
-	monitor     *stat.TrafficMonitor
-	dnsLock     sync.RWMutex
-	dns         map[string]string
+	argServer         = flag.String("s", "", "Servers in priority.")
 )
 
 func init() {
@@ -129,9 +98,6 @@ func init() {
 	}
 	log.Infof("%s %s\n\n", name, versionInfo)
 
-	// Start time
-	startTime = time.Now()
-
 	// Parse arguments
 	flag.Parse()
 
@@ -142,22 +108,12 @@ func init() {
 			*argConfig = "config.json"
 		}
 	}
-
-	sources = make([]*net.IPAddr, 0)
-	listenDevs = make([]*pcap.Device, 0)
-
-	listenConns = make([]*pcap.RawConn, 0)
-	c = make(chan pcap.ConnPacket, 1000)
-	nat = make(map[string]*natIndicator)
-	pingTime = -1
-	dns = make(map[string]string)
 }
 
 func main() {
 	var (
-		err     error
-		cfg     *config.Config
-		gateway net.IP
+		err error
+		cfg *config.Config
 	)
 
 	// Configuration
@@ -180,6 +136,20 @@ func main() {
 		cfg.Verbose = *argVerbose
 		cfg.Log = *argLog
 		cfg.MTU = *argMTU
+		cfg.Obfs = *argObfs
+		cfg.Fingerprint = *argFingerprint
+		cfg.Flows = *argFlows
+		cfg.Stripe = *argStripe
+		cfg.FEC = *argFEC
+		cfg.FECParity = *argFECParity
+		cfg.Dup = *argDup
+		cfg.DupDelay = *argDupDelay
+		cfg.DupPorts = splitArg(*argDupPorts)
+		cfg.Hop = *argHop
+		cfg.HopInterval = *argHopInterval
+		cfg.Keepalive = *argKeepalive
+		cfg.KeepMisses = *argKeepaliveMiss
+		cfg.Roam = *argRoam
 		cfg.KCP = *argKCP
 		cfg.KCPConfig = *config.NewKCPConfig()
 		cfg.KCPConfig.MTU = *argKCPMTU
@@ -192,11 +162,17 @@ func main() {
 		cfg.KCPConfig.Interval = *argKCPInterval
 		cfg.KCPConfig.Resend = *argKCPResend
 		cfg.KCPConfig.NC = *argKCPNC
+		cfg.Host = *argHost
+		cfg.Path = *argPath
+		cfg.SNI = *argSNI
+		cfg.Pin = *argPin
+		cfg.ALPN = *argALPN
 		cfg.Publish = *argPublish
+		cfg.Tun = *argTun
 		cfg.Fragment = *argFragment
 		cfg.Port = *argUpPort
 		cfg.Sources = splitArg(*argSources)
-		cfg.Server = *argServer
+		cfg.Server = splitArg(*argServer)
 	}
 
 	// Log
@@ -243,318 +219,54 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Verify parameters
-	if cfg.Gateway != "" {
-		gateway = net.ParseIP(cfg.Gateway)
-		if gateway == nil {
-			log.Fatalln(fmt.Errorf("invalid gateway %s", cfg.Gateway))
+	// Replay
+	var (
+		replay *pcap.Replay
+		devs   []*pcap.Device
+		ready  chan struct{}
+	)
+	if *argReplay != "" {
+		if cfg.Tun != "" {
+			log.Fatalln("tun not support in replay")
 		}
-	}
-	if cfg.Monitor < 0 || cfg.Monitor > 65535 {
-		log.Fatalln(fmt.Errorf("monitor port %d out of range", cfg.Monitor))
-	}
-	if cfg.MTU < 576 || cfg.MTU > pcap.MaxMTU {
-		log.Fatalln(fmt.Errorf("mtu %d out of range", cfg.MTU))
-	}
-	if cfg.KCPConfig.MTU > 1500 {
-		log.Fatalln(fmt.Errorf("kcp mtu %d out of range", cfg.KCPConfig.MTU))
-	}
-	if cfg.KCPConfig.SendWindow <= 0 || cfg.KCPConfig.SendWindow > math.MaxInt32 {
-		log.Fatalln(fmt.Errorf("kcp send window %d out of range", cfg.KCPConfig.SendWindow))
-	}
-	if cfg.KCPConfig.RecvWindow <= 0 || cfg.KCPConfig.RecvWindow > math.MaxInt32 {
-		log.Fatalln(fmt.Errorf("kcp receive window %d out of range", cfg.KCPConfig.RecvWindow))
-	}
-	if cfg.KCPConfig.DataShard < 0 {
-		log.Fatalln(fmt.Errorf("kcp data shard %d out of range", cfg.KCPConfig.DataShard))
-	}
-	if cfg.KCPConfig.ParityShard < 0 {
-		log.Fatalln(fmt.Errorf("kcp parity shard %d out of range", cfg.KCPConfig.ParityShard))
-	}
-	if cfg.KCPConfig.Interval < 0 {
-		log.Fatalln(fmt.Errorf("kcp interval %d out of range", cfg.KCPConfig.Interval))
-	}
-	if cfg.KCPConfig.Resend < 0 {
-		log.Fatalln(fmt.Errorf("kcp resend %d out of range", cfg.KCPConfig.Resend))
-	}
-	if cfg.KCPConfig.NC < 0 {
-		log.Fatalln(fmt.Errorf("kcp nc %d out of range", cfg.KCPConfig.NC))
-	}
-	if cfg.Fragment < 576 || cfg.Fragment > pcap.MaxMTU {
-		log.Fatalln(fmt.Errorf("fragment %d out of range", cfg.Fragment))
-	}
-	if cfg.Port < 0 || cfg.Port > 65535 {
-		log.Fatalln(fmt.Errorf("upstream port %d out of range", cfg.Port))
-	}
-	if len(cfg.Sources) <= 0 {
-		log.Fatalln("Please provide sources by -r addresses.")
-	}
-	if cfg.Server == "" {
-		log.Fatalln("Please provide server by -s address.")
-	}
-
-	// Find devices
-	listenDevs, err = pcap.FindListenDevs(cfg.ListenDevs)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("find listen devices: %w", err))
-	}
-	if len(cfg.ListenDevs) <= 0 {
-		// Remove loopback devices by default
-		result := make([]*pcap.Device, 0)
 
-		for _, dev := range listenDevs {
-			if dev.IsLoop() {
-				continue
-			}
-			result = append(result, dev)
+		output := *argReplayOutput
+		if output == "" {
+			output = strings.TrimSuffix(*argReplay, filepath.Ext(*argReplay)) + ".out.pcap"
 		}
 
-		listenDevs = result
-	}
-	if len(listenDevs) <= 0 {
-		log.Fatalln(errors.New("cannot determine listen device"))
-	}
-
-	upDev, gatewayDev, err = pcap.FindUpstreamDevAndGatewayDev(cfg.UpDev, gateway)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("find upstream device and gateway device: %w", err))
-	}
-	if upDev == nil && gatewayDev == nil {
-		log.Fatalln(errors.New("cannot determine upstream device and gateway device"))
-	}
-	if upDev == nil {
-		log.Fatalln(errors.New("cannot determine upstream device"))
-	}
-	if gatewayDev == nil {
-		log.Fatalln(errors.New("cannot determine gateway device"))
-	}
-
-	// Mode
-	switch cfg.Mode {
-	case "faketcp":
-		mode = "faketcp"
-		log.Infoln("Use FakeTCP")
-	case "tcp":
-		mode = "tcp"
-		log.Infoln("Use standard TCP")
-	default:
-		log.Fatalln(fmt.Errorf("mode %s not support", cfg.Mode))
-	}
-
-	// Crypt
-	crypt, err = crypto.ParseCrypt(cfg.Method, cfg.Password)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("parse crypt: %w", err))
-	}
-	method := crypt.Method()
-	if method != crypto.MethodPlain {
-		log.Infof("Encrypt with %s\n", method)
-	}
-
-	// Monitor
-	if cfg.Monitor != 0 {
-		if cfg.Monitor == int(upPort) {
-			log.Fatalln(fmt.Errorf("same monitor port with upstream port"))
+		replay, err = pcap.OpenReplay(*argReplay, output)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("open replay: %w", err))
 		}
+		log.Infof("Replay packets from %s to %s\n", *argReplay, output)
 
-		monitor = stat.NewTrafficMonitor()
-
-		// Host HTTP server
-		http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-			b, err := json.Marshal(&struct {
-				Name    string               `json:"name"`
-				Version string               `json:"version"`
-				Time    int                  `json:"time"`
-				Monitor *stat.TrafficMonitor `json:"monitor"`
-				Ping    int64                `json:"ping"`
-			}{
-				Name:    name,
-				Version: versionInfo,
-				Time:    int(time.Now().Sub(startTime).Seconds()),
-				Monitor: monitor,
-				Ping:    pingTime,
-			})
-			if err != nil {
-				log.Errorln(fmt.Errorf("monitor: %w", err))
-				return
-			}
-
-			// Handle CORS
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-
-			_, err = io.WriteString(w, string(b))
-			if err != nil {
-				log.Errorln(fmt.Errorf("monitor: %w", err))
-			}
-		})
-		http.HandleFunc("/dns", func(w http.ResponseWriter, req *http.Request) {
-			type IPName struct {
-				IP   string `json:"ip"`
-				Name string `json:"name"`
-			}
-
-			ipNames := make([]IPName, 0)
-			dnsLock.RLock()
-			for ip, name := range dns {
-				ipNames = append(ipNames, IPName{
-					IP:   ip,
-					Name: name,
-				})
-			}
-			dnsLock.RUnlock()
-
-			b, err := json.Marshal(ipNames)
-			if err != nil {
-				log.Errorln(fmt.Errorf("monitor: %w", err))
-				return
-			}
-
-			// Handle CORS
-			w.Header().Set("Access-Control-Allow-Origin", "*")
+		allDevs, err := pcap.FindAllDevs()
+		if err != nil {
+			log.Fatalln(fmt.Errorf("find all devices: %w", err))
+		}
+		devs = replay.Devices(allDevs)
 
-			_, err = io.WriteString(w, string(b))
-			if err != nil {
-				log.Errorln(fmt.Errorf("monitor: %w", err))
-			}
-		})
+		// Packets are replayed once the client handles packets, and the client is closed after all packets are replayed
+		ready = make(chan struct{})
 		go func() {
-			err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Monitor), nil)
-			if err != nil {
-				log.Errorln(fmt.Errorf("monitor: %w", err))
-			}
+			<-ready
+			replay.Start()
+			<-replay.Done()
+			client.Close()
 		}()
 
-		log.Infof("Monitor on :%d\n", cfg.Monitor)
-		log.Infoln("You can now observe traffic on http://ikago.ikas.ink")
+		// Firewall rules are not added in replay, for no packet is sent to the system
+		cfg.Rule = false
 	}
 
-	// Add rule
-	if cfg.Rule {
-		var (
-			ok   bool
-			devs map[string]bool
-		)
-
-		ok = true
-		devs = make(map[string]bool)
-
-		// IP forwarding
-		err := exec.DisableIPForwarding()
+	// Capture
+	if *argCapture != "" {
+		err = pcap.OpenCapture(*argCapture, name)
 		if err != nil {
-			log.Errorln(fmt.Errorf("disable ip forwarding: %w", err))
-		} else {
-			log.Infoln("Disable IP forwarding")
-		}
-
-		// GRO
-		for _, dev := range listenDevs {
-			devs[dev.Alias()] = true
-		}
-		devs[upDev.Alias()] = true
-
-		for dev := range devs {
-			err := exec.DisableGRO(dev)
-			if err != nil {
-				log.Errorln(fmt.Errorf("disable gro: %w", err))
-				ok = false
-			}
-		}
-		if ok {
-			log.Infoln("Disable GRO")
-		}
-	}
-
-	// Mode-related options
-	switch mode {
-	case "faketcp":
-		// MTU
-		mtu = cfg.MTU
-		log.Infof("Set MTU to %d Bytes\n", mtu)
-
-		// KCP
-		isKCP = cfg.KCP
-		kcpConfig = &cfg.KCPConfig
-		if isKCP {
-			log.Infoln("Enable KCP")
-		}
-	case "tcp":
-		break
-	default:
-		log.Fatalln(fmt.Errorf("mode %s not support", mode))
-	}
-
-	// Publish
-	if cfg.Publish != "" {
-		ip := net.ParseIP(cfg.Publish)
-		if ip == nil {
-			log.Errorln(fmt.Errorf("invalid publish %s", cfg.Publish))
-		}
-		publishIP = &net.IPAddr{IP: ip}
-	}
-	if publishIP != nil {
-		log.Infof("Publish %s\n", publishIP.IP)
-	}
-
-	// Fragment
-	fragment = cfg.Fragment
-	log.Infof("Set fragment to %d Bytes\n", fragment)
-
-	// Randomize upstream port
-	if cfg.Port == 0 {
-		s := rand.NewSource(time.Now().UnixNano())
-		for cfg.Port == 0 || cfg.Port == cfg.Monitor {
-			r := rand.New(s)
-			cfg.Port = 49152 + r.Intn(16384)
-		}
-	}
-	upPort = uint16(cfg.Port)
-
-	// Sources
-	for _, source := range cfg.Sources {
-		ip := net.ParseIP(source)
-		if ip == nil {
-			log.Fatalln(fmt.Errorf("invalid source %s", source))
-		}
-		sources = append(sources, &net.IPAddr{IP: ip})
-	}
-
-	// Server
-	serverAddr, err := addr.ParseTCPAddr(cfg.Server)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("parse server %s: %w", cfg.Server, err))
-	}
-	serverIP = serverAddr.IP
-	serverPort = uint16(serverAddr.Port)
-
-	// Add firewall rule (delay)
-	if cfg.Rule {
-		// Firewall
-		switch mode {
-		case "faketcp":
-			err = exec.AddSpecificFirewallRule(serverIP, serverPort)
-			if err != nil {
-				log.Errorln(fmt.Errorf("add firewall rule: %w", err))
-			} else {
-				log.Infoln("Add firewall rule")
-			}
-		case "tcp":
-			break
-		default:
-			log.Fatalln(fmt.Errorf("mode %s not support", cfg.Mode))
-		}
-	}
-
-	if len(sources) == 1 {
-		log.Infof("Proxy %s through :%d to %s\n", sources[0], upPort, serverAddr)
-	} else {
-		log.Infoln("Proxy:")
-		for i, f := range sources {
-			if i != len(sources)-1 {
-				log.Infof("  %s\n", f)
-			} else {
-				log.Infof("  %s through :%d to %s\n", f, upPort, serverAddr)
-			}
+			log.Fatalln(fmt.Errorf("open capture: %w", err))
 		}
+		log.Infof("Capture packets to %s\n", *argCapture)
 	}
 
 	// Wait signals
@@ -562,427 +274,22 @@ type IPName struct {
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sig
-		closeAll()
-		os.Exit(0)
-	}()
-
-	// Open pcap
-	err = open()
-	if err != nil {
-		log.Fatalln(fmt.Errorf("open pcap: %w", err))
-	}
-}
-
-func open() error {
-	var err error
-
-	if len(listenDevs) == 1 {
-		log.Infof("Listen on %s\n", listenDevs[0].String())
-	} else {
-		log.Infoln("Listen on:")
-		for _, dev := range listenDevs {
-			log.Infof("  %s\n", dev.String())
-		}
-	}
-	if !gatewayDev.IsLoop() {
-		log.Infof("Route upstream from %s to %s\n", upDev, gatewayDev)
-	} else {
-		log.Infof("Route upstream in %s\n", upDev)
-	}
-
-	// Filters for listening
-	fs := make([]string, 0)
-	for _, f := range sources {
-		s, err := addr.SrcBPFFilter(f)
-		if err != nil {
-			return fmt.Errorf("parse filter %s: %w", f, err)
-		}
-
-		fs = append(fs, s)
-	}
-	f := strings.Join(fs, " || ")
-	filter := fmt.Sprintf("ip && (((tcp || udp) && (%s) && not (src host %s && src port %d)) || ((icmp || (ip[6:2] & 0x1fff) != 0) && (%s) && not src host %s))",
-		f, serverIP, serverPort, f, serverIP)
-	if publishIP != nil {
-		s, err := addr.DstBPFFilter(publishIP)
-		if err != nil {
-			return fmt.Errorf("parse filter %s: %w", f, err)
-		}
-		filter = filter + fmt.Sprintf(" || (arp[6:2] = 1 && %s)", s)
-	}
-
-	// Handles for listening
-	for _, dev := range listenDevs {
-		var (
-			err  error
-			conn *pcap.RawConn
-		)
-
-		if dev.IsLoop() {
-			conn, err = pcap.CreateRawConn(dev, dev, filter)
-		} else {
-			conn, err = pcap.CreateRawConn(dev, gatewayDev, filter)
-		}
-		if err != nil {
-			return fmt.Errorf("open listen device %s: %w", conn.LocalDev().Alias(), err)
-		}
-
-		listenConns = append(listenConns, conn)
-	}
-
-	// Handle for routing upstream
-	switch mode {
-	case "faketcp":
-		if isKCP {
-			upConn, err = pcap.DialFakeTCPWithKCP(upDev, gatewayDev, upPort, &net.TCPAddr{IP: serverIP, Port: int(serverPort)}, crypt, mtu, kcpConfig)
-		} else {
-			upConn, err = pcap.DialFakeTCP(upDev, gatewayDev, upPort, &net.TCPAddr{IP: serverIP, Port: int(serverPort)}, crypt, mtu)
-		}
-	case "tcp":
-		upConn, err = pcap.DialTCP(upDev, upPort, &net.TCPAddr{IP: serverIP, Port: int(serverPort)}, crypt)
-	default:
-		err = fmt.Errorf("mode %s not support", mode)
-	}
-	if err != nil {
-		return fmt.Errorf("open upstream: %w", err)
-	}
-
-	// Ping
-	if monitor != nil {
-		pinger, err = ping.NewPinger(serverIP.String())
-		if err != nil {
-			log.Errorln(fmt.Errorf("ping: %w", err))
-		}
-		if pinger != nil {
-			pinger.SetPrivileged(true)
-			pinger.OnRecv = func(packet *ping.Packet) {
-				if packet != nil {
-					pingTime = packet.Rtt.Milliseconds()
-					pingSeq = packet.Seq
-
-					log.Verbosef("Receive ICMP Echo Reply: %s <- %s (%d ms)\n", upDev.IPAddr().IP, serverIP, packet.Rtt.Milliseconds())
-
-					// Timeout
-					go func() {
-						time.Sleep(pingDeadline)
-						if packet.Seq == pingSeq {
-							pingTime = -2
-
-							log.Errorf("Cannot receive ICMP Echo Reply from server %s, is your network down?\n", serverIP)
-						}
-					}()
-				}
-			}
-		}
-	}
-	if pinger != nil {
-		go func() {
-			pinger.Run()
-		}()
-	}
-
-	// Start handling
-	for i := 0; i < len(listenConns); i++ {
-		conn := listenConns[i]
-
-		go func() {
-			for {
-				packet, err := conn.ReadPacket()
-				if err != nil {
-					if isClosed {
-						return
-					}
-					log.Errorln(fmt.Errorf("read listen device %s: %w", conn.LocalDev().Alias(), err))
-					continue
-				}
-
-				c <- pcap.ConnPacket{Packet: packet, Conn: conn}
-			}
-		}()
-	}
-
-	go func() {
-		for cp := range c {
-			err := handleListen(cp.Packet, cp.Conn)
-			if err != nil {
-				log.Errorln(fmt.Errorf("handle listen in device %s: %w", cp.Conn.LocalDev().Alias(), err))
-				log.Verboseln(cp.Packet)
-				continue
-			}
+		client.Close()
+		if replay != nil {
+			replay.Close()
 		}
+		pcap.CloseCapture()
+		os.Exit(0)
 	}()
 
-	b := make([]byte, pcap.IPv4MaxSize)
-	for {
-		n, err := upConn.Read(b)
-		if err != nil {
-			if isClosed {
-				return nil
-			}
-			if errors.Is(err, io.EOF) {
-				log.Fatalf("Connection to server %s is closed, is the server or your network down?\n", upConn.RemoteAddr())
-			}
-			log.Errorln(fmt.Errorf("read upstream: %w", err))
-			continue
-		}
-
-		err = handleUpstream(b[:n])
-		if err != nil {
-			log.Errorln(fmt.Errorf("handle upstream in address %s: %w", upConn.LocalAddr().String(), err))
-			log.Verbosef("Source: %s\nSize: %d Bytes\n\n", upConn.RemoteAddr().String(), n)
-			continue
-		}
-	}
-}
-
-func closeAll() {
-	isClosed = true
-	for _, handle := range listenConns {
-		if handle != nil {
-			handle.Close()
-		}
-	}
-	if upConn != nil {
-		upConn.Close()
-	}
-	if pinger != nil {
-		pinger.Stop()
-	}
-}
-
-func publish(packet gopacket.Packet, conn *pcap.RawConn) error {
-	var (
-		indicator    *pcap.PacketIndicator
-		arpLayer     *layers.ARP
-		newARPLayer  *layers.ARP
-		linkLayer    gopacket.Layer
-		newLinkLayer *layers.Ethernet
-	)
-
-	// Parse packet
-	indicator, err := pcap.ParsePacket(packet)
-	if err != nil {
-		return fmt.Errorf("parse packet: %w", err)
-	}
-
-	if t := indicator.NetworkLayer().LayerType(); t != layers.LayerTypeARP {
-		return fmt.Errorf("network layer type %s not support", t)
-	}
-
-	// Create new ARP layer
-	arpLayer = indicator.ARPLayer()
-	newARPLayer = &layers.ARP{
-		AddrType:          arpLayer.AddrType,
-		Protocol:          arpLayer.Protocol,
-		HwAddressSize:     arpLayer.HwAddressSize,
-		ProtAddressSize:   arpLayer.ProtAddressSize,
-		Operation:         layers.ARPReply,
-		SourceHwAddress:   conn.LocalDev().HardwareAddr(),
-		SourceProtAddress: arpLayer.DstProtAddress,
-		DstHwAddress:      arpLayer.SourceHwAddress,
-		DstProtAddress:    arpLayer.SourceProtAddress,
-	}
-
-	// Create new link layer
-	linkLayer = packet.LinkLayer()
-
-	switch t := linkLayer.LayerType(); t {
-	case layers.LayerTypeEthernet:
-		newLinkLayer = &layers.Ethernet{
-			SrcMAC:       conn.LocalDev().HardwareAddr(),
-			DstMAC:       linkLayer.(*layers.Ethernet).SrcMAC,
-			EthernetType: linkLayer.(*layers.Ethernet).EthernetType,
-		}
-	default:
-		return fmt.Errorf("link layer type %s not support", t)
-	}
-
-	// Serialize layers
-	data, err := pcap.Serialize(newLinkLayer, newARPLayer)
-	if err != nil {
-		return fmt.Errorf("serialize: %w", err)
-	}
-
-	// Write packet data
-	_, err = conn.Write(data)
-	if err != nil {
-		return fmt.Errorf("write: %w", err)
-	}
-
-	// Reconnect
-	if upConn != nil {
-		switch upConn.(type) {
-		case *pcap.FakeTCPConn:
-			err = upConn.(*pcap.FakeTCPConn).Reconnect()
-		default:
-			break
-		}
-	}
-	if err != nil {
-		return fmt.Errorf("reconnect: %w", err)
-	}
-
-	log.Infof("Device %s [%s] joined the network\n", indicator.SrcIP(), net.HardwareAddr(arpLayer.SourceHwAddress))
-	log.Verbosef("Reply an %s request: %s -> %s\n", indicator.NetworkLayer().LayerType(), indicator.SrcIP(), indicator.DstIP())
-
-	return nil
-}
-
-func handleListen(packet gopacket.Packet, conn *pcap.RawConn) error {
-	var (
-		err          error
-		indicator    *pcap.PacketIndicator
-		hardwareAddr net.HardwareAddr
-		data         []byte
-	)
-
-	// Parse packet
-	indicator, err = pcap.ParsePacket(packet)
-	if err != nil {
-		return fmt.Errorf("parse packet: %w", err)
-	}
-
-	// ARP
-	if indicator.NetworkLayer().LayerType() == layers.LayerTypeARP {
-		err := publish(packet, conn)
-		if err != nil {
-			return fmt.Errorf("publish: %w", err)
-		}
-		return nil
+	err = client.Run(cfg, versionInfo, devs, ready)
+	if replay != nil {
+		replay.Close()
 	}
-
-	// Record source hardware address
-	switch t := indicator.LinkLayer().LayerType(); t {
-	case layers.LayerTypeEthernet:
-		hardwareAddr = indicator.SrcHardwareAddr()
-	default:
-		hardwareAddr, _ = net.ParseMAC("00:00:00:00:00:00")
-	}
-
-	data = make([]byte, 0)
-	data = append(data, packet.NetworkLayer().LayerContents()...)
-	data = append(data, packet.NetworkLayer().LayerPayload()...)
-
-	// Write packet data
-	_, err = upConn.Write(data)
+	pcap.CloseCapture()
 	if err != nil {
-		return fmt.Errorf("write: %w", err)
+		log.Fatalln(err)
 	}
-
-	// Record the connection of the packet
-	ni, ok := nat[indicator.SrcIP().String()]
-	if !ok || ni.srcHardwareAddr.String() != hardwareAddr.String() {
-		natLock.Lock()
-		nat[indicator.SrcIP().String()] = &natIndicator{srcHardwareAddr: hardwareAddr, conn: conn}
-		natLock.Unlock()
-	}
-
-	// Statistics
-	size := indicator.MTU()
-	if monitor != nil {
-		monitor.AddBidirectional(indicator.SrcIP().String(), indicator.DstIP().String(), stat.DirectionOut, uint(size))
-	}
-
-	log.Verbosef("Redirect an outbound %s packet: %s -> %s (%d Bytes)\n",
-		indicator.TransportProtocol(), indicator.Src().String(), indicator.Dst().String(), size)
-
-	return nil
-}
-
-func handleUpstream(contents []byte) error {
-	var (
-		err              error
-		embIndicator     *pcap.PacketIndicator
-		newLinkLayerType gopacket.LayerType
-		newLinkLayer     gopacket.Layer
-		fragments        [][]byte
-	)
-
-	// Empty payload
-	if len(contents) <= 0 {
-		// return errors.New("empty payload")
-		return nil
-	}
-
-	// Parse embedded packet
-	embIndicator, err = pcap.ParseEmbPacket(contents)
-	if err != nil {
-		return fmt.Errorf("parse embedded packet: %w", err)
-	}
-
-	// Check map
-	natLock.RLock()
-	ni, ok := nat[embIndicator.DstIP().String()]
-	natLock.RUnlock()
-	if !ok {
-		return fmt.Errorf("missing nat to %s", embIndicator.DstIP())
-	}
-
-	// Decide Loopback or Ethernet
-	if ni.conn.IsLoop() {
-		newLinkLayerType = layers.LayerTypeLoopback
-	} else {
-		newLinkLayerType = layers.LayerTypeEthernet
-	}
-
-	// Create new link layer
-	switch newLinkLayerType {
-	case layers.LayerTypeLoopback:
-		newLinkLayer, err = pcap.CreateLoopbackLayer(embIndicator.NetworkLayer().(gopacket.NetworkLayer))
-	case layers.LayerTypeEthernet:
-		newLinkLayer, err = pcap.CreateEthernetLayer(ni.conn.LocalDev().HardwareAddr(), ni.srcHardwareAddr, embIndicator.NetworkLayer().(gopacket.NetworkLayer))
-	default:
-		return fmt.Errorf("link layer type %s not support", newLinkLayerType)
-	}
-	if err != nil {
-		return fmt.Errorf("create link layer: %w", err)
-	}
-
-	// Fragment
-	fragments, err = pcap.CreateFragmentPackets(newLinkLayer, embIndicator.NetworkLayer(), embIndicator.TransportLayer(), gopacket.Payload(embIndicator.Payload()), fragment)
-	if err != nil {
-		return fmt.Errorf("fragment: %w", err)
-	}
-
-	// Write packet data
-	for i, fragment := range fragments {
-		_, err = ni.conn.Write(fragment)
-		if err != nil {
-			return fmt.Errorf("write: %w", err)
-		}
-
-		if i == len(fragments)-1 {
-			log.Verbosef("Redirect an inbound %s packet: %s <- %s (%d Bytes)\n",
-				embIndicator.TransportProtocol(), embIndicator.Dst().String(), embIndicator.Src().String(), embIndicator.Size())
-		} else {
-			log.Verbosef("Redirect an inbound %s packet: %s <- %s (...)\n",
-				embIndicator.TransportProtocol(), embIndicator.Dst().String(), embIndicator.Src().String())
-		}
-	}
-
-	// Statistics
-	if monitor != nil {
-		monitor.AddBidirectional(embIndicator.DstIP().String(), embIndicator.SrcIP().String(), stat.DirectionIn, uint(embIndicator.Size()))
-	}
-
-	// Record DNS
-	if monitor != nil {
-		if embIndicator.DNSIndicator() != nil {
-			if embIndicator.DNSIndicator().IsResponse() {
-				name, ips := embIndicator.DNSIndicator().Answers()
-				if name != "" && len(ips) > 0 {
-					dnsLock.Lock()
-					for _, ip := range ips {
-						dns[ip.String()] = name
-						log.Verbosef("Record DNS record %s = %s\n", name, ip)
-					}
-					dnsLock.Unlock()
-				}
-			}
-		}
-	}
-
-	return nil
 }
 
 func splitArg(s string) []string {
@@ -1,71 +1,28 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"github.com/xtaci/kcp-go"
-	"github.com/zhxie/ikago/internal/addr"
 	"github.com/zhxie/ikago/internal/config"
-	"github.com/zhxie/ikago/internal/crypto"
-	"github.com/zhxie/ikago/internal/exec"
 	"github.com/zhxie/ikago/internal/log"
 	"github.com/zhxie/ikago/internal/pcap"
-	"github.com/zhxie/ikago/internal/stat"
-	"io"
-	"math"
-	"net"
-	"net/http"
+	"github.com/zhxie/ikago/internal/server"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"strings"
-	"sync"
 	"syscall"
-	"time"
 )
 
-type quintuple struct {
-	src      string
-	dst      string
-	protocol gopacket.LayerType
-}
-
-type natIndicator struct {
-	src    net.Addr
-	embSrc net.Addr
-	conn   net.Conn
-}
-
-func (indicator *natIndicator) embSrcIP() net.IP {
-	switch t := indicator.embSrc.(type) {
-	case *net.IPAddr:
-		return indicator.embSrc.(*net.IPAddr).IP
-	case *net.TCPAddr:
-		return indicator.embSrc.(*net.TCPAddr).IP
-	case *net.UDPAddr:
-		return indicator.embSrc.(*net.UDPAddr).IP
-	case *addr.ICMPQueryAddr:
-		return indicator.embSrc.(*addr.ICMPQueryAddr).IP
-	default:
-		panic(fmt.Errorf("type %T not support", t))
-	}
-}
-
 const name string = "IkaGo-server"
 
-const keepAlive = 30 * time.Second
-const keepFragments = 30 * time.Second
-
 var (
 	version     = ""
 	build       = ""
 	commit      = ""
 	versionInfo string
-	startTime   time.Time
 )
 
 var (
@@ -82,6 +39,18 @@ func (indicator *natIndicator) embSrcIP() net.IP {
 	argVerbose        = flag.Bool("v", false, "Print verbose messages.")
 	argLog            = flag.String("log", "", "Log.")
 	argMTU            = flag.Int("mtu", pcap.MaxEthernetMTU, "MTU.")
+	argObfs           = flag.String("obfs", "plain", "Method of obfuscation.")
+	argFingerprint    = flag.String("fingerprint", "", "TCP fingerprint.")
+	argStripe         = flag.String("stripe", "", "Method of striping packets across flows.")
+	argFEC            = flag.Int("fec", 0, "Group size of FEC.")
+	argFECParity      = flag.Float64("fec-parity", 0.3, "Parity ratio of FEC.")
+	argDup            = flag.Int("dup", 1, "Times of sending packets.")
+	argDupDelay       = flag.Int("dup-delay", 0, "Delay between duplicated packets in milliseconds.")
+	argDupPorts       = flag.String("dup-ports", "", "Ports of packets to duplicate.")
+	argHop            = flag.String("hop", "", "Port range for hopping.")
+	argKeepalive      = flag.Int("keepalive", 0, "Interval of heartbeats in seconds.")
+	argKeepaliveMiss  = flag.Int("keepalive-misses", 3, "Misses of heartbeats before disconnecting.")
+	argRoam           = flag.Bool("roam", false, "Enable roaming.")
 	argKCP            = flag.Bool("kcp", false, "Enable KCP.")
 	argKCPMTU         = flag.Int("kcp-mtu", kcp.IKCP_MTU_DEF, "KCP tuning option mtu.")
 	argKCPSendWindow  = flag.Int("kcp-sndwnd", kcp.IKCP_WND_SND, "KCP tuning option sndwnd.")
@@ -93,41 +62,16 @@ func (indicator *natIndicator) embSrcIP() net.IP {
 	argKCPInterval    = flag.Int("kcp-interval", kcp.IKCP_INTERVAL, "KCP tuning option interval.")
 	argKCPResend      = flag.Int("kcp-resend", 0, "KCP tuning option resend.")
 	argKCPNC          = flag.Int("kcp-nc", 0, "KCP tuning option nc.")
+	argPath           = flag.String("path", "/", "Path in HTTP request.")
+	argCert           = flag.String("cert", "", "Certificate file in TLS.")
+	argKey            = flag.String("key", "", "Key file in TLS.")
+	argALPN           = flag.String("alpn", "ikago", "Application protocol in QUIC.")
+	argTun            = flag.String("tun", "", "TUN device for routing upstream.")
 	argFragment       = flag.Int("fragment", pcap.MaxEthernetMTU, "Fragmentation size for routing upstream.")
 	argPort           = flag.Int("p", 0, "Port for listening.")
-)
-
-var (
-	fragment   int
-	port       uint16
-	listenDevs []*pcap.Device
-	upDev      *pcap.Device
-	gatewayDev *pcap.Device
-	mode       string
-	crypt      crypto.Crypt
-	mtu        int
-	isKCP      bool
-	kcpConfig  *config.KCPConfig
-)
-
-var (
-	isClosed     bool
-	listeners    []net.Listener
-	upConn       *pcap.RawConn
-	c            chan pcap.ConnBytes
-	defrag       *pcap.EasyDefragmenter
-	nextTCPPort  uint16
-	tcpPortPool  []time.Time
-	nextUDPPort  uint16
-	udpPortPool  []time.Time
-	nextICMPv4Id uint16
-	icmpv4IdPool []time.Time
-	patMap       map[quintuple]uint16
-	natLock      sync.RWMutex
-	nat          map[pcap.NATGuide]*natIndicator
-	monitor      *stat.TrafficMonitor
-	dnsLock      sync.RWMutex
-	dns          map[string]string
+	argReplay         = flag.String("replay", "", "Pcap file for replaying.")
+	argReplayOutput   = flag.String("replay-output", "", "Pcap file for packets sent in replaying.")
+	argCapture        = flag.String("capture", "", "Directory for capturing packets.")
 )
 
 func init() {
@@ -148,9 +92,6 @@ func init() {
 	}
 	log.Infof("%s %s\n\n", name, versionInfo)
 
-	// Start time
-	startTime = time.Now()
-
 	// Parse arguments
 	flag.Parse()
 
@@ -161,26 +102,12 @@ func init() {
 			*argConfig = "config.json"
 		}
 	}
-
-	listenDevs = make([]*pcap.Device, 0)
-
-	listeners = make([]net.Listener, 0)
-	c = make(chan pcap.ConnBytes, 1000)
-	defrag = pcap.NewEasyDefragmenter()
-	defrag.SetDeadline(keepFragments)
-	tcpPortPool = make([]time.Time, 16384)
-	udpPortPool = make([]time.Time, 16384)
-	icmpv4IdPool = make([]time.Time, 65536)
-	patMap = make(map[quintuple]uint16)
-	nat = make(map[pcap.NATGuide]*natIndicator)
-	dns = make(map[string]string)
 }
 
 func main() {
 	var (
-		err     error
-		cfg     *config.Config
-		gateway net.IP
+		err error
+		cfg *config.Config
 	)
 
 	// Configuration file
@@ -203,6 +130,18 @@ func main() {
 		cfg.Verbose = *argVerbose
 		cfg.Log = *argLog
 		cfg.MTU = *argMTU
+		cfg.Obfs = *argObfs
+		cfg.Fingerprint = *argFingerprint
+		cfg.Stripe = *argStripe
+		cfg.FEC = *argFEC
+		cfg.FECParity = *argFECParity
+		cfg.Dup = *argDup
+		cfg.DupDelay = *argDupDelay
+		cfg.DupPorts = splitArg(*argDupPorts)
+		cfg.Hop = *argHop
+		cfg.Keepalive = *argKeepalive
+		cfg.KeepMisses = *argKeepaliveMiss
+		cfg.Roam = *argRoam
 		cfg.KCP = *argKCP
 		cfg.KCPConfig = *config.NewKCPConfig()
 		cfg.KCPConfig.MTU = *argKCPMTU
@@ -215,6 +154,11 @@ func main() {
 		cfg.KCPConfig.Interval = *argKCPInterval
 		cfg.KCPConfig.Resend = *argKCPResend
 		cfg.KCPConfig.NC = *argKCPNC
+		cfg.Path = *argPath
+		cfg.Cert = *argCert
+		cfg.Key = *argKey
+		cfg.ALPN = *argALPN
+		cfg.Tun = *argTun
 		cfg.Fragment = *argFragment
 		cfg.Port = *argPort
 	}
@@ -263,1023 +207,77 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Verify parameters
-	if cfg.Gateway != "" {
-		gateway = net.ParseIP(cfg.Gateway)
-		if gateway == nil {
-			log.Fatalln(fmt.Errorf("invalid gateway %s", cfg.Gateway))
+	// Replay
+	var (
+		replay *pcap.Replay
+		devs   []*pcap.Device
+		ready  chan struct{}
+	)
+	if *argReplay != "" {
+		if cfg.Tun != "" {
+			log.Fatalln("tun not support in replay")
 		}
-	}
-	if cfg.Monitor < 0 || cfg.Monitor > 65535 {
-		log.Fatalln(fmt.Errorf("monitor port %d out of range", cfg.Monitor))
-	}
-	if cfg.MTU < 576 || cfg.MTU > pcap.MaxMTU {
-		log.Fatalln(fmt.Errorf("mtu %d out of range", cfg.MTU))
-	}
-	if cfg.KCPConfig.MTU > 1500 {
-		log.Fatalln(fmt.Errorf("kcp mtu %d out of range", cfg.KCPConfig.MTU))
-	}
-	if cfg.KCPConfig.SendWindow <= 0 || cfg.KCPConfig.SendWindow > math.MaxInt32 {
-		log.Fatalln(fmt.Errorf("kcp send window %d out of range", cfg.KCPConfig.SendWindow))
-	}
-	if cfg.KCPConfig.RecvWindow <= 0 || cfg.KCPConfig.RecvWindow > math.MaxInt32 {
-		log.Fatalln(fmt.Errorf("kcp receive window %d out of range", cfg.KCPConfig.RecvWindow))
-	}
-	if cfg.KCPConfig.DataShard < 0 {
-		log.Fatalln(fmt.Errorf("kcp data shard %d out of range", cfg.KCPConfig.DataShard))
-	}
-	if cfg.KCPConfig.ParityShard < 0 {
-		log.Fatalln(fmt.Errorf("kcp parity shard %d out of range", cfg.KCPConfig.ParityShard))
-	}
-	if cfg.KCPConfig.Interval < 0 {
-		log.Fatalln(fmt.Errorf("kcp interval %d out of range", cfg.KCPConfig.Interval))
-	}
-	if cfg.KCPConfig.Resend < 0 {
-		log.Fatalln(fmt.Errorf("kcp resend %d out of range", cfg.KCPConfig.Resend))
-	}
-	if cfg.KCPConfig.NC < 0 {
-		log.Fatalln(fmt.Errorf("kcp nc %d out of range", cfg.KCPConfig.NC))
-	}
-	if cfg.Fragment < 576 || cfg.Fragment > pcap.MaxMTU {
-		log.Fatalln(fmt.Errorf("fragment %d out of range", cfg.Fragment))
-	}
-	if cfg.Port == 0 {
-		log.Fatalln("Please provide listen port by -p port.")
-	}
-	if cfg.Port <= 0 || cfg.Port > 65535 {
-		log.Fatalln(fmt.Errorf("listen port %d out of range", cfg.Port))
-	}
-
-	// Find devices
-	listenDevs, err = pcap.FindListenDevs(cfg.ListenDevs)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("find listen devices: %w", err))
-	}
-	if len(cfg.ListenDevs) <= 0 {
-		// Remove loopback devices by default
-		result := make([]*pcap.Device, 0)
 
-		for _, dev := range listenDevs {
-			if dev.IsLoop() {
-				continue
-			}
-			result = append(result, dev)
+		output := *argReplayOutput
+		if output == "" {
+			output = strings.TrimSuffix(*argReplay, filepath.Ext(*argReplay)) + ".out.pcap"
 		}
 
-		listenDevs = result
-	}
-	if len(listenDevs) <= 0 {
-		log.Fatalln(errors.New("cannot determine listen device"))
-	}
-
-	upDev, gatewayDev, err = pcap.FindUpstreamDevAndGatewayDev(cfg.UpDev, gateway)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("find upstream device and gateway device: %w", err))
-	}
-	if upDev == nil && gatewayDev == nil {
-		log.Fatalln(errors.New("cannot determine upstream device and gateway device"))
-	}
-	if upDev == nil {
-		log.Fatalln(errors.New("cannot determine upstream device"))
-	}
-	if gatewayDev == nil {
-		log.Fatalln(errors.New("cannot determine gateway device"))
-	}
-
-	// Mode
-	switch cfg.Mode {
-	case "faketcp":
-		mode = "faketcp"
-		log.Infoln("Use FakeTCP")
-	case "tcp":
-		mode = "tcp"
-		log.Infoln("Use standard TCP")
-	default:
-		log.Fatalln(fmt.Errorf("mode %s not support", cfg.Mode))
-	}
-
-	// Crypt
-	crypt, err = crypto.ParseCrypt(cfg.Method, cfg.Password)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("parse crypt: %w", err))
-	}
-	method := crypt.Method()
-	if method != crypto.MethodPlain {
-		log.Infof("Encrypt with %s\n", method)
-	}
-
-	// Add rule
-	if cfg.Rule {
-		var (
-			devs map[string]bool
-		)
-
-		devs = make(map[string]bool)
-
-		err := exec.DisableIPForwarding()
+		replay, err = pcap.OpenReplay(*argReplay, output)
 		if err != nil {
-			log.Fatalln(fmt.Errorf("disable ip forwarding: %w", err))
-		}
-
-		log.Infoln("Disable IP forwarding")
-
-		for _, dev := range listenDevs {
-			devs[dev.Alias()] = true
+			log.Fatalln(fmt.Errorf("open replay: %w", err))
 		}
-		devs[upDev.Alias()] = true
+		log.Infof("Replay packets from %s to %s\n", *argReplay, output)
 
-		for dev := range devs {
-			err := exec.DisableGRO(dev)
-			if err != nil {
-				log.Fatalln(fmt.Errorf("disable gro: %w", err))
-			}
-		}
-
-		log.Infoln("Disable GRO")
-
-		err = exec.AddGlobalFirewallRule()
+		allDevs, err := pcap.FindAllDevs()
 		if err != nil {
-			log.Fatalln(fmt.Errorf("add firewall rule: %w", err))
-		}
-
-		log.Infoln("Add firewall rule")
-	}
-
-	// Monitor
-	if cfg.Monitor != 0 {
-		if cfg.Monitor == int(port) {
-			log.Fatalln(fmt.Errorf("same monitor port with listen port"))
+			log.Fatalln(fmt.Errorf("find all devices: %w", err))
 		}
+		devs = replay.Devices(allDevs)
 
-		monitor = stat.NewTrafficMonitor()
-
-		// Host HTTP server
-		http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-			b, err := json.Marshal(&struct {
-				Name    string               `json:"name"`
-				Version string               `json:"version"`
-				Time    int                  `json:"time"`
-				Monitor *stat.TrafficMonitor `json:"monitor"`
-			}{
-				Name:    name,
-				Version: versionInfo,
-				Time:    int(time.Now().Sub(startTime).Seconds()),
-				Monitor: monitor,
-			})
-			if err != nil {
-				log.Errorln(fmt.Errorf("monitor: %w", err))
-				return
-			}
-
-			// Handle CORS
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-
-			_, err = io.WriteString(w, string(b))
-			if err != nil {
-				log.Errorln(fmt.Errorf("monitor: %w", err))
-			}
-		})
-		http.HandleFunc("/dns", func(w http.ResponseWriter, req *http.Request) {
-			type IPName struct {
-				IP   string `json:"ip"`
-				Name string `json:"name"`
-			}
-
-			ipNames := make([]IPName, 0)
-			dnsLock.RLock()
-			for ip, name := range dns {
-				ipNames = append(ipNames, IPName{
-					IP:   ip,
-					Name: name,
-				})
-			}
-			dnsLock.RUnlock()
-
-			b, err := json.Marshal(ipNames)
-			if err != nil {
-				log.Errorln(fmt.Errorf("monitor: %w", err))
-				return
-			}
-
-			// Handle CORS
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-
-			_, err = io.WriteString(w, string(b))
-			if err != nil {
-				log.Errorln(fmt.Errorf("monitor: %w", err))
-			}
-		})
+		// Packets are replayed once the server handles packets, and the server is closed after all packets are replayed
+		ready = make(chan struct{})
 		go func() {
-			err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Monitor), nil)
-			if err != nil {
-				log.Errorln(fmt.Errorf("monitor: %w", err))
-			}
+			<-ready
+			replay.Start()
+			<-replay.Done()
+			server.Close()
 		}()
 
-		log.Infof("Monitor on :%d\n", cfg.Monitor)
-		log.Infoln("You can now observe traffic on http://ikago.ikas.ink")
+		// Firewall rules are not added in replay, for no packet is sent to the system
+		cfg.Rule = false
 	}
 
-	// Mode-related options
-	switch mode {
-	case "faketcp":
-		// MTU
-		mtu = cfg.MTU
-		log.Infof("Set MTU to %d Bytes\n", mtu)
-
-		// KCP
-		isKCP = cfg.KCP
-		kcpConfig = &cfg.KCPConfig
-		if isKCP {
-			log.Infoln("Enable KCP")
+	// Capture
+	if *argCapture != "" {
+		err = pcap.OpenCapture(*argCapture, name)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("open capture: %w", err))
 		}
-	case "tcp":
-		break
-	default:
-		log.Fatalln(fmt.Errorf("mode %s not support", mode))
+		log.Infof("Capture packets to %s\n", *argCapture)
 	}
 
-	// Fragment
-	fragment = cfg.Fragment
-	log.Infof("Set fragment to %d Bytes\n", fragment)
-
-	// Port
-	port = uint16(cfg.Port)
-
-	log.Infof("Proxy from :%d\n", cfg.Port)
-
 	// Wait signals
 	sig := make(chan os.Signal)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sig
-		closeAll()
-		os.Exit(0)
-	}()
-
-	// Open pcap
-	err = open()
-	if err != nil {
-		log.Fatalln(fmt.Errorf("open pcap: %w", err))
-	}
-}
-
-func open() error {
-	var err error
-
-	// Verify
-	if port <= 0 || port > 65535 {
-		return fmt.Errorf("port %d out of range", port)
-	}
-	if len(listenDevs) <= 0 {
-		return errors.New("missing listen device")
-	}
-	if upDev == nil {
-		return errors.New("missing upstream device")
-	}
-	if gatewayDev == nil {
-		return errors.New("missing gateway")
-	}
-
-	if len(listenDevs) == 1 {
-		log.Infof("Listen on %s\n", listenDevs[0].String())
-	} else {
-		log.Infoln("Listen on:")
-		for _, dev := range listenDevs {
-			log.Infof("  %s\n", dev.String())
-		}
-	}
-	if !gatewayDev.IsLoop() {
-		log.Infof("Route upstream from %s to %s\n", upDev, gatewayDev)
-	} else {
-		log.Infof("Route upstream in %s\n", upDev)
-	}
-
-	for _, dev := range listenDevs {
-		var (
-			err      error
-			listener net.Listener
-		)
-
-		switch mode {
-		case "faketcp":
-			if dev.IsLoop() {
-				if isKCP {
-					listener, err = pcap.ListenFakeTCPWithKCP(dev, dev, port, crypt, mtu, kcpConfig)
-				} else {
-					listener, err = pcap.ListenFakeTCP(dev, dev, port, crypt, mtu)
-				}
-			} else {
-				if isKCP {
-					listener, err = pcap.ListenFakeTCPWithKCP(dev, gatewayDev, port, crypt, mtu, kcpConfig)
-				} else {
-					listener, err = pcap.ListenFakeTCP(dev, gatewayDev, port, crypt, mtu)
-				}
-			}
-		case "tcp":
-			listener, err = pcap.ListenTCP(dev, port, crypt)
-		default:
-			err = fmt.Errorf("mode %s not support", mode)
-		}
-		if err != nil {
-			return fmt.Errorf("open listen device %s: %w", dev.Alias(), err)
-		}
-
-		listeners = append(listeners, listener)
-	}
-
-	// Handles for routing upstream
-	upConn, err = pcap.CreateRawConn(upDev, gatewayDev, fmt.Sprintf("ip && (((tcp || udp) && not dst port %d) || icmp || (ip[6:2] & 0x1fff) != 0)", port))
-	if err != nil {
-		return fmt.Errorf("open upstream device %s: %w", upDev.Alias(), err)
-	}
-
-	// Start handling
-	for i := 0; i < len(listeners); i++ {
-		listener := listeners[i]
-		go func() {
-			for {
-				conn, err := listener.Accept()
-				if err != nil {
-					if isClosed {
-						return
-					}
-					log.Errorln(fmt.Errorf("accept: %w", err))
-					continue
-				}
-				if conn == nil {
-					continue
-				}
-
-				// Tune
-				switch conn.(type) {
-				case *kcp.UDPSession:
-					err := pcap.TuneKCP(conn.(*kcp.UDPSession), kcpConfig)
-					if err != nil {
-						conn.Close()
-						log.Errorln(fmt.Errorf("tune: %w", err))
-						continue
-					}
-				default:
-					break
-				}
-
-				log.Infof("Connect from client %s\n", conn.RemoteAddr().String())
-
-				go func() {
-					b := make([]byte, pcap.IPv4MaxSize)
-					for {
-						n, err := conn.Read(b)
-						if err != nil {
-							if isClosed {
-								return
-							}
-							if errors.Is(err, io.EOF) {
-								log.Infof("Disconnect from client %s\n", conn.RemoteAddr())
-								return
-							}
-							log.Errorln(fmt.Errorf("read listen: %w", err))
-							continue
-						}
-
-						newB := make([]byte, n)
-						copy(newB, b[:n])
-						c <- pcap.ConnBytes{
-							Bytes: newB,
-							Conn:  conn,
-						}
-					}
-				}()
-			}
-		}()
-	}
-
-	go func() {
-		for cab := range c {
-			err := handleListen(cab.Bytes, cab.Conn)
-			if err != nil {
-				log.Errorln(fmt.Errorf("handle listen in address %s: %w", cab.Conn.LocalAddr().String(), err))
-				log.Verbosef("Source: %s\nSize: %d Bytes\n\n", cab.Conn.RemoteAddr().String(), len(cab.Bytes))
-				continue
-			}
+		server.Close()
+		if replay != nil {
+			replay.Close()
 		}
+		pcap.CloseCapture()
+		os.Exit(0)
 	}()
 
-	for {
-		packet, err := upConn.ReadPacket()
-		if err != nil {
-			if isClosed {
-				return nil
-			}
-			log.Errorln(fmt.Errorf("read upstream in device %s: %w", upConn.LocalDev().Alias(), err))
-			continue
-		}
-
-		err = handleUpstream(packet)
-		if err != nil {
-			log.Errorln(fmt.Errorf("handle upstream in device %s: %w", upConn.LocalDev().Alias(), err))
-			log.Verboseln(packet)
-			continue
-		}
+	err = server.Run(cfg, versionInfo, devs, ready)
+	if replay != nil {
+		replay.Close()
 	}
-}
-
-func closeAll() {
-	isClosed = true
-	for _, handle := range listeners {
-		if handle != nil {
-			handle.Close()
-		}
-	}
-	if upConn != nil {
-		upConn.Close()
-	}
-}
-
-func handleListen(contents []byte, conn net.Conn) error {
-	var (
-		err               error
-		embIndicator      *pcap.PacketIndicator
-		upValue           uint16
-		newTransportLayer gopacket.Layer
-		newNetworkLayer   gopacket.NetworkLayer
-		upIP              net.IP
-		newLinkLayerType  gopacket.LayerType
-		newLinkLayer      gopacket.Layer
-		fragments         [][]byte
-	)
-
-	// Empty payload
-	if len(contents) <= 0 {
-		// return errors.New("empty payload")
-		return nil
-	}
-
-	// Parse embedded packet
-	embIndicator, err = pcap.ParseEmbPacket(contents)
+	pcap.CloseCapture()
 	if err != nil {
-		return fmt.Errorf("parse embedded packet: %w", err)
+		log.Fatalln(err)
 	}
-
-	// Distribute port/Id by source and client address and protocol
-	if !embIndicator.IsFrag() {
-		var ok bool
-
-		q := quintuple{
-			src:      embIndicator.NATSrc().String(),
-			dst:      conn.RemoteAddr().String(),
-			protocol: embIndicator.NATProtocol(),
-		}
-		upValue, ok = patMap[q]
-		if !ok {
-			// if ICMPv4 error is not in NAT, drop it
-			if t := embIndicator.TransportLayer().LayerType(); t == layers.LayerTypeICMPv4 && !embIndicator.ICMPv4Indicator().IsQuery() {
-				return errors.New("missing nat")
-			}
-
-			upValue, err = dist(embIndicator.TransportLayer().LayerType())
-			if err != nil {
-				return fmt.Errorf("distribute: %w", err)
-			}
-
-			patMap[q] = upValue
-		}
-	}
-
-	// Create new transport layer
-	if embIndicator.TransportLayer() != nil {
-		switch t := embIndicator.TransportLayer().LayerType(); t {
-		case layers.LayerTypeTCP:
-			tcpLayer := embIndicator.TCPLayer()
-			temp := *tcpLayer
-			newTransportLayer = &temp
-
-			newTCPLayer := newTransportLayer.(*layers.TCP)
-
-			newTCPLayer.SrcPort = layers.TCPPort(upValue)
-		case layers.LayerTypeUDP:
-			udpLayer := embIndicator.UDPLayer()
-			temp := *udpLayer
-			newTransportLayer = &temp
-
-			newUDPLayer := newTransportLayer.(*layers.UDP)
-
-			newUDPLayer.SrcPort = layers.UDPPort(upValue)
-		case layers.LayerTypeICMPv4:
-			if embIndicator.ICMPv4Indicator().IsQuery() {
-				temp := *embIndicator.ICMPv4Indicator().ICMPv4Layer()
-				newTransportLayer = &temp
-
-				newICMPv4Layer := newTransportLayer.(*layers.ICMPv4)
-
-				newICMPv4Layer.Id = upValue
-			} else {
-				newTransportLayer = embIndicator.ICMPv4Indicator().NewPureICMPv4Layer()
-
-				newICMPv4Layer := newTransportLayer.(*layers.ICMPv4)
-
-				temp := *embIndicator.ICMPv4Indicator().EmbIPv4Layer()
-				newEmbIPv4Layer := &temp
-
-				newEmbIPv4Layer.DstIP = upConn.LocalDev().IPAddr().IP
-
-				var (
-					err                  error
-					newEmbTransportLayer gopacket.Layer
-				)
-
-				embTransportLayerType := embIndicator.ICMPv4Indicator().EmbTransportLayer().LayerType()
-				switch embTransportLayerType {
-				case layers.LayerTypeTCP:
-					temp := *embIndicator.ICMPv4Indicator().EmbTCPLayer()
-					newEmbTransportLayer = &temp
-
-					newEmbTCPLayer := newEmbTransportLayer.(*layers.TCP)
-
-					newEmbTCPLayer.DstPort = layers.TCPPort(upValue)
-
-					err = newEmbTCPLayer.SetNetworkLayerForChecksum(newEmbIPv4Layer)
-				case layers.LayerTypeUDP:
-					temp := *embIndicator.ICMPv4Indicator().EmbUDPLayer()
-					newEmbTransportLayer = &temp
-
-					newEmbUDPLayer := newEmbTransportLayer.(*layers.UDP)
-
-					newEmbUDPLayer.DstPort = layers.UDPPort(upValue)
-
-					err = newEmbUDPLayer.SetNetworkLayerForChecksum(newEmbIPv4Layer)
-				case layers.LayerTypeICMPv4:
-					temp := *embIndicator.ICMPv4Indicator().EmbICMPv4Layer()
-					newEmbTransportLayer = &temp
-
-					if embIndicator.ICMPv4Indicator().IsEmbQuery() {
-						newEmbICMPv4Layer := newEmbTransportLayer.(*layers.ICMPv4)
-
-						newEmbICMPv4Layer.Id = upValue
-					}
-				default:
-					return fmt.Errorf("create transport layer: %w", fmt.Errorf("transport layer type %s not support", embTransportLayerType))
-				}
-				if err != nil {
-					return fmt.Errorf("create transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
-				}
-
-				payload, err := pcap.Serialize(newEmbIPv4Layer, newEmbTransportLayer.(gopacket.SerializableLayer))
-				if err != nil {
-					return fmt.Errorf("create transport layer: %w", fmt.Errorf("serialize: %w", err))
-				}
-
-				newICMPv4Layer.Payload = payload
-			}
-		default:
-			return fmt.Errorf("transport layer type %s not support", t)
-		}
-	}
-
-	// Create new network layer
-	switch t := embIndicator.NetworkLayer().LayerType(); t {
-	case layers.LayerTypeIPv4:
-		ipv4Layer := embIndicator.NetworkLayer().(*layers.IPv4)
-		temp := *ipv4Layer
-		newNetworkLayer = &temp
-
-		newIPv4Layer := newNetworkLayer.(*layers.IPv4)
-
-		newIPv4Layer.SrcIP = upConn.LocalDev().IPAddr().IP
-		upIP = newIPv4Layer.SrcIP
-	default:
-		return fmt.Errorf("network layer type %s not support", t)
-	}
-
-	// Set network layer for transport layer
-	if newTransportLayer != nil {
-		switch t := newTransportLayer.LayerType(); t {
-		case layers.LayerTypeTCP:
-			tcpLayer := newTransportLayer.(*layers.TCP)
-
-			err = tcpLayer.SetNetworkLayerForChecksum(newNetworkLayer)
-		case layers.LayerTypeUDP:
-			udpLayer := newTransportLayer.(*layers.UDP)
-
-			err = udpLayer.SetNetworkLayerForChecksum(newNetworkLayer)
-		case layers.LayerTypeICMPv4:
-			break
-		default:
-			return fmt.Errorf("transport layer type %s not support", t)
-		}
-		if err != nil {
-			return fmt.Errorf("set network layer for checksum: %w", err)
-		}
-	}
-
-	// Decide Loopback or Ethernet
-	if upConn.IsLoop() {
-		newLinkLayerType = layers.LayerTypeLoopback
-	} else {
-		newLinkLayerType = layers.LayerTypeEthernet
-	}
-
-	// Create new link layer
-	switch newLinkLayerType {
-	case layers.LayerTypeLoopback:
-		newLinkLayer, err = pcap.CreateLoopbackLayer(newNetworkLayer)
-	case layers.LayerTypeEthernet:
-		newLinkLayer, err = pcap.CreateEthernetLayer(upConn.LocalDev().HardwareAddr(), upConn.RemoteDev().HardwareAddr(), newNetworkLayer)
-	default:
-		return fmt.Errorf("link layer type %s not support", newLinkLayerType)
-	}
-	if err != nil {
-		return fmt.Errorf("create link layer: %w", err)
-	}
-
-	// Fragment
-	fragments, err = pcap.CreateFragmentPackets(newLinkLayer, newNetworkLayer, newTransportLayer, embIndicator.Payload(), fragment)
-	if err != nil {
-		return fmt.Errorf("fragment: %w", err)
-	}
-
-	// Write packet data
-	for i, fragment := range fragments {
-		_, err = upConn.Write(fragment)
-		if err != nil {
-			return fmt.Errorf("write: %w", err)
-		}
-
-		if i == len(fragment)-1 {
-			log.Verbosef("Redirect an inbound %s packet: %s -> %s -> %s (%d Bytes)\n",
-				embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String(), embIndicator.Size())
-		} else {
-			log.Verbosef("Redirect an inbound %s packet: %s -> %s -> %s (...)\n",
-				embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String())
-		}
-	}
-
-	// NAT
-	if embIndicator.TransportLayer() != nil {
-		// Record the source and the source device of the packet
-		var (
-			guide  pcap.NATGuide
-			addNAT bool
-		)
-
-		switch t := embIndicator.TransportLayer().LayerType(); t {
-		case layers.LayerTypeTCP:
-			a := net.TCPAddr{
-				IP:   upIP,
-				Port: int(upValue),
-			}
-			guide = pcap.NATGuide{
-				Src:      a.String(),
-				Protocol: t,
-			}
-			addNAT = true
-		case layers.LayerTypeUDP:
-			a := net.UDPAddr{
-				IP:   upIP,
-				Port: int(upValue),
-			}
-			guide = pcap.NATGuide{
-				Src:      a.String(),
-				Protocol: t,
-			}
-			addNAT = true
-		case layers.LayerTypeICMPv4:
-			if embIndicator.ICMPv4Indicator().IsQuery() {
-				guide = pcap.NATGuide{
-					Src: addr.ICMPQueryAddr{
-						IP: upIP,
-						Id: upValue,
-					}.String(),
-					Protocol: t,
-				}
-				addNAT = true
-			}
-		default:
-			return fmt.Errorf("transport layer type %s not support", t)
-		}
-		if addNAT {
-			ni := &natIndicator{
-				src:    conn.RemoteAddr(),
-				embSrc: embIndicator.NATSrc(),
-				conn:   conn,
-			}
-			natLock.Lock()
-			nat[guide] = ni
-			natLock.Unlock()
-		}
-
-		// Keep alive
-		protocol := embIndicator.NATProtocol()
-		switch protocol {
-		case layers.LayerTypeTCP:
-			tcpPortPool[convertFromPort(upValue)] = time.Now()
-		case layers.LayerTypeUDP:
-			udpPortPool[convertFromPort(upValue)] = time.Now()
-		case layers.LayerTypeICMPv4:
-			icmpv4IdPool[upValue] = time.Now()
-		default:
-			return fmt.Errorf("transport layer type %s not support", protocol)
-		}
-	}
-
-	// Statistics
-	if monitor != nil {
-		monitor.Add(conn.RemoteAddr().String(), stat.DirectionOut, uint(embIndicator.Size()))
-	}
-
-	return nil
-}
-
-func handleUpstream(packet gopacket.Packet) error {
-	var (
-		err       error
-		indicator *pcap.PacketIndicator
-		frags     []*pcap.PacketIndicator
-		ni        *natIndicator
-		data      []byte
-	)
-
-	// Parse packet
-	indicator, err = pcap.ParsePacket(packet)
-	if err != nil {
-		return fmt.Errorf("parse packet: %w", err)
-	}
-
-	// Handle fragments
-	indicator, frags, err = defrag.AppendOriginal(indicator)
-	if err != nil {
-		return fmt.Errorf("defrag: %w", err)
-	}
-	if indicator == nil {
-		return nil
-	}
-
-	// NAT
-	guide := pcap.NATGuide{
-		Src:      indicator.NATDst().String(),
-		Protocol: indicator.TransportLayer().LayerType(),
-	}
-	natLock.RLock()
-	ni, ok := nat[guide]
-	natLock.RUnlock()
-	if !ok {
-		return nil
-	}
-
-	// Keep alive
-	protocol := indicator.NATProtocol()
-	switch protocol {
-	case layers.LayerTypeTCP:
-		tcpPortPool[convertFromPort(indicator.DstPort())] = time.Now()
-	case layers.LayerTypeUDP:
-		udpPortPool[convertFromPort(indicator.DstPort())] = time.Now()
-	case layers.LayerTypeICMPv4:
-		icmpv4IdPool[indicator.ICMPv4Indicator().Id()] = time.Now()
-	default:
-		return fmt.Errorf("transport layer type %s not support", protocol)
-	}
-
-	for _, frag := range frags {
-		var (
-			embTransportLayer gopacket.Layer
-			embNetworkLayer   gopacket.NetworkLayer
-		)
-
-		// Create embedded transport layer
-		if frag.TransportLayer() != nil {
-			switch t := frag.TransportLayer().LayerType(); t {
-			case layers.LayerTypeTCP:
-				embTCPLayer := frag.TCPLayer()
-				temp := *embTCPLayer
-				embTransportLayer = &temp
-
-				newEmbTCPLayer := embTransportLayer.(*layers.TCP)
-
-				newEmbTCPLayer.DstPort = layers.TCPPort(ni.embSrc.(*net.TCPAddr).Port)
-			case layers.LayerTypeUDP:
-				embUDPLayer := frag.UDPLayer()
-				temp := *embUDPLayer
-				embTransportLayer = &temp
-
-				newEmbUDPLayer := embTransportLayer.(*layers.UDP)
-
-				newEmbUDPLayer.DstPort = layers.UDPPort(ni.embSrc.(*net.UDPAddr).Port)
-			case layers.LayerTypeICMPv4:
-				if frag.ICMPv4Indicator().IsQuery() {
-					embICMPv4Layer := frag.ICMPv4Indicator().ICMPv4Layer()
-					temp := *embICMPv4Layer
-					embTransportLayer = &temp
-
-					newEmbICMPv4Layer := embTransportLayer.(*layers.ICMPv4)
-
-					newEmbICMPv4Layer.Id = ni.embSrc.(*addr.ICMPQueryAddr).Id
-				} else {
-					embTransportLayer = frag.ICMPv4Indicator().NewPureICMPv4Layer()
-
-					newEmbICMPv4Layer := embTransportLayer.(*layers.ICMPv4)
-
-					temp := *frag.ICMPv4Indicator().EmbIPv4Layer()
-					newEmbEmbIPv4Layer := &temp
-
-					newEmbEmbIPv4Layer.SrcIP = ni.embSrcIP()
-
-					var (
-						err                     error
-						newEmbEmbTransportLayer gopacket.Layer
-					)
-
-					switch t := frag.ICMPv4Indicator().EmbTransportLayer().LayerType(); t {
-					case layers.LayerTypeTCP:
-						temp := *frag.ICMPv4Indicator().EmbTCPLayer()
-						newEmbEmbTransportLayer = &temp
-
-						newEmbEmbTCPLayer := newEmbEmbTransportLayer.(*layers.TCP)
-
-						newEmbEmbTCPLayer.SrcPort = layers.TCPPort(ni.embSrc.(*net.TCPAddr).Port)
-
-						err = newEmbEmbTCPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv4Layer)
-					case layers.LayerTypeUDP:
-						temp := *frag.ICMPv4Indicator().EmbUDPLayer()
-						newEmbEmbTransportLayer = &temp
-
-						newEmbEmbUDPLayer := newEmbEmbTransportLayer.(*layers.UDP)
-
-						newEmbEmbUDPLayer.SrcPort = layers.UDPPort(ni.embSrc.(*net.UDPAddr).Port)
-
-						err = newEmbEmbUDPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv4Layer)
-					case layers.LayerTypeICMPv4:
-						temp := *frag.ICMPv4Indicator().EmbICMPv4Layer()
-						newEmbEmbTransportLayer = &temp
-
-						if frag.ICMPv4Indicator().IsEmbQuery() {
-							newEmbEmbICMPv4Layer := newEmbEmbTransportLayer.(*layers.ICMPv4)
-
-							newEmbEmbICMPv4Layer.Id = ni.embSrc.(*addr.ICMPQueryAddr).Id
-						}
-					default:
-						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("transport layer type %s not support", t))
-					}
-					if err != nil {
-						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
-					}
-
-					payload, err := pcap.Serialize(newEmbEmbIPv4Layer, newEmbEmbTransportLayer.(gopacket.SerializableLayer))
-					if err != nil {
-						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("serialize: %w", err))
-					}
-
-					newEmbICMPv4Layer.Payload = payload
-				}
-			default:
-				return fmt.Errorf("embedded transport layer type %s not support", t)
-			}
-		}
-
-		// Create embedded network layer
-		switch t := frag.NetworkLayer().LayerType(); t {
-		case layers.LayerTypeIPv4:
-			embIPv4Layer := frag.IPv4Layer()
-			temp := *embIPv4Layer
-			embNetworkLayer = &temp
-
-			newEmbIPv4Layer := embNetworkLayer.(*layers.IPv4)
-
-			newEmbIPv4Layer.DstIP = ni.embSrcIP()
-		default:
-			return fmt.Errorf("embedded network layer type %s not support", t)
-		}
-
-		// Set network layer for transport layer
-		if embTransportLayer != nil {
-			switch t := embTransportLayer.LayerType(); t {
-			case layers.LayerTypeTCP:
-				embTCPLayer := embTransportLayer.(*layers.TCP)
-
-				err = embTCPLayer.SetNetworkLayerForChecksum(embNetworkLayer)
-			case layers.LayerTypeUDP:
-				embUDPLayer := embTransportLayer.(*layers.UDP)
-
-				err = embUDPLayer.SetNetworkLayerForChecksum(embNetworkLayer)
-			case layers.LayerTypeICMPv4:
-				break
-			default:
-				return fmt.Errorf("embedded transport layer type %s not support", t)
-			}
-			if err != nil {
-				return fmt.Errorf("set embedded network layer for checksum: %w", err)
-			}
-		}
-
-		// Serialize layers
-		if embTransportLayer == nil {
-			data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
-				gopacket.Payload(frag.Payload()))
-		} else {
-			data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
-				embTransportLayer.(gopacket.SerializableLayer),
-				gopacket.Payload(frag.Payload()))
-		}
-		if err != nil {
-			return fmt.Errorf("serialize: %w", err)
-		}
-
-		// Write packet data
-		_, err = ni.conn.Write(data)
-		if err != nil {
-			return fmt.Errorf("write: %w", err)
-		}
-
-		// Statistics
-		size := frag.MTU()
-		if monitor != nil {
-			monitor.Add(ni.conn.RemoteAddr().String(), stat.DirectionIn, uint(size))
-		}
-
-		log.Verbosef("Redirect an outbound %s packet: %s <- %s <- %s (%d Bytes)\n",
-			frag.TransportProtocol(), ni.embSrc.String(), ni.src.String(), frag.Src(), size)
-	}
-
-	// Record DNS
-	if monitor != nil {
-		if indicator.DNSIndicator() != nil {
-			if indicator.DNSIndicator().IsResponse() {
-				name, ips := indicator.DNSIndicator().Answers()
-				if name != "" && len(ips) > 0 {
-					dnsLock.Lock()
-					for _, ip := range ips {
-						dns[ip.String()] = name
-						log.Verbosef("Record DNS record %s = %s\n", name, ip)
-					}
-					dnsLock.Unlock()
-				}
-			}
-		}
-	}
-
-	return nil
-}
-
-func dist(t gopacket.LayerType) (uint16, error) {
-	now := time.Now()
-
-	switch t {
-	case layers.LayerTypeTCP:
-		for i := 0; i < 16384; i++ {
-			s := nextTCPPort % 16384
-
-			// Point to next port
-			nextTCPPort++
-
-			// Check if the port is alive
-			last := tcpPortPool[s]
-			if now.Sub(last) > keepAlive {
-				if !last.IsZero() {
-					log.Verbosef("Recycle %s port %d\n", t, 49152+s)
-				}
-				return 49152 + s, nil
-			}
-		}
-	case layers.LayerTypeUDP:
-		for i := 0; i < 16384; i++ {
-			s := nextUDPPort % 16384
-
-			// Point to next port
-			nextUDPPort++
-
-			// Check if the port is alive
-			last := udpPortPool[s]
-			if now.Sub(last) > keepAlive {
-				if !last.IsZero() {
-					log.Verbosef("Recycle %s port %d\n", t, 49152+s)
-				}
-				return 49152 + s, nil
-			}
-		}
-	case layers.LayerTypeICMPv4:
-		for i := 0; i < 65536; i++ {
-			s := nextICMPv4Id
-
-			// Point to next Id
-			nextICMPv4Id++
-
-			// Check if the Id is alive
-			last := icmpv4IdPool[s]
-			if now.Sub(last) > keepAlive {
-				if !last.IsZero() {
-					log.Verbosef("Recycle %s ID %d\n", t, s)
-				}
-				return s, nil
-			}
-		}
-	default:
-		return 0, fmt.Errorf("transport layer type %s not support", t)
-	}
-
-	return 0, fmt.Errorf("%s pool empty", t)
-}
-
-func convertFromPort(port uint16) uint16 {
-	return port - 49152
 }
 
 func splitArg(s string) []string {
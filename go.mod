@@ -1,18 +1,29 @@
 module github.com/zhxie/ikago
 
-go 1.13
+go 1.23
 
 require (
 	github.com/google/gopacket v1.1.17
+	github.com/gorilla/websocket v1.4.2
 	github.com/jackpal/gateway v1.0.6-0.20191118043651-5ceb358a720e
+	github.com/klauspost/reedsolomon v1.9.3
+	github.com/quic-go/quic-go v0.54.0
+	github.com/sparrc/go-ping v0.0.0-20190613174326-4e5b6552494c
+	github.com/xtaci/kcp-go v5.4.20+incompatible
+	golang.org/x/crypto v0.26.0
+	golang.org/x/net v0.28.0
+	golang.org/x/sys v0.23.0
+)
+
+require (
 	github.com/klauspost/cpuid v1.2.3 // indirect
-	github.com/klauspost/reedsolomon v1.9.3 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	github.com/sparrc/go-ping v0.0.0-20190613174326-4e5b6552494c
 	github.com/templexxx/cpufeat v0.0.0-20180724012125-cef66df7f161 // indirect
 	github.com/templexxx/xor v0.0.0-20191217153810-f85b25db303b // indirect
 	github.com/tjfoc/gmsm v1.3.0 // indirect
-	github.com/xtaci/kcp-go v5.4.20+incompatible
 	github.com/xtaci/lossyconn v0.0.0-20200209145036-adba10fffc37 // indirect
-	golang.org/x/crypto v0.0.0-20191219195013-becbf705a915
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
 )
@@ -65,10 +65,49 @@ func ParseTCPAddr(s string) (*net.TCPAddr, error) {
 	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
 }
 
+// ParsePortRange returns the start and the end of a port range in the form of start-end, or a single port.
+func ParsePortRange(s string) (uint16, uint16, error) {
+	strs := strings.SplitN(s, "-", 2)
+
+	start, err := strconv.ParseUint(strings.TrimSpace(strs[0]), 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse port %s: %w", strs[0], err)
+	}
+	end := start
+	if len(strs) > 1 {
+		end, err = strconv.ParseUint(strings.TrimSpace(strs[1]), 10, 16)
+		if err != nil {
+			return 0, 0, fmt.Errorf("parse port %s: %w", strs[1], err)
+		}
+	}
+	if start == 0 || end < start {
+		return 0, 0, fmt.Errorf("invalid port range %s", s)
+	}
+
+	return uint16(start), uint16(end), nil
+}
+
+// IPBPFFilter returns the BPF filter of the network protocol of the given IP.
+func IPBPFFilter(ip net.IP) string {
+	if ip.To4() == nil {
+		return "ip6"
+	}
+
+	return "ip"
+}
+
+func hostBPFFilter(prefix string, ip net.IP) string {
+	if ip.To4() == nil {
+		return fmt.Sprintf("ip6 %s host %s", prefix, fullString(ip))
+	}
+
+	return fmt.Sprintf("%s host %s", prefix, fullString(ip))
+}
+
 func bpfFilter(prefix string, addr net.Addr) (string, error) {
 	switch t := addr.(type) {
 	case *net.IPAddr:
-		return fmt.Sprintf("(%s host %s)", prefix, fullString(addr.(*net.IPAddr).IP)), nil
+		return fmt.Sprintf("(%s)", hostBPFFilter(prefix, addr.(*net.IPAddr).IP)), nil
 	case *net.TCPAddr:
 		tcpAddr := addr.(*net.TCPAddr)
 
@@ -76,7 +115,7 @@ func bpfFilter(prefix string, addr net.Addr) (string, error) {
 			return fmt.Sprintf("(%s port %d)", prefix, tcpAddr.Port), nil
 		}
 
-		return fmt.Sprintf("(%s host %s && %s port %d)", prefix, fullString(tcpAddr.IP), prefix, tcpAddr.Port), nil
+		return fmt.Sprintf("(%s && %s port %d)", hostBPFFilter(prefix, tcpAddr.IP), prefix, tcpAddr.Port), nil
 	default:
 		panic(fmt.Errorf("type %T not support", t))
 	}
@@ -0,0 +1,2104 @@
+package client
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/sparrc/go-ping"
+	"github.com/zhxie/ikago/internal/addr"
+	"github.com/zhxie/ikago/internal/config"
+	"github.com/zhxie/ikago/internal/control"
+	"github.com/zhxie/ikago/internal/crypto"
+	"github.com/zhxie/ikago/internal/exec"
+	"github.com/zhxie/ikago/internal/log"
+	"github.com/zhxie/ikago/internal/obfs"
+	"github.com/zhxie/ikago/internal/pcap"
+	"github.com/zhxie/ikago/internal/stat"
+	"github.com/zhxie/ikago/internal/tun"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type natIndicator struct {
+	srcHardwareAddr net.HardwareAddr
+	conn            pcap.Endpoint
+}
+
+const name string = "IkaGo-client"
+
+const pingDeadline = 2 * time.Second
+
+const (
+	probeInterval    = 10 * time.Second
+	probeDeadline    = 3 * time.Second
+	probeMisses      = 3
+	failbackInterval = 60 * time.Second
+)
+
+var (
+	versionInfo string
+	startTime   time.Time
+)
+
+var (
+	publishIPs  []*net.IPAddr
+	tunName     string
+	fragment    int
+	upPort      uint16
+	monitorPort int
+	sources     []*net.IPAddr
+	servers     []*net.TCPAddr
+	serverIP    net.IP
+	serverPort  uint16
+	listenDevs  []*pcap.Device
+	upDev       *pcap.Device
+	gatewayDev  *pcap.Device
+	mode        string
+	crypt       crypto.Crypt
+	mtu         int
+	obfuscator  obfs.Obfuscator
+	fingerprint pcap.Fingerprint
+	flows       int
+	stripe      pcap.Stripe
+	fecGroup    int
+	fecRatio    float64
+	dupTimes    int
+	dupDelay    time.Duration
+	dupFilter   *pcap.DupFilter
+	hopStart    uint16
+	hopEnd      uint16
+	hopInterval time.Duration
+	keepalive   time.Duration
+	keepMisses  int
+	roam        bool
+	session     []byte
+	isKCP       bool
+	kcpConfig   *config.KCPConfig
+	host        string
+	path        string
+	tlsConfig   *tls.Config
+)
+
+var (
+	closed      chan struct{}
+	routines    sync.WaitGroup
+	listenConns []pcap.Endpoint
+	tunDev      *tun.Device
+	upLock      sync.RWMutex
+	upConn      net.Conn
+	serverIndex int
+	lastRead    int64
+	lastBeat    int64
+	beatRTT     int64
+	down        chan struct{}
+	c           chan pcap.ConnPacket
+	natLock     sync.RWMutex
+	nat         map[string]*natIndicator
+	pingTime    int64
+	pingSeq     int
+	pinger      *ping.Pinger
+	monitor     *stat.TrafficMonitor
+	dnsLock     sync.RWMutex
+	dns         map[string]string
+)
+
+// reset resets the states of the last run.
+func reset() {
+	publishIPs = nil
+	tunName = ""
+	fragment = 0
+	upPort = 0
+	monitorPort = 0
+	sources = make([]*net.IPAddr, 0)
+	servers = nil
+	serverIP = nil
+	serverPort = 0
+	listenDevs = make([]*pcap.Device, 0)
+	upDev = nil
+	gatewayDev = nil
+	mode = ""
+	crypt = nil
+	mtu = 0
+	obfuscator = nil
+	fingerprint = 0
+	flows = 0
+	stripe = 0
+	fecGroup = 0
+	fecRatio = 0
+	dupTimes = 0
+	dupDelay = 0
+	dupFilter = nil
+	hopStart = 0
+	hopEnd = 0
+	hopInterval = 0
+	keepalive = 0
+	keepMisses = 0
+	roam = false
+	session = nil
+	isKCP = false
+	kcpConfig = nil
+	host = ""
+	path = ""
+	tlsConfig = nil
+	closed = make(chan struct{})
+	listenConns = make([]pcap.Endpoint, 0)
+	tunDev = nil
+	upConn = nil
+	serverIndex = 0
+	lastRead = 0
+	lastBeat = 0
+	beatRTT = -1
+	down = make(chan struct{}, 1)
+	c = make(chan pcap.ConnPacket, 1000)
+	nat = make(map[string]*natIndicator)
+	pingTime = -1
+	pingSeq = 0
+	pinger = nil
+	monitor = nil
+	dns = make(map[string]string)
+}
+
+// isClosed returns if the client is closed.
+func isClosed() bool {
+	select {
+	case <-closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run runs the client in the configuration on the devices until it is closed. Devices in current computer are used if
+// devs is nil. The ready channel is closed once the client starts handling packets if it is not nil.
+func Run(cfg *config.Config, version string, devs []*pcap.Device, ready chan<- struct{}) error {
+	var (
+		err     error
+		gateway net.IP
+	)
+
+	versionInfo = version
+	startTime = time.Now()
+
+	reset()
+
+	// Verify parameters
+	if cfg.Gateway != "" {
+		gateway = net.ParseIP(cfg.Gateway)
+		if gateway == nil {
+			return fmt.Errorf("invalid gateway %s", cfg.Gateway)
+		}
+	}
+	if cfg.Monitor < 0 || cfg.Monitor > 65535 {
+		return fmt.Errorf("monitor port %d out of range", cfg.Monitor)
+	}
+	if cfg.MTU < 576 || cfg.MTU > pcap.MaxMTU {
+		return fmt.Errorf("mtu %d out of range", cfg.MTU)
+	}
+	if cfg.KCPConfig.MTU > 1500 {
+		return fmt.Errorf("kcp mtu %d out of range", cfg.KCPConfig.MTU)
+	}
+	if cfg.KCPConfig.SendWindow <= 0 || cfg.KCPConfig.SendWindow > math.MaxInt32 {
+		return fmt.Errorf("kcp send window %d out of range", cfg.KCPConfig.SendWindow)
+	}
+	if cfg.KCPConfig.RecvWindow <= 0 || cfg.KCPConfig.RecvWindow > math.MaxInt32 {
+		return fmt.Errorf("kcp receive window %d out of range", cfg.KCPConfig.RecvWindow)
+	}
+	if cfg.KCPConfig.DataShard < 0 {
+		return fmt.Errorf("kcp data shard %d out of range", cfg.KCPConfig.DataShard)
+	}
+	if cfg.KCPConfig.ParityShard < 0 {
+		return fmt.Errorf("kcp parity shard %d out of range", cfg.KCPConfig.ParityShard)
+	}
+	if cfg.KCPConfig.Interval < 0 {
+		return fmt.Errorf("kcp interval %d out of range", cfg.KCPConfig.Interval)
+	}
+	if cfg.KCPConfig.Resend < 0 {
+		return fmt.Errorf("kcp resend %d out of range", cfg.KCPConfig.Resend)
+	}
+	if cfg.KCPConfig.NC < 0 {
+		return fmt.Errorf("kcp nc %d out of range", cfg.KCPConfig.NC)
+	}
+	if cfg.Fragment < 576 || cfg.Fragment > pcap.MaxMTU {
+		return fmt.Errorf("fragment %d out of range", cfg.Fragment)
+	}
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		return fmt.Errorf("upstream port %d out of range", cfg.Port)
+	}
+	if len(cfg.Sources) <= 0 && cfg.Tun == "" {
+		return errors.New("please provide sources by -r addresses")
+	}
+	if cfg.Tun != "" && cfg.Publish != "" {
+		return errors.New("publish not support with tun")
+	}
+	if len(cfg.Server) <= 0 {
+		return errors.New("please provide server by -s addresses")
+	}
+
+	// Devices
+	if devs == nil {
+		devs, err = pcap.FindAllDevs()
+		if err != nil {
+			return fmt.Errorf("find all devices: %w", err)
+		}
+	}
+
+	// Find devices, which are not listened with TUN
+	if cfg.Tun == "" {
+		listenDevs, err = pcap.FindListenDevs(devs, cfg.ListenDevs)
+		if err != nil {
+			return fmt.Errorf("find listen devices: %w", err)
+		}
+		if len(cfg.ListenDevs) <= 0 {
+			// Remove loopback devices by default
+			result := make([]*pcap.Device, 0)
+
+			for _, dev := range listenDevs {
+				if dev.IsLoop() {
+					continue
+				}
+				result = append(result, dev)
+			}
+
+			listenDevs = result
+		}
+		if len(listenDevs) <= 0 {
+			return errors.New("cannot determine listen device")
+		}
+	}
+
+	// Mode
+	switch cfg.Mode {
+	case "faketcp":
+		mode = "faketcp"
+		log.Infoln("Use FakeTCP")
+	case "tcp":
+		mode = "tcp"
+		log.Infoln("Use standard TCP")
+	case "udp":
+		mode = "udp"
+		log.Infoln("Use standard UDP")
+	case "fakeicmp":
+		mode = "fakeicmp"
+		log.Infoln("Use FakeICMP")
+	case "ws":
+		mode = "ws"
+		log.Infoln("Use WebSocket")
+	case "tls":
+		mode = "tls"
+		log.Infoln("Use TLS")
+	case "quic":
+		mode = "quic"
+		log.Infoln("Use QUIC")
+	default:
+		return fmt.Errorf("mode %s not support", cfg.Mode)
+	}
+
+	// Servers
+	for _, server := range cfg.Server {
+		serverAddr, err := addr.ParseTCPAddr(server)
+		if err != nil {
+			return fmt.Errorf("parse server %s: %w", server, err)
+		}
+		servers = append(servers, serverAddr)
+	}
+	serverIP = servers[0].IP
+	serverPort = uint16(servers[0].Port)
+
+	// Find upstream device and gateway device by the family of servers
+	if serverIP.To4() == nil {
+		if mode != "faketcp" && mode != "tcp" {
+			return fmt.Errorf("mode %s in ipv6 not support", mode)
+		}
+		for _, server := range servers[1:] {
+			if server.IP.To4() != nil {
+				return errors.New("servers in both ipv4 and ipv6 not support")
+			}
+		}
+
+		upDev, gatewayDev, err = pcap.FindIPv6UpstreamDevAndGatewayDev(devs, cfg.UpDev, serverIP)
+	} else {
+		for _, server := range servers[1:] {
+			if server.IP.To4() == nil {
+				return errors.New("servers in both ipv4 and ipv6 not support")
+			}
+		}
+
+		upDev, gatewayDev, err = pcap.FindUpstreamDevAndGatewayDev(devs, cfg.UpDev, gateway)
+	}
+	if err != nil {
+		return fmt.Errorf("find upstream device and gateway device: %w", err)
+	}
+	if upDev == nil && gatewayDev == nil {
+		return errors.New("cannot determine upstream device and gateway device")
+	}
+	if upDev == nil {
+		return errors.New("cannot determine upstream device")
+	}
+	if gatewayDev == nil {
+		return errors.New("cannot determine gateway device")
+	}
+
+	// Crypt
+	crypt, err = crypto.ParseCrypt(cfg.Method, cfg.Password)
+	if err != nil {
+		return fmt.Errorf("parse crypt: %w", err)
+	}
+	method := crypt.Method()
+	if method != crypto.MethodPlain {
+		log.Infof("Encrypt with %s\n", method)
+	}
+
+	// Monitor
+	monitorPort = cfg.Monitor
+	if cfg.Monitor != 0 {
+		if cfg.Monitor == int(upPort) {
+			return fmt.Errorf("same monitor port with upstream port")
+		}
+
+		monitor = stat.NewTrafficMonitor()
+		mux := http.NewServeMux()
+
+		// Host HTTP server
+		mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+			b, err := json.Marshal(&struct {
+				Name    string               `json:"name"`
+				Version string               `json:"version"`
+				Time    int                  `json:"time"`
+				Monitor *stat.TrafficMonitor `json:"monitor"`
+				Ping    int64                `json:"ping"`
+				Beat    *beatStatus          `json:"heartbeat,omitempty"`
+			}{
+				Name:    name,
+				Version: versionInfo,
+				Time:    int(time.Now().Sub(startTime).Seconds()),
+				Monitor: monitor,
+				Ping:    pingTime,
+				Beat:    heartbeatStatus(),
+			})
+			if err != nil {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+				return
+			}
+
+			// Handle CORS
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+
+			_, err = io.WriteString(w, string(b))
+			if err != nil {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+			}
+		})
+		mux.HandleFunc("/dns", func(w http.ResponseWriter, req *http.Request) {
+			type IPName struct {
+				IP   string `json:"ip"`
+				Name string `json:"name"`
+			}
+
+			ipNames := make([]IPName, 0)
+			dnsLock.RLock()
+			for ip, name := range dns {
+				ipNames = append(ipNames, IPName{
+					IP:   ip,
+					Name: name,
+				})
+			}
+			dnsLock.RUnlock()
+
+			b, err := json.Marshal(ipNames)
+			if err != nil {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+				return
+			}
+
+			// Handle CORS
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+
+			_, err = io.WriteString(w, string(b))
+			if err != nil {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+			}
+		})
+		go func() {
+			err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Monitor), mux)
+			if err != nil {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+			}
+		}()
+
+		log.Infof("Monitor on :%d\n", cfg.Monitor)
+		log.Infoln("You can now observe traffic on http://ikago.ikas.ink")
+	}
+
+	// Add rule
+	if cfg.Rule {
+		var (
+			ok   bool
+			devs map[string]bool
+		)
+
+		ok = true
+		devs = make(map[string]bool)
+
+		// IP forwarding, which is required by routing into TUN
+		if cfg.Tun == "" {
+			err := exec.DisableIPForwarding()
+			if err != nil {
+				log.Errorln(fmt.Errorf("disable ip forwarding: %w", err))
+			} else {
+				log.Infoln("Disable IP forwarding")
+			}
+		}
+
+		// GRO
+		for _, dev := range listenDevs {
+			devs[dev.Alias()] = true
+		}
+		devs[upDev.Alias()] = true
+
+		for dev := range devs {
+			err := exec.DisableGRO(dev)
+			if err != nil {
+				log.Errorln(fmt.Errorf("disable gro: %w", err))
+				ok = false
+			}
+		}
+		if ok {
+			log.Infoln("Disable GRO")
+		}
+	}
+
+	// Mode-related options
+	switch mode {
+	case "faketcp":
+		// MTU
+		mtu = cfg.MTU
+		log.Infof("Set MTU to %d Bytes\n", mtu)
+
+		// Obfuscation
+		host = cfg.Host
+		if host == "" {
+			host = cfg.Server[0]
+		}
+
+		obfuscator, err = obfs.ParseObfuscator(cfg.Obfs, host, cfg.Path)
+		if err != nil {
+			return fmt.Errorf("parse obfuscator: %w", err)
+		}
+		if obfuscator.Method() != obfs.MethodPlain {
+			log.Infof("Obfuscate with %s\n", obfuscator.Method())
+		}
+
+		// Fingerprint
+		fingerprint, err = pcap.ParseFingerprint(cfg.Fingerprint)
+		if err != nil {
+			return fmt.Errorf("parse fingerprint: %w", err)
+		}
+		if fingerprint != pcap.FingerprintNone {
+			log.Infof("Imitate TCP fingerprint of %s\n", fingerprint)
+		}
+
+		// KCP
+		isKCP = cfg.KCP
+		kcpConfig = &cfg.KCPConfig
+		if isKCP {
+			log.Infoln("Enable KCP")
+		}
+
+		// Flows
+		flows = cfg.Flows
+		if flows < 1 || flows > 256 {
+			return fmt.Errorf("flows %d out of range", flows)
+		}
+		stripe, err = pcap.ParseStripe(cfg.Stripe)
+		if err != nil {
+			return fmt.Errorf("parse stripe: %w", err)
+		}
+		if flows > 1 {
+			log.Infof("Stripe across %d flows in %s\n", flows, stripe)
+		}
+
+		// FEC
+		if cfg.FEC != 0 {
+			if isKCP {
+				return errors.New("fec not support with KCP")
+			}
+			if cfg.FEC < 0 || cfg.FEC > 128 {
+				return fmt.Errorf("fec %d out of range", cfg.FEC)
+			}
+			if cfg.FECParity <= 0 || cfg.FECParity > 1 {
+				return fmt.Errorf("fec parity %f out of range", cfg.FECParity)
+			}
+
+			fecGroup = cfg.FEC
+			fecRatio = cfg.FECParity
+			log.Infof("Enable FEC in group of %d with parity of %.2f\n", fecGroup, fecRatio)
+		}
+
+		// Hop
+		if cfg.Hop != "" {
+			if isKCP {
+				return errors.New("hop not support with KCP")
+			}
+			if cfg.HopInterval < 0 {
+				return fmt.Errorf("hop interval %d out of range", cfg.HopInterval)
+			}
+
+			hopStart, hopEnd, err = addr.ParsePortRange(cfg.Hop)
+			if err != nil {
+				return fmt.Errorf("parse hop: %w", err)
+			}
+			hopInterval = time.Duration(cfg.HopInterval) * time.Second
+
+			if hopInterval > 0 {
+				log.Infof("Hop in ports %d-%d every %s\n", hopStart, hopEnd, hopInterval)
+			} else {
+				log.Infof("Hop in ports %d-%d on loss\n", hopStart, hopEnd)
+			}
+		}
+
+		// Keepalive
+		if cfg.Keepalive != 0 {
+			if isKCP {
+				return errors.New("keepalive not support with KCP")
+			}
+			if cfg.Keepalive < 0 {
+				return fmt.Errorf("keepalive %d out of range", cfg.Keepalive)
+			}
+			if cfg.KeepMisses < 0 {
+				return fmt.Errorf("keepalive misses %d out of range", cfg.KeepMisses)
+			}
+
+			keepalive = time.Duration(cfg.Keepalive) * time.Second
+			keepMisses = cfg.KeepMisses
+			if keepMisses == 0 {
+				keepMisses = 3
+			}
+			log.Infof("Send heartbeats every %s and reconnect after %d misses\n", keepalive, keepMisses)
+		}
+
+		// Roam
+		if cfg.Roam {
+			if isKCP {
+				return errors.New("roam not support with KCP")
+			}
+			// Sessions must be authenticated, or times in them can be flipped without the key
+			if crypt.Cost() <= 0 {
+				return errors.New("roam not support without AEAD")
+			}
+
+			roam = true
+			log.Infoln("Enable roaming")
+		}
+
+		// Session, which identifies flows of the client in the server
+		if roam || flows > 1 || hopStart != 0 {
+			// Sessions are sent in the payload of TCP SYNs, which neither HTTP nor OSes do
+			if obfuscator.Method() != obfs.MethodPlain {
+				return errors.New("roam, flows and hop not support with obfuscation")
+			}
+			if fingerprint != pcap.FingerprintNone {
+				return errors.New("roam, flows and hop not support with fingerprint")
+			}
+
+			session, err = crypto.GenerateNonce(pcap.SessionSize)
+			if err != nil {
+				return fmt.Errorf("generate session: %w", err)
+			}
+		}
+	case "tcp":
+		break
+	case "udp":
+		// KCP
+		isKCP = cfg.KCP
+		kcpConfig = &cfg.KCPConfig
+		if isKCP {
+			log.Infoln("Enable KCP")
+		}
+	case "fakeicmp":
+		// MTU
+		mtu = cfg.MTU
+		log.Infof("Set MTU to %d Bytes\n", mtu)
+	case "ws":
+		// Path
+		path = cfg.Path
+		if path == "" || path[0] != '/' {
+			return fmt.Errorf("invalid path %s", path)
+		}
+
+		// Host
+		host = cfg.Host
+		if host != "" {
+			log.Infof("Use host %s\n", host)
+		}
+	case "tls", "quic":
+		// SNI
+		if cfg.SNI != "" {
+			log.Infof("Use SNI %s\n", cfg.SNI)
+		}
+
+		// Pin
+		if cfg.Pin != "" {
+			log.Infof("Pin server certificate %s\n", cfg.Pin)
+		}
+
+		tlsConfig, err = pcap.CreateTLSClientConfig(cfg.SNI, cfg.Pin)
+		if err != nil {
+			return fmt.Errorf("create tls config: %w", err)
+		}
+
+		// ALPN
+		if mode == "quic" {
+			if cfg.ALPN == "" {
+				return errors.New("missing alpn")
+			}
+
+			tlsConfig.NextProtos = []string{cfg.ALPN}
+			log.Infof("Use ALPN %s\n", cfg.ALPN)
+		}
+	default:
+		return fmt.Errorf("mode %s not support", mode)
+	}
+
+	// Duplication
+	if cfg.Dup > 1 {
+		if mode != "faketcp" && mode != "udp" && mode != "fakeicmp" {
+			return fmt.Errorf("duplication not support in mode %s", mode)
+		}
+		if isKCP {
+			return errors.New("duplication not support with KCP")
+		}
+		if cfg.Dup > 16 {
+			return fmt.Errorf("dup %d out of range", cfg.Dup)
+		}
+		if cfg.DupDelay < 0 {
+			return fmt.Errorf("dup delay %d out of range", cfg.DupDelay)
+		}
+
+		dupFilter, err = pcap.ParseDupFilter(cfg.DupPorts)
+		if err != nil {
+			return fmt.Errorf("parse dup ports: %w", err)
+		}
+		dupTimes = cfg.Dup
+		dupDelay = time.Duration(cfg.DupDelay) * time.Millisecond
+
+		if len(cfg.DupPorts) > 0 {
+			log.Infof("Duplicate packets in ports %s in %d times\n", dupFilter, dupTimes)
+		} else {
+			log.Infof("Duplicate packets in %d times\n", dupTimes)
+		}
+	}
+
+	// Publish
+	for _, p := range splitArg(cfg.Publish) {
+		ip := net.ParseIP(p)
+		if ip == nil {
+			log.Errorln(fmt.Errorf("invalid publish %s", p))
+			continue
+		}
+		publishIPs = append(publishIPs, &net.IPAddr{IP: ip})
+	}
+	for _, publishIP := range publishIPs {
+		log.Infof("Publish %s\n", publishIP.IP)
+	}
+
+	// Fragment
+	fragment = cfg.Fragment
+	log.Infof("Set fragment to %d Bytes\n", fragment)
+
+	// TUN
+	tunName = cfg.Tun
+
+	// Randomize upstream port
+	if flows < 1 {
+		flows = 1
+	}
+	if cfg.Port == 0 {
+		s := rand.NewSource(time.Now().UnixNano())
+		for cfg.Port == 0 || (cfg.Monitor >= cfg.Port && cfg.Monitor < cfg.Port+flows) {
+			r := rand.New(s)
+			cfg.Port = 49152 + r.Intn(16384-(flows-1))
+		}
+	}
+	if cfg.Port <= 0 || cfg.Port+flows-1 > 65535 {
+		return fmt.Errorf("port %d out of range", cfg.Port)
+	}
+	upPort = uint16(cfg.Port)
+
+	// Sources
+	for _, source := range cfg.Sources {
+		ip := net.ParseIP(source)
+		if ip == nil {
+			return fmt.Errorf("invalid source %s", source)
+		}
+		sources = append(sources, &net.IPAddr{IP: ip})
+	}
+
+	// Add firewall rule (delay)
+	if cfg.Rule {
+		// Firewall
+		switch mode {
+		case "faketcp":
+			for _, server := range servers {
+				err = exec.AddSpecificFirewallRule(server.IP, uint16(server.Port))
+				if err != nil {
+					break
+				}
+				if hopStart != 0 {
+					err = exec.AddSpecificRangeFirewallRule(server.IP, hopStart, hopEnd)
+					if err != nil {
+						break
+					}
+				}
+			}
+			if err != nil {
+				log.Errorln(fmt.Errorf("add firewall rule: %w", err))
+			} else {
+				log.Infoln("Add firewall rule")
+			}
+		case "tcp", "udp", "fakeicmp", "ws", "tls", "quic":
+			break
+		default:
+			return fmt.Errorf("mode %s not support", cfg.Mode)
+		}
+	}
+
+	if len(sources) <= 0 {
+		log.Infof("Proxy packets in TUN %s through :%d to %s\n", cfg.Tun, upPort, servers[0])
+	} else if len(sources) == 1 {
+		log.Infof("Proxy %s through :%d to %s\n", sources[0], upPort, servers[0])
+	} else {
+		log.Infoln("Proxy:")
+		for i, f := range sources {
+			if i != len(sources)-1 {
+				log.Infof("  %s\n", f)
+			} else {
+				log.Infof("  %s through :%d to %s\n", f, upPort, servers[0])
+			}
+		}
+	}
+	if len(servers) > 1 {
+		log.Infoln("Fail over to:")
+		for _, server := range servers[1:] {
+			log.Infof("  %s\n", server)
+		}
+	}
+
+	// Open pcap
+	err = open(ready)
+	if err != nil {
+		return fmt.Errorf("open pcap: %w", err)
+	}
+
+	return nil
+}
+
+func open(ready chan<- struct{}) error {
+	var err error
+
+	if tunName != "" {
+		log.Infof("Listen on TUN %s\n", tunName)
+	} else if len(listenDevs) == 1 {
+		log.Infof("Listen on %s\n", listenDevs[0].String())
+	} else {
+		log.Infoln("Listen on:")
+		for _, dev := range listenDevs {
+			log.Infof("  %s\n", dev.String())
+		}
+	}
+	if !gatewayDev.IsLoop() {
+		log.Infof("Route upstream from %s to %s\n", upDev, gatewayDev)
+	} else {
+		log.Infof("Route upstream in %s\n", upDev)
+	}
+
+	// Handles for listening
+	if tunName != "" {
+		err = openTun()
+	} else {
+		err = openListen()
+	}
+	if err != nil {
+		return err
+	}
+
+	// Handle for routing upstream
+	for i, server := range servers {
+		upConn, err = dial(server, upPort)
+		if err == nil {
+			serverIndex = i
+			serverIP = server.IP
+			serverPort = uint16(server.Port)
+			break
+		}
+		if i < len(servers)-1 {
+			log.Errorln(fmt.Errorf("open upstream: %w", err))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("open upstream: %w", err)
+	}
+	atomic.StoreInt64(&lastRead, time.Now().UnixNano())
+
+	// Ping
+	if monitor != nil {
+		startPing()
+	}
+
+	// Heartbeat
+	if keepalive > 0 {
+		routines.Add(1)
+		go func() {
+			defer routines.Done()
+			heartbeat()
+		}()
+	}
+
+	// Start handling
+	if tunDev != nil {
+		routines.Add(1)
+		go func() {
+			defer routines.Done()
+			b := make([]byte, pcap.IPv4MaxSize)
+			for {
+				n, err := tunDev.Read(b)
+				if err != nil {
+					if isClosed() {
+						return
+					}
+					log.Errorln(fmt.Errorf("read tun %s: %w", tunDev.Name(), err))
+					continue
+				}
+
+				err = handleTun(b[:n])
+				if err != nil {
+					log.Errorln(fmt.Errorf("handle tun %s: %w", tunDev.Name(), err))
+					log.Verbosef("Size: %d Bytes\n\n", n)
+					continue
+				}
+			}
+		}()
+	}
+	for i := 0; i < len(listenConns); i++ {
+		conn := listenConns[i]
+
+		routines.Add(1)
+		go func() {
+			defer routines.Done()
+			for {
+				packet, err := conn.ReadPacket()
+				if err != nil {
+					if isClosed() {
+						return
+					}
+					log.Errorln(fmt.Errorf("read listen device %s: %w", conn.LocalDev().Alias(), err))
+					continue
+				}
+
+				select {
+				case <-closed:
+					return
+				case c <- pcap.ConnPacket{Packet: packet, Conn: conn}:
+				}
+			}
+		}()
+	}
+
+	routines.Add(1)
+	go func() {
+		defer routines.Done()
+		for {
+			var cp pcap.ConnPacket
+			select {
+			case <-closed:
+				return
+			case cp = <-c:
+			}
+
+			err := handleListen(cp.Packet, cp.Conn)
+			if err != nil {
+				log.Errorln(fmt.Errorf("handle listen in device %s: %w", cp.Conn.LocalDev().Alias(), err))
+				log.Verboseln(cp.Packet)
+				continue
+			}
+		}
+	}()
+
+	// Fail over, hop and roam
+	if len(servers) > 1 || hopStart != 0 || roam {
+		routines.Add(1)
+		go func() {
+			defer routines.Done()
+			supervise()
+		}()
+	}
+
+	if ready != nil {
+		close(ready)
+	}
+
+	b := make([]byte, pcap.IPv4MaxSize)
+	for {
+		conn := currentUpConn()
+
+		n, err := conn.Read(b)
+		if err != nil {
+			if isClosed() {
+				return nil
+			}
+			// The connection has been replaced
+			if conn != currentUpConn() {
+				continue
+			}
+			if errors.Is(err, io.EOF) {
+				if len(servers) <= 1 {
+					return fmt.Errorf("connection to server %s is closed, is the server or your network down?", conn.RemoteAddr())
+				}
+
+				log.Errorf("Connection to server %s is closed, is the server or your network down?\n", conn.RemoteAddr())
+
+				// Wait for failing over
+				select {
+				case down <- struct{}{}:
+				default:
+				}
+				for !isClosed() && conn == currentUpConn() {
+					time.Sleep(time.Second)
+				}
+				continue
+			}
+			log.Errorln(fmt.Errorf("read upstream: %w", err))
+			continue
+		}
+
+		atomic.StoreInt64(&lastRead, time.Now().UnixNano())
+
+		err = handleUpstream(conn, b[:n])
+		if err != nil {
+			log.Errorln(fmt.Errorf("handle upstream in address %s: %w", conn.LocalAddr().String(), err))
+			log.Verbosef("Source: %s\nSize: %d Bytes\n\n", conn.RemoteAddr().String(), n)
+			continue
+		}
+	}
+}
+
+// openListen opens listen devices with filters of sources.
+func openListen() error {
+	// Filters for listening
+	fs := make([]string, 0)
+	fs6 := make([]string, 0)
+	for _, f := range sources {
+		s, err := addr.SrcBPFFilter(f)
+		if err != nil {
+			return fmt.Errorf("parse filter %s: %w", f, err)
+		}
+
+		if f.IP.To4() == nil {
+			fs6 = append(fs6, s)
+		} else {
+			fs = append(fs, s)
+		}
+	}
+	sfs := make([]string, 0)
+	shfs := make([]string, 0)
+	for _, server := range servers {
+		sfs = append(sfs, fmt.Sprintf("not (src host %s && src port %d)", server.IP, server.Port))
+		if hopStart != 0 {
+			sfs = append(sfs, fmt.Sprintf("not (src host %s && src portrange %d-%d)", server.IP, hopStart, hopEnd))
+		}
+		shfs = append(shfs, fmt.Sprintf("not src host %s", server.IP))
+	}
+	filters := make([]string, 0)
+	if len(fs) > 0 {
+		f := strings.Join(fs, " || ")
+		filters = append(filters, fmt.Sprintf("(ip && (((tcp || udp) && (%s) && %s) || ((icmp || (ip[6:2] & 0x1fff) != 0) && (%s) && %s)))",
+			f, strings.Join(sfs, " && "), f, strings.Join(shfs, " && ")))
+	}
+	if len(fs6) > 0 {
+		// Neighbor discovery is never redirected
+		f := strings.Join(fs6, " || ")
+		filters = append(filters, fmt.Sprintf("(ip6 && (((tcp || udp) && (%s) && %s) || (((icmp6 && (ip6[40] < 133 || ip6[40] > 137)) || ip6[6] = 44) && (%s) && %s)))",
+			f, strings.Join(sfs, " && "), f, strings.Join(shfs, " && ")))
+	}
+	isNDP := false
+	for _, publishIP := range publishIPs {
+		if publishIP.IP.To4() == nil {
+			// Targets of neighbor solicitations are checked later
+			isNDP = true
+			continue
+		}
+
+		s, err := addr.DstBPFFilter(publishIP)
+		if err != nil {
+			return fmt.Errorf("parse filter %s: %w", publishIP, err)
+		}
+		filters = append(filters, fmt.Sprintf("(arp[6:2] = 1 && %s)", s))
+	}
+	if isNDP {
+		filters = append(filters, "(icmp6 && ip6[40] = 135)")
+	}
+	filter := strings.Join(filters, " || ")
+
+	// Handles for listening
+	for _, dev := range listenDevs {
+		var (
+			err  error
+			conn pcap.Endpoint
+		)
+
+		if dev.IsLoop() {
+			conn, err = pcap.CreateEndpoint(dev, dev, filter)
+		} else {
+			conn, err = pcap.CreateEndpoint(dev, gatewayDev, filter)
+		}
+		if err != nil {
+			return fmt.Errorf("open listen device %s: %w", conn.LocalDev().Alias(), err)
+		}
+
+		listenConns = append(listenConns, conn)
+	}
+
+	return nil
+}
+
+// openTun creates the TUN device for listening.
+func openTun() error {
+	var err error
+
+	tunDev, err = tun.Create(tunName, fragment)
+	if err != nil {
+		return fmt.Errorf("create tun %s: %w", tunName, err)
+	}
+
+	return nil
+}
+
+// dial connects to the server from the port in the mode.
+func dial(server *net.TCPAddr, port uint16) (net.Conn, error) {
+	var (
+		err  error
+		conn net.Conn
+	)
+
+	switch mode {
+	case "faketcp":
+		conns := make([]net.Conn, 0)
+		for i := 0; i < flows; i++ {
+			var conn net.Conn
+
+			if isKCP {
+				conn, err = pcap.DialFakeTCPWithKCP(upDev, gatewayDev, port+uint16(i), server, crypt, obfuscator, fingerprint, mtu, kcpConfig)
+			} else {
+				conn, err = pcap.DialFakeTCPWithSession(upDev, gatewayDev, port+uint16(i), server, crypt, obfuscator, fingerprint, mtu, flowSession(i))
+				if err == nil && fecGroup > 0 {
+					var fecConn *pcap.FECConn
+
+					fecConn, err = pcap.NewFECConn(conn, fecGroup, fecRatio)
+					if err != nil {
+						conn.Close()
+					} else {
+						conn = fecConn
+					}
+				}
+				if err == nil {
+					conn, err = duplicate(conn)
+				}
+			}
+			if err != nil {
+				for _, conn := range conns {
+					conn.Close()
+				}
+				break
+			}
+
+			conns = append(conns, conn)
+		}
+		if err == nil {
+			if len(conns) == 1 {
+				conn = conns[0]
+			} else {
+				conn = pcap.NewStripeConn(conns, stripe)
+			}
+		}
+	case "tcp":
+		conn, err = pcap.DialTCP(upDev, port, server, crypt)
+	case "udp":
+		if isKCP {
+			conn, err = pcap.DialUDPWithKCP(upDev, port, &net.UDPAddr{IP: server.IP, Port: server.Port}, crypt, kcpConfig)
+		} else {
+			conn, err = pcap.DialUDP(upDev, port, &net.UDPAddr{IP: server.IP, Port: server.Port}, crypt)
+			if err == nil {
+				conn, err = duplicate(conn)
+			}
+		}
+	case "fakeicmp":
+		conn, err = pcap.DialFakeICMP(upDev, gatewayDev, port, server.IP, crypt, mtu)
+		if err == nil {
+			conn, err = duplicate(conn)
+		}
+	case "ws":
+		conn, err = pcap.DialWS(upDev, port, server, host, path, crypt)
+	case "tls":
+		conn, err = pcap.DialTLS(upDev, port, server, tlsConfig, crypt)
+	case "quic":
+		conn, err = pcap.DialQUIC(upDev, port, &net.UDPAddr{IP: server.IP, Port: server.Port}, tlsConfig, crypt)
+	default:
+		err = fmt.Errorf("mode %s not support", mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func currentUpConn() net.Conn {
+	upLock.RLock()
+	defer upLock.RUnlock()
+
+	return upConn
+}
+
+func startPing() {
+	var err error
+
+	pinger, err = ping.NewPinger(serverIP.String())
+	if err != nil {
+		log.Errorln(fmt.Errorf("ping: %w", err))
+	}
+	if pinger != nil {
+		p := pinger
+		p.SetPrivileged(true)
+		p.OnRecv = func(packet *ping.Packet) {
+			if packet != nil {
+				pingTime = packet.Rtt.Milliseconds()
+				pingSeq = packet.Seq
+
+				log.Verbosef("Receive ICMP Echo Reply: %s <- %s (%d ms)\n", upDev.IPAddr().IP, p.IPAddr().IP, packet.Rtt.Milliseconds())
+
+				// Timeout
+				go func() {
+					time.Sleep(pingDeadline)
+					if packet.Seq == pingSeq {
+						pingTime = -2
+
+						log.Errorf("Cannot receive ICMP Echo Reply from server %s, is your network down?\n", p.IPAddr().IP)
+					}
+				}()
+			}
+		}
+
+		go func() {
+			p.Run()
+		}()
+	}
+}
+
+// heartbeat sends heartbeats to the server in every flow periodically, and reconnects to the server if it misses
+// heartbeats.
+func heartbeat() {
+	timeout := keepalive * time.Duration(keepMisses)
+	lastReconnect := time.Now()
+
+	atomic.StoreInt64(&lastBeat, time.Now().UnixNano())
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-time.After(keepalive):
+		}
+
+		conn := currentUpConn()
+		rtt := time.Duration(atomic.LoadInt64(&beatRTT))
+
+		conns := []net.Conn{conn}
+		if stripeConn, ok := conn.(*pcap.StripeConn); ok {
+			conns = stripeConn.Conns()
+		}
+		for _, c := range conns {
+			_, err := c.Write(control.NewHeartbeat(time.Now(), rtt).Serialize())
+			if err != nil {
+				log.Errorln(fmt.Errorf("heartbeat: %w", err))
+			}
+		}
+
+		idle := time.Now().Sub(time.Unix(0, atomic.LoadInt64(&lastBeat)))
+		if idle > timeout && time.Now().Sub(lastReconnect) > timeout {
+			lastReconnect = time.Now()
+
+			log.Errorf("Server %s misses heartbeats in %.0f seconds, reconnect\n", conn.RemoteAddr(), idle.Seconds())
+
+			err := reconnect(conn)
+			if err != nil {
+				log.Errorln(fmt.Errorf("reconnect: %w", err))
+			}
+		}
+	}
+}
+
+type beatStatus struct {
+	IsAlive bool  `json:"alive"`
+	RTT     int64 `json:"rtt"`
+}
+
+// heartbeatStatus returns the liveness of the server, or nil if heartbeats are disabled.
+func heartbeatStatus() *beatStatus {
+	if keepalive <= 0 {
+		return nil
+	}
+
+	rtt := atomic.LoadInt64(&beatRTT)
+	if rtt >= 0 {
+		rtt = time.Duration(rtt).Milliseconds()
+	}
+
+	return &beatStatus{
+		IsAlive: time.Now().Sub(time.Unix(0, atomic.LoadInt64(&lastBeat))) <= keepalive*time.Duration(keepMisses),
+		RTT:     rtt,
+	}
+}
+
+func handleControl(contents []byte) error {
+	message, err := control.Parse(contents)
+	if err != nil {
+		return fmt.Errorf("parse: %w", err)
+	}
+
+	switch message.Type {
+	case control.TypeHeartbeatAck:
+		t, err := message.Time()
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", message.Type, err)
+		}
+
+		rtt := time.Now().Sub(t)
+		atomic.StoreInt64(&lastBeat, time.Now().UnixNano())
+		atomic.StoreInt64(&beatRTT, int64(rtt))
+
+		log.Verbosef("Receive heartbeat ACK from server in %.3f ms (RTT)\n", float64(rtt.Microseconds())/1000)
+	default:
+		return fmt.Errorf("type %s not support", message.Type)
+	}
+
+	return nil
+}
+
+// supervise probes the current server periodically. It hops to another port of the server if the server misses a
+// probe or on schedule, fails over to the next server if the current one misses probes continuously, and fails back to
+// servers in higher priority once they recover.
+func supervise() {
+	misses := 0
+	lastFailback := time.Now()
+	lastHop := time.Now()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-down:
+			misses = probeMisses
+		case <-time.After(probeInterval):
+		}
+
+		// Probe the current server if nothing is received recently
+		if misses < probeMisses {
+			idle := time.Now().Sub(time.Unix(0, atomic.LoadInt64(&lastRead)))
+
+			if idle < probeInterval {
+				misses = 0
+			} else {
+				err := probe(currentUpConn())
+				if err != nil {
+					misses++
+					log.Errorln(fmt.Errorf("probe server %s (%d/%d): %w", servers[serverIndex], misses, probeMisses, err))
+				} else {
+					misses = 0
+				}
+			}
+		}
+
+		// Hop on loss or on schedule
+		if hopStart != 0 && ((misses > 0 && misses < probeMisses) || (hopInterval > 0 && time.Now().Sub(lastHop) >= hopInterval)) {
+			lastHop = time.Now()
+
+			err := hop()
+			if err != nil {
+				log.Errorln(fmt.Errorf("hop: %w", err))
+			} else {
+				misses = 0
+			}
+		}
+
+		// Fail over to servers in lower priority
+		if misses >= probeMisses && len(servers) > 1 {
+			for i := 1; i < len(servers); i++ {
+				index := (serverIndex + i) % len(servers)
+
+				err := switchServer(index)
+				if err != nil {
+					log.Errorln(fmt.Errorf("fail over to server %s: %w", servers[index], err))
+					continue
+				}
+
+				log.Infof("Fail over to server %s\n", servers[index])
+				misses = 0
+				lastFailback = time.Now()
+				break
+			}
+			continue
+		}
+
+		// Fail back to servers in higher priority
+		if serverIndex > 0 && time.Now().Sub(lastFailback) > failbackInterval {
+			lastFailback = time.Now()
+
+			for i := 0; i < serverIndex; i++ {
+				err := switchServer(i)
+				if err != nil {
+					log.Verboseln(fmt.Errorf("fail back to server %s: %w", servers[i], err))
+					continue
+				}
+
+				log.Infof("Fail back to server %s\n", servers[i])
+				break
+			}
+		}
+	}
+}
+
+// switchServer connects to the server from a new port, and replaces the current connection if the server is reachable.
+func switchServer(index int) error {
+	port := randPort()
+
+	conn, err := dial(servers[index], port)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+
+	err = verify(conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("verify: %w", err)
+	}
+
+	replaceUpConn(conn, port, index)
+
+	return nil
+}
+
+// hop connects to a random port in the hop range of the current server from a new port, and replaces the current
+// connection. The server is told to migrate the connections of the client.
+func hop() error {
+	upLock.RLock()
+	index := serverIndex
+	oldPort := upPort
+	upLock.RUnlock()
+
+	port := randPort()
+	server := &net.TCPAddr{
+		IP:   servers[index].IP,
+		Port: int(hopStart) + rand.Intn(int(hopEnd-hopStart)+1),
+	}
+
+	conn, err := dial(server, port)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+
+	err = verify(conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("verify: %w", err)
+	}
+
+	// Tell the server each flow hops from which port
+	conns := []net.Conn{conn}
+	if c, ok := conn.(*pcap.StripeConn); ok {
+		conns = c.Conns()
+	}
+	for i, c := range conns {
+		_, err = c.Write(control.NewHop(oldPort + uint16(i)).Serialize())
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+
+	replaceUpConn(conn, port, index)
+
+	log.Infof("Hop to server %s from :%d\n", server, port)
+
+	return nil
+}
+
+// replaceUpConn replaces the current connection with the connection to the server.
+func replaceUpConn(conn net.Conn, port uint16, index int) {
+	upLock.Lock()
+	old := upConn
+	isSwitched := index != serverIndex
+	upConn = conn
+	upPort = port
+	serverIndex = index
+	serverIP = servers[index].IP
+	serverPort = uint16(servers[index].Port)
+	upLock.Unlock()
+
+	atomic.StoreInt64(&lastRead, time.Now().UnixNano())
+
+	old.Close()
+
+	// Ping
+	if pinger != nil && isSwitched {
+		pinger.Stop()
+		startPing()
+	}
+}
+
+// probe reconnects the connection and reports if the server responds. The connection must be read concurrently.
+// Connections cannot be probed are always considered to be reachable.
+func probe(conn net.Conn) error {
+	switch conn.(type) {
+	case *pcap.FakeTCPConn:
+		c := conn.(*pcap.FakeTCPConn)
+
+		err := c.Reconnect()
+		if err != nil {
+			return fmt.Errorf("reconnect: %w", err)
+		}
+
+		time.Sleep(probeDeadline)
+
+		if !c.IsReconnected() {
+			return errors.New("timeout")
+		}
+	case *pcap.FakeICMPConn:
+		c := conn.(*pcap.FakeICMPConn)
+
+		err := c.Reconnect()
+		if err != nil {
+			return fmt.Errorf("reconnect: %w", err)
+		}
+
+		time.Sleep(probeDeadline)
+
+		if !c.IsReconnected() {
+			return errors.New("timeout")
+		}
+	case *pcap.FECConn, *pcap.DupConn:
+		return probe(unwrap(conn))
+	case *pcap.StripeConn:
+		// Any flow responds
+		var err error
+		for _, c := range conn.(*pcap.StripeConn).Conns() {
+			err = probe(c)
+			if err == nil {
+				return nil
+			}
+		}
+		return err
+	default:
+		break
+	}
+
+	return nil
+}
+
+// verify reads a newly dialed connection until the handshake is responded by the server.
+func verify(conn net.Conn) error {
+	switch unwrap(conn).(type) {
+	case *pcap.FakeTCPConn, *pcap.FakeICMPConn:
+		type connectedConn interface {
+			net.Conn
+			IsConnected() bool
+		}
+
+		// Read through wrapping connections
+		c := conn
+		cc := unwrap(conn).(connectedConn)
+
+		err := c.SetReadDeadline(time.Now().Add(probeDeadline))
+		if err != nil {
+			return fmt.Errorf("set read deadline: %w", err)
+		}
+
+		b := make([]byte, pcap.IPv4MaxSize)
+		for !cc.IsConnected() {
+			_, err := c.Read(b)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					return errors.New("timeout")
+				}
+				return err
+			}
+		}
+
+		err = c.SetReadDeadline(time.Time{})
+		if err != nil {
+			return fmt.Errorf("set read deadline: %w", err)
+		}
+	case *pcap.StripeConn:
+		// Flows are read by the connection itself
+		time.Sleep(probeDeadline)
+
+		for _, c := range conn.(*pcap.StripeConn).Conns() {
+			c = unwrap(c)
+
+			switch c.(type) {
+			case *pcap.FakeTCPConn:
+				if c.(*pcap.FakeTCPConn).IsConnected() {
+					return nil
+				}
+			default:
+				return nil
+			}
+		}
+
+		return errors.New("timeout")
+	default:
+		break
+	}
+
+	return nil
+}
+
+// randPort returns a random port for routing upstream which is not in use.
+func randPort() uint16 {
+	for {
+		port := 49152 + rand.Intn(16384-(flows-1))
+
+		upLock.RLock()
+		isUsed := port+flows > int(upPort) && port < int(upPort)+flows
+		upLock.RUnlock()
+
+		if isUsed || (monitorPort >= port && monitorPort < port+flows) {
+			continue
+		}
+
+		return uint16(port)
+	}
+}
+
+// Close closes the client, and waits for its routines.
+func Close() {
+	if closed == nil || isClosed() {
+		return
+	}
+	close(closed)
+	for _, handle := range listenConns {
+		if handle != nil {
+			handle.Close()
+		}
+	}
+	if tunDev != nil {
+		tunDev.Close()
+	}
+	if conn := currentUpConn(); conn != nil {
+		conn.Close()
+	}
+	if pinger != nil {
+		pinger.Stop()
+	}
+	routines.Wait()
+}
+
+func publish(packet gopacket.Packet, conn pcap.Endpoint) error {
+	var (
+		indicator    *pcap.PacketIndicator
+		linkLayer    gopacket.Layer
+		newLinkLayer *layers.Ethernet
+		hardwareAddr net.HardwareAddr
+		data         []byte
+	)
+
+	// Parse packet
+	indicator, err := pcap.ParsePacket(packet)
+	if err != nil {
+		return fmt.Errorf("parse packet: %w", err)
+	}
+
+	// Create new link layer
+	linkLayer = packet.LinkLayer()
+
+	switch t := linkLayer.LayerType(); t {
+	case layers.LayerTypeEthernet:
+		newLinkLayer = &layers.Ethernet{
+			SrcMAC:       conn.LocalDev().HardwareAddr(),
+			DstMAC:       linkLayer.(*layers.Ethernet).SrcMAC,
+			EthernetType: linkLayer.(*layers.Ethernet).EthernetType,
+		}
+	default:
+		return fmt.Errorf("link layer type %s not support", t)
+	}
+
+	switch t := indicator.NetworkLayer().LayerType(); t {
+	case layers.LayerTypeARP:
+		// Create new ARP layer
+		arpLayer := indicator.ARPLayer()
+		newARPLayer := &layers.ARP{
+			AddrType:          arpLayer.AddrType,
+			Protocol:          arpLayer.Protocol,
+			HwAddressSize:     arpLayer.HwAddressSize,
+			ProtAddressSize:   arpLayer.ProtAddressSize,
+			Operation:         layers.ARPReply,
+			SourceHwAddress:   conn.LocalDev().HardwareAddr(),
+			SourceProtAddress: arpLayer.DstProtAddress,
+			DstHwAddress:      arpLayer.SourceHwAddress,
+			DstProtAddress:    arpLayer.SourceProtAddress,
+		}
+		hardwareAddr = arpLayer.SourceHwAddress
+
+		// Serialize layers
+		data, err = pcap.Serialize(newLinkLayer, newARPLayer)
+		if err != nil {
+			return fmt.Errorf("serialize: %w", err)
+		}
+	case layers.LayerTypeIPv6:
+		// Create new ICMPv6 layers
+		newICMPv6Layer := &layers.ICMPv6{
+			TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborAdvertisement, 0),
+		}
+		newNALayer := &layers.ICMPv6NeighborAdvertisement{
+			// Router and override
+			Flags:         0xa0,
+			TargetAddress: indicator.ICMPv6Indicator().TargetIP(),
+			Options: layers.ICMPv6Options{
+				layers.ICMPv6Option{
+					Type: layers.ICMPv6OptTargetAddress,
+					Data: conn.LocalDev().HardwareAddr(),
+				},
+			},
+		}
+
+		hardwareAddr = indicator.SrcHardwareAddr()
+
+		// Duplicate address detection is replied to all nodes
+		dstIP := indicator.SrcIP()
+		if dstIP.IsUnspecified() {
+			dstIP = net.IPv6linklocalallnodes
+			newLinkLayer.DstMAC = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01}
+		} else {
+			// Solicited
+			newNALayer.Flags = newNALayer.Flags | 0x40
+		}
+
+		// Create new IPv6 layer
+		newIPv6Layer, err := pcap.CreateIPv6Layer(newNALayer.TargetAddress, dstIP, 255, newICMPv6Layer)
+		if err != nil {
+			return fmt.Errorf("create network layer: %w", err)
+		}
+
+		// Serialize layers
+		data, err = pcap.Serialize(newLinkLayer, newIPv6Layer, newICMPv6Layer, newNALayer)
+		if err != nil {
+			return fmt.Errorf("serialize: %w", err)
+		}
+	default:
+		return fmt.Errorf("network layer type %s not support", t)
+	}
+
+	// Write packet data
+	_, err = conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	pcap.CaptureDevice(conn, pcap.RoleServer, nil, data)
+
+	// Reconnect
+	if conn := currentUpConn(); conn != nil {
+		err = reconnect(conn)
+		if err != nil {
+			return fmt.Errorf("reconnect: %w", err)
+		}
+	}
+
+	log.Infof("Device %s [%s] joined the network\n", indicator.SrcIP(), hardwareAddr)
+	if indicator.NetworkLayer().LayerType() == layers.LayerTypeARP {
+		log.Verbosef("Reply an %s request: %s -> %s\n", indicator.NetworkLayer().LayerType(), indicator.SrcIP(), indicator.DstIP())
+	} else {
+		log.Verbosef("Reply a neighbor solicitation: %s -> %s\n", indicator.SrcIP(), indicator.ICMPv6Indicator().TargetIP())
+	}
+
+	return nil
+}
+
+// isPublished returns if the neighbor solicitation in the packet asks for a publishing address.
+func isPublished(indicator *pcap.PacketIndicator) bool {
+	if indicator.ICMPv6Indicator() == nil || !indicator.ICMPv6Indicator().IsNeighborSolicitation() {
+		return false
+	}
+
+	for _, publishIP := range publishIPs {
+		if publishIP.IP.Equal(indicator.ICMPv6Indicator().TargetIP()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func reconnect(conn net.Conn) error {
+	switch conn.(type) {
+	case *pcap.FakeTCPConn:
+		return conn.(*pcap.FakeTCPConn).Reconnect()
+	case *pcap.FakeICMPConn:
+		return conn.(*pcap.FakeICMPConn).Reconnect()
+	case *pcap.StripeConn:
+		for _, c := range conn.(*pcap.StripeConn).Conns() {
+			err := reconnect(c)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case *pcap.FECConn, *pcap.DupConn:
+		return reconnect(unwrap(conn))
+	default:
+		return nil
+	}
+}
+
+// duplicate returns a connection with duplication over the connection if duplication is enabled.
+func duplicate(conn net.Conn) (net.Conn, error) {
+	if dupTimes <= 1 {
+		return conn, nil
+	}
+
+	dupConn, err := pcap.NewDupConn(conn, dupTimes, dupDelay, dupFilter, false)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("duplicate: %w", err)
+	}
+
+	return dupConn, nil
+}
+
+// flowSession returns the session of the flow, or nil if the client is not in a session.
+func flowSession(i int) []byte {
+	if session == nil {
+		return nil
+	}
+
+	// Flows are in different sessions
+	s := make([]byte, len(session))
+	copy(s, session)
+	s[len(s)-1] = byte(i)
+
+	return s
+}
+
+// unwrap returns the underlying connection of FEC and duplication.
+func unwrap(conn net.Conn) net.Conn {
+	for {
+		switch conn.(type) {
+		case *pcap.FECConn:
+			conn = conn.(*pcap.FECConn).Conn()
+		case *pcap.DupConn:
+			conn = conn.(*pcap.DupConn).Conn()
+		default:
+			return conn
+		}
+	}
+}
+
+func handleListen(packet gopacket.Packet, conn pcap.Endpoint) error {
+	var (
+		err          error
+		indicator    *pcap.PacketIndicator
+		hardwareAddr net.HardwareAddr
+		data         []byte
+	)
+
+	// Parse packet
+	indicator, err = pcap.ParsePacket(packet)
+	if err != nil {
+		return fmt.Errorf("parse packet: %w", err)
+	}
+
+	// ARP and NDP
+	if indicator.NetworkLayer().LayerType() == layers.LayerTypeARP || isPublished(indicator) {
+		err := publish(packet, conn)
+		if err != nil {
+			return fmt.Errorf("publish: %w", err)
+		}
+		return nil
+	}
+	if t := indicator.TransportLayer(); t != nil && t.LayerType() == layers.LayerTypeICMPv6 && indicator.ICMPv6Indicator().IsNeighborSolicitation() {
+		// Neighbor solicitations for others
+		return nil
+	}
+
+	// Record source hardware address
+	switch t := indicator.LinkLayer().LayerType(); t {
+	case layers.LayerTypeEthernet:
+		hardwareAddr = indicator.SrcHardwareAddr()
+	default:
+		hardwareAddr, _ = net.ParseMAC("00:00:00:00:00:00")
+	}
+
+	data = make([]byte, 0)
+	data = append(data, packet.NetworkLayer().LayerContents()...)
+	data = append(data, packet.NetworkLayer().LayerPayload()...)
+
+	// Write packet data
+	upstreamConn := currentUpConn()
+	_, err = upstreamConn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	pcap.CaptureInner(true, pcap.RoleServer, upstreamConn, data)
+
+	// Record the connection of the packet
+	ni, ok := nat[indicator.SrcIP().String()]
+	if !ok || ni.srcHardwareAddr.String() != hardwareAddr.String() {
+		natLock.Lock()
+		nat[indicator.SrcIP().String()] = &natIndicator{srcHardwareAddr: hardwareAddr, conn: conn}
+		natLock.Unlock()
+	}
+
+	// Statistics
+	size := indicator.MTU()
+	if monitor != nil {
+		monitor.AddBidirectional(indicator.SrcIP().String(), indicator.DstIP().String(), stat.DirectionOut, uint(size))
+	}
+
+	log.Verbosef("Redirect an outbound %s packet: %s -> %s (%d Bytes)\n",
+		indicator.TransportProtocol(), indicator.Src().String(), indicator.Dst().String(), size)
+
+	return nil
+}
+
+func handleTun(contents []byte) error {
+	var (
+		err       error
+		indicator *pcap.PacketIndicator
+	)
+
+	// Parse packet
+	indicator, err = pcap.ParseEmbPacket(contents)
+	if err != nil {
+		return fmt.Errorf("parse packet: %w", err)
+	}
+
+	// Router solicitations and neighbor discoveries of the device itself
+	if t := indicator.TransportLayer(); t != nil && t.LayerType() == layers.LayerTypeICMPv6 {
+		if indicator.ICMPv6Indicator().IsNeighborDiscovery() {
+			return nil
+		}
+	}
+
+	// Filter sources
+	if len(sources) > 0 && !containsIP(sources, indicator.SrcIP()) {
+		return nil
+	}
+
+	// Packets to servers may loop back to the TUN device
+	for _, server := range servers {
+		if indicator.DstIP().Equal(server.IP) {
+			return fmt.Errorf("loop to server %s", server.IP)
+		}
+	}
+
+	// Write packet data
+	upstreamConn := currentUpConn()
+	_, err = upstreamConn.Write(contents)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	pcap.CaptureInner(true, pcap.RoleServer, upstreamConn, contents)
+
+	// Record the connection of the packet
+	natLock.RLock()
+	_, ok := nat[indicator.SrcIP().String()]
+	natLock.RUnlock()
+	if !ok {
+		natLock.Lock()
+		nat[indicator.SrcIP().String()] = &natIndicator{}
+		natLock.Unlock()
+	}
+
+	// Statistics
+	size := indicator.Size()
+	if monitor != nil {
+		monitor.AddBidirectional(indicator.SrcIP().String(), indicator.DstIP().String(), stat.DirectionOut, uint(size))
+	}
+
+	log.Verbosef("Redirect an outbound %s packet: %s -> %s (%d Bytes)\n",
+		indicator.TransportProtocol(), indicator.Src().String(), indicator.Dst().String(), size)
+
+	return nil
+}
+
+func handleUpstream(conn net.Conn, contents []byte) error {
+	var (
+		err          error
+		embIndicator *pcap.PacketIndicator
+	)
+
+	// Empty payload
+	if len(contents) <= 0 {
+		// return errors.New("empty payload")
+		return nil
+	}
+
+	// Control message
+	if control.IsControl(contents) {
+		err := handleControl(contents)
+		if err != nil {
+			return fmt.Errorf("handle control: %w", err)
+		}
+		return nil
+	}
+
+	pcap.CaptureInner(false, pcap.RoleServer, conn, contents)
+
+	// Parse embedded packet
+	embIndicator, err = pcap.ParseEmbPacket(contents)
+	if err != nil {
+		return fmt.Errorf("parse embedded packet: %w", err)
+	}
+
+	// Check map
+	natLock.RLock()
+	ni, ok := nat[embIndicator.DstIP().String()]
+	natLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("missing nat to %s", embIndicator.DstIP())
+	}
+
+	// Write packet data
+	if ni.conn == nil {
+		_, err = tunDev.Write(contents)
+		if err != nil {
+			return fmt.Errorf("write tun: %w", err)
+		}
+		pcap.CaptureTun(tunDev.Name(), pcap.RoleServer, conn, contents)
+
+		log.Verbosef("Redirect an inbound %s packet: %s <- %s (%d Bytes)\n",
+			embIndicator.TransportProtocol(), embIndicator.Dst().String(), embIndicator.Src().String(), embIndicator.Size())
+	} else {
+		err = redirectListen(conn, embIndicator, ni)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Statistics
+	if monitor != nil {
+		monitor.AddBidirectional(embIndicator.DstIP().String(), embIndicator.SrcIP().String(), stat.DirectionIn, uint(embIndicator.Size()))
+	}
+
+	// Record DNS
+	if monitor != nil {
+		if embIndicator.DNSIndicator() != nil {
+			if embIndicator.DNSIndicator().IsResponse() {
+				name, ips := embIndicator.DNSIndicator().Answers()
+				if name != "" && len(ips) > 0 {
+					dnsLock.Lock()
+					for _, ip := range ips {
+						dns[ip.String()] = name
+						log.Verbosef("Record DNS record %s = %s\n", name, ip)
+					}
+					dnsLock.Unlock()
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// redirectListen writes an inbound packet with a new link layer to the listen device where its destination locates.
+func redirectListen(conn net.Conn, embIndicator *pcap.PacketIndicator, ni *natIndicator) error {
+	var (
+		err              error
+		newLinkLayerType gopacket.LayerType
+		newLinkLayer     gopacket.Layer
+		fragments        [][]byte
+	)
+
+	// Decide Loopback or Ethernet
+	if ni.conn.IsLoop() {
+		newLinkLayerType = layers.LayerTypeLoopback
+	} else {
+		newLinkLayerType = layers.LayerTypeEthernet
+	}
+
+	// Create new link layer
+	switch newLinkLayerType {
+	case layers.LayerTypeLoopback:
+		newLinkLayer, err = pcap.CreateLoopbackLayer(embIndicator.NetworkLayer().(gopacket.NetworkLayer))
+	case layers.LayerTypeEthernet:
+		newLinkLayer, err = pcap.CreateEthernetLayer(ni.conn.LocalDev().HardwareAddr(), ni.srcHardwareAddr, embIndicator.NetworkLayer().(gopacket.NetworkLayer))
+	default:
+		return fmt.Errorf("link layer type %s not support", newLinkLayerType)
+	}
+	if err != nil {
+		return fmt.Errorf("create link layer: %w", err)
+	}
+
+	// Fragment, and fragments are redirected with their network payloads
+	payload := embIndicator.Payload()
+	if embIndicator.TransportLayer() == nil {
+		payload = embIndicator.NetworkPayload()
+	}
+	fragments, err = pcap.CreateFragmentPackets(newLinkLayer, embIndicator.NetworkLayer(), embIndicator.TransportLayer(), gopacket.Payload(payload), fragment)
+	if err != nil {
+		return fmt.Errorf("fragment: %w", err)
+	}
+
+	// Write packet data
+	for i, fragment := range fragments {
+		_, err = ni.conn.Write(fragment)
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+		pcap.CaptureDevice(ni.conn, pcap.RoleServer, conn, fragment)
+
+		if i == len(fragments)-1 {
+			log.Verbosef("Redirect an inbound %s packet: %s <- %s (%d Bytes)\n",
+				embIndicator.TransportProtocol(), embIndicator.Dst().String(), embIndicator.Src().String(), embIndicator.Size())
+		} else {
+			log.Verbosef("Redirect an inbound %s packet: %s <- %s (...)\n",
+				embIndicator.TransportProtocol(), embIndicator.Dst().String(), embIndicator.Src().String())
+		}
+	}
+
+	return nil
+}
+
+func containsIP(addrs []*net.IPAddr, ip net.IP) bool {
+	for _, addr := range addrs {
+		if addr.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func splitArg(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	result := make([]string, 0)
+
+	strs := strings.Split(s, ",")
+
+	for _, str := range strs {
+		result = append(result, strings.Trim(str, " "))
+	}
+
+	return result
+}
@@ -22,23 +22,77 @@ type Config struct {
 	Verbose     bool      `json:"verbose"`
 	Log         string    `json:"log"`
 	MTU         int       `json:"mtu"`
+	Obfs        string    `json:"obfs"`
+	Fingerprint string    `json:"fingerprint"`
+	Flows       int       `json:"flows"`
+	Stripe      string    `json:"stripe"`
+	FEC         int       `json:"fec"`
+	FECParity   float64   `json:"fec-parity"`
+	Dup         int       `json:"dup"`
+	DupDelay    int       `json:"dup-delay"`
+	DupPorts    []string  `json:"dup-ports"`
+	Hop         string    `json:"hop"`
+	HopInterval int       `json:"hop-interval"`
+	Keepalive   int       `json:"keepalive"`
+	KeepMisses  int       `json:"keepalive-misses"`
+	Roam        bool      `json:"roam"`
 	KCP         bool      `json:"kcp"`
 	KCPConfig   KCPConfig `json:"kcp-tuning"`
+	Host        string    `json:"host"`
+	Path        string    `json:"path"`
+	Cert        string    `json:"cert"`
+	Key         string    `json:"key"`
+	SNI         string    `json:"sni"`
+	Pin         string    `json:"pin"`
+	ALPN        string    `json:"alpn"`
 	Fragment    int       `json:"fragment"`
 	Port        int       `json:"port"`
 	Publish     string    `json:"publish"`
+	Tun         string    `json:"tun"`
 	Sources     []string  `json:"sources"`
-	Server      string    `json:"server"`
+	Server      Servers   `json:"server"`
 	Destination string    `json:"destination"`
 }
 
+// Servers describes servers in priority. It can be unmarshalled from either an address or an array of addresses.
+type Servers []string
+
+// UnmarshalJSON unmarshals servers from either an address or an array of addresses.
+func (servers *Servers) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err == nil {
+		if s == "" {
+			*servers = nil
+		} else {
+			*servers = Servers{s}
+		}
+		return nil
+	}
+
+	var ss []string
+	err = json.Unmarshal(data, &ss)
+	if err != nil {
+		return err
+	}
+	*servers = ss
+
+	return nil
+}
+
 // NewConfig returns a new config.
 func NewConfig() *Config {
 	return &Config{
 		Mode:      "faketcp",
 		Method:    "plain",
 		MTU:       1500,
+		Obfs:      "plain",
+		Flows:     1,
+		FECParity: 0.3,
+		Dup:       1,
 		KCPConfig: *NewKCPConfig(),
+		Path:      "/",
+		ALPN:      "ikago",
 		Fragment:  1500,
 		Sources:   make([]string, 0),
 	}
@@ -0,0 +1,136 @@
+package control
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Control messages are transmitted between the client and the server in the same way as tunnelled packets. They start
+// with a zero byte, which can never be the first byte of an IPv4 packet.
+const marker = 0
+
+const headerSize = 2
+
+// Type describes the type of a control message.
+type Type uint8
+
+const (
+	// TypeHop describes the client has hopped to the connection from the connection in the port.
+	TypeHop Type = iota + 1
+	// TypeHeartbeat describes the client is alive, and asks the server to reply with the same timestamp.
+	TypeHeartbeat
+	// TypeHeartbeatAck describes the server replies to a heartbeat.
+	TypeHeartbeatAck
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeHop:
+		return "Hop"
+	case TypeHeartbeat:
+		return "Heartbeat"
+	case TypeHeartbeatAck:
+		return "Heartbeat ACK"
+	default:
+		return strconv.Itoa(int(t))
+	}
+}
+
+// Message describes a control message.
+type Message struct {
+	Type    Type
+	Payload []byte
+}
+
+// IsControl returns if the contents is a control message.
+func IsControl(contents []byte) bool {
+	return len(contents) > 0 && contents[0] == marker
+}
+
+// Parse returns the control message in the contents.
+func Parse(contents []byte) (*Message, error) {
+	if len(contents) < headerSize {
+		return nil, errors.New("missing header")
+	}
+	if contents[0] != marker {
+		return nil, errors.New("not control message")
+	}
+
+	return &Message{
+		Type:    Type(contents[1]),
+		Payload: contents[headerSize:],
+	}, nil
+}
+
+// Serialize returns the bytes of the control message.
+func (m *Message) Serialize() []byte {
+	b := make([]byte, headerSize, headerSize+len(m.Payload))
+	b[0] = marker
+	b[1] = byte(m.Type)
+
+	return append(b, m.Payload...)
+}
+
+// NewHop returns a hop message from the connection in the port.
+func NewHop(port uint16) *Message {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, port)
+
+	return &Message{Type: TypeHop, Payload: payload}
+}
+
+// Port returns the port in the hop message.
+func (m *Message) Port() (uint16, error) {
+	if m.Type != TypeHop {
+		return 0, fmt.Errorf("type %s not support", m.Type)
+	}
+	if len(m.Payload) < 2 {
+		return 0, errors.New("missing port")
+	}
+
+	return binary.BigEndian.Uint16(m.Payload), nil
+}
+
+// NewHeartbeat returns a heartbeat message in the time with the last RTT measured by the client.
+func NewHeartbeat(t time.Time, rtt time.Duration) *Message {
+	payload := make([]byte, 16)
+	binary.BigEndian.PutUint64(payload[0:8], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(payload[8:16], uint64(rtt))
+
+	return &Message{Type: TypeHeartbeat, Payload: payload}
+}
+
+// NewHeartbeatAck returns a heartbeat ACK message replying the heartbeat in the time.
+func NewHeartbeatAck(t time.Time) *Message {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(t.UnixNano()))
+
+	return &Message{Type: TypeHeartbeatAck, Payload: payload}
+}
+
+// Time returns the time in the heartbeat or heartbeat ACK message.
+func (m *Message) Time() (time.Time, error) {
+	if m.Type != TypeHeartbeat && m.Type != TypeHeartbeatAck {
+		return time.Time{}, fmt.Errorf("type %s not support", m.Type)
+	}
+	if len(m.Payload) < 8 {
+		return time.Time{}, errors.New("missing time")
+	}
+
+	return time.Unix(0, int64(binary.BigEndian.Uint64(m.Payload[0:8]))), nil
+}
+
+// RTT returns the RTT in the heartbeat message.
+func (m *Message) RTT() (time.Duration, error) {
+	if m.Type != TypeHeartbeat {
+		return 0, fmt.Errorf("type %s not support", m.Type)
+	}
+	if len(m.Payload) < 16 {
+		return 0, errors.New("missing rtt")
+	}
+
+	return time.Duration(binary.BigEndian.Uint64(m.Payload[8:16])), nil
+}
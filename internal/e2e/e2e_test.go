@@ -0,0 +1,794 @@
+package e2e
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/zhxie/ikago/internal/client"
+	"github.com/zhxie/ikago/internal/config"
+	"github.com/zhxie/ikago/internal/pcap"
+	"github.com/zhxie/ikago/internal/server"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readTimeout is the timeout of expecting a packet in a hop.
+const readTimeout = 3 * time.Second
+
+const serverPort = 8080
+
+var (
+	consoleIP    = net.IPv4(192, 168, 1, 10).To4()
+	console2IP   = net.IPv4(192, 168, 1, 11).To4()
+	lanIP        = net.IPv4(192, 168, 1, 2).To4()
+	publishIP    = net.IPv4(192, 168, 1, 1).To4()
+	gatewayIP    = net.IPv4(10, 0, 0, 1).To4()
+	clientIP     = net.IPv4(10, 0, 0, 2).To4()
+	serverIP     = net.IPv4(10, 0, 0, 3).To4()
+	hostIP       = net.IPv4(10, 0, 0, 4).To4()
+	consoleMAC   = net.HardwareAddr{0x02, 0x00, 0x00, 0x01, 0x00, 0x10}
+	lanMAC       = net.HardwareAddr{0x02, 0x00, 0x00, 0x01, 0x00, 0x02}
+	gatewayMAC   = net.HardwareAddr{0x02, 0x00, 0x00, 0x02, 0x00, 0x01}
+	clientMAC    = net.HardwareAddr{0x02, 0x00, 0x00, 0x02, 0x00, 0x02}
+	serverMAC    = net.HardwareAddr{0x02, 0x00, 0x00, 0x02, 0x00, 0x03}
+	hostMAC      = net.HardwareAddr{0x02, 0x00, 0x00, 0x02, 0x00, 0x04}
+	lanMask      = net.CIDRMask(24, 32)
+	internetMask = net.CIDRMask(24, 32)
+)
+
+// hop is a tap in a virtual device which collects packets on the wire.
+type hop struct {
+	conn    pcap.Endpoint
+	packets chan gopacket.Packet
+}
+
+func newHop(t *testing.T, dev *pcap.Device, filter string) *hop {
+	conn, err := pcap.CreateEndpoint(dev, dev, filter)
+	if err != nil {
+		t.Fatal(fmt.Errorf("create endpoint in %s: %w", dev.Alias(), err))
+	}
+
+	h := &hop{conn: conn, packets: make(chan gopacket.Packet, 1024)}
+	go func() {
+		for {
+			packet, err := conn.ReadPacket()
+			if err != nil {
+				close(h.packets)
+				return
+			}
+			packet.Metadata().Timestamp = time.Now()
+			h.packets <- packet
+		}
+	}()
+
+	return h
+}
+
+// expect returns the first packet matches in the hop, packets before are dropped.
+func (h *hop) expect(t *testing.T, desc string, match func(gopacket.Packet) bool) gopacket.Packet {
+	t.Helper()
+
+	timer := time.NewTimer(readTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case packet, ok := <-h.packets:
+			if !ok {
+				t.Fatalf("%s: hop closed", desc)
+			}
+			if match(packet) {
+				return packet
+			}
+		case <-timer.C:
+			t.Fatalf("%s: timeout", desc)
+		}
+	}
+}
+
+// drain drops all packets collected in the hop.
+func (h *hop) drain() {
+	for {
+		select {
+		case <-h.packets:
+		default:
+			return
+		}
+	}
+}
+
+func (h *hop) write(t *testing.T, data []byte) {
+	t.Helper()
+
+	_, err := h.conn.Write(data)
+	if err != nil {
+		t.Fatal(fmt.Errorf("write: %w", err))
+	}
+}
+
+// simulation is a console behind an IkaGo client, which connects to an IkaGo server with a host in the internet.
+type simulation struct {
+	lan       *pcap.Wire
+	internet  *pcap.Wire
+	console   *hop
+	host      *hop
+	tunnel    *hop
+	ingress   *hop
+	clientErr chan error
+	serverErr chan error
+}
+
+func newSimulation(t *testing.T, clientCfg, serverCfg *config.Config) *simulation {
+	lan, err := pcap.NewWire(0, 0, 0)
+	if err != nil {
+		t.Fatal(fmt.Errorf("create lan: %w", err))
+	}
+	internet, err := pcap.NewWire(0, 0, time.Millisecond)
+	if err != nil {
+		t.Fatal(fmt.Errorf("create internet: %w", err))
+	}
+
+	consoleDev := lan.CreateDevice("console", []*net.IPNet{{IP: consoleIP, Mask: lanMask}}, consoleMAC)
+	lan.CreateDevice("lan", []*net.IPNet{{IP: lanIP, Mask: lanMask}}, lanMAC)
+	gatewayDev := internet.CreateDevice("gateway", []*net.IPNet{{IP: gatewayIP, Mask: internetMask}}, gatewayMAC)
+	internet.CreateDevice("client", []*net.IPNet{{IP: clientIP, Mask: internetMask}}, clientMAC)
+	internet.CreateDevice("server", []*net.IPNet{{IP: serverIP, Mask: internetMask}}, serverMAC)
+	hostDev := internet.CreateDevice("host", []*net.IPNet{{IP: hostIP, Mask: internetMask}}, hostMAC)
+	devs := append(lan.FindAllDevs(), internet.FindAllDevs()...)
+
+	s := &simulation{
+		lan:       lan,
+		internet:  internet,
+		console:   newHop(t, consoleDev, "arp || ip"),
+		host:      newHop(t, hostDev, fmt.Sprintf("ip && dst host %s", hostIP)),
+		tunnel:    newHop(t, gatewayDev, fmt.Sprintf("tcp && host %s && host %s", clientIP, serverIP)),
+		ingress:   newHop(t, gatewayDev, fmt.Sprintf("ip && dst host %s", serverIP)),
+		clientErr: make(chan error, 1),
+		serverErr: make(chan error, 1),
+	}
+
+	// Handshakes are waited for, or packets may be sent before the server accepts the client
+	handshake := newHop(t, gatewayDev, fmt.Sprintf("tcp && src host %s && dst host %s && tcp[tcpflags] & tcp-syn != 0", serverIP, clientIP))
+	defer handshake.conn.Close()
+
+	serverCfg.ListenDevs = []string{"server"}
+	serverCfg.UpDev = "server"
+	serverCfg.Gateway = gatewayIP.String()
+	serverCfg.Port = serverPort
+	serverReady := make(chan struct{})
+	go func() {
+		s.serverErr <- server.Run(serverCfg, "", devs, serverReady)
+	}()
+	waitReady(t, "server", serverReady, s.serverErr)
+
+	clientCfg.ListenDevs = []string{"lan"}
+	clientCfg.UpDev = "client"
+	clientCfg.Gateway = gatewayIP.String()
+	clientCfg.Sources = []string{consoleIP.String(), console2IP.String()}
+	clientCfg.Server = []string{fmt.Sprintf("%s:%d", serverIP, serverPort)}
+	clientReady := make(chan struct{})
+	go func() {
+		s.clientErr <- client.Run(clientCfg, "", devs, clientReady)
+	}()
+	waitReady(t, "client", clientReady, s.clientErr)
+	for i := 0; i < clientCfg.Flows || i < 1; i++ {
+		handshake.expect(t, "handshake", func(gopacket.Packet) bool { return true })
+	}
+
+	return s
+}
+
+// waitReady waits for the client or the server to be ready.
+func waitReady(t *testing.T, name string, ready chan struct{}, errs chan error) {
+	t.Helper()
+
+	select {
+	case <-ready:
+	case err := <-errs:
+		t.Fatal(fmt.Errorf("run %s: %w", name, err))
+	case <-time.After(readTimeout):
+		t.Fatalf("run %s: timeout", name)
+	}
+}
+
+func (s *simulation) close(t *testing.T) {
+	client.Close()
+	server.Close()
+
+	for _, c := range []chan error{s.clientErr, s.serverErr} {
+		select {
+		case err := <-c:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(readTimeout):
+			t.Error("close: timeout")
+		}
+	}
+
+	s.lan.Close()
+	s.internet.Close()
+}
+
+// send writes a UDP datagram from the hop in fragments of the size.
+func send(t *testing.T, h *hop, srcMAC, dstMAC net.HardwareAddr, srcIP, dstIP net.IP, srcPort, dstPort uint16,
+	payload []byte, fragment int) {
+	t.Helper()
+
+	udpLayer := pcap.CreateUDPLayer(srcPort, dstPort)
+	ipv4Layer, err := pcap.CreateIPv4Layer(srcIP, dstIP, uint16(rand.Uint32()), 64, udpLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ethernetLayer, err := pcap.CreateEthernetLayer(srcMAC, dstMAC, ipv4Layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := pcap.CreateFragmentPackets(ethernetLayer, ipv4Layer, udpLayer, payload, fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range data {
+		h.write(t, d)
+	}
+}
+
+// reply echoes the UDP datagram from the host.
+func (s *simulation) reply(t *testing.T, packet gopacket.Packet) {
+	t.Helper()
+
+	ipv4Layer := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	udpLayer := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+
+	send(t, s.host, hostMAC, gatewayMAC, hostIP, ipv4Layer.SrcIP, uint16(udpLayer.DstPort), uint16(udpLayer.SrcPort),
+		udpLayer.Payload, pcap.MaxEthernetMTU)
+}
+
+// reassemble returns the UDP datagram reassembled from fragments in the hop, whose sizes are not larger than the size.
+func (h *hop) reassemble(t *testing.T, desc string, match func(gopacket.Packet) bool, size int) *layers.UDP {
+	t.Helper()
+
+	var (
+		first   *layers.IPv4
+		payload = make([]byte, 0)
+	)
+	for {
+		ipv4Layer := h.expect(t, desc, match).Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		if int(ipv4Layer.Length) > size {
+			t.Errorf("%s: fragment size %d", desc, ipv4Layer.Length)
+		}
+		if first == nil {
+			first = ipv4Layer
+		} else if ipv4Layer.Id != first.Id {
+			t.Fatalf("%s: fragment id %d of %d", desc, ipv4Layer.Id, first.Id)
+		}
+		if int(ipv4Layer.FragOffset)*8 != len(payload) {
+			t.Fatalf("%s: fragment offset %d after %d Bytes", desc, ipv4Layer.FragOffset*8, len(payload))
+		}
+
+		payload = append(payload, ipv4Layer.Payload...)
+		if ipv4Layer.Flags&layers.IPv4MoreFragments == 0 {
+			break
+		}
+	}
+
+	if !isValidChecksum(first.SrcIP, first.DstIP, first.Protocol, payload) {
+		t.Errorf("%s: invalid checksum", desc)
+	}
+	packet := gopacket.NewPacket(payload, layers.LayerTypeUDP, gopacket.Default)
+	udpLayer, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok {
+		t.Fatalf("%s: missing udp layer", desc)
+	}
+
+	return udpLayer
+}
+
+// isValidChecksum returns if the checksum of the transport layer in IPv4 is valid.
+func isValidChecksum(srcIP, dstIP net.IP, protocol layers.IPProtocol, data []byte) bool {
+	var sum uint32
+
+	pseudo := make([]byte, 0, 12)
+	pseudo = append(pseudo, srcIP.To4()...)
+	pseudo = append(pseudo, dstIP.To4()...)
+	pseudo = append(pseudo, 0, byte(protocol), byte(len(data)>>8), byte(len(data)))
+
+	for _, b := range [][]byte{pseudo, data} {
+		for i := 0; i+1 < len(b); i = i + 2 {
+			sum = sum + (uint32(b[i])<<8 | uint32(b[i+1]))
+		}
+		if len(b)%2 == 1 {
+			sum = sum + uint32(b[len(b)-1])<<8
+		}
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+
+	return sum == 0xffff
+}
+
+func isUDP(srcIP net.IP, dstIP net.IP) func(gopacket.Packet) bool {
+	return func(packet gopacket.Packet) bool {
+		ipv4Layer, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		if !ok || ipv4Layer.Protocol != layers.IPProtocolUDP {
+			return false
+		}
+
+		return ipv4Layer.SrcIP.Equal(srcIP) && ipv4Layer.DstIP.Equal(dstIP)
+	}
+}
+
+// echo sends a datagram from the console and checks it in each hop until the echo returns.
+func (s *simulation) echo(t *testing.T, srcIP net.IP, srcPort uint16, payload []byte) (upPort uint16) {
+	t.Helper()
+
+	s.tunnel.drain()
+	send(t, s.console, consoleMAC, lanMAC, srcIP, hostIP, srcPort, 7, payload, pcap.MaxEthernetMTU)
+
+	// Tunnel
+	p := s.tunnel.expect(t, "tunnel outbound", func(packet gopacket.Packet) bool {
+		tcpLayer, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		return ok && tcpLayer.DstPort == serverPort && len(tcpLayer.Payload) > 0
+	})
+	if !p.Layer(layers.LayerTypeIPv4).(*layers.IPv4).SrcIP.Equal(clientIP) {
+		t.Errorf("tunnel outbound: source %s", p.Layer(layers.LayerTypeIPv4).(*layers.IPv4).SrcIP)
+	}
+
+	// Server egress
+	p = s.host.expect(t, "host", isUDP(serverIP, hostIP))
+	ethernetLayer := p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !bytes.Equal(ethernetLayer.SrcMAC, serverMAC) || !bytes.Equal(ethernetLayer.DstMAC, gatewayMAC) {
+		t.Errorf("host: link %s -> %s", ethernetLayer.SrcMAC, ethernetLayer.DstMAC)
+	}
+	ipv4Layer := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !isValidChecksum(ipv4Layer.SrcIP, ipv4Layer.DstIP, ipv4Layer.Protocol, ipv4Layer.Payload) {
+		t.Error("host: invalid checksum")
+	}
+	udpLayer := p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if udpLayer.DstPort != 7 {
+		t.Errorf("host: destination port %d", udpLayer.DstPort)
+	}
+	if !bytes.Equal(udpLayer.Payload, payload) {
+		t.Errorf("host: payload %q", udpLayer.Payload)
+	}
+	s.reply(t, p)
+
+	// Console
+	p = s.console.expect(t, "console", isUDP(hostIP, srcIP))
+	ethernetLayer = p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !bytes.Equal(ethernetLayer.SrcMAC, lanMAC) || !bytes.Equal(ethernetLayer.DstMAC, consoleMAC) {
+		t.Errorf("console: link %s -> %s", ethernetLayer.SrcMAC, ethernetLayer.DstMAC)
+	}
+	ipv4Layer = p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !isValidChecksum(ipv4Layer.SrcIP, ipv4Layer.DstIP, ipv4Layer.Protocol, ipv4Layer.Payload) {
+		t.Error("console: invalid checksum")
+	}
+	newUDPLayer := p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if newUDPLayer.SrcPort != 7 || uint16(newUDPLayer.DstPort) != srcPort {
+		t.Errorf("console: ports %d -> %d", newUDPLayer.SrcPort, newUDPLayer.DstPort)
+	}
+	if !bytes.Equal(newUDPLayer.Payload, payload) {
+		t.Errorf("console: payload %q", newUDPLayer.Payload)
+	}
+
+	return uint16(udpLayer.SrcPort)
+}
+
+// tunnelPayload returns payloads of the tunnel from the client to the server.
+func (s *simulation) tunnelPayload(t *testing.T, srcIP net.IP, payload []byte) []byte {
+	t.Helper()
+
+	s.tunnel.drain()
+	send(t, s.console, consoleMAC, lanMAC, srcIP, hostIP, 40001, 7, payload, pcap.MaxEthernetMTU)
+
+	p := s.tunnel.expect(t, "tunnel outbound", func(packet gopacket.Packet) bool {
+		tcpLayer, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		return ok && tcpLayer.DstPort == serverPort && len(tcpLayer.Payload) > 0
+	})
+	s.reply(t, s.host.expect(t, "host", isUDP(serverIP, hostIP)))
+	s.console.expect(t, "console", isUDP(hostIP, srcIP))
+
+	return p.Layer(layers.LayerTypeTCP).(*layers.TCP).Payload
+}
+
+func TestHandshake(t *testing.T) {
+	s := newSimulation(t, config.NewConfig(), config.NewConfig())
+	defer s.close(t)
+
+	isTCP := func(srcIP net.IP, syn, ack bool) func(gopacket.Packet) bool {
+		return func(packet gopacket.Packet) bool {
+			tcpLayer := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+			return packet.NetworkLayer().(*layers.IPv4).SrcIP.Equal(srcIP) && tcpLayer.SYN == syn && tcpLayer.ACK == ack
+		}
+	}
+
+	syn := s.tunnel.expect(t, "syn", isTCP(clientIP, true, false)).Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if syn.DstPort != serverPort {
+		t.Errorf("syn: destination port %d", syn.DstPort)
+	}
+	p := s.tunnel.expect(t, "syn+ack", isTCP(serverIP, true, true))
+	if ttl := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4).TTL; ttl != 128 {
+		t.Errorf("syn+ack: ttl %d", ttl)
+	}
+	synAck := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if synAck.SrcPort != syn.DstPort || synAck.DstPort != syn.SrcPort {
+		t.Errorf("syn+ack: ports %d -> %d", synAck.SrcPort, synAck.DstPort)
+	}
+	if synAck.Ack != syn.Seq+1 {
+		t.Errorf("syn+ack: ack %d of seq %d", synAck.Ack, syn.Seq)
+	}
+	ack := s.tunnel.expect(t, "ack", isTCP(clientIP, false, true)).Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if ack.Seq != syn.Seq+1 || ack.Ack != synAck.Seq+1 {
+		t.Errorf("ack: seq %d ack %d", ack.Seq, ack.Ack)
+	}
+
+	s.echo(t, consoleIP, 40000, []byte("handshake"))
+}
+
+func TestProxyARP(t *testing.T) {
+	clientCfg := config.NewConfig()
+	clientCfg.Publish = publishIP.String()
+	s := newSimulation(t, clientCfg, config.NewConfig())
+	defer s.close(t)
+
+	ethernetLayer := &layers.Ethernet{
+		SrcMAC:       consoleMAC,
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arpLayer := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   consoleMAC,
+		SourceProtAddress: consoleIP,
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    publishIP,
+	}
+	data, err := pcap.Serialize(ethernetLayer, arpLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.console.write(t, data)
+
+	p := s.console.expect(t, "arp reply", func(packet gopacket.Packet) bool {
+		arpLayer, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP)
+		return ok && arpLayer.Operation == layers.ARPReply
+	})
+	reply := p.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !bytes.Equal(reply.SourceHwAddress, lanMAC) || !net.IP(reply.SourceProtAddress).Equal(publishIP) {
+		t.Errorf("arp reply: %s is at %s", net.IP(reply.SourceProtAddress), net.HardwareAddr(reply.SourceHwAddress))
+	}
+	if !bytes.Equal(reply.DstHwAddress, consoleMAC) || !net.IP(reply.DstProtAddress).Equal(consoleIP) {
+		t.Errorf("arp reply: to %s at %s", net.IP(reply.DstProtAddress), net.HardwareAddr(reply.DstHwAddress))
+	}
+	ethernetLayer = p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !bytes.Equal(ethernetLayer.DstMAC, consoleMAC) {
+		t.Errorf("arp reply: link to %s", ethernetLayer.DstMAC)
+	}
+}
+
+func TestMethods(t *testing.T) {
+	methods := []string{"plain", "aes-128-gcm", "aes-192-gcm", "aes-256-gcm", "chacha20-poly1305", "xchacha20-poly1305"}
+
+	for _, method := range methods {
+		t.Run(method, func(t *testing.T) {
+			clientCfg, serverCfg := config.NewConfig(), config.NewConfig()
+			clientCfg.Method, serverCfg.Method = method, method
+			clientCfg.Password, serverCfg.Password = "ikago", "ikago"
+			s := newSimulation(t, clientCfg, serverCfg)
+			defer s.close(t)
+
+			s.echo(t, consoleIP, 40000, []byte("method "+method))
+
+			// Inner packets can be only seen in the tunnel without encryption
+			marker := []byte("marker " + method)
+			payload := s.tunnelPayload(t, consoleIP, marker)
+			if isPlain := method == "plain"; bytes.Contains(payload, marker) != isPlain {
+				t.Errorf("tunnel: payload %x", payload)
+			}
+		})
+	}
+}
+
+func TestObfs(t *testing.T) {
+	clientCfg, serverCfg := config.NewConfig(), config.NewConfig()
+	clientCfg.Obfs, serverCfg.Obfs = "http", "http"
+	s := newSimulation(t, clientCfg, serverCfg)
+	defer s.close(t)
+
+	isPayload := func(srcIP net.IP) func(gopacket.Packet) bool {
+		return func(packet gopacket.Packet) bool {
+			tcpLayer, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+			return ok && packet.NetworkLayer().(*layers.IPv4).SrcIP.Equal(srcIP) && len(tcpLayer.Payload) > 0
+		}
+	}
+
+	// The server responds after the request of the client, and its packets follow the response
+	s.tunnel.drain()
+	payload := []byte("obfs")
+	send(t, s.console, consoleMAC, lanMAC, consoleIP, hostIP, 40000, 7, payload, pcap.MaxEthernetMTU)
+	request := s.tunnel.expect(t, "request", isPayload(clientIP)).Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !bytes.HasPrefix(request.Payload, []byte("GET ")) {
+		t.Errorf("request: payload %q", request.Payload)
+	}
+	s.reply(t, s.host.expect(t, "host", isUDP(serverIP, hostIP)))
+	response := s.tunnel.expect(t, "response", isPayload(serverIP)).Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !bytes.HasPrefix(response.Payload, []byte("HTTP/1.1 200 OK\r\n")) {
+		t.Errorf("response: payload %q", response.Payload)
+	}
+	s.tunnel.expect(t, "tunnel inbound", isPayload(serverIP))
+	s.console.expect(t, "console", isUDP(hostIP, consoleIP))
+
+	s.echo(t, consoleIP, 40000, payload)
+}
+
+func TestKCP(t *testing.T) {
+	clientCfg, serverCfg := config.NewConfig(), config.NewConfig()
+	clientCfg.KCP, serverCfg.KCP = true, true
+	s := newSimulation(t, clientCfg, serverCfg)
+	defer s.close(t)
+
+	for i := 0; i < 4; i++ {
+		s.echo(t, consoleIP, 40000, []byte(fmt.Sprintf("kcp %d", i)))
+	}
+}
+
+func TestFragment(t *testing.T) {
+	clientCfg := config.NewConfig()
+	clientCfg.Fragment = 576
+	s := newSimulation(t, clientCfg, config.NewConfig())
+	defer s.close(t)
+
+	payload := bytes.Repeat([]byte("fragment"), 250)
+
+	// Fragments from the console are reassembled by the server for PAT
+	send(t, s.console, consoleMAC, lanMAC, consoleIP, hostIP, 40000, 7, payload, 1000)
+	udpLayer := s.host.reassemble(t, "host", isUDP(serverIP, hostIP), pcap.MaxEthernetMTU)
+	if udpLayer.SrcPort == 40000 || udpLayer.DstPort != 7 {
+		t.Errorf("host: ports %d -> %d", udpLayer.SrcPort, udpLayer.DstPort)
+	}
+	if !bytes.Equal(udpLayer.Payload, payload) {
+		t.Error("host: payload mismatch")
+	}
+
+	// Fragments from the host are reassembled by the server for NAT, and are fragmented again by the client
+	send(t, s.host, hostMAC, gatewayMAC, hostIP, serverIP, 7, uint16(udpLayer.SrcPort), payload, 1000)
+	udpLayer = s.console.reassemble(t, "console", isUDP(hostIP, consoleIP), 576)
+	if udpLayer.SrcPort != 7 || udpLayer.DstPort != 40000 {
+		t.Errorf("console: ports %d -> %d", udpLayer.SrcPort, udpLayer.DstPort)
+	}
+	if !bytes.Equal(udpLayer.Payload, payload) {
+		t.Error("console: payload mismatch")
+	}
+}
+
+func TestFlows(t *testing.T) {
+	for _, stripe := range []string{"roundrobin", "hash"} {
+		t.Run(stripe, func(t *testing.T) {
+			clientCfg, serverCfg := config.NewConfig(), config.NewConfig()
+			clientCfg.Flows = 2
+			clientCfg.Stripe, serverCfg.Stripe = stripe, stripe
+			s := newSimulation(t, clientCfg, serverCfg)
+			defer s.close(t)
+
+			// Flows of the client share ports in the session
+			port := s.echo(t, consoleIP, 40000, []byte("flows 0"))
+			for i := 1; i < 4; i++ {
+				if p := s.echo(t, consoleIP, 40000, []byte(fmt.Sprintf("flows %d", i))); p != port {
+					t.Errorf("host: port %d of %d", p, port)
+				}
+			}
+		})
+	}
+}
+
+func TestPAT(t *testing.T) {
+	s := newSimulation(t, config.NewConfig(), config.NewConfig())
+	defer s.close(t)
+
+	// Sources with the same port are distributed to different ports
+	port := s.echo(t, consoleIP, 40000, []byte("pat 1"))
+	port2 := s.echo(t, console2IP, 40000, []byte("pat 2"))
+	if port == port2 {
+		t.Errorf("host: same port %d", port)
+	}
+
+	// Flows keep their ports
+	if p := s.echo(t, consoleIP, 40000, []byte("pat 1 again")); p != port {
+		t.Errorf("host: port %d of %d", p, port)
+	}
+	if p := s.echo(t, console2IP, 40000, []byte("pat 2 again")); p != port2 {
+		t.Errorf("host: port %d of %d", p, port2)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	payload := []byte("replay")
+
+	// Capture packets to the server
+	s := newSimulation(t, config.NewConfig(), config.NewConfig())
+	port := s.echo(t, consoleIP, 40000, payload)
+	s.close(t)
+
+	input := filepath.Join(t.TempDir(), "input.pcap")
+	f, err := os.Create(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := pcapgo.NewWriter(f)
+	err = w.WriteFileHeader(pcap.MaxMTU, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for packet := range s.ingress.packets {
+		ci := packet.Metadata().CaptureInfo
+		ci.CaptureLength, ci.Length = len(packet.Data()), len(packet.Data())
+		err = w.WritePacket(ci, packet.Data())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	// Replay in the server alone
+	internet, err := pcap.NewWire(0, 0, 0)
+	if err != nil {
+		t.Fatal(fmt.Errorf("create internet: %w", err))
+	}
+	defer internet.Close()
+	internet.CreateDevice("gateway", []*net.IPNet{{IP: gatewayIP, Mask: internetMask}}, gatewayMAC)
+	internet.CreateDevice("server", []*net.IPNet{{IP: serverIP, Mask: internetMask}}, serverMAC)
+
+	output := filepath.Join(t.TempDir(), "output.pcap")
+	replay, err := pcap.OpenReplay(input, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+
+	serverCfg := config.NewConfig()
+	serverCfg.ListenDevs = []string{"server"}
+	serverCfg.UpDev = "server"
+	serverCfg.Gateway = gatewayIP.String()
+	serverCfg.Port = serverPort
+	ready, errs := make(chan struct{}), make(chan error, 1)
+	go func() {
+		errs <- server.Run(serverCfg, "", replay.Devices(internet.FindAllDevs()), ready)
+	}()
+	waitReady(t, "server", ready, errs)
+
+	replay.Start()
+	<-replay.Done()
+	server.Close()
+	err = <-errs
+	if err != nil {
+		t.Fatal(fmt.Errorf("run server: %w", err))
+	}
+	err = replay.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Packets sent by the server are the same as the capture
+	r, err := pcap.CreateReader(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var isSynAck, isHost, isTunnel bool
+	for {
+		packet, err := r.ReadPacket()
+		if err != nil {
+			break
+		}
+
+		if tcpLayer, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok && tcpLayer.SrcPort == serverPort {
+			isSynAck = isSynAck || tcpLayer.SYN && tcpLayer.ACK
+			isTunnel = isTunnel || bytes.Contains(tcpLayer.Payload, payload)
+		}
+		if isUDP(serverIP, hostIP)(packet) {
+			udpLayer := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+			isHost = isHost || uint16(udpLayer.SrcPort) == port && bytes.Equal(udpLayer.Payload, payload)
+		}
+	}
+	if !isSynAck {
+		t.Error("output: missing syn+ack")
+	}
+	if !isHost {
+		t.Error("output: missing datagram to the host")
+	}
+	if !isTunnel {
+		t.Error("output: missing echo to the client")
+	}
+}
+
+func TestCapture(t *testing.T) {
+	payload := []byte("capture")
+
+	// The client and the server share the capture in one process
+	dir := t.TempDir()
+	err := pcap.OpenCapture(dir, "ikago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSimulation(t, config.NewConfig(), config.NewConfig())
+	s.echo(t, consoleIP, 40000, payload)
+	s.close(t)
+	err = pcap.CloseCapture()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.pcapng"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("capture: %d files", len(files))
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewNgReader(f, pcapgo.NgReaderOptions{WantMixedLinkType: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Packets of each interface
+	found := make(map[string]bool)
+	for {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		intf, err := r.Interface(ci.InterfaceIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		packet := gopacket.NewPacket(data, intf.LinkType, gopacket.Default)
+		if intf.Name == "tunnel" {
+			found["tunnel "+intf.Comment] = true
+			continue
+		}
+		udpLayer, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if ok && bytes.Equal(udpLayer.Payload, payload) {
+			found[intf.Name+" "+intf.Comment] = true
+		}
+	}
+
+	// Interfaces of the server are of the client in a random port, and the ones of the client are of the server
+	for _, prefix := range []string{
+		fmt.Sprintf("tunnel inbound, client %s:", clientIP),
+		fmt.Sprintf("tunnel outbound, client %s:", clientIP),
+		fmt.Sprintf("inner inbound, client %s:", clientIP),
+		fmt.Sprintf("server outbound, client %s:", clientIP),
+		fmt.Sprintf("tunnel inbound, server %s:%d", serverIP, serverPort),
+		fmt.Sprintf("tunnel outbound, server %s:%d", serverIP, serverPort),
+		fmt.Sprintf("inner outbound, server %s:%d", serverIP, serverPort),
+		fmt.Sprintf("lan outbound, server %s:%d", serverIP, serverPort),
+	} {
+		ok := false
+		for key := range found {
+			ok = ok || strings.HasPrefix(key, prefix)
+		}
+		if !ok {
+			t.Errorf("capture: missing %s", prefix)
+		}
+	}
+}
@@ -23,15 +23,74 @@ func AddGlobalFirewallRule() error {
 	return nil
 }
 
+// AddGlobalIPv6FirewallRule adds a rule for firewall blocking certain traffic in all incoming and outgoing IPv6
+// packets.
+func AddGlobalIPv6FirewallRule() error {
+	var err error
+
+	switch t := runtime.GOOS; t {
+	case "linux":
+		err = addGlobalIPv6FirewallRule()
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AddMasqueradeRule adds a rule for firewall translating source addresses of packets forwarded out of the device.
+func AddMasqueradeRule(dev string) error {
+	var err error
+
+	switch t := runtime.GOOS; t {
+	case "linux":
+		err = addMasqueradeRule(dev)
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AddIPv6MasqueradeRule adds a rule for firewall translating source addresses of IPv6 packets forwarded out of the
+// device.
+func AddIPv6MasqueradeRule(dev string) error {
+	var err error
+
+	switch t := runtime.GOOS; t {
+	case "linux":
+		err = addIPv6MasqueradeRule(dev)
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // AddSpecificFirewallRule adds a rule for firewall blocking certain traffic in packets transmission with specific host.
 func AddSpecificFirewallRule(ip net.IP, port uint16) error {
+	return AddSpecificRangeFirewallRule(ip, port, port)
+}
+
+// AddSpecificRangeFirewallRule adds a rule for firewall blocking certain traffic in packets transmission with specific
+// host in a port range.
+func AddSpecificRangeFirewallRule(ip net.IP, startPort, endPort uint16) error {
 	var err error
 
 	switch t := runtime.GOOS; t {
 	case "darwin", "freebsd":
-		err = addSpecificFirewallRule(ip, port)
+		err = addSpecificFirewallRule(ip, startPort, endPort)
 	case "linux":
-		err = addSpecificFirewallRule(ip, port)
+		err = addSpecificFirewallRule(ip, startPort, endPort)
 	default:
 		return fmt.Errorf("os %s not support", t)
 	}
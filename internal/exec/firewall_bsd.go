@@ -13,15 +13,38 @@ func addGlobalFirewallRule() error {
 	return nil
 }
 
-func addSpecificFirewallRule(ip net.IP, port uint16) error {
+func addGlobalIPv6FirewallRule() error {
+	return nil
+}
+
+func addMasqueradeRule(_ string) error {
+	return nil
+}
+
+func addIPv6MasqueradeRule(_ string) error {
+	return nil
+}
+
+// rules are the rules added before, which will be written again since the file is overwritten.
+var rules []string
+
+func addSpecificFirewallRule(ip net.IP, startPort, endPort uint16) error {
 	file, err := os.OpenFile("./pf.conf", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 755)
 	if err != nil {
 		return fmt.Errorf("open: %w", err)
 	}
 
-	_, err = file.WriteString(fmt.Sprintf("block drop proto tcp from any to %s port %d\n", ip, port))
-	if err != nil {
-		return fmt.Errorf("write: %w", err)
+	port := fmt.Sprintf("%d", startPort)
+	if endPort != startPort {
+		port = fmt.Sprintf("%d:%d", startPort, endPort)
+	}
+	rules = append(rules, fmt.Sprintf("block drop proto tcp from any to %s port %s\n", ip, port))
+
+	for _, rule := range rules {
+		_, err = file.WriteString(rule)
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
 	}
 
 	err = file.Close()
@@ -17,8 +17,18 @@ func addGlobalFirewallRule() error {
 	return nil
 }
 
-func addSpecificFirewallRule(ip net.IP, port uint16) error {
-	routeCmd := exec.Command("iptables", "-A", "OUTPUT", "-s", ip.String(), "-p", "tcp", "--dport", strconv.Itoa(int(port)), "-j", "DROP")
+func addGlobalIPv6FirewallRule() error {
+	routeCmd := exec.Command("ip6tables", "-A", "OUTPUT", "-p", "tcp", "--tcp-flags", "RST", "RST", "-j", "DROP")
+	_, err := routeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec ip6tables: %w", err)
+	}
+
+	return nil
+}
+
+func addMasqueradeRule(dev string) error {
+	routeCmd := exec.Command("iptables", "-t", "nat", "-A", "POSTROUTING", "-o", dev, "-j", "MASQUERADE")
 	_, err := routeCmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("exec iptables: %w", err)
@@ -26,3 +36,33 @@ func addSpecificFirewallRule(ip net.IP, port uint16) error {
 
 	return nil
 }
+
+func addIPv6MasqueradeRule(dev string) error {
+	routeCmd := exec.Command("ip6tables", "-t", "nat", "-A", "POSTROUTING", "-o", dev, "-j", "MASQUERADE")
+	_, err := routeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec ip6tables: %w", err)
+	}
+
+	return nil
+}
+
+func addSpecificFirewallRule(ip net.IP, startPort, endPort uint16) error {
+	port := strconv.Itoa(int(startPort))
+	if endPort != startPort {
+		port = fmt.Sprintf("%d:%d", startPort, endPort)
+	}
+
+	name := "iptables"
+	if ip.To4() == nil {
+		name = "ip6tables"
+	}
+
+	routeCmd := exec.Command(name, "-A", "OUTPUT", "-s", ip.String(), "-p", "tcp", "--dport", port, "-j", "DROP")
+	_, err := routeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec %s: %w", name, err)
+	}
+
+	return nil
+}
@@ -8,6 +8,18 @@ func addGlobalFirewallRule() error {
 	return nil
 }
 
-func addSpecificFirewallRule(_ net.IP, _ uint16) error {
+func addGlobalIPv6FirewallRule() error {
+	return nil
+}
+
+func addMasqueradeRule(_ string) error {
+	return nil
+}
+
+func addIPv6MasqueradeRule(_ string) error {
+	return nil
+}
+
+func addSpecificFirewallRule(_ net.IP, _, _ uint16) error {
 	return nil
 }
@@ -23,3 +23,74 @@ func DisableIPForwarding() error {
 
 	return nil
 }
+
+// EnableIPForwarding enables IPv4 and IPv6 forwarding. The original settings are kept for RestoreIPForwarding.
+func EnableIPForwarding() error {
+	var err error
+
+	switch t := runtime.GOOS; t {
+	case "linux":
+		err = enableIPForwarding()
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RestoreIPForwarding restores IPv4 and IPv6 forwarding to the settings before EnableIPForwarding.
+func RestoreIPForwarding() error {
+	var err error
+
+	switch runtime.GOOS {
+	case "linux":
+		err = restoreIPForwarding()
+	default:
+		// Nothing is enabled in other OSes
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DisableICMPEchoReply disables replying ICMPv4 echo requests by the OS. The original setting is kept for
+// RestoreICMPEchoReply.
+func DisableICMPEchoReply() error {
+	var err error
+
+	switch t := runtime.GOOS; t {
+	case "linux":
+		err = disableICMPEchoReply()
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RestoreICMPEchoReply restores replying ICMPv4 echo requests by the OS to the setting before DisableICMPEchoReply.
+func RestoreICMPEchoReply() error {
+	var err error
+
+	switch runtime.GOOS {
+	case "linux":
+		err = restoreICMPEchoReply()
+	default:
+		// Nothing is disabled in other OSes
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -16,3 +16,19 @@ func disableIPForwarding() error {
 
 	return nil
 }
+
+func enableIPForwarding() error {
+	return nil
+}
+
+func restoreIPForwarding() error {
+	return nil
+}
+
+func disableICMPEchoReply() error {
+	return nil
+}
+
+func restoreICMPEchoReply() error {
+	return nil
+}
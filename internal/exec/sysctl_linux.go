@@ -3,8 +3,15 @@
 import (
 	"fmt"
 	"os/exec"
+	"strings"
 )
 
+// ipForwards are the original values of IP forwarding enabled before, which is empty if they are not changed.
+var ipForwards map[string]string
+
+// icmpEchoIgnoreAll is the original value of net.ipv4.icmp_echo_ignore_all, which is empty if it is not changed.
+var icmpEchoIgnoreAll string
+
 func disableIPForwarding() error {
 	routeCmd := exec.Command("sysctl", "-w", "net.ipv4.ip_forward=0")
 	_, err := routeCmd.CombinedOutput()
@@ -14,3 +21,89 @@ func disableIPForwarding() error {
 
 	return nil
 }
+
+func enableIPForwarding() error {
+	for _, key := range []string{"net.ipv4.ip_forward", "net.ipv6.conf.all.forwarding"} {
+		value, err := readSysctl(key)
+		if err != nil {
+			return err
+		}
+
+		routeCmd := exec.Command("sysctl", "-w", fmt.Sprintf("%s=1", key))
+		_, err = routeCmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("exec sysctl: %w", err)
+		}
+
+		// Keep the first value in case of enabling twice
+		if ipForwards == nil {
+			ipForwards = make(map[string]string)
+		}
+		if _, ok := ipForwards[key]; !ok {
+			ipForwards[key] = value
+		}
+	}
+
+	return nil
+}
+
+func restoreIPForwarding() error {
+	for key, value := range ipForwards {
+		routeCmd := exec.Command("sysctl", "-w", fmt.Sprintf("%s=%s", key, value))
+		_, err := routeCmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("exec sysctl: %w", err)
+		}
+
+		delete(ipForwards, key)
+	}
+
+	return nil
+}
+
+func disableICMPEchoReply() error {
+	value, err := readSysctl("net.ipv4.icmp_echo_ignore_all")
+	if err != nil {
+		return err
+	}
+
+	routeCmd := exec.Command("sysctl", "-w", "net.ipv4.icmp_echo_ignore_all=1")
+	_, err = routeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec sysctl: %w", err)
+	}
+
+	// Keep the first value in case of disabling twice
+	if icmpEchoIgnoreAll == "" {
+		icmpEchoIgnoreAll = value
+	}
+
+	return nil
+}
+
+func restoreICMPEchoReply() error {
+	if icmpEchoIgnoreAll == "" {
+		return nil
+	}
+
+	routeCmd := exec.Command("sysctl", "-w", fmt.Sprintf("net.ipv4.icmp_echo_ignore_all=%s", icmpEchoIgnoreAll))
+	_, err := routeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec sysctl: %w", err)
+	}
+
+	icmpEchoIgnoreAll = ""
+
+	return nil
+}
+
+// readSysctl returns the value of the kernel parameter.
+func readSysctl(key string) (string, error) {
+	routeCmd := exec.Command("sysctl", "-n", key)
+	out, err := routeCmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("exec sysctl: %w", err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
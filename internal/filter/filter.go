@@ -0,0 +1,613 @@
+// Package filter compiles filters in the syntax of pcap-filter to classic BPF without libpcap.
+//
+// Only the subset used by IkaGo is supported: protocols ip, ip6, arp, tcp, udp, icmp and icmp6, primitives host, port
+// and portrange with qualifiers src and dst, relations of arithmetic expressions with loads like ip[6:2], and boolean
+// operators.
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+	"net"
+)
+
+// snapLen is the size of packets accepted by filters.
+const snapLen = 262144
+
+// maxInstructions is the max number of instructions in a classic BPF program.
+const maxInstructions = 4096
+
+const (
+	ethernetTypeOffset = 12
+	ipv6HeaderLength   = 40
+)
+
+// label is a position in the program which is resolved when the program is assembled.
+type label int
+
+// inst is an instruction in the program, whose jumps are to labels.
+type inst struct {
+	ins  bpf.Instruction
+	cond bpf.JumpTest
+	val  uint32
+	isX  bool
+	isJA bool
+	jt   label
+	jf   label
+}
+
+func (i *inst) isJump() bool {
+	return i.ins == nil
+}
+
+type compiler struct {
+	linkOffset uint32
+	isRaw      bool
+	insts      []*inst
+	labels     []int
+	scratch    uint32
+}
+
+// Compile compiles the filter to classic BPF for packets in the link type. Ethernet and raw IP are supported.
+func Compile(filter string, linkType layers.LinkType) ([]bpf.RawInstruction, error) {
+	c := &compiler{}
+
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		c.linkOffset = 14
+	case layers.LinkTypeRaw:
+		c.isRaw = true
+	default:
+		return nil, fmt.Errorf("link type %s not support", linkType)
+	}
+
+	n, err := parse(filter)
+	if err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+
+	accept, reject := c.newLabel(), c.newLabel()
+	if n != nil {
+		err = c.compile(n, accept, reject)
+		if err != nil {
+			return nil, fmt.Errorf("compile: %w", err)
+		}
+	}
+	c.place(accept)
+	c.emit(bpf.RetConstant{Val: snapLen})
+	c.place(reject)
+	c.emit(bpf.RetConstant{Val: 0})
+
+	insts, err := c.resolve()
+	if err != nil {
+		return nil, fmt.Errorf("resolve: %w", err)
+	}
+
+	raws, err := bpf.Assemble(insts)
+	if err != nil {
+		return nil, fmt.Errorf("assemble: %w", err)
+	}
+
+	return raws, nil
+}
+
+func (c *compiler) newLabel() label {
+	c.labels = append(c.labels, -1)
+
+	return label(len(c.labels) - 1)
+}
+
+func (c *compiler) place(l label) {
+	c.labels[l] = len(c.insts)
+}
+
+func (c *compiler) emit(ins bpf.Instruction) {
+	c.insts = append(c.insts, &inst{ins: ins})
+}
+
+func (c *compiler) jump(cond bpf.JumpTest, val uint32, t, f label) {
+	c.insts = append(c.insts, &inst{cond: cond, val: val, jt: t, jf: f})
+}
+
+func (c *compiler) jumpX(cond bpf.JumpTest, t, f label) {
+	c.insts = append(c.insts, &inst{cond: cond, isX: true, jt: t, jf: f})
+}
+
+func (c *compiler) ja(l label) {
+	c.insts = append(c.insts, &inst{isJA: true, jt: l})
+}
+
+// resolve resolves labels of jumps. Conditional jumps can only skip 255 instructions, so jumps to farther labels go
+// through inserted unconditional jumps.
+func (c *compiler) resolve() ([]bpf.Instruction, error) {
+	for {
+		isInserted := false
+		for i := 0; i < len(c.insts); i++ {
+			in := c.insts[i]
+			if !in.isJump() || in.isJA {
+				continue
+			}
+
+			for _, target := range []*label{&in.jt, &in.jf} {
+				if c.labels[*target]-i-1 <= 255 {
+					continue
+				}
+
+				// Insert an unconditional jump after the instruction
+				c.insts = append(c.insts[:i+1], append([]*inst{{isJA: true, jt: *target}}, c.insts[i+1:]...)...)
+				for j := range c.labels {
+					if c.labels[j] > i {
+						c.labels[j]++
+					}
+				}
+				stub := c.newLabel()
+				c.labels[stub] = i + 1
+				*target = stub
+				isInserted = true
+				break
+			}
+			if isInserted {
+				break
+			}
+		}
+		if !isInserted {
+			break
+		}
+	}
+
+	result := make([]bpf.Instruction, 0, len(c.insts))
+	for i, in := range c.insts {
+		if !in.isJump() {
+			result = append(result, in.ins)
+			continue
+		}
+
+		jt := c.labels[in.jt] - i - 1
+		if jt < 0 {
+			return nil, errors.New("backward jump")
+		}
+		if in.isJA {
+			result = append(result, bpf.Jump{Skip: uint32(jt)})
+			continue
+		}
+		jf := c.labels[in.jf] - i - 1
+		if jf < 0 {
+			return nil, errors.New("backward jump")
+		}
+		if in.isX {
+			result = append(result, bpf.JumpIfX{Cond: in.cond, SkipTrue: uint8(jt), SkipFalse: uint8(jf)})
+		} else {
+			result = append(result, bpf.JumpIf{Cond: in.cond, Val: in.val, SkipTrue: uint8(jt), SkipFalse: uint8(jf)})
+		}
+	}
+	if len(result) > maxInstructions {
+		return nil, fmt.Errorf("too many instructions %d", len(result))
+	}
+
+	return result, nil
+}
+
+// compile emits the node which jumps to t if it matches, or f otherwise.
+func (c *compiler) compile(n node, t, f label) error {
+	switch n := n.(type) {
+	case *andNode:
+		mid := c.newLabel()
+		err := c.compile(n.left, mid, f)
+		if err != nil {
+			return err
+		}
+		c.place(mid)
+		return c.compile(n.right, t, f)
+	case *orNode:
+		mid := c.newLabel()
+		err := c.compile(n.left, t, mid)
+		if err != nil {
+			return err
+		}
+		c.place(mid)
+		return c.compile(n.right, t, f)
+	case *notNode:
+		return c.compile(n.node, f, t)
+	case *protoNode:
+		return c.compileProto(n.proto, t, f)
+	case *hostNode:
+		return c.compileHost(n, t, f)
+	case *portNode:
+		return c.compilePort(n, t, f)
+	case *relNode:
+		return c.compileRel(n, t, f)
+	case *testNode:
+		c.compileTest(n, t, f)
+		return nil
+	case bool:
+		if n {
+			c.ja(t)
+		} else {
+			c.ja(f)
+		}
+		return nil
+	default:
+		return fmt.Errorf("node type %T not support", n)
+	}
+}
+
+// testNode loads bytes at the offset, masks them and tests them with the value. The offset is relative to the
+// transport header of IPv4 if it is indirect.
+type testNode struct {
+	offset     uint32
+	size       int
+	mask       uint32
+	cond       bpf.JumpTest
+	val        uint32
+	isIndirect bool
+}
+
+func (c *compiler) compileTest(n *testNode, t, f label) {
+	if n.isIndirect {
+		c.emit(bpf.LoadMemShift{Off: c.linkOffset})
+		c.emit(bpf.LoadIndirect{Off: c.linkOffset + n.offset, Size: n.size})
+	} else {
+		c.emit(bpf.LoadAbsolute{Off: n.offset, Size: n.size})
+	}
+	if n.mask != 0 {
+		c.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: n.mask})
+	}
+	c.jump(n.cond, n.val, t, f)
+}
+
+func and(nodes ...node) node {
+	var result node
+	for _, n := range nodes {
+		if result == nil {
+			result = n
+		} else {
+			result = &andNode{left: result, right: n}
+		}
+	}
+
+	return result
+}
+
+func or(nodes ...node) node {
+	var result node
+	for _, n := range nodes {
+		if result == nil {
+			result = n
+		} else {
+			result = &orNode{left: result, right: n}
+		}
+	}
+
+	return result
+}
+
+func (c *compiler) isIPv4() node {
+	if c.isRaw {
+		return &testNode{offset: 0, size: 1, mask: 0xf0, cond: bpf.JumpEqual, val: 0x40}
+	}
+
+	return &testNode{offset: ethernetTypeOffset, size: 2, cond: bpf.JumpEqual, val: uint32(layers.EthernetTypeIPv4)}
+}
+
+func (c *compiler) isIPv6() node {
+	if c.isRaw {
+		return &testNode{offset: 0, size: 1, mask: 0xf0, cond: bpf.JumpEqual, val: 0x60}
+	}
+
+	return &testNode{offset: ethernetTypeOffset, size: 2, cond: bpf.JumpEqual, val: uint32(layers.EthernetTypeIPv6)}
+}
+
+func (c *compiler) isARP() node {
+	if c.isRaw {
+		return false
+	}
+
+	return &testNode{offset: ethernetTypeOffset, size: 2, cond: bpf.JumpEqual, val: uint32(layers.EthernetTypeARP)}
+}
+
+func (c *compiler) isIPv4Protocol(protocol layers.IPProtocol) node {
+	return and(c.isIPv4(), &testNode{offset: c.linkOffset + 9, size: 1, cond: bpf.JumpEqual, val: uint32(protocol)})
+}
+
+func (c *compiler) isIPv6Protocol(protocol layers.IPProtocol) node {
+	return and(c.isIPv6(), &testNode{offset: c.linkOffset + 6, size: 1, cond: bpf.JumpEqual, val: uint32(protocol)})
+}
+
+// isIPv4First returns a node matching IPv4 packets which are not fragments or are first fragments.
+func (c *compiler) isIPv4First() node {
+	return &testNode{offset: c.linkOffset + 6, size: 2, mask: 0x1fff, cond: bpf.JumpEqual, val: 0}
+}
+
+func (c *compiler) compileProto(proto string, t, f label) error {
+	var n node
+
+	switch proto {
+	case "ip":
+		n = c.isIPv4()
+	case "ip6":
+		n = c.isIPv6()
+	case "arp":
+		n = c.isARP()
+	case "tcp":
+		n = or(c.isIPv4Protocol(layers.IPProtocolTCP), c.isIPv6Protocol(layers.IPProtocolTCP))
+	case "udp":
+		n = or(c.isIPv4Protocol(layers.IPProtocolUDP), c.isIPv6Protocol(layers.IPProtocolUDP))
+	case "icmp":
+		n = c.isIPv4Protocol(layers.IPProtocolICMPv4)
+	case "icmp6":
+		n = c.isIPv6Protocol(layers.IPProtocolICMPv6)
+	default:
+		return fmt.Errorf("protocol %s not support", proto)
+	}
+
+	return c.compile(n, t, f)
+}
+
+func (c *compiler) compileHost(n *hostNode, t, f label) error {
+	var (
+		srcs []node
+		dsts []node
+	)
+
+	if ip := n.ip.To4(); ip != nil {
+		val := uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+
+		// IPv4 hosts also match the sender and target protocol addresses in ARP
+		if n.proto == "" || n.proto == "ip" {
+			srcs = append(srcs, and(c.isIPv4(), &testNode{offset: c.linkOffset + 12, size: 4, cond: bpf.JumpEqual, val: val}))
+			dsts = append(dsts, and(c.isIPv4(), &testNode{offset: c.linkOffset + 16, size: 4, cond: bpf.JumpEqual, val: val}))
+		}
+		if n.proto == "" || n.proto == "arp" {
+			srcs = append(srcs, and(c.isARP(), &testNode{offset: c.linkOffset + 14, size: 4, cond: bpf.JumpEqual, val: val}))
+			dsts = append(dsts, and(c.isARP(), &testNode{offset: c.linkOffset + 24, size: 4, cond: bpf.JumpEqual, val: val}))
+		}
+	} else {
+		ip := n.ip.To16()
+		src := []node{c.isIPv6()}
+		dst := []node{c.isIPv6()}
+		for i := 0; i < net.IPv6len; i = i + 4 {
+			val := uint32(ip[i])<<24 | uint32(ip[i+1])<<16 | uint32(ip[i+2])<<8 | uint32(ip[i+3])
+			src = append(src, &testNode{offset: c.linkOffset + 8 + uint32(i), size: 4, cond: bpf.JumpEqual, val: val})
+			dst = append(dst, &testNode{offset: c.linkOffset + 24 + uint32(i), size: 4, cond: bpf.JumpEqual, val: val})
+		}
+		srcs = append(srcs, and(src...))
+		dsts = append(dsts, and(dst...))
+	}
+
+	switch n.dir {
+	case "src":
+		return c.compile(or(srcs...), t, f)
+	case "dst":
+		return c.compile(or(dsts...), t, f)
+	default:
+		return c.compile(or(or(srcs...), or(dsts...)), t, f)
+	}
+}
+
+func (c *compiler) compilePort(n *portNode, t, f label) error {
+	// Ports in IPv4 are only in the first fragments
+	port := func(offset uint32, isIndirect bool) node {
+		if n.start == n.end {
+			return &testNode{offset: offset, size: 2, cond: bpf.JumpEqual, val: uint32(n.start), isIndirect: isIndirect}
+		}
+
+		return and(&testNode{offset: offset, size: 2, cond: bpf.JumpGreaterOrEqual, val: uint32(n.start), isIndirect: isIndirect},
+			&testNode{offset: offset, size: 2, cond: bpf.JumpLessOrEqual, val: uint32(n.end), isIndirect: isIndirect})
+	}
+	var srcs, dsts []node
+	srcs = append(srcs, port(0, true), port(c.linkOffset+ipv6HeaderLength, false))
+	dsts = append(dsts, port(2, true), port(c.linkOffset+ipv6HeaderLength+2, false))
+
+	ipv4 := and(or(c.isIPv4Protocol(layers.IPProtocolTCP), c.isIPv4Protocol(layers.IPProtocolUDP)), c.isIPv4First())
+	ipv6 := or(c.isIPv6Protocol(layers.IPProtocolTCP), c.isIPv6Protocol(layers.IPProtocolUDP))
+
+	var n4, n6 node
+	switch n.dir {
+	case "src":
+		n4, n6 = srcs[0], srcs[1]
+	case "dst":
+		n4, n6 = dsts[0], dsts[1]
+	default:
+		n4, n6 = or(srcs[0], dsts[0]), or(srcs[1], dsts[1])
+	}
+
+	return c.compile(or(and(ipv4, n4), and(ipv6, n6)), t, f)
+}
+
+// guards returns nodes which must match before loading bytes in the arithmetic expression.
+func (c *compiler) guards(a arith, result []node, protos map[string]bool) ([]node, error) {
+	switch a := a.(type) {
+	case *constArith:
+		return result, nil
+	case *binArith:
+		result, err := c.guards(a.left, result, protos)
+		if err != nil {
+			return nil, err
+		}
+		return c.guards(a.right, result, protos)
+	case *loadArith:
+		if protos[a.proto] {
+			return result, nil
+		}
+		protos[a.proto] = true
+
+		switch a.proto {
+		case "ether":
+			if c.isRaw {
+				return nil, errors.New("ether not support in raw")
+			}
+			return result, nil
+		case "ip":
+			return append(result, c.isIPv4()), nil
+		case "ip6":
+			return append(result, c.isIPv6()), nil
+		case "arp":
+			return append(result, c.isARP()), nil
+		case "tcp":
+			return append(result, c.isIPv4Protocol(layers.IPProtocolTCP), c.isIPv4First()), nil
+		case "udp":
+			return append(result, c.isIPv4Protocol(layers.IPProtocolUDP), c.isIPv4First()), nil
+		case "icmp":
+			return append(result, c.isIPv4Protocol(layers.IPProtocolICMPv4), c.isIPv4First()), nil
+		case "icmp6":
+			return append(result, c.isIPv6Protocol(layers.IPProtocolICMPv6)), nil
+		default:
+			return nil, fmt.Errorf("protocol %s not support", a.proto)
+		}
+	default:
+		return nil, fmt.Errorf("arithmetic type %T not support", a)
+	}
+}
+
+func (c *compiler) compileRel(n *relNode, t, f label) error {
+	var cond bpf.JumpTest
+	switch n.op {
+	case "=", "==":
+		cond = bpf.JumpEqual
+	case "!=":
+		cond = bpf.JumpNotEqual
+	case "<":
+		cond = bpf.JumpLessThan
+	case "<=":
+		cond = bpf.JumpLessOrEqual
+	case ">":
+		cond = bpf.JumpGreaterThan
+	case ">=":
+		cond = bpf.JumpGreaterOrEqual
+	default:
+		return fmt.Errorf("operator %s not support", n.op)
+	}
+
+	protos := make(map[string]bool)
+	guards, err := c.guards(n.left, nil, protos)
+	if err != nil {
+		return err
+	}
+	guards, err = c.guards(n.right, guards, protos)
+	if err != nil {
+		return err
+	}
+	if len(guards) > 0 {
+		mid := c.newLabel()
+		err = c.compile(and(guards...), mid, f)
+		if err != nil {
+			return err
+		}
+		c.place(mid)
+	}
+
+	if right, ok := n.right.(*constArith); ok {
+		err = c.compileArith(n.left)
+		if err != nil {
+			return err
+		}
+		c.jump(cond, right.value, t, f)
+
+		return nil
+	}
+
+	err = c.compileArith(n.right)
+	if err != nil {
+		return err
+	}
+	n2, err := c.store()
+	if err != nil {
+		return err
+	}
+	err = c.compileArith(n.left)
+	if err != nil {
+		return err
+	}
+	c.emit(bpf.LoadScratch{Dst: bpf.RegX, N: n2})
+	c.scratch--
+	c.jumpX(cond, t, f)
+
+	return nil
+}
+
+// store stores the accumulator in the scratch memory and returns its index.
+func (c *compiler) store() (int, error) {
+	if c.scratch >= 16 {
+		return 0, errors.New("too complex expression")
+	}
+	c.emit(bpf.StoreScratch{Src: bpf.RegA, N: int(c.scratch)})
+	c.scratch++
+
+	return int(c.scratch - 1), nil
+}
+
+// compileArith emits the arithmetic expression whose value is in the accumulator.
+func (c *compiler) compileArith(a arith) error {
+	switch a := a.(type) {
+	case *constArith:
+		c.emit(bpf.LoadConstant{Dst: bpf.RegA, Val: a.value})
+	case *loadArith:
+		switch a.proto {
+		case "ether":
+			c.emit(bpf.LoadAbsolute{Off: a.offset, Size: a.size})
+		case "ip", "ip6", "arp":
+			c.emit(bpf.LoadAbsolute{Off: c.linkOffset + a.offset, Size: a.size})
+		case "tcp", "udp", "icmp":
+			c.emit(bpf.LoadMemShift{Off: c.linkOffset})
+			c.emit(bpf.LoadIndirect{Off: c.linkOffset + a.offset, Size: a.size})
+		case "icmp6":
+			c.emit(bpf.LoadAbsolute{Off: c.linkOffset + ipv6HeaderLength + a.offset, Size: a.size})
+		default:
+			return fmt.Errorf("protocol %s not support", a.proto)
+		}
+	case *binArith:
+		var op bpf.ALUOp
+		switch a.op {
+		case "|":
+			op = bpf.ALUOpOr
+		case "&":
+			op = bpf.ALUOpAnd
+		case "<<":
+			op = bpf.ALUOpShiftLeft
+		case ">>":
+			op = bpf.ALUOpShiftRight
+		case "+":
+			op = bpf.ALUOpAdd
+		case "-":
+			op = bpf.ALUOpSub
+		case "*":
+			op = bpf.ALUOpMul
+		case "/":
+			op = bpf.ALUOpDiv
+		default:
+			return fmt.Errorf("operator %s not support", a.op)
+		}
+
+		if right, ok := a.right.(*constArith); ok {
+			err := c.compileArith(a.left)
+			if err != nil {
+				return err
+			}
+			c.emit(bpf.ALUOpConstant{Op: op, Val: right.value})
+
+			return nil
+		}
+
+		err := c.compileArith(a.right)
+		if err != nil {
+			return err
+		}
+		n, err := c.store()
+		if err != nil {
+			return err
+		}
+		err = c.compileArith(a.left)
+		if err != nil {
+			return err
+		}
+		c.emit(bpf.LoadScratch{Dst: bpf.RegX, N: n})
+		c.scratch--
+		c.emit(bpf.ALUOpX{Op: op})
+	default:
+		return fmt.Errorf("arithmetic type %T not support", a)
+	}
+
+	return nil
+}
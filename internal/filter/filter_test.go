@@ -0,0 +1,328 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/addr"
+	"golang.org/x/net/bpf"
+	"net"
+	"testing"
+)
+
+var (
+	clientIP  = net.IPv4(192, 168, 1, 2).To4()
+	serverIP  = net.IPv4(10, 0, 0, 1).To4()
+	otherIP   = net.IPv4(10, 0, 0, 9).To4()
+	clientIP6 = net.ParseIP("2001:db8::2")
+	serverIP6 = net.ParseIP("2001:db8::1")
+	otherIP6  = net.ParseIP("2001:db8::9")
+)
+
+// packet describes a crafted packet.
+type packet struct {
+	src, dst         net.IP
+	proto            layers.IPProtocol
+	srcPort, dstPort uint16
+	flags            string
+	icmpType         uint8
+	icmpID           uint16
+	fragOffset       uint16
+	isFrag           bool
+	size             int
+	isARP            bool
+}
+
+// serialize returns the packet in Ethernet, or in raw IP.
+func (p packet) serialize(t *testing.T, isRaw bool) []byte {
+	var (
+		ls  []gopacket.SerializableLayer
+		eth = &layers.Ethernet{
+			SrcMAC: net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			DstMAC: net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		}
+	)
+
+	if p.isARP {
+		eth.EthernetType = layers.EthernetTypeARP
+		ls = append(ls, eth, &layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPRequest,
+			SourceHwAddress:   eth.SrcMAC,
+			SourceProtAddress: p.src,
+			DstHwAddress:      make([]byte, 6),
+			DstProtAddress:    p.dst,
+		})
+	} else {
+		var network gopacket.NetworkLayer
+		if p.src.To4() != nil {
+			eth.EthernetType = layers.EthernetTypeIPv4
+			ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: p.proto, SrcIP: p.src, DstIP: p.dst, FragOffset: p.fragOffset}
+			network = ip
+			ls = append(ls, eth, ip)
+		} else {
+			eth.EthernetType = layers.EthernetTypeIPv6
+			ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: p.proto, SrcIP: p.src, DstIP: p.dst}
+			network = ip
+			ls = append(ls, eth, ip)
+			if p.isFrag {
+				ip.NextHeader = layers.IPProtocolIPv6Fragment
+				ls = append(ls, gopacket.Payload([]byte{byte(p.proto), 0, byte(p.fragOffset >> 5), byte(p.fragOffset << 3), 0, 0, 0, 1}))
+			}
+		}
+
+		if p.fragOffset == 0 {
+			switch p.proto {
+			case layers.IPProtocolTCP:
+				tcp := &layers.TCP{SrcPort: layers.TCPPort(p.srcPort), DstPort: layers.TCPPort(p.dstPort), Window: 65535}
+				switch p.flags {
+				case "syn":
+					tcp.SYN = true
+				case "rst":
+					tcp.RST = true
+				default:
+					tcp.ACK = true
+				}
+				_ = tcp.SetNetworkLayerForChecksum(network)
+				ls = append(ls, tcp)
+			case layers.IPProtocolUDP:
+				udp := &layers.UDP{SrcPort: layers.UDPPort(p.srcPort), DstPort: layers.UDPPort(p.dstPort)}
+				_ = udp.SetNetworkLayerForChecksum(network)
+				ls = append(ls, udp)
+			case layers.IPProtocolICMPv4:
+				ls = append(ls, &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(p.icmpType, 0), Id: p.icmpID})
+			case layers.IPProtocolICMPv6:
+				icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(p.icmpType, 0)}
+				_ = icmp.SetNetworkLayerForChecksum(network)
+				ls = append(ls, icmp, gopacket.Payload(make([]byte, 4)))
+			}
+		}
+	}
+
+	payload := make([]byte, 8)
+	if p.size > 0 && !p.isARP {
+		size := p.size - 20 - 8
+		if p.proto == layers.IPProtocolTCP {
+			size = p.size - 20 - 20
+		}
+		payload = make([]byte, size)
+	}
+	ls = append(ls, gopacket.Payload(payload))
+
+	buffer := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ls...)
+	if err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+
+	b := buffer.Bytes()
+	if isRaw {
+		return b[14:]
+	}
+
+	return b
+}
+
+// hostFilter returns the filter of the address in the format of IkaGo.
+func hostFilter(t *testing.T, f func(net.Addr) (string, error), a net.Addr) string {
+	s, err := f(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// TestCompile runs filters in formats of IkaGo on crafted packets.
+func TestCompile(t *testing.T) {
+	var (
+		server     = hostFilter(t, addr.SrcBPFFilter, &net.TCPAddr{IP: serverIP, Port: 8080})
+		serverHost = hostFilter(t, addr.SrcBPFFilter, &net.IPAddr{IP: serverIP})
+		server6    = hostFilter(t, addr.SrcBPFFilter, &net.TCPAddr{IP: serverIP6, Port: 8080})
+		client     = hostFilter(t, addr.SrcBPFFilter, &net.IPAddr{IP: clientIP})
+		client6    = hostFilter(t, addr.SrcBPFFilter, &net.IPAddr{IP: clientIP6})
+		publish    = hostFilter(t, addr.DstBPFFilter, &net.IPAddr{IP: net.IPv4(192, 168, 1, 100).To4()})
+	)
+
+	tests := []struct {
+		name    string
+		filter  string
+		match   []packet
+		unmatch []packet
+	}{
+		{
+			name:   "server upstream",
+			filter: fmt.Sprintf("ip && (((tcp || udp) && %s) || %s || (ip[6:2] & 0x1fff) != 0)", "not dst port 8080 && not dst portrange 20000-20010", "(icmp && icmp[icmptype] != icmp-echo)"),
+			match: []packet{
+				{src: otherIP, dst: serverIP, proto: layers.IPProtocolTCP, srcPort: 80, dstPort: 49152},
+				{src: otherIP, dst: serverIP, proto: layers.IPProtocolUDP, srcPort: 53, dstPort: 49153},
+				{src: otherIP, dst: serverIP, proto: layers.IPProtocolICMPv4, icmpType: layers.ICMPv4TypeEchoReply},
+				{src: otherIP, dst: serverIP, proto: layers.IPProtocolUDP, fragOffset: 185},
+			},
+			unmatch: []packet{
+				{src: clientIP, dst: serverIP, proto: layers.IPProtocolTCP, srcPort: 50000, dstPort: 8080},
+				{src: clientIP, dst: serverIP, proto: layers.IPProtocolTCP, srcPort: 50000, dstPort: 20005},
+				{src: otherIP, dst: serverIP, proto: layers.IPProtocolICMPv4, icmpType: layers.ICMPv4TypeEchoRequest},
+				{src: otherIP6, dst: serverIP6, proto: layers.IPProtocolTCP, srcPort: 80, dstPort: 49152},
+				{src: otherIP, dst: serverIP, isARP: true},
+			},
+		},
+		{
+			name:   "server upstream in IPv6",
+			filter: fmt.Sprintf("ip6 && (((tcp || udp) && %s) || (icmp6 && (ip6[40] < 133 || ip6[40] > 137)) || ip6[6] = 44)", "not dst port 8080"),
+			match: []packet{
+				{src: otherIP6, dst: serverIP6, proto: layers.IPProtocolTCP, srcPort: 80, dstPort: 49152},
+				{src: otherIP6, dst: serverIP6, proto: layers.IPProtocolICMPv6, icmpType: layers.ICMPv6TypeEchoReply},
+				{src: otherIP6, dst: serverIP6, proto: layers.IPProtocolUDP, isFrag: true, fragOffset: 185},
+			},
+			unmatch: []packet{
+				{src: clientIP6, dst: serverIP6, proto: layers.IPProtocolTCP, srcPort: 50000, dstPort: 8080},
+				{src: otherIP6, dst: serverIP6, proto: layers.IPProtocolICMPv6, icmpType: layers.ICMPv6TypeNeighborSolicitation},
+				{src: otherIP, dst: serverIP, proto: layers.IPProtocolTCP, srcPort: 80, dstPort: 49152},
+			},
+		},
+		{
+			name:   "faketcp dial",
+			filter: fmt.Sprintf("ip && ((tcp && dst port %d && %s) || ((ip[6:2] & 0x1fff) != 0 && %s))", 50000, server, serverHost),
+			match: []packet{
+				{src: serverIP, dst: clientIP, proto: layers.IPProtocolTCP, srcPort: 8080, dstPort: 50000},
+				{src: serverIP, dst: clientIP, proto: layers.IPProtocolTCP, fragOffset: 185},
+			},
+			unmatch: []packet{
+				{src: serverIP, dst: clientIP, proto: layers.IPProtocolTCP, srcPort: 8081, dstPort: 50000},
+				{src: serverIP, dst: clientIP, proto: layers.IPProtocolTCP, srcPort: 8080, dstPort: 50001},
+				{src: otherIP, dst: clientIP, proto: layers.IPProtocolTCP, srcPort: 8080, dstPort: 50000},
+				{src: otherIP, dst: clientIP, proto: layers.IPProtocolTCP, fragOffset: 185},
+				{src: serverIP, dst: clientIP, proto: layers.IPProtocolUDP, srcPort: 8080, dstPort: 50000},
+			},
+		},
+		{
+			name:   "faketcp dial in IPv6",
+			filter: fmt.Sprintf("ip6 && tcp && dst port %d && %s", 50000, server6),
+			match: []packet{
+				{src: serverIP6, dst: clientIP6, proto: layers.IPProtocolTCP, srcPort: 8080, dstPort: 50000},
+			},
+			unmatch: []packet{
+				{src: otherIP6, dst: clientIP6, proto: layers.IPProtocolTCP, srcPort: 8080, dstPort: 50000},
+				{src: serverIP6, dst: clientIP6, proto: layers.IPProtocolTCP, srcPort: 8080, dstPort: 50001},
+				{src: serverIP, dst: clientIP, proto: layers.IPProtocolTCP, srcPort: 8080, dstPort: 50000},
+			},
+		},
+		{
+			name:   "faketcp listen",
+			filter: fmt.Sprintf("tcp && dst port %d", 8080),
+			match: []packet{
+				{src: clientIP, dst: serverIP, proto: layers.IPProtocolTCP, srcPort: 50000, dstPort: 8080},
+				{src: clientIP6, dst: serverIP6, proto: layers.IPProtocolTCP, srcPort: 50000, dstPort: 8080},
+			},
+			unmatch: []packet{
+				{src: clientIP, dst: serverIP, proto: layers.IPProtocolTCP, srcPort: 8080, dstPort: 50000},
+				{src: clientIP, dst: serverIP, proto: layers.IPProtocolUDP, srcPort: 50000, dstPort: 8080},
+			},
+		},
+		{
+			name:   "faketcp hop",
+			filter: fmt.Sprintf("tcp && tcp[tcpflags] & tcp-syn != 0 && dst portrange %d-%d", 20000, 20010),
+			match: []packet{
+				{src: clientIP, dst: serverIP, proto: layers.IPProtocolTCP, srcPort: 50000, dstPort: 20000, flags: "syn"},
+				{src: clientIP, dst: serverIP, proto: layers.IPProtocolTCP, srcPort: 50000, dstPort: 20010, flags: "syn"},
+			},
+			unmatch: []packet{
+				{src: clientIP, dst: serverIP, proto: layers.IPProtocolTCP, srcPort: 50000, dstPort: 20005},
+				{src: clientIP, dst: serverIP, proto: layers.IPProtocolTCP, srcPort: 50000, dstPort: 20011, flags: "syn"},
+			},
+		},
+		{
+			name:   "fakeicmp dial",
+			filter: fmt.Sprintf("ip && ((icmp && icmp[icmptype] == %s && icmp[4:2] == %d && %s) || ((ip[6:2] & 0x1fff) != 0 && %s))", "icmp-echoreply", 1234, serverHost, serverHost),
+			match: []packet{
+				{src: serverIP, dst: clientIP, proto: layers.IPProtocolICMPv4, icmpType: layers.ICMPv4TypeEchoReply, icmpID: 1234},
+				{src: serverIP, dst: clientIP, proto: layers.IPProtocolICMPv4, fragOffset: 185},
+			},
+			unmatch: []packet{
+				{src: serverIP, dst: clientIP, proto: layers.IPProtocolICMPv4, icmpType: layers.ICMPv4TypeEchoReply, icmpID: 1235},
+				{src: serverIP, dst: clientIP, proto: layers.IPProtocolICMPv4, icmpType: layers.ICMPv4TypeEchoRequest, icmpID: 1234},
+				{src: otherIP, dst: clientIP, proto: layers.IPProtocolICMPv4, icmpType: layers.ICMPv4TypeEchoReply, icmpID: 1234},
+			},
+		},
+		{
+			name:   "fakeicmp listen",
+			filter: fmt.Sprintf("icmp && icmp[icmptype] == icmp-echo && ip[2:2] == %d && (ip[6:2] & 0x1fff) == 0", 1000),
+			match: []packet{
+				{src: clientIP, dst: serverIP, proto: layers.IPProtocolICMPv4, icmpType: layers.ICMPv4TypeEchoRequest, size: 1000},
+			},
+			unmatch: []packet{
+				{src: clientIP, dst: serverIP, proto: layers.IPProtocolICMPv4, icmpType: layers.ICMPv4TypeEchoRequest, size: 999},
+				{src: clientIP, dst: serverIP, proto: layers.IPProtocolICMPv4, icmpType: layers.ICMPv4TypeEchoReply, size: 1000},
+				{src: clientIP, dst: serverIP, proto: layers.IPProtocolICMPv4, fragOffset: 185, size: 1000},
+			},
+		},
+		{
+			name: "client listen",
+			filter: fmt.Sprintf("(ip && (((tcp || udp) && (%s) && %s) || ((icmp || (ip[6:2] & 0x1fff) != 0) && (%s) && %s)))", client, "not (src host 10.0.0.1 && src port 8080)", client, "not src host 10.0.0.1") +
+				" || " + fmt.Sprintf("(ip6 && (((tcp || udp) && (%s) && %s) || (((icmp6 && (ip6[40] < 133 || ip6[40] > 137)) || ip6[6] = 44) && (%s) && %s)))", client6, "not (src host 10.0.0.1 && src port 8080)", client6, "not src host 10.0.0.1") +
+				" || " + fmt.Sprintf("(arp[6:2] = 1 && %s)", publish) +
+				" || (icmp6 && ip6[40] = 135)",
+			match: []packet{
+				{src: clientIP, dst: otherIP, proto: layers.IPProtocolTCP, srcPort: 50000, dstPort: 80},
+				{src: clientIP, dst: otherIP, proto: layers.IPProtocolICMPv4, icmpType: layers.ICMPv4TypeEchoRequest},
+				{src: clientIP, dst: otherIP, proto: layers.IPProtocolUDP, fragOffset: 185},
+				{src: clientIP6, dst: otherIP6, proto: layers.IPProtocolUDP, srcPort: 50000, dstPort: 53},
+				{src: clientIP6, dst: otherIP6, proto: layers.IPProtocolICMPv6, icmpType: layers.ICMPv6TypeEchoRequest},
+				{src: clientIP, dst: net.IPv4(192, 168, 1, 100).To4(), isARP: true},
+				{src: otherIP6, dst: clientIP6, proto: layers.IPProtocolICMPv6, icmpType: layers.ICMPv6TypeNeighborSolicitation},
+			},
+			unmatch: []packet{
+				{src: otherIP, dst: clientIP, proto: layers.IPProtocolTCP, srcPort: 80, dstPort: 50000},
+				{src: clientIP, dst: otherIP, isARP: true},
+				{src: clientIP6, dst: otherIP6, proto: layers.IPProtocolICMPv6, icmpType: layers.ICMPv6TypeRouterSolicitation},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		for _, isRaw := range []bool{false, true} {
+			linkType := layers.LinkTypeEthernet
+			if isRaw {
+				linkType = layers.LinkTypeRaw
+			}
+
+			raw, err := Compile(test.filter, linkType)
+			if err != nil {
+				t.Fatalf("%s: compile: %v", test.name, err)
+			}
+			insts, ok := bpf.Disassemble(raw)
+			if !ok {
+				t.Fatalf("%s: disassemble", test.name)
+			}
+			vm, err := bpf.NewVM(insts)
+			if err != nil {
+				t.Fatalf("%s: new vm: %v", test.name, err)
+			}
+
+			run := func(p packet, expect bool) {
+				// ARP is never in raw IP
+				if isRaw && p.isARP {
+					return
+				}
+
+				n, err := vm.Run(p.serialize(t, isRaw))
+				if err != nil {
+					t.Fatalf("%s: run: %v", test.name, err)
+				}
+				if (n > 0) != expect {
+					t.Errorf("%s in %s: packet %+v matched %t", test.name, linkType, p, n > 0)
+				}
+			}
+			for _, p := range test.match {
+				run(p, true)
+			}
+			for _, p := range test.unmatch {
+				run(p, false)
+			}
+		}
+	}
+}
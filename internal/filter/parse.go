@@ -0,0 +1,541 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// node is a boolean expression of a filter.
+type node interface{}
+
+type andNode struct {
+	left  node
+	right node
+}
+
+type orNode struct {
+	left  node
+	right node
+}
+
+type notNode struct {
+	node node
+}
+
+// protoNode matches packets in the protocol, like ip, ip6, arp, tcp, udp, icmp and icmp6.
+type protoNode struct {
+	proto string
+}
+
+// hostNode matches packets from or to the host.
+type hostNode struct {
+	proto string
+	dir   string
+	ip    net.IP
+}
+
+// portNode matches TCP and UDP segments from or to ports in the range.
+type portNode struct {
+	dir   string
+	start uint16
+	end   uint16
+}
+
+// relNode compares two arithmetic expressions.
+type relNode struct {
+	op    string
+	left  arith
+	right arith
+}
+
+// arith is an arithmetic expression of a filter.
+type arith interface{}
+
+type constArith struct {
+	value uint32
+}
+
+// loadArith loads bytes in the size at the offset of the header of the protocol.
+type loadArith struct {
+	proto  string
+	offset uint32
+	size   int
+}
+
+type binArith struct {
+	op    string
+	left  arith
+	right arith
+}
+
+var protos = map[string]bool{
+	"ether": true,
+	"ip":    true,
+	"ip6":   true,
+	"arp":   true,
+	"tcp":   true,
+	"udp":   true,
+	"icmp":  true,
+	"icmp6": true,
+}
+
+var consts = map[string]uint32{
+	// Offsets
+	"icmptype":  0,
+	"icmpcode":  1,
+	"icmp6type": 0,
+	"icmp6code": 1,
+	"tcpflags":  13,
+	// ICMPv4 types
+	"icmp-echoreply":    0,
+	"icmp-unreach":      3,
+	"icmp-sourcequench": 4,
+	"icmp-redirect":     5,
+	"icmp-echo":         8,
+	"icmp-timxceed":     11,
+	"icmp-paramprob":    12,
+	// ICMPv6 types
+	"icmp6-destinationunreach": 1,
+	"icmp6-packettoobig":       2,
+	"icmp6-timeexceeded":       3,
+	"icmp6-parameterproblem":   4,
+	"icmp6-echo":               128,
+	"icmp6-echoreply":          129,
+	"icmp6-routersolicit":      133,
+	"icmp6-routeradvert":       134,
+	"icmp6-neighborsolicit":    135,
+	"icmp6-neighboradvert":     136,
+	"icmp6-redirect":           137,
+	// TCP flags
+	"tcp-fin":  0x01,
+	"tcp-syn":  0x02,
+	"tcp-rst":  0x04,
+	"tcp-push": 0x08,
+	"tcp-ack":  0x10,
+	"tcp-urg":  0x20,
+}
+
+// parser parses filters in the syntax of pcap-filter. Boolean operators are in the same precedence and are left
+// associative as in pcap-filter.
+type parser struct {
+	s   string
+	pos int
+}
+
+func parse(s string) (node, error) {
+	p := &parser{s: s}
+
+	p.skipSpace()
+	if p.eof() {
+		return nil, nil
+	}
+
+	n, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+	if !p.eof() {
+		return nil, p.errorf("unexpected %q", p.s[p.pos:])
+	}
+
+	return n, nil
+}
+
+func (p *parser) parseExpr() (node, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		switch {
+		case p.acceptOp("&&") || p.acceptWord("and"):
+			right, err := p.parseTerm()
+			if err != nil {
+				return nil, err
+			}
+			left = &andNode{left: left, right: right}
+		case p.acceptOp("||") || p.acceptWord("or"):
+			right, err := p.parseTerm()
+			if err != nil {
+				return nil, err
+			}
+			left = &orNode{left: left, right: right}
+		default:
+			return left, nil
+		}
+	}
+}
+
+func (p *parser) parseTerm() (node, error) {
+	if p.acceptOp("!") || p.acceptWord("not") {
+		n, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+
+		return &notNode{node: n}, nil
+	}
+
+	// Relations may begin with parentheses, so parse them at first
+	pos := p.pos
+	n, err := p.parseRel()
+	if err == nil {
+		return n, nil
+	}
+	p.pos = pos
+
+	if p.acceptOp("(") {
+		n, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.acceptOp(")") {
+			return nil, p.errorf("missing )")
+		}
+
+		return n, nil
+	}
+
+	return p.parsePrimitive()
+}
+
+func (p *parser) parseRel() (node, error) {
+	left, err := p.parseArith(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var op string
+	for _, o := range []string{"==", "!=", "<=", ">=", "=", "<", ">"} {
+		if p.acceptOp(o) {
+			op = o
+			break
+		}
+	}
+	if op == "" {
+		return nil, p.errorf("missing relational operator")
+	}
+
+	right, err := p.parseArith(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &relNode{op: op, left: left, right: right}, nil
+}
+
+// arithOps are arithmetic operators from the lowest precedence to the highest.
+var arithOps = [][]string{{"|"}, {"&"}, {"<<", ">>"}, {"+", "-"}, {"*", "/"}}
+
+func (p *parser) parseArith(level int) (arith, error) {
+	if level >= len(arithOps) {
+		return p.parseArithAtom()
+	}
+
+	left, err := p.parseArith(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var op string
+		for _, o := range arithOps[level] {
+			if p.acceptOp(o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+
+		right, err := p.parseArith(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = fold(&binArith{op: op, left: left, right: right})
+	}
+}
+
+func (p *parser) parseArithAtom() (arith, error) {
+	if p.acceptOp("(") {
+		a, err := p.parseArith(0)
+		if err != nil {
+			return nil, err
+		}
+		if !p.acceptOp(")") {
+			return nil, p.errorf("missing )")
+		}
+
+		return a, nil
+	}
+
+	p.skipSpace()
+	if !p.eof() && isDigit(p.s[p.pos]) {
+		value, err := p.readNumber()
+		if err != nil {
+			return nil, err
+		}
+
+		return &constArith{value: value}, nil
+	}
+
+	word := p.readWord()
+	if word == "" {
+		return nil, p.errorf("missing arithmetic expression")
+	}
+	if protos[word] && p.acceptOp("[") {
+		offset, err := p.parseArith(0)
+		if err != nil {
+			return nil, err
+		}
+		c, ok := offset.(*constArith)
+		if !ok {
+			return nil, p.errorf("variable offset not support")
+		}
+
+		size := 1
+		if p.acceptOp(":") {
+			p.skipSpace()
+			s, err := p.readNumber()
+			if err != nil {
+				return nil, err
+			}
+			if s != 1 && s != 2 && s != 4 {
+				return nil, p.errorf("size %d not support", s)
+			}
+			size = int(s)
+		}
+		if !p.acceptOp("]") {
+			return nil, p.errorf("missing ]")
+		}
+
+		return &loadArith{proto: word, offset: c.value, size: size}, nil
+	}
+	value, ok := consts[word]
+	if !ok {
+		return nil, p.errorf("unknown name %s", word)
+	}
+
+	return &constArith{value: value}, nil
+}
+
+func (p *parser) parsePrimitive() (node, error) {
+	var proto, dir string
+
+	pos := p.pos
+	word := p.readWord()
+	if protos[word] {
+		proto = word
+		pos = p.pos
+		word = p.readWord()
+	}
+	if word == "src" || word == "dst" {
+		dir = word
+		pos = p.pos
+		word = p.readWord()
+	}
+
+	switch word {
+	case "host":
+		p.skipSpace()
+		s := p.readAddr()
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, p.errorf("invalid host %s", s)
+		}
+		if proto != "" && proto != "ip" && proto != "ip6" && proto != "arp" {
+			return nil, p.errorf("host not support in %s", proto)
+		}
+		if (proto == "ip" || proto == "arp") && ip.To4() == nil || proto == "ip6" && ip.To4() != nil {
+			return nil, p.errorf("host %s not support in %s", s, proto)
+		}
+
+		return &hostNode{proto: proto, dir: dir, ip: ip}, nil
+	case "port", "portrange":
+		if proto != "" {
+			return nil, p.errorf("%s not support in %s", word, proto)
+		}
+
+		p.skipSpace()
+		start, err := p.readNumber()
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if word == "portrange" {
+			if !p.acceptOp("-") {
+				return nil, p.errorf("missing -")
+			}
+			p.skipSpace()
+			end, err = p.readNumber()
+			if err != nil {
+				return nil, err
+			}
+		}
+		if start > 65535 || end > 65535 || start > end {
+			return nil, p.errorf("invalid %s", word)
+		}
+
+		return &portNode{dir: dir, start: uint16(start), end: uint16(end)}, nil
+	default:
+		if proto != "" && dir == "" {
+			// A word which is not a qualifier is left to the caller
+			p.pos = pos
+
+			return &protoNode{proto: proto}, nil
+		}
+		if word == "" {
+			return nil, p.errorf("missing primitive")
+		}
+
+		return nil, p.errorf("unknown primitive %s", word)
+	}
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *parser) skipSpace() {
+	for !p.eof() && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t' || p.s[p.pos] == '\n') {
+		p.pos++
+	}
+}
+
+// acceptOp consumes the operator if it is next, where "&" and "|" never match "&&" and "||".
+func (p *parser) acceptOp(op string) bool {
+	p.skipSpace()
+	if !strings.HasPrefix(p.s[p.pos:], op) {
+		return false
+	}
+
+	next := p.pos + len(op)
+	if (op == "&" || op == "|") && next < len(p.s) && p.s[next] == op[0] {
+		return false
+	}
+	if (op == "!" || op == "<" || op == ">" || op == "=") && next < len(p.s) && p.s[next] == '=' {
+		return false
+	}
+	if (op == "<" && next < len(p.s) && p.s[next] == '<') || (op == ">" && next < len(p.s) && p.s[next] == '>') {
+		return false
+	}
+	p.pos = next
+
+	return true
+}
+
+func (p *parser) acceptWord(word string) bool {
+	pos := p.pos
+	if p.readWord() == word {
+		return true
+	}
+	p.pos = pos
+
+	return false
+}
+
+// readWord reads a name, which begins with a letter and may contain letters, digits, "-" and "_".
+func (p *parser) readWord() string {
+	p.skipSpace()
+
+	start := p.pos
+	if p.eof() || !isLetter(p.s[p.pos]) {
+		return ""
+	}
+	for !p.eof() && (isLetter(p.s[p.pos]) || isDigit(p.s[p.pos]) || p.s[p.pos] == '-' || p.s[p.pos] == '_') {
+		p.pos++
+	}
+
+	return p.s[start:p.pos]
+}
+
+func (p *parser) readAddr() string {
+	start := p.pos
+	for !p.eof() && (isHex(p.s[p.pos]) || p.s[p.pos] == '.' || p.s[p.pos] == ':') {
+		p.pos++
+	}
+
+	return p.s[start:p.pos]
+}
+
+func (p *parser) readNumber() (uint32, error) {
+	start := p.pos
+	if strings.HasPrefix(p.s[p.pos:], "0x") || strings.HasPrefix(p.s[p.pos:], "0X") {
+		p.pos += 2
+		for !p.eof() && isHex(p.s[p.pos]) {
+			p.pos++
+		}
+	} else {
+		for !p.eof() && isDigit(p.s[p.pos]) {
+			p.pos++
+		}
+	}
+
+	value, err := strconv.ParseUint(p.s[start:p.pos], 0, 32)
+	if err != nil {
+		return 0, p.errorf("invalid number %s", p.s[start:p.pos])
+	}
+
+	return uint32(value), nil
+}
+
+func (p *parser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("%s at %d", fmt.Sprintf(format, a...), p.pos)
+}
+
+// fold folds the arithmetic expression of constants.
+func fold(a *binArith) arith {
+	left, ok := a.left.(*constArith)
+	if !ok {
+		return a
+	}
+	right, ok := a.right.(*constArith)
+	if !ok {
+		return a
+	}
+
+	var value uint32
+	switch a.op {
+	case "|":
+		value = left.value | right.value
+	case "&":
+		value = left.value & right.value
+	case "<<":
+		value = left.value << right.value
+	case ">>":
+		value = left.value >> right.value
+	case "+":
+		value = left.value + right.value
+	case "-":
+		value = left.value - right.value
+	case "*":
+		value = left.value * right.value
+	case "/":
+		if right.value == 0 {
+			return a
+		}
+		value = left.value / right.value
+	default:
+		return a
+	}
+
+	return &constArith{value: value}
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHex(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
@@ -0,0 +1,75 @@
+package obfs
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+var userAgents = []string{
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/80.0.3987.132 Safari/537.36",
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:74.0) Gecko/20100101 Firefox/74.0",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_3) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.0.5 Safari/605.1.15",
+	"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/80.0.3987.132 Safari/537.36",
+}
+
+// HTTPObfuscator describes an obfuscator which disguises a connection as an HTTP/1.1 GET request and its response. The
+// tunnelled data follows as the body of the response, which has no length and ends when the connection is closed.
+type HTTPObfuscator struct {
+	host string
+	path string
+}
+
+// CreateHTTPObfuscator returns an HTTP obfuscator with the host and the path in the request.
+func CreateHTTPObfuscator(host, path string) *HTTPObfuscator {
+	if path == "" {
+		path = "/"
+	}
+
+	return &HTTPObfuscator{
+		host: host,
+		path: path,
+	}
+}
+
+func (o *HTTPObfuscator) Request() []byte {
+	var b bytes.Buffer
+
+	b.WriteString(fmt.Sprintf("GET %s HTTP/1.1\r\n", o.path))
+	b.WriteString(fmt.Sprintf("Host: %s\r\n", o.host))
+	b.WriteString(fmt.Sprintf("User-Agent: %s\r\n", userAgents[rand.Intn(len(userAgents))]))
+	b.WriteString("Accept: */*\r\n")
+	b.WriteString("Accept-Encoding: gzip, deflate\r\n")
+	b.WriteString("Accept-Language: en-US,en;q=0.9\r\n")
+	b.WriteString("Connection: keep-alive\r\n")
+	b.WriteString("\r\n")
+
+	return b.Bytes()
+}
+
+func (o *HTTPObfuscator) Response() []byte {
+	var b bytes.Buffer
+
+	b.WriteString("HTTP/1.1 200 OK\r\n")
+	b.WriteString("Server: nginx\r\n")
+	b.WriteString(fmt.Sprintf("Date: %s\r\n", time.Now().UTC().Format(http.TimeFormat)))
+	b.WriteString("Content-Type: application/octet-stream\r\n")
+	b.WriteString("Connection: close\r\n")
+	b.WriteString("\r\n")
+
+	return b.Bytes()
+}
+
+func (o *HTTPObfuscator) IsRequest(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("GET ")) && bytes.HasSuffix(b, []byte("\r\n\r\n"))
+}
+
+func (o *HTTPObfuscator) IsResponse(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("HTTP/1.1 200 OK\r\n")) && bytes.HasSuffix(b, []byte("\r\n\r\n"))
+}
+
+func (o *HTTPObfuscator) Method() Method {
+	return MethodHTTP
+}
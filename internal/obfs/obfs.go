@@ -0,0 +1,54 @@
+package obfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Method describes the method of the obfuscation.
+type Method int
+
+const (
+	// MethodPlain describes the obfuscation is in plain which will not obfuscate the connection.
+	MethodPlain Method = iota
+	// MethodHTTP describes the obfuscation is in HTTP.
+	MethodHTTP
+)
+
+func (m Method) String() string {
+	switch m {
+	case MethodPlain:
+		return "Plain"
+	case MethodHTTP:
+		return "HTTP"
+	default:
+		return strconv.Itoa(int(m))
+	}
+}
+
+// Obfuscator describes an obfuscator which disguises a connection by the first payloads of the client and the server.
+type Obfuscator interface {
+	// Request returns the first payload sent by the client, or nil if nothing should be sent.
+	Request() []byte
+	// Response returns the first payload sent by the server, or nil if nothing should be sent.
+	Response() []byte
+	// IsRequest returns if the payload is a request.
+	IsRequest([]byte) bool
+	// IsResponse returns if the payload is a response.
+	IsResponse([]byte) bool
+	// Method returns the method of obfuscator.
+	Method() Method
+}
+
+// ParseObfuscator returns an obfuscator by given method, and the host and the path in the request.
+func ParseObfuscator(method, host, path string) (Obfuscator, error) {
+	switch strings.ToLower(method) {
+	case "plain":
+		return CreatePlainObfuscator(), nil
+	case "http":
+		return CreateHTTPObfuscator(host, path), nil
+	default:
+		return nil, fmt.Errorf("method %s not support", method)
+	}
+}
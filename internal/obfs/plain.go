@@ -0,0 +1,30 @@
+package obfs
+
+// PlainObfuscator describes a plain obfuscator which will not obfuscate the connection.
+type PlainObfuscator struct {
+}
+
+// CreatePlainObfuscator returns a plain obfuscator.
+func CreatePlainObfuscator() *PlainObfuscator {
+	return &PlainObfuscator{}
+}
+
+func (o *PlainObfuscator) Request() []byte {
+	return nil
+}
+
+func (o *PlainObfuscator) Response() []byte {
+	return nil
+}
+
+func (o *PlainObfuscator) IsRequest(_ []byte) bool {
+	return false
+}
+
+func (o *PlainObfuscator) IsResponse(_ []byte) bool {
+	return false
+}
+
+func (o *PlainObfuscator) Method() Method {
+	return MethodPlain
+}
@@ -0,0 +1,330 @@
+// +build afpacket
+
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/filter"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	// rxBlockSize is the size of each block in RX ring.
+	rxBlockSize = 1 << 20
+	// rxBlockNum is the number of blocks in RX ring.
+	rxBlockNum = 8
+	// rxFrameSize is the nominal size of each frame in RX ring. Frames are packed in variable sizes in TPACKET_V3.
+	rxFrameSize = 1 << 11
+	// rxRetireTimeout is the timeout in milliseconds before the kernel hands a block which is not full to the user.
+	rxRetireTimeout = 10
+	// txFrameSize is the size of each frame in TX ring, which must hold a frame of the loopback device.
+	txFrameSize = 1 << 17
+	// txFrameNum is the number of frames in TX ring.
+	txFrameNum = 16
+	// pollTimeout is the timeout in milliseconds of each poll, so the handle can be closed when it is idle.
+	pollTimeout = 100
+)
+
+// hdrLen is the offset of the link-layer address in each frame of RX ring, and the offset of the packet in each frame
+// of TX ring, which is TPACKET_ALIGN(sizeof(struct tpacket3_hdr)).
+var hdrLen = tpacketAlign(int(unsafe.Sizeof(unix.Tpacket3Hdr{})))
+
+// blockDescHdrOffset is the offset of the block header in each block descriptor.
+var blockDescHdrOffset = int(unsafe.Offsetof(unix.TpacketBlockDesc{}.Hdr))
+
+// afpacketHandle is a handle captures packets from a TPACKET_V3 RX ring and injects packets through a TX ring.
+type afpacketHandle struct {
+	fd        int
+	ifindex   int
+	linkType  layers.LinkType
+	isLoop    bool
+	ring      []byte
+	block     int
+	pkts      int
+	offset    int
+	frame     int
+	buffer    []byte
+	closed    bool
+	readLock  sync.Mutex
+	writeLock sync.Mutex
+}
+
+func tpacketAlign(x int) int {
+	return (x + unix.TPACKET_ALIGNMENT - 1) &^ (unix.TPACKET_ALIGNMENT - 1)
+}
+
+func htons(i uint16) uint16 {
+	return i<<8 | i>>8
+}
+
+func openAFPacket(dev, expr string) (rawHandle, error) {
+	inter, err := net.InterfaceByName(dev)
+	if err != nil {
+		return nil, err
+	}
+
+	// Devices without hardware addresses like TUN devices carry IP packets directly, while loopback devices carry
+	// Ethernet frames with zero hardware addresses
+	linkType := layers.LinkTypeEthernet
+	if inter.Flags&net.FlagLoopback == 0 && len(inter.HardwareAddr) != 6 {
+		linkType = layers.LinkTypeRaw
+	}
+
+	insts, err := filter.Compile(expr, linkType)
+	if err != nil {
+		return nil, fmt.Errorf("compile filter: %w", err)
+	}
+
+	// The socket receives nothing until it is bound, so no packet bypasses the filter
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("socket: %w", err)
+	}
+
+	h := &afpacketHandle{
+		fd:       fd,
+		ifindex:  inter.Index,
+		linkType: linkType,
+		isLoop:   inter.Flags&net.FlagLoopback != 0,
+		buffer:   make([]byte, maxSnapLen),
+	}
+
+	err = h.setup(insts)
+	if err != nil {
+		if h.ring != nil {
+			unix.Munmap(h.ring)
+		}
+		unix.Close(fd)
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func (h *afpacketHandle) setup(insts []bpf.RawInstruction) error {
+	// Attach filter
+	fs := make([]unix.SockFilter, 0, len(insts))
+	for _, inst := range insts {
+		fs = append(fs, unix.SockFilter{Code: inst.Op, Jt: inst.Jt, Jf: inst.Jf, K: inst.K})
+	}
+	err := unix.SetsockoptSockFprog(h.fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &unix.SockFprog{
+		Len:    uint16(len(fs)),
+		Filter: &fs[0],
+	})
+	if err != nil {
+		return fmt.Errorf("attach filter: %w", err)
+	}
+
+	// Rings
+	err = unix.SetsockoptInt(h.fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3)
+	if err != nil {
+		return fmt.Errorf("set version: %w", err)
+	}
+	// Malformed frames in TX ring are skipped instead of blocking the ring
+	err = unix.SetsockoptInt(h.fd, unix.SOL_PACKET, unix.PACKET_LOSS, 1)
+	if err != nil {
+		return fmt.Errorf("set loss: %w", err)
+	}
+	err = unix.SetsockoptTpacketReq3(h.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, &unix.TpacketReq3{
+		Block_size:     rxBlockSize,
+		Block_nr:       rxBlockNum,
+		Frame_size:     rxFrameSize,
+		Frame_nr:       rxBlockSize / rxFrameSize * rxBlockNum,
+		Retire_blk_tov: rxRetireTimeout,
+	})
+	if err != nil {
+		return fmt.Errorf("set rx ring: %w", err)
+	}
+	err = unix.SetsockoptTpacketReq3(h.fd, unix.SOL_PACKET, unix.PACKET_TX_RING, &unix.TpacketReq3{
+		Block_size: txFrameSize,
+		Block_nr:   txFrameNum,
+		Frame_size: txFrameSize,
+		Frame_nr:   txFrameNum,
+	})
+	if err != nil {
+		return fmt.Errorf("set tx ring: %w", err)
+	}
+
+	// RX ring is followed by TX ring in the mapping
+	h.ring, err = unix.Mmap(h.fd, 0, rxBlockSize*rxBlockNum+txFrameSize*txFrameNum, unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("mmap: %w", err)
+	}
+
+	err = unix.Bind(h.fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: h.ifindex})
+	if err != nil {
+		return fmt.Errorf("bind: %w", err)
+	}
+
+	err = unix.SetsockoptPacketMreq(h.fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &unix.PacketMreq{
+		Ifindex: int32(h.ifindex),
+		Type:    unix.PACKET_MR_PROMISC,
+	})
+	if err != nil {
+		return fmt.Errorf("set promiscuous: %w", err)
+	}
+
+	return nil
+}
+
+func (h *afpacketHandle) poll(events int16) error {
+	fds := []unix.PollFd{{Fd: int32(h.fd), Events: events}}
+	_, err := unix.Poll(fds, pollTimeout)
+	if err != nil && err != unix.EINTR {
+		return fmt.Errorf("poll: %w", err)
+	}
+
+	return nil
+}
+
+func (h *afpacketHandle) blockHdr() *unix.TpacketHdrV1 {
+	return (*unix.TpacketHdrV1)(unsafe.Pointer(&h.ring[h.block*rxBlockSize+blockDescHdrOffset]))
+}
+
+func (h *afpacketHandle) releaseBlock(hdr *unix.TpacketHdrV1) {
+	atomic.StoreUint32(&hdr.Block_status, unix.TP_STATUS_KERNEL)
+	h.block = (h.block + 1) % rxBlockNum
+}
+
+// ZeroCopyReadPacketData reads a packet from RX ring. The data is valid until the next call.
+func (h *afpacketHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	h.readLock.Lock()
+	defer h.readLock.Unlock()
+
+	for {
+		if h.closed {
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+
+		hdr := h.blockHdr()
+
+		// Enter the next block
+		if h.pkts <= 0 {
+			if atomic.LoadUint32(&hdr.Block_status)&unix.TP_STATUS_USER == 0 {
+				// Wait without lock so the handle can be closed
+				h.readLock.Unlock()
+				err := h.poll(unix.POLLIN)
+				h.readLock.Lock()
+				if err != nil {
+					return nil, gopacket.CaptureInfo{}, err
+				}
+				continue
+			}
+
+			h.pkts = int(hdr.Num_pkts)
+			h.offset = int(hdr.Offset_to_first_pkt)
+			if h.pkts <= 0 {
+				h.releaseBlock(hdr)
+				continue
+			}
+		}
+
+		frame := h.block*rxBlockSize + h.offset
+		ph := (*unix.Tpacket3Hdr)(unsafe.Pointer(&h.ring[frame]))
+		sll := (*unix.RawSockaddrLinklayer)(unsafe.Pointer(&h.ring[frame+hdrLen]))
+
+		// Packets sent in the loopback device will be received again, and the same as pcap, only the received ones are
+		// captured
+		var n int
+		skip := h.isLoop && sll.Pkttype == unix.PACKET_OUTGOING
+		if !skip {
+			start := frame + int(ph.Mac)
+			n = copy(h.buffer, h.ring[start:start+int(ph.Snaplen)])
+		}
+		ci := gopacket.CaptureInfo{
+			Timestamp:      time.Unix(int64(ph.Sec), int64(ph.Nsec)),
+			CaptureLength:  n,
+			Length:         int(ph.Len),
+			InterfaceIndex: h.ifindex,
+		}
+
+		h.offset = h.offset + int(ph.Next_offset)
+		h.pkts--
+		if h.pkts <= 0 {
+			h.releaseBlock(hdr)
+		}
+
+		if skip {
+			continue
+		}
+
+		return h.buffer[:n], ci, nil
+	}
+}
+
+// WritePacketData writes a packet to TX ring and flushes the ring.
+func (h *afpacketHandle) WritePacketData(data []byte) error {
+	if len(data) > txFrameSize-hdrLen {
+		return fmt.Errorf("packet too large: %d", len(data))
+	}
+
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+
+	var ph *unix.Tpacket3Hdr
+	for {
+		if h.closed {
+			return errors.New("closed")
+		}
+
+		ph = (*unix.Tpacket3Hdr)(unsafe.Pointer(&h.ring[rxBlockSize*rxBlockNum+h.frame*txFrameSize]))
+		status := atomic.LoadUint32(&ph.Status)
+		if status == unix.TP_STATUS_AVAILABLE || status == unix.TP_STATUS_WRONG_FORMAT {
+			break
+		}
+
+		// The frame is still being sent by the kernel
+		h.writeLock.Unlock()
+		err := h.poll(unix.POLLOUT)
+		h.writeLock.Lock()
+		if err != nil {
+			return err
+		}
+	}
+
+	frame := rxBlockSize*rxBlockNum + h.frame*txFrameSize + hdrLen
+	copy(h.ring[frame:], data)
+	ph.Next_offset = 0
+	ph.Len = uint32(len(data))
+	atomic.StoreUint32(&ph.Status, unix.TP_STATUS_SEND_REQUEST)
+	h.frame = (h.frame + 1) % txFrameNum
+
+	err := unix.Sendto(h.fd, nil, 0, nil)
+	if err != nil {
+		// Give the frame back so it will not be sent again in the next flush
+		atomic.StoreUint32(&ph.Status, unix.TP_STATUS_AVAILABLE)
+		return fmt.Errorf("send: %w", err)
+	}
+
+	return nil
+}
+
+func (h *afpacketHandle) LinkType() layers.LinkType {
+	return h.linkType
+}
+
+func (h *afpacketHandle) Close() {
+	h.readLock.Lock()
+	h.writeLock.Lock()
+	defer h.readLock.Unlock()
+	defer h.writeLock.Unlock()
+
+	if h.closed {
+		return
+	}
+	h.closed = true
+
+	unix.Munmap(h.ring)
+	unix.Close(h.fd)
+}
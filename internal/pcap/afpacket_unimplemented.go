@@ -0,0 +1,9 @@
+// +build afpacket,!linux
+
+package pcap
+
+import "errors"
+
+func openAFPacket(dev, filter string) (rawHandle, error) {
+	return nil, errors.New("afpacket not support")
+}
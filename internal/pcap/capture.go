@@ -0,0 +1,456 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/zhxie/ikago/internal/log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// captureFileSize is the size of each capture file, a new file is created after the size is exceeded.
+const captureFileSize = 64 << 20
+
+// captureFiles is the number of capture files kept, older files are removed.
+const captureFiles = 8
+
+// captureFlushInterval is the interval of flushing packets to capture files.
+const captureFlushInterval = time.Second
+
+const (
+	captureTunnel = "tunnel"
+	captureInner  = "inner"
+)
+
+// Role describes the role of the peer of packets in captures.
+type Role int
+
+const (
+	// RoleClient describes the peer is a client.
+	RoleClient Role = iota
+	// RoleServer describes the peer is a server.
+	RoleServer
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleClient:
+		return "client"
+	case RoleServer:
+		return "server"
+	default:
+		return strconv.Itoa(int(r))
+	}
+}
+
+// captureInterface describes an interface in capture files. Packets of the same layer or device, direction and peer
+// are in the same interface.
+type captureInterface struct {
+	name       string
+	isOutbound bool
+	role       Role
+	peer       string
+	linkType   layers.LinkType
+}
+
+// capturer writes packets to rotating pcapng files in a directory.
+type capturer struct {
+	dir      string
+	name     string
+	seq      int
+	files    []string
+	file     *os.File
+	writer   *pcapgo.NgWriter
+	size     int
+	intfs    map[captureInterface]int
+	closed   chan struct{}
+	routines sync.WaitGroup
+	lock     sync.Mutex
+}
+
+var (
+	capture     *capturer
+	captureLock sync.RWMutex
+)
+
+// OpenCapture opens a capture in the directory. Packets between clients and servers in pcap, packets before
+// encapsulated and after decapsulated, and packets injected in devices are written to pcapng files in the directory in
+// the name. Files are rotated in size, and packets are flushed in intervals.
+func OpenCapture(dir, name string) error {
+	captureLock.Lock()
+	defer captureLock.Unlock()
+
+	if capture != nil {
+		return errors.New("capture already opened")
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", dir, err)
+	}
+
+	capture = &capturer{
+		dir:    dir,
+		name:   name,
+		files:  make([]string, 0),
+		closed: make(chan struct{}),
+	}
+
+	c := capture
+	c.routines.Add(1)
+	go func() {
+		defer c.routines.Done()
+		c.flushLoop()
+	}()
+
+	return nil
+}
+
+// CloseCapture closes the capture.
+func CloseCapture() error {
+	captureLock.Lock()
+	c := capture
+	capture = nil
+	captureLock.Unlock()
+
+	if c == nil {
+		return nil
+	}
+
+	close(c.closed)
+	c.routines.Wait()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.close()
+}
+
+// currentCapture returns the capture opened, or nil if there is no capture.
+func currentCapture() *capturer {
+	captureLock.RLock()
+	defer captureLock.RUnlock()
+
+	return capture
+}
+
+// CaptureInner writes a packet before encapsulated or after decapsulated in the connection to the peer in the role to
+// the capture if a capture is opened.
+func CaptureInner(isOutbound bool, role Role, peer net.Conn, data []byte) {
+	c := currentCapture()
+	if c == nil {
+		return
+	}
+
+	c.capture(captureInterface{
+		name:       captureInner,
+		isOutbound: isOutbound,
+		role:       role,
+		peer:       remoteAddrString(peer),
+		linkType:   layers.LinkTypeRaw,
+	}, data)
+}
+
+// CaptureDevice writes a packet injected in the endpoint for the connection to the peer in the role to the capture if a
+// capture is opened. The peer can be nil.
+func CaptureDevice(conn Endpoint, role Role, peer net.Conn, data []byte) {
+	c := currentCapture()
+	if c == nil {
+		return
+	}
+
+	c.capture(captureInterface{
+		name:       conn.LocalDev().Alias(),
+		isOutbound: true,
+		role:       role,
+		peer:       remoteAddrString(peer),
+		linkType:   endpointLinkType(conn),
+	}, data)
+}
+
+// CaptureTun writes a packet injected in the TUN device for the connection to the peer in the role to the capture if a
+// capture is opened.
+func CaptureTun(name string, role Role, peer net.Conn, data []byte) {
+	c := currentCapture()
+	if c == nil {
+		return
+	}
+
+	c.capture(captureInterface{
+		name:       name,
+		isOutbound: true,
+		role:       role,
+		peer:       remoteAddrString(peer),
+		linkType:   layers.LinkTypeRaw,
+	}, data)
+}
+
+func remoteAddrString(conn net.Conn) string {
+	if conn == nil {
+		return ""
+	}
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+
+	return addr.String()
+}
+
+func endpointLinkType(conn Endpoint) layers.LinkType {
+	if conn.IsLoop() {
+		return layers.LinkTypeNull
+	}
+
+	return layers.LinkTypeEthernet
+}
+
+func (c *capturer) capture(intf captureInterface, data []byte) {
+	err := c.write(intf, data)
+	if err != nil {
+		log.Errorln(fmt.Errorf("capture: %w", err))
+	}
+}
+
+func (c *capturer) flushLoop() {
+	ticker := time.NewTicker(captureFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := c.flush()
+			if err != nil {
+				log.Errorln(fmt.Errorf("capture: %w", err))
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *capturer) flush() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.writer == nil {
+		return nil
+	}
+
+	err := c.writer.Flush()
+	if err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+
+	return nil
+}
+
+func (c *capturer) write(intf captureInterface, data []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var err error
+
+	if c.writer == nil {
+		err = c.create(intf)
+		if err != nil {
+			return err
+		}
+	}
+
+	id, ok := c.intfs[intf]
+	if !ok {
+		id, err = c.writer.AddInterface(c.ngInterface(intf))
+		if err != nil {
+			return fmt.Errorf("add interface: %w", err)
+		}
+		c.intfs[intf] = id
+	}
+
+	err = c.writer.WritePacket(gopacket.CaptureInfo{
+		Timestamp:      time.Now(),
+		CaptureLength:  len(data),
+		Length:         len(data),
+		InterfaceIndex: id,
+	}, data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	// Rotate
+	c.size = c.size + len(data)
+	if c.size >= captureFileSize {
+		return c.close()
+	}
+
+	return nil
+}
+
+func (c *capturer) ngInterface(intf captureInterface) pcapgo.NgInterface {
+	comment := "inbound"
+	if intf.isOutbound {
+		comment = "outbound"
+	}
+	if intf.peer != "" {
+		comment = fmt.Sprintf("%s, %s %s", comment, intf.role, intf.peer)
+	}
+
+	var description string
+	switch intf.name {
+	case captureTunnel:
+		description = "Packets between the client and the server"
+	case captureInner:
+		description = "Packets before encapsulated and after decapsulated"
+	default:
+		description = fmt.Sprintf("Packets injected in %s", intf.name)
+	}
+
+	return pcapgo.NgInterface{
+		Name:                intf.name,
+		Comment:             comment,
+		Description:         description,
+		OS:                  runtime.GOOS,
+		LinkType:            intf.linkType,
+		TimestampResolution: 9,
+	}
+}
+
+func (c *capturer) create(intf captureInterface) error {
+	c.seq++
+	name := filepath.Join(c.dir, fmt.Sprintf("%s-%s-%d.pcapng", c.name, time.Now().Format("20060102-150405"), c.seq))
+
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", name, err)
+	}
+
+	// Each file begins with the interface of its first packet
+	writer, err := pcapgo.NewNgWriterInterface(f, c.ngInterface(intf), pcapgo.NgWriterOptions{
+		SectionInfo: pcapgo.NgSectionInfo{
+			Hardware:    runtime.GOARCH,
+			OS:          runtime.GOOS,
+			Application: c.name,
+			Comment:     fmt.Sprintf("Capture %d of %s", c.seq, c.name),
+		},
+	})
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("write %s: %w", name, err)
+	}
+
+	c.file = f
+	c.writer = writer
+	c.size = 0
+	c.intfs = map[captureInterface]int{intf: 0}
+
+	// Remove older files
+	c.files = append(c.files, name)
+	for len(c.files) > captureFiles {
+		err = os.Remove(c.files[0])
+		if err != nil {
+			log.Errorln(fmt.Errorf("capture: remove %s: %w", c.files[0], err))
+		}
+		c.files = c.files[1:]
+	}
+
+	return nil
+}
+
+func (c *capturer) close() error {
+	if c.writer == nil {
+		return nil
+	}
+
+	err := c.writer.Flush()
+	c.writer = nil
+	if err != nil {
+		c.file.Close()
+		return fmt.Errorf("flush: %w", err)
+	}
+
+	return c.file.Close()
+}
+
+// captureConn is a packet endpoint of tunnels between clients and servers, whose packets are written to the capture.
+type captureConn struct {
+	Endpoint
+	role Role
+}
+
+func (c *captureConn) Read(b []byte) (n int, err error) {
+	n, err = c.Endpoint.Read(b)
+	if err != nil {
+		return 0, err
+	}
+
+	c.capture(false, b[:n])
+
+	return n, nil
+}
+
+// ReadPacket reads packet from the connection.
+func (c *captureConn) ReadPacket() (gopacket.Packet, error) {
+	packet, err := c.Endpoint.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	c.capture(false, packet.Data())
+
+	return packet, nil
+}
+
+func (c *captureConn) Write(b []byte) (n int, err error) {
+	n, err = c.Endpoint.Write(b)
+	if err != nil {
+		return 0, err
+	}
+
+	c.capture(true, b)
+
+	return n, nil
+}
+
+func (c *captureConn) capture(isOutbound bool, data []byte) {
+	cp := currentCapture()
+	if cp == nil {
+		return
+	}
+
+	linkType := endpointLinkType(c)
+
+	// The peer is the remote of the packet
+	var peer string
+	packet := gopacket.NewPacket(data, linkType, gopacket.NoCopy)
+	if networkLayer := packet.NetworkLayer(); networkLayer != nil {
+		src, dst := networkLayer.NetworkFlow().Endpoints()
+		peer = src.String()
+		if isOutbound {
+			peer = dst.String()
+		}
+
+		if transportLayer := packet.TransportLayer(); transportLayer != nil {
+			src, dst := transportLayer.TransportFlow().Endpoints()
+			port := src.String()
+			if isOutbound {
+				port = dst.String()
+			}
+			peer = net.JoinHostPort(peer, port)
+		}
+	}
+
+	cp.capture(captureInterface{
+		name:       captureTunnel,
+		isOutbound: isOutbound,
+		role:       c.role,
+		peer:       peer,
+		linkType:   linkType,
+	}, data)
+}
@@ -5,7 +5,6 @@
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/jackpal/gateway"
 	"github.com/zhxie/ikago/internal/addr"
 	"github.com/zhxie/ikago/internal/log"
@@ -21,6 +20,8 @@ type Device struct {
 	ipAddrs      []*net.IPNet
 	hardwareAddr net.HardwareAddr
 	isLoop       bool
+	wire         *Wire
+	replay       *Replay
 }
 
 // Name returns the pcap name of the device.
@@ -48,7 +49,7 @@ func (dev *Device) IsLoop() bool {
 	return dev.isLoop
 }
 
-// IPAddr returns the first IP address of the device.
+// IPAddr returns the first IP address of the device. IPv4 addresses are always in front of IPv6 addresses.
 func (dev *Device) IPAddr() *net.IPNet {
 	if len(dev.ipAddrs) > 0 {
 		return dev.ipAddrs[0]
@@ -57,6 +58,32 @@ func (dev *Device) IPAddr() *net.IPNet {
 	return nil
 }
 
+// IPv6Addr returns the first IPv6 address of the device.
+func (dev *Device) IPv6Addr() *net.IPNet {
+	for _, a := range dev.ipAddrs {
+		if a.IP.To4() == nil {
+			return a
+		}
+	}
+
+	return nil
+}
+
+// IPAddrTo returns the first IP address of the device in the same family of the given IP.
+func (dev *Device) IPAddrTo(ip net.IP) *net.IPNet {
+	if ip.To4() == nil {
+		return dev.IPv6Addr()
+	}
+
+	for _, a := range dev.ipAddrs {
+		if a.IP.To4() != nil {
+			return a
+		}
+	}
+
+	return nil
+}
+
 func (dev Device) String() string {
 	var result string
 
@@ -70,7 +97,12 @@ func (dev Device) String() string {
 	for _, a := range dev.ipAddrs {
 		addrs = append(addrs, a.IP.String())
 	}
-	result = result + strings.Join(addrs, ", ")
+	if len(addrs) > 0 {
+		result = result + strings.Join(addrs, ", ")
+	} else {
+		// Gateways in IPv6 are only known by their hardware addresses
+		result = strings.TrimSuffix(result, ": ")
+	}
 
 	if dev.isLoop {
 		result = result + " (Loopback)"
@@ -79,17 +111,9 @@ func (dev Device) String() string {
 	return result
 }
 
-const flagPcapLoopback = 1
-
-var blacklist map[string]bool
-
 // FindAllDevs returns all valid network devices in current computer.
 func FindAllDevs() ([]*Device, error) {
 	t := make([]*Device, 0)
-	result := make([]*Device, 0)
-	if blacklist == nil {
-		blacklist = make(map[string]bool)
-	}
 
 	// Enumerate system's network interfaces
 	inters, err := net.Interfaces()
@@ -115,6 +139,7 @@ func FindAllDevs() ([]*Device, error) {
 		}
 
 		as := make([]*net.IPNet, 0)
+		as6 := make([]*net.IPNet, 0)
 		for _, a := range addrs {
 			ipnet, ok := a.(*net.IPNet)
 			if !ok {
@@ -122,76 +147,25 @@ func FindAllDevs() ([]*Device, error) {
 				continue
 			}
 
-			// Only pass IPv4 address
-			if ipnet.IP.To4() == nil {
+			if ipnet.IP.To4() != nil {
+				as = append(as, ipnet)
 				continue
 			}
 
-			as = append(as, ipnet)
-		}
-
-		t = append(t, &Device{alias: inter.Name, ipAddrs: as, hardwareAddr: inter.HardwareAddr, isLoop: isLoop})
-	}
-
-	// Enumerate pcap devices
-	mid := make([]*Device, 0)
-	devs, err := pcap.FindAllDevs()
-	if err != nil {
-		return nil, fmt.Errorf("find pcap devices: %w", err)
-	}
-	for _, dev := range devs {
-		// Check blacklist
-		_, ok := blacklist[dev.Name]
-		if ok {
-			continue
-		}
-
-		// Match pcap device with interface
-		if dev.Flags&flagPcapLoopback != 0 {
-			d := FindLoopDev(t)
-			if d == nil {
-				continue
-			}
-			if d.name != "" {
-				// return nil, errors.New("too many loopback devices")
-				blacklist[dev.Name] = true
-				blacklist[d.name] = true
-				log.Infof("Device %s is a loopback device but so is %s, these devices will not be used\n", dev.Name, d.name)
-			}
-			d.name = dev.Name
-			mid = append(mid, d)
-		} else {
-			if len(dev.Addresses) <= 0 {
+			// Link-local IPv6 addresses cannot be used in transmission
+			if ipnet.IP.IsLinkLocalUnicast() {
 				continue
 			}
-			for _, a := range dev.Addresses {
-				d := FindDev(t, a.IP)
-				if d == nil {
-					continue
-				}
-				if d.name != "" {
-					// return nil, fmt.Errorf("parse pcap device %s: %w", dev.Name, fmt.Errorf("same address with %s", d.Name))
-					blacklist[dev.Name] = true
-					blacklist[d.name] = true
-					log.Infof("Device %s has the same address with %s, these devices will not be used\n", dev.Name, d.name)
-					break
-				}
-				d.name = dev.Name
-				mid = append(mid, d)
-				break
-			}
-		}
-	}
 
-	// Check blacklist
-	for _, dev := range mid {
-		_, ok := blacklist[dev.name]
-		if !ok {
-			result = append(result, dev)
+			as6 = append(as6, ipnet)
 		}
+		as = append(as, as6...)
+
+		t = append(t, &Device{alias: inter.Name, ipAddrs: as, hardwareAddr: inter.HardwareAddr, isLoop: isLoop})
 	}
 
-	return result, nil
+	// Name devices by the capture backend
+	return nameDevs(t)
 }
 
 // FindLoopDev returns the loop device in designated devices.
@@ -230,6 +204,32 @@ func FindGatewayAddr() (net.IP, error) {
 
 // FindGatewayDev returns the gateway device.
 func FindGatewayDev(dev *Device, ip net.IP) (*Device, error) {
+	if dev.wire != nil {
+		return dev.wire.findGatewayDev(ip)
+	}
+
+	packet, err := captureUDPPacket(dev, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	// Analyze the packet and get gateway's hardware address
+	ethernetLayer := packet.Layer(layers.LayerTypeEthernet)
+	if ethernetLayer == nil {
+		return nil, errors.New("missing ethernet layer")
+	}
+	ethernetPacket, ok := ethernetLayer.(*layers.Ethernet)
+	if !ok {
+		return nil, errors.New("invalid packet")
+	}
+
+	addrs := append(make([]*net.IPNet, 0), &net.IPNet{IP: ip})
+
+	return &Device{alias: "Gateway", ipAddrs: addrs, hardwareAddr: ethernetPacket.DstMAC}, nil
+}
+
+// captureUDPPacket sends a UDP packet to the IP by the system and captures it in the device.
+func captureUDPPacket(dev *Device, ip net.IP) (gopacket.Packet, error) {
 	f, err := addr.DstBPFFilter(&net.TCPAddr{
 		IP:   ip,
 		Port: 65535,
@@ -238,7 +238,7 @@ func FindGatewayDev(dev *Device, ip net.IP) (*Device, error) {
 		return nil, fmt.Errorf("parse filter %s: %w", ip, err)
 	}
 
-	conn, err := createPureRawConn(dev.Name(), fmt.Sprintf("ip && udp && %s", f))
+	conn, err := createPureRawConn(dev.Name(), fmt.Sprintf("%s && udp && %s", addr.IPBPFFilter(ip), f))
 	if err != nil {
 		return nil, fmt.Errorf("open device %s: %w", dev.Alias(), err)
 	}
@@ -257,39 +257,83 @@ func FindGatewayDev(dev *Device, ip net.IP) (*Device, error) {
 	}()
 
 	// Attempt to send and capture a UDP packet
-	err = SendUDPPacket(ip.String()+":65535", []byte("0"))
+	err = SendUDPPacket(net.JoinHostPort(ip.String(), "65535"), []byte("0"))
 	if err != nil {
 		return nil, fmt.Errorf("send udp packet: %w", err)
 	}
 
-	// Analyze the packet and get gateway's hardware address
 	packet := <-c
 	if packet == nil {
 		return nil, errors.New("timeout")
 	}
+
+	return packet, nil
+}
+
+// findNextHopDev returns the upstream device with the IPv6 address and the next hop device the system decides for the
+// IPv6 destination. The next hop is learned from a packet sent by the system, so the neighbor discovery is left to the
+// system.
+func findNextHopDev(dev *Device, dst net.IP) (upDev, nextHopDev *Device, err error) {
+	if dev.wire != nil {
+		nextHopDev, err = dev.wire.findGatewayDev(dst)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		upDev = &Device{
+			name:         dev.name,
+			alias:        dev.alias,
+			ipAddrs:      append(make([]*net.IPNet, 0), dev.IPv6Addr()),
+			hardwareAddr: dev.hardwareAddr,
+			isLoop:       dev.isLoop,
+			wire:         dev.wire,
+			replay:       dev.replay,
+		}
+
+		return upDev, nextHopDev, nil
+	}
+
+	packet, err := captureUDPPacket(dev, dst)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	ethernetLayer := packet.Layer(layers.LayerTypeEthernet)
 	if ethernetLayer == nil {
-		return nil, errors.New("missing ethernet layer")
+		return nil, nil, errors.New("missing ethernet layer")
 	}
-	ethernetPacket, ok := ethernetLayer.(*layers.Ethernet)
-	if !ok {
-		return nil, errors.New("invalid packet")
+	ipv6Layer := packet.Layer(layers.LayerTypeIPv6)
+	if ipv6Layer == nil {
+		return nil, nil, errors.New("missing ipv6 layer")
 	}
 
-	addrs := append(make([]*net.IPNet, 0), &net.IPNet{IP: ip})
+	// The source address is also decided by the system
+	srcIP := ipv6Layer.(*layers.IPv6).SrcIP
+	for _, a := range dev.ipAddrs {
+		if a.IP.Equal(srcIP) {
+			upDev = &Device{
+				name:         dev.name,
+				alias:        dev.alias,
+				ipAddrs:      append(make([]*net.IPNet, 0), a),
+				hardwareAddr: dev.hardwareAddr,
+				isLoop:       dev.isLoop,
+				wire:         dev.wire,
+				replay:       dev.replay,
+			}
+			break
+		}
+	}
+	if upDev == nil {
+		return nil, nil, fmt.Errorf("unknown source %s", srcIP)
+	}
 
-	return &Device{alias: "Gateway", ipAddrs: addrs, hardwareAddr: ethernetPacket.DstMAC}, nil
+	return upDev, &Device{alias: "Gateway", hardwareAddr: ethernetLayer.(*layers.Ethernet).DstMAC}, nil
 }
 
-// FindListenDevs returns all valid pcap devices for listening.
-func FindListenDevs(names []string) ([]*Device, error) {
+// FindListenDevs returns pcap devices in the devices for listening.
+func FindListenDevs(devs []*Device, names []string) ([]*Device, error) {
 	result := make([]*Device, 0)
 
-	devs, err := FindAllDevs()
-	if err != nil {
-		return nil, fmt.Errorf("find all devices: %w", err)
-	}
-
 	if len(names) <= 0 {
 		result = devs
 	} else {
@@ -310,13 +354,8 @@ func FindListenDevs(names []string) ([]*Device, error) {
 	return result, nil
 }
 
-// FindUpstreamDevAndGatewayDev returns the pcap device for routing upstream and the gateway.
-func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDev *Device, err error) {
-	devs, err := FindAllDevs()
-	if err != nil {
-		return nil, nil, fmt.Errorf("find all devices: %w", err)
-	}
-
+// FindUpstreamDevAndGatewayDev returns the pcap device in the devices for routing upstream and the gateway.
+func FindUpstreamDevAndGatewayDev(devs []*Device, name string, gateway net.IP) (upDev, gatewayDev *Device, err error) {
 	if name != "" {
 		// Find upstream device
 		for _, dev := range devs {
@@ -356,6 +395,8 @@ func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDe
 						ipAddrs:      append(make([]*net.IPNet, 0), a),
 						hardwareAddr: upDev.hardwareAddr,
 						isLoop:       upDev.isLoop,
+						wire:         upDev.wire,
+						replay:       upDev.replay,
 					}
 					break
 				}
@@ -394,6 +435,8 @@ func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDe
 						ipAddrs:      append(make([]*net.IPNet, 0), a),
 						hardwareAddr: dev.hardwareAddr,
 						isLoop:       dev.isLoop,
+						wire:         dev.wire,
+						replay:       dev.replay,
 					}
 					break
 				}
@@ -406,3 +449,53 @@ func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDe
 
 	return upDev, gatewayDev, nil
 }
+
+// FindIPv6UpstreamDevAndGatewayDev returns the pcap device in the devices for routing upstream to the IPv6 destination
+// and the gateway.
+func FindIPv6UpstreamDevAndGatewayDev(devs []*Device, name string, dst net.IP) (upDev, gatewayDev *Device, err error) {
+	for _, dev := range devs {
+		if name != "" {
+			if dev.alias != name {
+				continue
+			}
+		} else if dev.isLoop != dst.IsLoopback() {
+			continue
+		}
+
+		if dev.IPv6Addr() == nil {
+			if name != "" {
+				return nil, nil, fmt.Errorf("missing ipv6 address in upstream device %s", name)
+			}
+			continue
+		}
+
+		if dev.isLoop {
+			upDev = &Device{
+				name:         dev.name,
+				alias:        dev.alias,
+				ipAddrs:      append(make([]*net.IPNet, 0), dev.IPv6Addr()),
+				hardwareAddr: dev.hardwareAddr,
+				isLoop:       dev.isLoop,
+				wire:         dev.wire,
+				replay:       dev.replay,
+			}
+
+			return upDev, upDev, nil
+		}
+
+		upDev, gatewayDev, err = findNextHopDev(dev, dst)
+		if err != nil {
+			if name != "" {
+				return nil, nil, fmt.Errorf("find gateway device: %w", err)
+			}
+			continue
+		}
+
+		return upDev, gatewayDev, nil
+	}
+	if name != "" {
+		return nil, nil, fmt.Errorf("unknown upstream device %s", name)
+	}
+
+	return nil, nil, nil
+}
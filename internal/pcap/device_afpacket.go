@@ -0,0 +1,20 @@
+// +build afpacket
+
+package pcap
+
+// nameDevs names devices in their interface names, which AF_PACKET sockets are bound to.
+func nameDevs(t []*Device) ([]*Device, error) {
+	result := make([]*Device, 0)
+
+	for _, dev := range t {
+		// Ignore devices without addresses like pcap
+		if len(dev.ipAddrs) <= 0 && !dev.isLoop {
+			continue
+		}
+
+		dev.name = dev.alias
+		result = append(result, dev)
+	}
+
+	return result, nil
+}
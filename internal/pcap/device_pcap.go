@@ -0,0 +1,82 @@
+// +build !afpacket
+
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket/pcap"
+	"github.com/zhxie/ikago/internal/log"
+)
+
+const flagPcapLoopback = 1
+
+var blacklist map[string]bool
+
+// nameDevs matches pcap devices with interfaces and names them in pcap names.
+func nameDevs(t []*Device) ([]*Device, error) {
+	result := make([]*Device, 0)
+	if blacklist == nil {
+		blacklist = make(map[string]bool)
+	}
+
+	// Enumerate pcap devices
+	mid := make([]*Device, 0)
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, fmt.Errorf("find pcap devices: %w", err)
+	}
+	for _, dev := range devs {
+		// Check blacklist
+		_, ok := blacklist[dev.Name]
+		if ok {
+			continue
+		}
+
+		// Match pcap device with interface
+		if dev.Flags&flagPcapLoopback != 0 {
+			d := FindLoopDev(t)
+			if d == nil {
+				continue
+			}
+			if d.name != "" {
+				// return nil, errors.New("too many loopback devices")
+				blacklist[dev.Name] = true
+				blacklist[d.name] = true
+				log.Infof("Device %s is a loopback device but so is %s, these devices will not be used\n", dev.Name, d.name)
+			}
+			d.name = dev.Name
+			mid = append(mid, d)
+		} else {
+			if len(dev.Addresses) <= 0 {
+				continue
+			}
+			for _, a := range dev.Addresses {
+				d := FindDev(t, a.IP)
+				if d == nil {
+					continue
+				}
+				if d.name != "" {
+					// return nil, fmt.Errorf("parse pcap device %s: %w", dev.Name, fmt.Errorf("same address with %s", d.Name))
+					blacklist[dev.Name] = true
+					blacklist[d.name] = true
+					log.Infof("Device %s has the same address with %s, these devices will not be used\n", dev.Name, d.name)
+					break
+				}
+				d.name = dev.Name
+				mid = append(mid, d)
+				break
+			}
+		}
+	}
+
+	// Check blacklist
+	for _, dev := range mid {
+		_, ok := blacklist[dev.name]
+		if !ok {
+			result = append(result, dev)
+		}
+	}
+
+	return result, nil
+}
+
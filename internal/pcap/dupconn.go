@@ -0,0 +1,336 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/zhxie/ikago/internal/addr"
+	"github.com/zhxie/ikago/internal/log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dupHeaderSize is the size of the header of a packet in duplication, which contains the sequence.
+const dupHeaderSize = 4
+
+// dupWindowSize is the number of sequences behind the latest one which will be recognized as duplicates.
+const dupWindowSize = 1024
+
+type dupPortRange struct {
+	isSrc bool
+	isDst bool
+	start uint16
+	end   uint16
+}
+
+// DupFilter describes which packets will be duplicated by their ports.
+type DupFilter struct {
+	ranges []dupPortRange
+}
+
+// ParseDupFilter returns a filter by given ports. A port or a range of ports may be prefixed by "src:" or "dst:" to
+// match only the source or the destination port, such as "dst:27015-27030", otherwise it matches either.
+func ParseDupFilter(ss []string) (*DupFilter, error) {
+	f := &DupFilter{ranges: make([]dupPortRange, 0)}
+
+	for _, s := range ss {
+		r := dupPortRange{isSrc: true, isDst: true}
+
+		strs := strings.SplitN(s, ":", 2)
+		if len(strs) > 1 {
+			switch strings.ToLower(strings.TrimSpace(strs[0])) {
+			case "src":
+				r.isDst = false
+			case "dst":
+				r.isSrc = false
+			default:
+				return nil, fmt.Errorf("direction %s not support", strs[0])
+			}
+			s = strs[1]
+		}
+
+		var err error
+
+		r.start, r.end, err = addr.ParsePortRange(s)
+		if err != nil {
+			return nil, err
+		}
+
+		f.ranges = append(f.ranges, r)
+	}
+
+	return f, nil
+}
+
+// Match returns if the IPv4 packet matches the filter. If reverse is true, the source and the destination port of the
+// packet will be swapped, so the same filter matches packets in both directions.
+func (f *DupFilter) Match(b []byte, reverse bool) bool {
+	if len(f.ranges) <= 0 {
+		return true
+	}
+
+	if len(b) < 20 || b[0]>>4 != 4 {
+		return false
+	}
+	ihl := int(b[0]&0x0f) * 4
+	if ihl < 20 || len(b) < ihl+4 {
+		return false
+	}
+	protocol := b[9]
+	if protocol != 6 && protocol != 17 {
+		return false
+	}
+	// Fragments other than the first one have no ports
+	if binary.BigEndian.Uint16(b[6:8])&0x1fff != 0 {
+		return false
+	}
+
+	srcPort := binary.BigEndian.Uint16(b[ihl : ihl+2])
+	dstPort := binary.BigEndian.Uint16(b[ihl+2 : ihl+4])
+	if reverse {
+		srcPort, dstPort = dstPort, srcPort
+	}
+
+	for _, r := range f.ranges {
+		if r.isSrc && srcPort >= r.start && srcPort <= r.end {
+			return true
+		}
+		if r.isDst && dstPort >= r.start && dstPort <= r.end {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *DupFilter) String() string {
+	strs := make([]string, 0)
+
+	for _, r := range f.ranges {
+		var s string
+		if r.start == r.end {
+			s = fmt.Sprintf("%d", r.start)
+		} else {
+			s = fmt.Sprintf("%d-%d", r.start, r.end)
+		}
+
+		switch {
+		case r.isSrc && !r.isDst:
+			s = "src " + s
+		case !r.isSrc && r.isDst:
+			s = "dst " + s
+		}
+
+		strs = append(strs, s)
+	}
+
+	return strings.Join(strs, ", ")
+}
+
+// dupWindow records the latest sequences received.
+type dupWindow struct {
+	top    uint32
+	bitmap [dupWindowSize / 64]uint64
+	isInit bool
+}
+
+// check records the sequence, and returns if it has not been received before. A sequence far behind the window is
+// recognized as the peer is restarted, and the window is reset.
+func (w *dupWindow) check(seq uint32) bool {
+	if !w.isInit {
+		w.reset(seq)
+
+		return true
+	}
+
+	diff := int32(seq - w.top)
+	if diff > 0 {
+		// Slide
+		if diff >= dupWindowSize {
+			w.bitmap = [dupWindowSize / 64]uint64{}
+		} else {
+			for i := w.top + 1; i != seq; i++ {
+				w.clear(i)
+			}
+		}
+		w.top = seq
+		w.set(seq)
+
+		return true
+	}
+	if -diff >= dupWindowSize {
+		// The peer is restarted in new sequences
+		w.reset(seq)
+
+		return true
+	}
+	if w.isSet(seq) {
+		return false
+	}
+	w.set(seq)
+
+	return true
+}
+
+func (w *dupWindow) reset(seq uint32) {
+	w.isInit = true
+	w.top = seq
+	w.bitmap = [dupWindowSize / 64]uint64{}
+	w.set(seq)
+}
+
+func (w *dupWindow) set(seq uint32) {
+	i := seq % dupWindowSize
+	w.bitmap[i/64] |= 1 << (i % 64)
+}
+
+func (w *dupWindow) clear(seq uint32) {
+	i := seq % dupWindowSize
+	w.bitmap[i/64] &^= 1 << (i % 64)
+}
+
+func (w *dupWindow) isSet(seq uint32) bool {
+	i := seq % dupWindowSize
+	return w.bitmap[i/64]&(1<<(i%64)) != 0
+}
+
+// DupConn is a connection which sends packets matching the filter multiple times, and drops duplicates received.
+type DupConn struct {
+	conn      net.Conn
+	times     int
+	delay     time.Duration
+	filter    *DupFilter
+	reverse   bool
+	writeLock sync.Mutex
+	seq       uint32
+	readLock  sync.Mutex
+	window    dupWindow
+	buffer    []byte
+}
+
+// NewDupConn returns a connection with duplication over the given connection. Packets matching the filter will be sent
+// in the times, and each copy is sent after the delay since the last one. If reverse is true, packets will be matched
+// in reverse direction.
+func NewDupConn(conn net.Conn, times int, delay time.Duration, filter *DupFilter, reverse bool) (*DupConn, error) {
+	if times <= 0 || times > 16 {
+		return nil, fmt.Errorf("times %d out of range", times)
+	}
+	if delay < 0 {
+		return nil, fmt.Errorf("delay %s out of range", delay)
+	}
+	if filter == nil {
+		filter = &DupFilter{}
+	}
+
+	return &DupConn{
+		conn:    conn,
+		times:   times,
+		delay:   delay,
+		filter:  filter,
+		reverse: reverse,
+		buffer:  make([]byte, IPv4MaxSize),
+	}, nil
+}
+
+// Read reads a packet from the connection. Duplicated packets will be dropped.
+func (c *DupConn) Read(b []byte) (n int, err error) {
+	for {
+		n, err := c.conn.Read(c.buffer)
+		if err != nil {
+			return 0, err
+		}
+		if n <= 0 {
+			return 0, nil
+		}
+		if n < dupHeaderSize {
+			log.Verboseln(fmt.Errorf("read %s: %w", c.RemoteAddr(), errors.New("missing header")))
+			continue
+		}
+
+		seq := binary.BigEndian.Uint32(c.buffer[:dupHeaderSize])
+
+		c.readLock.Lock()
+		ok := c.window.check(seq)
+		c.readLock.Unlock()
+		if !ok {
+			continue
+		}
+
+		copy(b, c.buffer[dupHeaderSize:n])
+
+		return n - dupHeaderSize, nil
+	}
+}
+
+// Write writes a packet to the connection. Packets matching the filter will be written multiple times.
+func (c *DupConn) Write(b []byte) (n int, err error) {
+	c.writeLock.Lock()
+	seq := c.seq
+	c.seq++
+	c.writeLock.Unlock()
+
+	d := make([]byte, dupHeaderSize+len(b))
+	binary.BigEndian.PutUint32(d[:dupHeaderSize], seq)
+	copy(d[dupHeaderSize:], b)
+
+	_, err = c.conn.Write(d)
+	if err != nil {
+		return 0, err
+	}
+
+	if c.times > 1 && c.filter.Match(b, c.reverse) {
+		if c.delay <= 0 {
+			for i := 1; i < c.times; i++ {
+				_, err = c.conn.Write(d)
+				if err != nil {
+					return 0, err
+				}
+			}
+		} else {
+			go func() {
+				for i := 1; i < c.times; i++ {
+					time.Sleep(c.delay)
+
+					_, err := c.conn.Write(d)
+					if err != nil {
+						log.Verboseln(fmt.Errorf("write %s: %w", c.RemoteAddr(), err))
+						return
+					}
+				}
+			}()
+		}
+	}
+
+	return len(b), nil
+}
+
+func (c *DupConn) Close() error {
+	return c.conn.Close()
+}
+
+// Conn returns the underlying connection.
+func (c *DupConn) Conn() net.Conn {
+	return c.conn
+}
+
+func (c *DupConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *DupConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *DupConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *DupConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *DupConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,40 @@
+package pcap
+
+import "testing"
+
+func TestDupWindow(t *testing.T) {
+	var w dupWindow
+
+	// New sequences are accepted once
+	for _, seq := range []uint32{5000, 5001, 5003, 5002} {
+		if !w.check(seq) {
+			t.Errorf("seq %d rejected", seq)
+		}
+	}
+	for _, seq := range []uint32{5000, 5003} {
+		if w.check(seq) {
+			t.Errorf("duplicate seq %d accepted", seq)
+		}
+	}
+
+	// Sequences of a restarted peer reset the window
+	for _, seq := range []uint32{0, 1, 2} {
+		if !w.check(seq) {
+			t.Errorf("seq %d after restart rejected", seq)
+		}
+	}
+	if w.check(1) {
+		t.Error("duplicate seq 1 after restart accepted")
+	}
+
+	// Sequences wrap around
+	w = dupWindow{}
+	for _, seq := range []uint32{0xffffffff, 0, 1} {
+		if !w.check(seq) {
+			t.Errorf("seq %d rejected", seq)
+		}
+	}
+	if w.check(0xffffffff) {
+		t.Error("duplicate seq 4294967295 accepted")
+	}
+}
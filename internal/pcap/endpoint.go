@@ -0,0 +1,68 @@
+package pcap
+
+import "github.com/google/gopacket"
+
+// Endpoint is a packet endpoint which reads and writes packets with link layers in a device.
+type Endpoint interface {
+	// Read reads a packet from the endpoint.
+	Read(b []byte) (n int, err error)
+	// ReadPacket reads a packet from the endpoint and decodes it.
+	ReadPacket() (gopacket.Packet, error)
+	// Write writes a packet to the endpoint.
+	Write(b []byte) (n int, err error)
+	// Close closes the endpoint.
+	Close() error
+	// LocalDev returns the local device.
+	LocalDev() *Device
+	// RemoteDev returns the remote device.
+	RemoteDev() *Device
+	// IsLoop returns if the endpoint is to a loopback device.
+	IsLoop() bool
+}
+
+// CreateEndpoint creates a packet endpoint between devices with BPF filter. Endpoints in virtual devices are on their
+// wires, endpoints in devices of replays are on their replays, and others are raw connections.
+func CreateEndpoint(srcDev, dstDev *Device, filter string) (Endpoint, error) {
+	if srcDev.replay != nil {
+		conn, err := srcDev.replay.createConn(srcDev, dstDev, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		return conn, nil
+	}
+
+	if srcDev.wire != nil {
+		conn, err := srcDev.wire.createConn(srcDev, dstDev, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		return conn, nil
+	}
+
+	conn, err := CreateRawConn(srcDev, dstDev, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// createTunnelEndpoint creates a packet endpoint of tunnels between clients and servers, whose peers are in the role.
+// Packets in the endpoint are written to the capture once a capture is opened.
+func createTunnelEndpoint(srcDev, dstDev *Device, filter string, role Role) (Endpoint, error) {
+	conn, err := CreateEndpoint(srcDev, dstDev, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	captureLock.RLock()
+	defer captureLock.RUnlock()
+
+	if capture == nil {
+		return conn, nil
+	}
+
+	return &captureConn{Endpoint: conn, role: role}, nil
+}
@@ -0,0 +1,685 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/addr"
+	"github.com/zhxie/ikago/internal/crypto"
+	"github.com/zhxie/ikago/internal/log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Directions of the payload in ICMPv4 echo. The direction is encrypted with the payload, so echo replies generated by
+// the OS of the server which carry the payload of the client can be recognized and dropped.
+const (
+	icmpDirectionRequest byte = iota
+	icmpDirectionReply
+)
+
+// keepICMP is the interval of ICMPv4 echo requests sent by the client to keep the mapping in NAT devices alive.
+const keepICMP = 10 * time.Second
+
+// FakeICMPConn is a packet pcap network connection add ICMPv4 echo header to all traffic.
+type FakeICMPConn struct {
+	lock          sync.Mutex
+	conn          Endpoint
+	defrag        Defragmenter
+	srcId         uint16
+	dstAddr       *addr.ICMPQueryAddr
+	isClient      bool
+	crypt         crypto.Crypt
+	mtu           int
+	appear        time.Time
+	isConnected   atomic.Bool
+	isReconnected atomic.Bool
+	isClosed      atomic.Bool
+	listener      *FakeICMPListener
+	client        *clientIndicator
+	id            uint16
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newFakeICMPConn() *FakeICMPConn {
+	conn := &FakeICMPConn{
+		defrag: NewEasyDefragmenter(),
+		mtu:    MaxEthernetMTU,
+	}
+	conn.defrag.SetDeadline(keepFragments)
+	return conn
+}
+
+// DialFakeICMP establishes FakeICMP connection for pcap networks. The ICMPv4 Id works as the port of the client.
+func DialFakeICMP(srcDev, dstDev *Device, srcId uint16, dstIP net.IP, crypt crypto.Crypt, mtu int) (*FakeICMPConn, error) {
+	srcAddr := &addr.ICMPQueryAddr{
+		IP: srcDev.IPAddr().IP,
+		Id: srcId,
+	}
+	dstAddr := &addr.ICMPQueryAddr{
+		IP: dstIP,
+		Id: srcId,
+	}
+
+	conn, err := dialFakeICMPPassive(srcDev, dstDev, dstAddr, true, crypt, mtu)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    err,
+		}
+	}
+
+	log.Infof("Connect to server %s\n", dstIP)
+
+	// Handshake
+	err = conn.handshake()
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    fmt.Errorf("handshake: %w", err),
+		}
+	}
+
+	conn.appear = time.Now()
+
+	go func() {
+		time.Sleep(establishDeadline)
+
+		if !conn.isConnected.Load() {
+			log.Errorf("Cannot receive response from server %s, is your network down?\n", dstIP)
+		}
+	}()
+
+	// Keep alive
+	go func() {
+		for {
+			time.Sleep(keepICMP)
+
+			if conn.isClosed.Load() {
+				return
+			}
+
+			err := conn.handshake()
+			if err != nil {
+				log.Errorln(fmt.Errorf("keep alive: %w", err))
+			}
+		}
+	}()
+
+	return conn, nil
+}
+
+func dialFakeICMPPassive(srcDev, dstDev *Device, dstAddr *addr.ICMPQueryAddr, isClient bool, crypt crypto.Crypt, mtu int) (*FakeICMPConn, error) {
+	dstIP := &net.IPAddr{IP: dstAddr.IP}
+	filter, err := addr.SrcBPFFilter(dstIP)
+	if err != nil {
+		return nil, fmt.Errorf("parse filter %s: %w", dstIP, err)
+	}
+
+	// The client receives echo replies, and the server receives echo requests
+	t := "icmp-echoreply"
+	if !isClient {
+		t = "icmp-echo"
+	}
+
+	// Peers of clients are servers
+	role := RoleClient
+	if isClient {
+		role = RoleServer
+	}
+
+	rawConn, err := createTunnelEndpoint(srcDev, dstDev, fmt.Sprintf("ip && ((icmp && icmp[icmptype] == %s && icmp[4:2] == %d && %s) || ((ip[6:2] & 0x1fff) != 0 && %s))", t, dstAddr.Id, filter, filter), role)
+	if err != nil {
+		return nil, fmt.Errorf("create raw connection: %w", err)
+	}
+
+	conn := newFakeICMPConn()
+	conn.srcId = dstAddr.Id
+	conn.dstAddr = dstAddr
+	conn.isClient = isClient
+	conn.crypt = crypt
+	conn.mtu = mtu
+	conn.conn = rawConn
+	conn.client = &clientIndicator{crypt: crypt}
+
+	return conn, nil
+}
+
+func (c *FakeICMPConn) Read(b []byte) (n int, err error) {
+	n, _, err = c.ReadFrom(b)
+
+	return n, err
+}
+
+// handshake sends an echo with only the direction in payload. The client sends it as a request to establish and keep
+// the connection, and the server replies it.
+func (c *FakeICMPConn) handshake() error {
+	err := c.write(nil)
+	if err != nil {
+		return err
+	}
+
+	if c.isClient {
+		log.Verbosef("Send ICMPv4 Echo Request: %s -> %s\n", c.LocalAddr().String(), c.RemoteAddr().String())
+	} else {
+		log.Verbosef("Send ICMPv4 Echo Reply: %s <- %s\n", c.RemoteAddr().String(), c.LocalAddr().String())
+	}
+
+	return nil
+}
+
+func (c *FakeICMPConn) write(p []byte) error {
+	var (
+		t         uint8
+		seq       uint16
+		direction byte
+		fragments [][]byte
+	)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.isClient {
+		t = layers.ICMPv4TypeEchoRequest
+		seq = uint16(c.client.seq)
+		direction = icmpDirectionRequest
+	} else {
+		// Replies use the Seq of the last request, so they can pass through NAT devices
+		t = layers.ICMPv4TypeEchoReply
+		seq = uint16(c.client.ack)
+		direction = icmpDirectionReply
+	}
+
+	// Create layers
+	transportLayer, networkLayer, linkLayer, err := CreateICMPv4Layers(t, c.dstAddr.Id, seq, c.conn, c.dstAddr.IP, c.id, 128, c.conn.RemoteDev().HardwareAddr())
+	if err != nil {
+		return fmt.Errorf("create layers: %w", err)
+	}
+
+	// Encrypt
+	contents, err := c.client.crypt.Encrypt(append([]byte{direction}, p...))
+	if err != nil {
+		return fmt.Errorf("encrypt: %w", err)
+	}
+
+	// Fragment
+	fragments, err = CreateFragmentPackets(linkLayer.(gopacket.Layer), networkLayer.(gopacket.Layer), transportLayer.(gopacket.Layer), contents, c.mtu)
+	if err != nil {
+		return fmt.Errorf("fragment: %w", err)
+	}
+
+	// Write packet data
+	for _, frag := range fragments {
+		_, err := c.conn.Write(frag)
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+
+	// ICMPv4 Seq
+	if c.isClient {
+		c.client.seq++
+	}
+
+	// IPv4 Id
+	c.id++
+
+	return nil
+}
+
+func (c *FakeICMPConn) Write(b []byte) (n int, err error) {
+	return c.WriteTo(b, c.RemoteAddr())
+}
+
+func (c *FakeICMPConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	type tuple struct {
+		indicator *PacketIndicator
+		err       error
+	}
+
+	ch := make(chan tuple)
+	go func() {
+		for {
+			packet, err := c.conn.ReadPacket()
+			if err != nil {
+				ch <- tuple{err: err}
+				return
+			}
+
+			// Parse packet
+			indicator, err := ParsePacket(packet)
+			if err != nil {
+				ch <- tuple{err: fmt.Errorf("parse packet: %w", err)}
+				return
+			}
+
+			// Handle fragments
+			indicator, err = c.defrag.Append(indicator)
+			if err != nil {
+				ch <- tuple{err: fmt.Errorf("defrag: %w", err)}
+				return
+			}
+			if indicator != nil {
+				ch <- tuple{indicator: indicator}
+				return
+			}
+		}
+	}()
+	// Timeout
+	if !c.readDeadline.IsZero() {
+		go func() {
+			duration := c.readDeadline.Sub(time.Now())
+			if duration > 0 {
+				time.Sleep(duration)
+			}
+			ch <- tuple{err: &timeoutError{Err: "timeout"}}
+		}()
+	}
+
+	tu := <-ch
+	if tu.err != nil {
+		return 0, nil, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Err:    tu.err,
+		}
+	}
+
+	indicator := tu.indicator
+	addr = c.RemoteAddr()
+
+	// Drop packets from other connections, since fragments from the same address are all captured
+	if indicator.TransportLayer() == nil || indicator.TransportLayer().LayerType() != layers.LayerTypeICMPv4 {
+		return 0, addr, nil
+	}
+	icmpv4Layer := indicator.ICMPv4Indicator().ICMPv4Layer()
+	if icmpv4Layer.Id != c.dstAddr.Id {
+		return 0, addr, nil
+	}
+	if c.isClient && icmpv4Layer.TypeCode.Type() != layers.ICMPv4TypeEchoReply {
+		return 0, addr, nil
+	}
+	if !c.isClient && icmpv4Layer.TypeCode.Type() != layers.ICMPv4TypeEchoRequest {
+		return 0, addr, nil
+	}
+
+	if indicator.Payload() == nil {
+		return 0, addr, nil
+	}
+
+	// Decrypt
+	contents, err := c.client.crypt.Decrypt(indicator.Payload())
+	if err != nil {
+		return 0, addr, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   addr,
+			Err:    fmt.Errorf("decrypt: %w", err),
+		}
+	}
+	if len(contents) <= 0 {
+		return 0, addr, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   addr,
+			Err:    errors.New("missing direction"),
+		}
+	}
+
+	// Drop echoes of own packets
+	if c.isClient && contents[0] != icmpDirectionReply {
+		return 0, addr, nil
+	}
+	if !c.isClient {
+		if contents[0] != icmpDirectionRequest {
+			return 0, addr, nil
+		}
+
+		// ICMPv4 Seq
+		c.client.ack = uint32(icmpv4Layer.Seq)
+	}
+
+	// Handshake
+	if len(contents) == 1 {
+		if c.isClient {
+			log.Verbosef("Receive ICMPv4 Echo Reply: %s <- %s\n", c.LocalAddr().String(), addr.String())
+
+			if !c.isConnected.Load() {
+				t := time.Now()
+				duration := t.Sub(c.appear)
+
+				log.Infof("Connected to server %s in %.3f ms (RTT)\n", c.dstAddr.IP, float64(duration.Microseconds())/1000)
+
+				c.isConnected.Store(true)
+			}
+			c.isReconnected.Store(true)
+		} else {
+			log.Verbosef("Receive ICMPv4 Echo Request: %s -> %s\n", addr.String(), c.LocalAddr().String())
+
+			err = c.handshake()
+			if err != nil {
+				return 0, addr, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   addr,
+					Err:    fmt.Errorf("handshake: %w", err),
+				}
+			}
+		}
+
+		return 0, addr, nil
+	}
+
+	copy(p, contents[1:])
+
+	return len(contents) - 1, addr, nil
+}
+
+func (c *FakeICMPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if addr.String() != c.RemoteAddr().String() {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   addr,
+			Err:    fmt.Errorf("client %s unrecognized", addr.String()),
+		}
+	}
+
+	ch := make(chan error)
+
+	go func() {
+		ch <- c.write(p)
+	}()
+	// Timeout
+	if !c.writeDeadline.IsZero() {
+		go func() {
+			duration := c.writeDeadline.Sub(time.Now())
+			if duration > 0 {
+				time.Sleep(duration)
+			}
+			ch <- &timeoutError{Err: "timeout"}
+		}()
+	}
+
+	err = <-ch
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   addr,
+			Err:    err,
+		}
+	}
+
+	return len(p), nil
+}
+
+func (c *FakeICMPConn) Close() error {
+	if !c.isClosed.CompareAndSwap(false, true) {
+		return nil
+	}
+	if c.listener != nil {
+		c.listener.remove(c)
+	}
+
+	err := c.conn.Close()
+	if err != nil {
+		return &net.OpError{
+			Op:   "close",
+			Net:  "pcap",
+			Addr: c.LocalAddr(),
+			Err:  err,
+		}
+	}
+
+	return nil
+}
+
+// LocalDev returns the local device.
+func (c *FakeICMPConn) LocalDev() *Device {
+	return c.conn.LocalDev()
+}
+
+func (c *FakeICMPConn) LocalAddr() net.Addr {
+	return &addr.ICMPQueryAddr{IP: c.LocalDev().IPAddr().IP, Id: c.srcId}
+}
+
+// RemoteDev returns the remote device.
+func (c *FakeICMPConn) RemoteDev() *Device {
+	return c.conn.RemoteDev()
+}
+
+func (c *FakeICMPConn) RemoteAddr() net.Addr {
+	return c.dstAddr
+}
+
+func (c *FakeICMPConn) SetDeadline(t time.Time) error {
+	readDeadline := c.readDeadline
+
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+
+	err = c.SetWriteDeadline(t)
+	if err != nil {
+		_ = c.SetReadDeadline(readDeadline)
+		return err
+	}
+
+	return nil
+}
+
+func (c *FakeICMPConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline = t
+
+	return nil
+}
+
+func (c *FakeICMPConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline = t
+
+	return nil
+}
+
+// Reconnect reconnects the connection by sending ICMPv4 echo request.
+func (c *FakeICMPConn) Reconnect() error {
+	c.isReconnected.Store(false)
+
+	err := c.handshake()
+	if err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+
+	go func() {
+		time.Sleep(establishDeadline)
+
+		if !c.isReconnected.Load() {
+			log.Errorf("Cannot receive response from server %s, is it down?\n", c.dstAddr.IP)
+		}
+	}()
+
+	return nil
+}
+
+// IsConnected returns if the connection has received the response of the handshake from the server.
+func (c *FakeICMPConn) IsConnected() bool {
+	return c.isConnected.Load()
+}
+
+// IsReconnected returns if the connection has received the response of the last reconnection from the server.
+func (c *FakeICMPConn) IsReconnected() bool {
+	return c.isReconnected.Load()
+}
+
+// FakeICMPListener is a pcap network listener in FakeICMP network.
+type FakeICMPListener struct {
+	conn        Endpoint
+	crypt       crypto.Crypt
+	mtu         int
+	clientsLock sync.Mutex
+	clients     map[string]*FakeICMPConn
+}
+
+// ListenFakeICMP announces on the local network address in FakeICMP network.
+func ListenFakeICMP(srcDev, dstDev *Device, crypt crypto.Crypt, mtu int) (*FakeICMPListener, error) {
+	srcAddr := &net.IPAddr{IP: srcDev.IPAddr().IP}
+
+	// Only echo requests used in handshaking which contain the direction only are captured
+	size := 20 + 8 + 1 + crypt.Cost()
+
+	conn, err := createTunnelEndpoint(srcDev, dstDev, fmt.Sprintf("icmp && icmp[icmptype] == icmp-echo && ip[2:2] == %d && (ip[6:2] & 0x1fff) == 0", size), RoleClient)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Err:    fmt.Errorf("create handshake connection: %w", err),
+		}
+	}
+
+	listener := &FakeICMPListener{
+		conn:    conn,
+		crypt:   crypt,
+		mtu:     mtu,
+		clients: make(map[string]*FakeICMPConn),
+	}
+
+	return listener, nil
+}
+
+func (l *FakeICMPListener) Accept() (net.Conn, error) {
+	packet, err := l.conn.ReadPacket()
+	if err != nil {
+		return nil, &net.OpError{
+			Op:   "accept",
+			Net:  "pcap",
+			Addr: l.Addr(),
+			Err:  fmt.Errorf("read device %s: %w", l.Dev().Alias(), err),
+		}
+	}
+
+	// Parse packet
+	indicator, err := ParsePacket(packet)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:   "accept",
+			Net:  "pcap",
+			Addr: l.Addr(),
+			Err:  fmt.Errorf("parse packet: %w", err),
+		}
+	}
+	if indicator.TransportLayer() == nil || indicator.TransportLayer().LayerType() != layers.LayerTypeICMPv4 {
+		return nil, nil
+	}
+
+	srcAddr := &addr.ICMPQueryAddr{
+		IP: indicator.SrcIP(),
+		Id: indicator.ICMPv4Indicator().Id(),
+	}
+
+	// Requests of accepted clients are handled in their connections
+	l.clientsLock.Lock()
+	_, ok := l.clients[srcAddr.String()]
+	l.clientsLock.Unlock()
+	if ok {
+		return nil, nil
+	}
+
+	// Verify handshaking
+	contents, err := l.crypt.Decrypt(indicator.Payload())
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "accept",
+			Net:    "pcap",
+			Source: l.Addr(),
+			Addr:   srcAddr,
+			Err:    fmt.Errorf("decrypt: %w", err),
+		}
+	}
+	if len(contents) != 1 || contents[0] != icmpDirectionRequest {
+		return nil, nil
+	}
+
+	conn, err := dialFakeICMPPassive(l.Dev(), l.conn.RemoteDev(), srcAddr, false, l.crypt, l.mtu)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: l.Addr(),
+			Addr:   srcAddr,
+			Err:    err,
+		}
+	}
+
+	// ICMPv4 Seq
+	conn.client.ack = uint32(indicator.ICMPv4Indicator().ICMPv4Layer().Seq)
+
+	// Handshaking with client (echo reply)
+	err = conn.handshake()
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "handshake",
+			Net:    "pcap",
+			Source: l.Addr(),
+			Addr:   srcAddr,
+			Err:    err,
+		}
+	}
+
+	// Map client
+	conn.listener = l
+	l.clientsLock.Lock()
+	l.clients[srcAddr.String()] = conn
+	l.clientsLock.Unlock()
+
+	return conn, nil
+}
+
+func (l *FakeICMPListener) remove(conn *FakeICMPConn) {
+	l.clientsLock.Lock()
+	defer l.clientsLock.Unlock()
+
+	if l.clients[conn.RemoteAddr().String()] == conn {
+		delete(l.clients, conn.RemoteAddr().String())
+	}
+}
+
+func (l *FakeICMPListener) Close() error {
+	err := l.conn.Close()
+	if err != nil {
+		return &net.OpError{
+			Op:   "close",
+			Net:  "pcap",
+			Addr: l.Addr(),
+			Err:  err,
+		}
+	}
+
+	return nil
+}
+
+// Dev returns the device.
+func (l *FakeICMPListener) Dev() *Device {
+	return l.conn.LocalDev()
+}
+
+func (l *FakeICMPListener) Addr() net.Addr {
+	return &net.IPAddr{IP: l.Dev().IPAddr().IP}
+}
@@ -1,6 +1,8 @@
 package pcap
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -9,34 +11,59 @@
 	"github.com/zhxie/ikago/internal/config"
 	"github.com/zhxie/ikago/internal/crypto"
 	"github.com/zhxie/ikago/internal/log"
+	"github.com/zhxie/ikago/internal/obfs"
+	"io"
 	"math"
+	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type clientIndicator struct {
-	crypt crypto.Crypt
-	seq   uint32
-	ack   uint32
+	crypt        crypto.Crypt
+	seq          uint32
+	ack          uint32
+	isObfuscated bool
+	pending      [][]byte
+	isTimestamp  bool
+	tsEcr        uint32
 }
 
+// SessionSize is the size of a session ID.
+const SessionSize = 16
+
 const establishDeadline = 3 * time.Second
+const finishDeadline = 1 * time.Second
 const keepFragments = 30 * time.Second
 
+// obfuscationQueue is the number of payloads queued by the server before the request of the obfuscator arrives.
+const obfuscationQueue = 64
+
 // FakeTCPConn is a packet pcap network connection add fake TCP header to all traffic.
 type FakeTCPConn struct {
 	lock          sync.Mutex
-	conn          *RawConn
+	conn          Endpoint
 	defrag        Defragmenter
 	srcPort       uint16
 	dstAddr       *net.TCPAddr
 	crypt         crypto.Crypt
+	obfs          obfs.Obfuscator
+	fingerprint   Fingerprint
+	tsBase        uint32
+	tsTime        time.Time
 	mtu           int
 	appear        time.Time
-	isConnected   bool
-	isReconnected bool
-	isClosed      bool
+	isClient      bool
+	isConnected   atomic.Bool
+	isReconnected atomic.Bool
+	isClosing     atomic.Bool
+	isClosed      atomic.Bool
+	finished      chan struct{}
+	listener      *FakeTCPListener
+	session       []byte
+	sessionTime   time.Time
 	clientsLock   sync.RWMutex
 	clients       map[string]*clientIndicator
 	id            uint16
@@ -47,21 +74,40 @@ type FakeTCPConn struct {
 func newConn() *FakeTCPConn {
 	conn := &FakeTCPConn{
 		defrag:  NewEasyDefragmenter(),
+		tsBase:  rand.Uint32(),
+		tsTime:  time.Now(),
 		mtu:     MaxEthernetMTU,
 		clients: make(map[string]*clientIndicator),
+		id:      uint16(rand.Intn(math.MaxUint16 + 1)),
 	}
 	conn.defrag.SetDeadline(keepFragments)
+	conn.finished = make(chan struct{}, 1)
 	return conn
 }
 
 // DialFakeTCP establishes FakeTCP connection for pcap networks.
-func DialFakeTCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, mtu int) (*FakeTCPConn, error) {
+func DialFakeTCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, obfuscator obfs.Obfuscator, fingerprint Fingerprint, mtu int) (*FakeTCPConn, error) {
+	return DialFakeTCPWithSession(srcDev, dstDev, srcPort, dstAddr, crypt, obfuscator, fingerprint, mtu, nil)
+}
+
+// DialFakeTCPWithSession establishes FakeTCP connection for pcap networks in the session. The session will be sent
+// encrypted in every handshake, so the server can recognize the connection after the address of the client changes.
+func DialFakeTCPWithSession(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, obfuscator obfs.Obfuscator, fingerprint Fingerprint, mtu int, session []byte) (*FakeTCPConn, error) {
+	if session != nil && len(session) != SessionSize {
+		return nil, &net.OpError{
+			Op:   "dial",
+			Net:  "pcap",
+			Addr: dstAddr,
+			Err:  fmt.Errorf("session in size %d not support", len(session)),
+		}
+	}
+
 	srcAddr := &net.TCPAddr{
 		IP:   srcDev.IPAddr().IP,
 		Port: int(srcPort),
 	}
 
-	conn, err := dialFakeTCPPassive(srcDev, dstDev, srcPort, dstAddr, crypt, mtu)
+	conn, err := dialFakeTCPPassive(srcDev, dstDev, srcPort, dstAddr, true, crypt, obfuscator, fingerprint, mtu)
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -71,6 +117,7 @@ func DialFakeTCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, c
 			Err:    err,
 		}
 	}
+	conn.session = session
 
 	log.Infof("Connect to server %s\n", dstAddr.String())
 
@@ -91,7 +138,7 @@ func DialFakeTCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, c
 	go func() {
 		time.Sleep(establishDeadline)
 
-		if !conn.isConnected {
+		if !conn.isConnected.Load() {
 			log.Errorf("Cannot receive response from server %s, is your network down?\n", dstAddr.String())
 		}
 	}()
@@ -99,9 +146,13 @@ func DialFakeTCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, c
 	return conn, nil
 }
 
-func dialFakeTCPPassive(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, mtu int) (*FakeTCPConn, error) {
+func dialFakeTCPPassive(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, isClient bool, crypt crypto.Crypt, obfuscator obfs.Obfuscator, fingerprint Fingerprint, mtu int) (*FakeTCPConn, error) {
+	srcIPAddr := srcDev.IPAddrTo(dstAddr.IP)
+	if srcIPAddr == nil {
+		return nil, fmt.Errorf("missing address to %s", dstAddr.IP)
+	}
 	srcAddr := &net.TCPAddr{
-		IP:   srcDev.IPAddr().IP,
+		IP:   srcIPAddr.IP,
 		Port: int(srcPort),
 	}
 
@@ -115,7 +166,19 @@ func dialFakeTCPPassive(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCP
 		return nil, fmt.Errorf("parse filter %s: %w", dstIP, err)
 	}
 
-	rawConn, err := CreateRawConn(srcDev, dstDev, fmt.Sprintf("ip && ((tcp && dst port %d && %s) || ((ip[6:2] & 0x1fff) != 0 && %s))", srcAddr.Port, filter, filter2))
+	// Segments in IPv6 are never fragmented
+	f := fmt.Sprintf("ip && ((tcp && dst port %d && %s) || ((ip[6:2] & 0x1fff) != 0 && %s))", srcAddr.Port, filter, filter2)
+	if dstAddr.IP.To4() == nil {
+		f = fmt.Sprintf("ip6 && tcp && dst port %d && %s", srcAddr.Port, filter)
+	}
+
+	// Peers of clients are servers
+	role := RoleClient
+	if isClient {
+		role = RoleServer
+	}
+
+	rawConn, err := createTunnelEndpoint(srcDev, dstDev, f, role)
 	if err != nil {
 		return nil, fmt.Errorf("create raw connection: %w", err)
 	}
@@ -123,21 +186,24 @@ func dialFakeTCPPassive(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCP
 	conn := newConn()
 	conn.srcPort = srcPort
 	conn.dstAddr = dstAddr
+	conn.isClient = isClient
 	conn.crypt = crypt
+	conn.obfs = obfuscator
+	conn.fingerprint = fingerprint
 	conn.mtu = mtu
 	conn.conn = rawConn
 
 	return conn, nil
 }
 
-func listenFakeTCPMulticast(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, mtu int) (*FakeTCPConn, error) {
+func listenFakeTCPMulticast(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, obfuscator obfs.Obfuscator, fingerprint Fingerprint, mtu int) (*FakeTCPConn, error) {
 	addrs := make([]*net.TCPAddr, 0)
 	for _, ip := range srcDev.IPAddrs() {
 		addrs = append(addrs, &net.TCPAddr{IP: ip.IP, Port: int(srcPort)})
 	}
 	srcAddrs := addr.MultiTCPAddr{Addrs: addrs}
 
-	rawConn, err := CreateRawConn(srcDev, dstDev, fmt.Sprintf("tcp && dst port %d", srcPort))
+	rawConn, err := createTunnelEndpoint(srcDev, dstDev, fmt.Sprintf("tcp && dst port %d", srcPort), RoleClient)
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -150,6 +216,8 @@ func listenFakeTCPMulticast(srcDev, dstDev *Device, srcPort uint16, crypt crypto
 	conn := newConn()
 	conn.srcPort = srcPort
 	conn.crypt = crypt
+	conn.obfs = obfuscator
+	conn.fingerprint = fingerprint
 	conn.mtu = mtu
 	conn.conn = rawConn
 
@@ -180,7 +248,7 @@ func (c *FakeTCPConn) handshakeSYN() error {
 		// Initial TCP Seq
 		client = &clientIndicator{
 			crypt: c.crypt,
-			seq:   0,
+			seq:   rand.Uint32(),
 		}
 
 		// Map client
@@ -188,18 +256,29 @@ func (c *FakeTCPConn) handshakeSYN() error {
 		c.clients[c.RemoteAddr().String()] = client
 		c.clientsLock.Unlock()
 	}
+	client.isObfuscated = false
 
 	// Create layers
-	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(c.dstAddr.Port), client.seq, client.ack, c.conn, c.dstAddr.IP, c.id, 128, c.RemoteDev().HardwareAddr())
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(c.dstAddr.Port), client.seq, client.ack, c.conn, c.dstAddr.IP, c.id, c.fingerprint.Hop(), c.RemoteDev().HardwareAddr())
 	if err != nil {
 		return err
 	}
 
 	// Make TCP layer SYN
 	FlagTCPLayer(transportLayer.(*layers.TCP), true, false, false)
+	c.fingerprintLayers(transportLayer, networkLayer, client)
+
+	// Session
+	var payload []byte
+	if c.session != nil {
+		payload, err = client.crypt.Encrypt(createSession(c.session, time.Now()))
+		if err != nil {
+			return fmt.Errorf("encrypt: %w", err)
+		}
+	}
 
 	// Serialize layers
-	data, err := Serialize(linkLayer, networkLayer, transportLayer)
+	data, err := Serialize(linkLayer, networkLayer, transportLayer, gopacket.Payload(payload))
 	if err != nil {
 		return fmt.Errorf("serialize: %w", err)
 	}
@@ -211,7 +290,7 @@ func (c *FakeTCPConn) handshakeSYN() error {
 	}
 
 	// TCP Seq
-	client.seq++
+	client.seq = client.seq + uint32(len(payload)) + 1
 
 	// IPv4 Id
 	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
@@ -246,7 +325,7 @@ func (c *FakeTCPConn) handshakeSYNACK(indicator *PacketIndicator) error {
 		// Initial TCP Seq
 		client = &clientIndicator{
 			crypt: c.crypt,
-			seq:   0,
+			seq:   rand.Uint32(),
 		}
 
 		// Map client
@@ -254,16 +333,20 @@ func (c *FakeTCPConn) handshakeSYNACK(indicator *PacketIndicator) error {
 		c.clients[indicator.Src().String()] = client
 		c.clientsLock.Unlock()
 	}
-	client.ack = indicator.TCPLayer().Seq + 1
+	client.ack = indicator.TCPLayer().Seq + uint32(len(indicator.Payload())) + 1
+	client.isObfuscated = false
+	client.pending = nil
+	client.tsEcr, client.isTimestamp = ParseTimestamp(indicator.TCPLayer())
 
 	// Create layers
-	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.seq, client.ack, c.conn, indicator.SrcIP(), c.id, 64, indicator.SrcHardwareAddr())
+	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.seq, client.ack, c.conn, indicator.SrcIP(), c.id, c.fingerprint.Hop(), indicator.SrcHardwareAddr())
 	if err != nil {
 		return fmt.Errorf("create layers: %w", err)
 	}
 
 	// Make TCP layer SYN & ACK
 	FlagTCPLayer(newTransportLayer.(*layers.TCP), true, false, true)
+	c.fingerprintLayers(newTransportLayer, newNetworkLayer, client)
 
 	// Serialize layers
 	data, err := Serialize(newLinkLayer, newNetworkLayer, newTransportLayer)
@@ -315,15 +398,17 @@ func (c *FakeTCPConn) handshakeACK(indicator *PacketIndicator) error {
 
 	// TCP Ack
 	client.ack = indicator.TCPLayer().Seq + 1
+	client.tsEcr, client.isTimestamp = ParseTimestamp(indicator.TCPLayer())
 
 	// Create layers
-	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.seq, client.ack, c.conn, indicator.SrcIP(), c.id, 128, indicator.SrcHardwareAddr())
+	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.seq, client.ack, c.conn, indicator.SrcIP(), c.id, c.fingerprint.Hop(), indicator.SrcHardwareAddr())
 	if err != nil {
 		return fmt.Errorf("create layers: %w", err)
 	}
 
 	// Make TCP layer ACK
 	FlagTCPLayer(newTransportLayer.(*layers.TCP), false, false, true)
+	c.fingerprintLayers(newTransportLayer, newNetworkLayer, client)
 
 	// Serialize layers
 	data, err := Serialize(newLinkLayer, newNetworkLayer, newTransportLayer)
@@ -351,6 +436,200 @@ func (c *FakeTCPConn) handshakeACK(indicator *PacketIndicator) error {
 	return nil
 }
 
+func (c *FakeTCPConn) handshakeFIN() error {
+	var (
+		transportLayer gopacket.SerializableLayer
+		networkLayer   gopacket.SerializableLayer
+		linkLayer      gopacket.SerializableLayer
+	)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Client
+	c.clientsLock.RLock()
+	client, ok := c.clients[c.RemoteAddr().String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("client %s unrecognized", c.RemoteAddr().String())
+	}
+
+	// Create layers
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(c.dstAddr.Port), client.seq, client.ack, c.conn, c.dstAddr.IP, c.id, c.fingerprint.Hop(), c.RemoteDev().HardwareAddr())
+	if err != nil {
+		return err
+	}
+
+	// Make TCP layer FIN & ACK
+	FlagTCPLayer(transportLayer.(*layers.TCP), false, false, true)
+	transportLayer.(*layers.TCP).FIN = true
+	c.fingerprintLayers(transportLayer, networkLayer, client)
+
+	// Serialize layers
+	data, err := Serialize(linkLayer, networkLayer, transportLayer)
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	// Write packet data
+	_, err = c.conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// TCP Seq
+	client.seq++
+
+	// IPv4 Id
+	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
+		c.id++
+	}
+
+	srcAddr := &net.TCPAddr{
+		IP:   c.LocalDev().IPAddr().IP,
+		Port: int(c.srcPort),
+	}
+	log.Verbosef("Send TCP FIN: %s -> %s\n", srcAddr.String(), c.RemoteAddr().String())
+
+	return nil
+}
+
+func (c *FakeTCPConn) handshakeFINACK(indicator *PacketIndicator) error {
+	var (
+		err               error
+		newTransportLayer gopacket.SerializableLayer
+		newNetworkLayer   gopacket.SerializableLayer
+		newLinkLayer      gopacket.SerializableLayer
+	)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Client
+	c.clientsLock.RLock()
+	client, ok := c.clients[indicator.Src().String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("client %s unauthorized", indicator.Src().String())
+	}
+
+	// TCP Ack
+	client.ack = indicator.TCPLayer().Seq + uint32(len(indicator.Payload())) + 1
+
+	// Create layers
+	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.seq, client.ack, c.conn, indicator.SrcIP(), c.id, c.fingerprint.Hop(), indicator.SrcHardwareAddr())
+	if err != nil {
+		return fmt.Errorf("create layers: %w", err)
+	}
+
+	// Make TCP layer FIN & ACK
+	FlagTCPLayer(newTransportLayer.(*layers.TCP), false, false, true)
+	newTransportLayer.(*layers.TCP).FIN = true
+	c.fingerprintLayers(newTransportLayer, newNetworkLayer, client)
+
+	// Serialize layers
+	data, err := Serialize(newLinkLayer, newNetworkLayer, newTransportLayer)
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	// Write packet data
+	_, err = c.conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// TCP Seq
+	client.seq++
+
+	// IPv4 Id
+	if newNetworkLayer.LayerType() == layers.LayerTypeIPv4 {
+		c.id++
+	}
+
+	srcAddr := &net.TCPAddr{
+		IP:   c.LocalDev().IPAddr().IP,
+		Port: int(indicator.DstPort()),
+	}
+	log.Verbosef("Send TCP FIN+ACK: %s <- %s\n", indicator.Src().String(), srcAddr.String())
+
+	return nil
+}
+
+// fingerprintLayers applies the fingerprint of the connection to the layers.
+func (c *FakeTCPConn) fingerprintLayers(transportLayer, networkLayer gopacket.SerializableLayer, client *clientIndicator) {
+	// Timestamps in milliseconds
+	tsVal := c.tsBase + uint32(time.Now().Sub(c.tsTime).Milliseconds())
+
+	switch networkLayer := networkLayer.(type) {
+	case *layers.IPv4:
+		FingerprintLayers(transportLayer.(*layers.TCP), networkLayer, c.fingerprint, uint16(c.mtu-40), client.isTimestamp, tsVal, client.tsEcr)
+	case *layers.IPv6:
+		FingerprintLayers(transportLayer.(*layers.TCP), nil, c.fingerprint, uint16(c.mtu-60), client.isTimestamp, tsVal, client.tsEcr)
+	}
+}
+
+// obfuscate sends the request of the obfuscator to the server as a client, or the response to the client as a server.
+// The caller must hold the lock.
+func (c *FakeTCPConn) obfuscate(client *clientIndicator, dstIP net.IP, dstPort uint16, dstHardwareAddr net.HardwareAddr) error {
+	var data []byte
+	if c.isClient {
+		data = c.obfs.Request()
+	} else {
+		data = c.obfs.Response()
+	}
+	if data == nil {
+		client.isObfuscated = true
+
+		return nil
+	}
+
+	// Create layers
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, dstPort, client.seq, client.ack, c.conn, dstIP, c.id, c.fingerprint.Hop(), dstHardwareAddr)
+	if err != nil {
+		return fmt.Errorf("create layers: %w", err)
+	}
+	c.fingerprintLayers(transportLayer, networkLayer, client)
+
+	// Serialize layers
+	packet, err := Serialize(linkLayer, networkLayer, transportLayer, gopacket.Payload(data))
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	// Write packet data
+	_, err = c.conn.Write(packet)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// TCP Seq
+	client.seq = client.seq + uint32(len(data))
+
+	// IPv4 Id
+	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
+		c.id++
+	}
+
+	client.isObfuscated = true
+
+	srcAddr := &net.TCPAddr{
+		IP:   c.LocalDev().IPAddr().IP,
+		Port: int(c.srcPort),
+	}
+	dstAddr := &net.TCPAddr{
+		IP:   dstIP,
+		Port: int(dstPort),
+	}
+	if c.isClient {
+		log.Verbosef("Send %s obfuscation request: %s -> %s\n", c.obfs.Method(), srcAddr.String(), dstAddr.String())
+	} else {
+		log.Verbosef("Send %s obfuscation response: %s <- %s\n", c.obfs.Method(), dstAddr.String(), srcAddr.String())
+	}
+
+	return nil
+}
+
 func (c *FakeTCPConn) Write(b []byte) (n int, err error) {
 	return c.WriteTo(b, c.RemoteAddr())
 }
@@ -402,11 +681,15 @@ type tuple struct {
 
 	tu := <-ch
 	if tu.err != nil {
+		if c.isClosed.Load() {
+			return 0, nil, io.EOF
+		}
+
 		return 0, nil, &net.OpError{
 			Op:     "read",
 			Net:    "pcap",
 			Source: c.LocalAddr(),
-			Err:    err,
+			Err:    tu.err,
 		}
 	}
 
@@ -451,6 +734,28 @@ type tuple struct {
 		}
 		if indicator.IsFIN() {
 			log.Infof("Receive TCP FIN: %s <- %s\n", indicator.Dst().String(), addr.String())
+
+			// Forget the client in multicast
+			if c.dstAddr == nil {
+				c.clientsLock.Lock()
+				delete(c.clients, addr.String())
+				c.clientsLock.Unlock()
+
+				return 0, addr, nil
+			}
+
+			err := c.finish(indicator)
+			if err != nil {
+				return 0, addr, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   addr,
+					Err:    fmt.Errorf("finish: %w", err),
+				}
+			}
+
+			return 0, addr, io.EOF
 		}
 	}
 
@@ -461,15 +766,15 @@ type tuple struct {
 			if indicator.IsACK() {
 				log.Verbosef("Receive TCP SYN+ACK: %s <- %s\n", indicator.Dst().String(), addr.String())
 
-				if !c.isConnected {
+				if !c.isConnected.Load() {
 					t := time.Now()
 					duration := t.Sub(c.appear)
 
 					log.Infof("Connected to server %s in %.3f ms (RTT)\n", addr.String(), float64(duration.Microseconds())/1000)
 
-					c.isConnected = true
+					c.isConnected.Store(true)
 				}
-				c.isReconnected = true
+				c.isReconnected.Store(true)
 
 				err = c.handshakeACK(indicator)
 			} else {
@@ -511,10 +816,47 @@ type tuple struct {
 
 	// TCP Ack, always use the expected one
 	if indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
+		tsVal, ok := ParseTimestamp(indicator.TCPLayer())
+		if ok {
+			client.tsEcr = tsVal
+		}
+
 		expectedAck := indicator.TCPLayer().Seq + uint32(len(indicator.Payload()))
 		if expectedAck > client.ack || (math.MaxUint32-indicator.TCPLayer().Seq < uint32(len(indicator.Payload()))) {
 			client.ack = expectedAck
 		}
+
+		// Obfuscation
+		if c.isClient && c.obfs.IsResponse(indicator.Payload()) {
+			log.Verbosef("Receive %s obfuscation response: %s <- %s\n", c.obfs.Method(), indicator.Dst().String(), addr.String())
+
+			return 0, addr, nil
+		}
+		if !c.isClient && c.obfs.IsRequest(indicator.Payload()) {
+			log.Verbosef("Receive %s obfuscation request: %s -> %s\n", c.obfs.Method(), addr.String(), indicator.Dst().String())
+
+			c.lock.Lock()
+			if !client.isObfuscated {
+				err = c.obfuscate(client, indicator.SrcIP(), indicator.SrcPort(), indicator.SrcHardwareAddr())
+			}
+			// Payloads queued are sent behind the response
+			for err == nil && len(client.pending) > 0 {
+				err = c.writePayload(client, indicator.SrcIP(), indicator.SrcPort(), client.pending[0])
+				client.pending = client.pending[1:]
+			}
+			c.lock.Unlock()
+			if err != nil {
+				return 0, addr, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   addr,
+					Err:    fmt.Errorf("obfuscate: %w", err),
+				}
+			}
+
+			return 0, addr, nil
+		}
 	}
 
 	// Decrypt
@@ -560,13 +902,6 @@ func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	}
 
 	go func() {
-		var (
-			transportLayer gopacket.SerializableLayer
-			networkLayer   gopacket.SerializableLayer
-			linkLayer      gopacket.SerializableLayer
-			fragments      [][]byte
-		)
-
 		c.lock.Lock()
 		defer c.lock.Unlock()
 
@@ -579,47 +914,31 @@ func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 			return
 		}
 
-		// Create layers
-		transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, dstPort, client.seq, client.ack, c.conn, dstIP, c.id, 128, c.conn.RemoteDev().HardwareAddr())
-		if err != nil {
-			ch <- fmt.Errorf("create layers: %w", err)
-			return
-		}
-
-		// Encrypt
-		contents, err := client.crypt.Encrypt(p)
-		if err != nil {
-			ch <- fmt.Errorf("encrypt: %w", err)
-			return
-		}
+		// Obfuscate
+		if !client.isObfuscated {
+			// The server responds only after the request of the client, so payloads before are queued
+			if !c.isClient && c.obfs.Request() != nil {
+				if len(client.pending) >= obfuscationQueue {
+					ch <- errors.New("obfuscation request not received")
+					return
+				}
+				client.pending = append(client.pending, append([]byte{}, p...))
 
-		// Fragment
-		fragments, err = CreateFragmentPackets(linkLayer.(gopacket.Layer), networkLayer.(gopacket.Layer), transportLayer.(gopacket.Layer), contents, c.mtu)
-		if err != nil {
-			ch <- fmt.Errorf("fragment: %w", err)
-			return
-		}
+				ch <- nil
+				return
+			}
 
-		// Write packet data
-		for _, frag := range fragments {
-			_, err := c.conn.Write(frag)
+			err := c.obfuscate(client, dstIP, dstPort, c.conn.RemoteDev().HardwareAddr())
 			if err != nil {
-				ch <- fmt.Errorf("write: %w", err)
+				ch <- fmt.Errorf("obfuscate: %w", err)
 				return
 			}
 		}
 
-		// TCP Seq
-		client.seq = client.seq + uint32(len(contents))
-
-		// IPv4 Id
-		if networkLayer.LayerType() == layers.LayerTypeIPv4 {
-			switch transportLayer.LayerType() {
-			case layers.LayerTypeTCP:
-				c.id = c.id + uint16(len(fragments))
-			default:
-				c.id++
-			}
+		err := c.writePayload(client, dstIP, dstPort, p)
+		if err != nil {
+			ch <- err
+			return
 		}
 
 		ch <- nil
@@ -650,8 +969,105 @@ func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	return len(p), nil
 }
 
+// writePayload encrypts and writes the payload to the client. The caller must hold the lock.
+func (c *FakeTCPConn) writePayload(client *clientIndicator, dstIP net.IP, dstPort uint16, p []byte) error {
+	// Create layers
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, dstPort, client.seq, client.ack, c.conn, dstIP, c.id, c.fingerprint.Hop(), c.conn.RemoteDev().HardwareAddr())
+	if err != nil {
+		return fmt.Errorf("create layers: %w", err)
+	}
+	c.fingerprintLayers(transportLayer, networkLayer, client)
+
+	// Encrypt
+	contents, err := client.crypt.Encrypt(p)
+	if err != nil {
+		return fmt.Errorf("encrypt: %w", err)
+	}
+
+	// Fragment
+	fragments, err := CreateFragmentPackets(linkLayer.(gopacket.Layer), networkLayer.(gopacket.Layer), transportLayer.(gopacket.Layer), contents, c.mtu)
+	if err != nil {
+		return fmt.Errorf("fragment: %w", err)
+	}
+
+	// Write packet data
+	for _, frag := range fragments {
+		_, err := c.conn.Write(frag)
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+
+	// TCP Seq
+	client.seq = client.seq + uint32(len(contents))
+
+	// IPv4 Id
+	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
+		switch transportLayer.LayerType() {
+		case layers.LayerTypeTCP:
+			c.id = c.id + uint16(len(fragments))
+		default:
+			c.id++
+		}
+	}
+
+	return nil
+}
+
+// finish responds the TCP FIN from the remote. If the remote closes the connection first, the connection will be closed.
+func (c *FakeTCPConn) finish(indicator *PacketIndicator) error {
+	if c.isClosing.Load() {
+		// Response of the TCP FIN sent
+		err := c.handshakeACK(indicator)
+
+		select {
+		case c.finished <- struct{}{}:
+		default:
+		}
+
+		return err
+	}
+
+	err := c.handshakeFINACK(indicator)
+
+	c.isClosed.Store(true)
+	if c.listener != nil {
+		c.listener.remove(c)
+	}
+	e := c.conn.Close()
+	if err == nil {
+		err = e
+	}
+
+	return err
+}
+
+// Close closes the connection. A TCP FIN will be sent to the remote, and the connection will be closed once the remote
+// responds or after a while.
 func (c *FakeTCPConn) Close() error {
-	c.isClosed = true
+	// Only one close performs the finishing
+	if c.isClosed.Load() || !c.isClosing.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	if c.dstAddr != nil && (!c.isClient || c.isConnected.Load()) {
+
+		err := c.handshakeFIN()
+		if err != nil {
+			log.Verboseln(fmt.Errorf("close %s: %w", c.RemoteAddr(), err))
+		} else {
+			select {
+			case <-c.finished:
+			case <-time.After(finishDeadline):
+				log.Verbosef("Cannot receive TCP FIN from %s, close anyway\n", c.RemoteAddr())
+			}
+		}
+	}
+
+	c.isClosed.Store(true)
+	if c.listener != nil {
+		c.listener.remove(c)
+	}
 
 	err := c.conn.Close()
 	if err != nil {
@@ -672,6 +1088,10 @@ func (c *FakeTCPConn) LocalDev() *Device {
 }
 
 func (c *FakeTCPConn) LocalAddr() net.Addr {
+	if c.dstAddr != nil {
+		return &net.UDPAddr{IP: c.LocalDev().IPAddrTo(c.dstAddr.IP).IP, Port: int(c.srcPort)}
+	}
+
 	return &net.UDPAddr{IP: c.LocalDev().IPAddr().IP, Port: int(c.srcPort)}
 }
 
@@ -715,7 +1135,7 @@ func (c *FakeTCPConn) SetWriteDeadline(t time.Time) error {
 
 // Reconnect reconnects the connection by sending TCP SYN.
 func (c *FakeTCPConn) Reconnect() error {
-	c.isReconnected = false
+	c.isReconnected.Store(false)
 
 	err := c.handshakeSYN()
 	if err != nil {
@@ -725,7 +1145,7 @@ func (c *FakeTCPConn) Reconnect() error {
 	go func() {
 		time.Sleep(establishDeadline)
 
-		if !c.isReconnected {
+		if !c.isReconnected.Load() {
 			log.Errorf("Cannot receive response from server %s, is it down?\n", c.RemoteAddr().String())
 		}
 	}()
@@ -733,24 +1153,68 @@ func (c *FakeTCPConn) Reconnect() error {
 	return nil
 }
 
+// IsConnected returns if the connection has received the response of the handshake from the server.
+func (c *FakeTCPConn) IsConnected() bool {
+	return c.isConnected.Load()
+}
+
+// IsReconnected returns if the connection has received the response of the last reconnection from the server.
+func (c *FakeTCPConn) IsReconnected() bool {
+	return c.isReconnected.Load()
+}
+
+// Session returns the session of the client and the time it is sent in the handshake, or nil if the client is not in a
+// session.
+func (c *FakeTCPConn) Session() ([]byte, time.Time) {
+	return c.session, c.sessionTime
+}
+
+func createSession(session []byte, t time.Time) []byte {
+	b := make([]byte, SessionSize+8)
+	copy(b, session)
+	binary.BigEndian.PutUint64(b[SessionSize:], uint64(t.UnixNano()))
+
+	return b
+}
+
+func parseSession(b []byte) ([]byte, time.Time, error) {
+	if len(b) != SessionSize+8 {
+		return nil, time.Time{}, errors.New("invalid session")
+	}
+
+	session := make([]byte, SessionSize)
+	copy(session, b[:SessionSize])
+
+	return session, time.Unix(0, int64(binary.BigEndian.Uint64(b[SessionSize:]))), nil
+}
+
 // FakeTCPListener is a pcap network listener in FakeTCP network.
 type FakeTCPListener struct {
-	conn    *RawConn
-	srcPort uint16
-	crypt   crypto.Crypt
-	mtu     int
-	clients map[string]net.Conn
+	conn        Endpoint
+	srcPort     uint16
+	endPort     uint16
+	crypt       crypto.Crypt
+	obfs        obfs.Obfuscator
+	fingerprint Fingerprint
+	mtu         int
+	clientsLock sync.Mutex
+	clients     map[string]net.Conn
 }
 
 // ListenFakeTCP announces on the local network address in FakeTCP network.
-func ListenFakeTCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, mtu int) (*FakeTCPListener, error) {
+func ListenFakeTCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, obfuscator obfs.Obfuscator, fingerprint Fingerprint, mtu int) (*FakeTCPListener, error) {
+	return ListenFakeTCPRange(srcDev, dstDev, srcPort, srcPort, crypt, obfuscator, fingerprint, mtu)
+}
+
+// ListenFakeTCPRange announces on the local network addresses in a port range in FakeTCP network.
+func ListenFakeTCPRange(srcDev, dstDev *Device, srcPort, endPort uint16, crypt crypto.Crypt, obfuscator obfs.Obfuscator, fingerprint Fingerprint, mtu int) (*FakeTCPListener, error) {
 	addrs := make([]*net.TCPAddr, 0)
 	for _, ip := range srcDev.IPAddrs() {
 		addrs = append(addrs, &net.TCPAddr{IP: ip.IP, Port: int(srcPort)})
 	}
 	srcAddrs := addr.MultiTCPAddr{Addrs: addrs}
 
-	conn, err := CreateRawConn(srcDev, dstDev, fmt.Sprintf("tcp && tcp[tcpflags] & tcp-syn != 0 && dst port %d", srcPort))
+	conn, err := createTunnelEndpoint(srcDev, dstDev, fmt.Sprintf("tcp && tcp[tcpflags] & tcp-syn != 0 && dst portrange %d-%d", srcPort, endPort), RoleClient)
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -761,11 +1225,14 @@ func ListenFakeTCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, m
 	}
 
 	listener := &FakeTCPListener{
-		conn:    conn,
-		srcPort: srcPort,
-		crypt:   crypt,
-		mtu:     mtu,
-		clients: make(map[string]net.Conn),
+		conn:        conn,
+		srcPort:     srcPort,
+		endPort:     endPort,
+		crypt:       crypt,
+		obfs:        obfuscator,
+		fingerprint: fingerprint,
+		mtu:         mtu,
+		clients:     make(map[string]net.Conn),
 	}
 
 	return listener, nil
@@ -793,13 +1260,21 @@ func (l *FakeTCPListener) Accept() (net.Conn, error) {
 		}
 	}
 
-	_, ok := l.clients[indicator.Src().String()]
-	if ok {
+	l.clientsLock.Lock()
+	client, ok := l.clients[indicator.Src().String()]
+	l.clientsLock.Unlock()
+	if ok && !client.(*FakeTCPConn).isClosed.Load() {
 		// Duplicate
 		return nil, nil
 	}
 
-	conn, err := dialFakeTCPPassive(l.Dev(), l.conn.RemoteDev(), l.srcPort, indicator.Src().(*net.TCPAddr), l.crypt, l.mtu)
+	// The gateway in IPv6 may differ from the one in IPv4, so replies follow the way the client comes
+	dstDev := l.conn.RemoteDev()
+	if indicator.SrcIP().To4() == nil && !dstDev.IsLoop() {
+		dstDev = &Device{alias: "Gateway", hardwareAddr: indicator.SrcHardwareAddr()}
+	}
+
+	conn, err := dialFakeTCPPassive(l.Dev(), dstDev, indicator.DstPort(), indicator.Src().(*net.TCPAddr), false, l.crypt, l.obfs, l.fingerprint, l.mtu)
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -812,10 +1287,21 @@ func (l *FakeTCPListener) Accept() (net.Conn, error) {
 
 	conn.clients[indicator.Src().String()] = &clientIndicator{
 		crypt: l.crypt,
-		seq:   0,
+		seq:   rand.Uint32(),
 		ack:   0,
 	}
 
+	// Session
+	if len(indicator.Payload()) > 0 {
+		contents, err := l.crypt.Decrypt(indicator.Payload())
+		if err == nil {
+			conn.session, conn.sessionTime, err = parseSession(contents)
+		}
+		if err != nil {
+			log.Verboseln(fmt.Errorf("accept %s: %w", indicator.Src(), fmt.Errorf("parse session: %w", err)))
+		}
+	}
+
 	// Handshaking with client (SYN+ACK)
 	err = conn.handshakeSYNACK(indicator)
 	if err != nil {
@@ -829,11 +1315,23 @@ func (l *FakeTCPListener) Accept() (net.Conn, error) {
 	}
 
 	// Map client
+	conn.listener = l
+	l.clientsLock.Lock()
 	l.clients[indicator.Src().String()] = conn
+	l.clientsLock.Unlock()
 
 	return conn, nil
 }
 
+func (l *FakeTCPListener) remove(conn *FakeTCPConn) {
+	l.clientsLock.Lock()
+	defer l.clientsLock.Unlock()
+
+	if l.clients[conn.RemoteAddr().String()] == conn {
+		delete(l.clients, conn.RemoteAddr().String())
+	}
+}
+
 func (l *FakeTCPListener) Close() error {
 	err := l.conn.Close()
 	if err != nil {
@@ -861,8 +1359,8 @@ func (l *FakeTCPListener) Addr() net.Addr {
 }
 
 // DialFakeTCPWithKCP connects to the remote address in the FakeTCP network with KCP support.
-func DialFakeTCPWithKCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, mtu int, config *config.KCPConfig) (*kcp.UDPSession, error) {
-	conn, err := DialFakeTCP(srcDev, dstDev, srcPort, dstAddr, crypt, mtu)
+func DialFakeTCPWithKCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, obfuscator obfs.Obfuscator, fingerprint Fingerprint, mtu int, config *config.KCPConfig) (*kcp.UDPSession, error) {
+	conn, err := DialFakeTCP(srcDev, dstDev, srcPort, dstAddr, crypt, obfuscator, fingerprint, mtu)
 	if err != nil {
 		return nil, err
 	}
@@ -895,8 +1393,8 @@ func DialFakeTCPWithKCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCP
 }
 
 // ListenFakeTCPWithKCP listens for incoming packets addressed to the local address in the FakeTCP network with KCP support.
-func ListenFakeTCPWithKCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, mtu int, config *config.KCPConfig) (*kcp.Listener, error) {
-	conn, err := listenFakeTCPMulticast(srcDev, dstDev, srcPort, crypt, mtu)
+func ListenFakeTCPWithKCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, obfuscator obfs.Obfuscator, fingerprint Fingerprint, mtu int, config *config.KCPConfig) (*kcp.Listener, error) {
+	conn, err := listenFakeTCPMulticast(srcDev, dstDev, srcPort, crypt, obfuscator, fingerprint, mtu)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,415 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/klauspost/reedsolomon"
+	"github.com/zhxie/ikago/internal/log"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	fecTypeData   = 0
+	fecTypeParity = 1
+)
+
+// fecHeaderSize is the size of the header of a packet in FEC, which contains the type, the group, the index in the
+// group, and the number of data and parity shards in the group.
+const fecHeaderSize = 6
+
+// fecFlushTimeout is the time after which parity shards of an incomplete group will be sent.
+const fecFlushTimeout = 20 * time.Millisecond
+
+// fecGroupTimeout is the time after which a group will be dropped by the receiver.
+const fecGroupTimeout = 1 * time.Second
+
+type fecGroup struct {
+	shards [][]byte
+	data   int
+	parity int
+	recv   int
+	done   bool
+	t      time.Time
+}
+
+// FECConn is a connection which sends Reed-Solomon parity shards after every group of packets, so lost packets can be
+// recovered by the receiver without retransmission.
+type FECConn struct {
+	conn      net.Conn
+	group     int
+	parity    int
+	encoders  map[[2]int]reedsolomon.Encoder
+	writeLock sync.Mutex
+	id        uint16
+	shards    [][]byte
+	timer     *time.Timer
+	readLock  sync.Mutex
+	groups    map[uint16]*fecGroup
+	recovered [][]byte
+	buffer    []byte
+}
+
+// NewFECConn returns a connection with FEC over the given connection. A parity shard will be sent for every group of
+// packets in the ratio.
+func NewFECConn(conn net.Conn, group int, ratio float64) (*FECConn, error) {
+	if group <= 0 || group > 128 {
+		return nil, fmt.Errorf("group %d out of range", group)
+	}
+	if ratio <= 0 || ratio > 1 {
+		return nil, fmt.Errorf("parity ratio %f out of range", ratio)
+	}
+
+	return &FECConn{
+		conn:     conn,
+		group:    group,
+		parity:   fecParity(group, ratio),
+		encoders: make(map[[2]int]reedsolomon.Encoder),
+		groups:   make(map[uint16]*fecGroup),
+		buffer:   make([]byte, IPv4MaxSize),
+	}, nil
+}
+
+func fecParity(data int, ratio float64) int {
+	return int(math.Ceil(float64(data) * ratio))
+}
+
+func (c *FECConn) encoder(data, parity int) (reedsolomon.Encoder, error) {
+	key := [2]int{data, parity}
+
+	enc, ok := c.encoders[key]
+	if !ok {
+		var err error
+
+		enc, err = reedsolomon.New(data, parity)
+		if err != nil {
+			return nil, err
+		}
+
+		c.encoders[key] = enc
+	}
+
+	return enc, nil
+}
+
+// Read reads a packet from the connection. Recovered packets will be read before new packets.
+func (c *FECConn) Read(b []byte) (n int, err error) {
+	for {
+		c.readLock.Lock()
+		if len(c.recovered) > 0 {
+			contents := c.recovered[0]
+			c.recovered = c.recovered[1:]
+			c.readLock.Unlock()
+
+			copy(b, contents)
+
+			return len(contents), nil
+		}
+		c.readLock.Unlock()
+
+		n, err := c.conn.Read(c.buffer)
+		if err != nil {
+			return 0, err
+		}
+		if n <= 0 {
+			return 0, nil
+		}
+
+		contents, err := c.handle(c.buffer[:n])
+		if err != nil {
+			log.Verboseln(fmt.Errorf("read %s: %w", c.RemoteAddr(), err))
+			continue
+		}
+		if contents == nil {
+			continue
+		}
+
+		copy(b, contents)
+
+		return len(contents), nil
+	}
+}
+
+// handle records the shard in its group, and returns the contents if it is a data shard. Lost data shards will be
+// recovered once enough shards of the group are received.
+func (c *FECConn) handle(d []byte) ([]byte, error) {
+	if len(d) < fecHeaderSize {
+		return nil, errors.New("missing header")
+	}
+
+	t := d[0]
+	id := binary.BigEndian.Uint16(d[1:3])
+	index := int(d[3])
+	data, parity := int(d[4]), int(d[5])
+	payload := d[fecHeaderSize:]
+
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	now := time.Now()
+
+	group, ok := c.groups[id]
+	if !ok || now.Sub(group.t) > fecGroupTimeout {
+		// Drop expired groups
+		for id, group := range c.groups {
+			if now.Sub(group.t) > fecGroupTimeout {
+				delete(c.groups, id)
+			}
+		}
+
+		group = &fecGroup{
+			shards: make([][]byte, 256),
+			t:      now,
+		}
+		c.groups[id] = group
+	}
+
+	var contents []byte
+
+	switch t {
+	case fecTypeData:
+		if group.shards[index] != nil {
+			// Duplicate
+			return nil, nil
+		}
+
+		shard := make([]byte, 2+len(payload))
+		binary.BigEndian.PutUint16(shard[0:2], uint16(len(payload)))
+		copy(shard[2:], payload)
+		group.shards[index] = shard
+
+		contents = payload
+	case fecTypeParity:
+		if data <= 0 || parity <= 0 || data+parity > 256 || index < data || index >= data+parity {
+			return nil, fmt.Errorf("shard %d out of %d+%d", index, data, parity)
+		}
+		if group.shards[index] != nil {
+			return nil, nil
+		}
+
+		shard := make([]byte, len(payload))
+		copy(shard, payload)
+		group.shards[index] = shard
+		group.data, group.parity = data, parity
+	default:
+		return nil, fmt.Errorf("type %d not support", t)
+	}
+	group.recv++
+
+	// Recover
+	if group.done || group.data <= 0 || group.recv < group.data {
+		return contents, nil
+	}
+	group.done = true
+
+	err := c.recover(group)
+	if err != nil {
+		return contents, fmt.Errorf("recover: %w", err)
+	}
+
+	return contents, nil
+}
+
+// recover reconstructs lost data shards in the group, and queues them to be read.
+func (c *FECConn) recover(group *fecGroup) error {
+	size := 0
+	for _, shard := range group.shards[group.data : group.data+group.parity] {
+		if shard != nil {
+			size = len(shard)
+			break
+		}
+	}
+
+	shards := make([][]byte, group.data+group.parity)
+	missing := make([]int, 0)
+	for i := range shards {
+		shard := group.shards[i]
+		if shard == nil {
+			if i < group.data {
+				missing = append(missing, i)
+			}
+			continue
+		}
+		if len(shard) > size {
+			return fmt.Errorf("shard %d exceeds %d Bytes", i, size)
+		}
+
+		// Pad
+		padded := make([]byte, size)
+		copy(padded, shard)
+		shards[i] = padded
+	}
+	if len(missing) <= 0 {
+		return nil
+	}
+
+	enc, err := c.encoder(group.data, group.parity)
+	if err != nil {
+		return err
+	}
+
+	err = enc.ReconstructData(shards)
+	if err != nil {
+		return err
+	}
+
+	for _, i := range missing {
+		shard := shards[i]
+		length := int(binary.BigEndian.Uint16(shard[0:2]))
+		if length > len(shard)-2 {
+			return fmt.Errorf("shard %d in length %d out of range", i, length)
+		}
+
+		// Later arrivals are duplicates
+		group.shards[i] = shard[:2+length]
+
+		c.recovered = append(c.recovered, shard[2:2+length])
+	}
+
+	log.Verbosef("Recover %d packets: %s <- %s\n", len(missing), c.LocalAddr(), c.RemoteAddr())
+
+	return nil
+}
+
+// Write writes a packet to the connection. Parity shards will be written once the group is full, or after a while.
+func (c *FECConn) Write(b []byte) (n int, err error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	index := len(c.shards)
+
+	_, err = c.conn.Write(append(createFECHeader(fecTypeData, c.id, uint8(index), 0, 0), b...))
+	if err != nil {
+		return 0, err
+	}
+
+	shard := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(shard[0:2], uint16(len(b)))
+	copy(shard[2:], b)
+	c.shards = append(c.shards, shard)
+
+	if len(c.shards) >= c.group {
+		err = c.flush()
+		if err != nil {
+			return 0, err
+		}
+	} else if index == 0 {
+		id := c.id
+		c.timer = time.AfterFunc(fecFlushTimeout, func() {
+			c.writeLock.Lock()
+			defer c.writeLock.Unlock()
+
+			if c.id != id || len(c.shards) <= 0 {
+				return
+			}
+
+			err := c.flush()
+			if err != nil {
+				log.Verboseln(fmt.Errorf("write %s: %w", c.RemoteAddr(), err))
+			}
+		})
+	}
+
+	return len(b), nil
+}
+
+// flush writes parity shards of the current group and starts a new group. The caller must hold the write lock.
+func (c *FECConn) flush() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+
+	data := len(c.shards)
+	parity := c.parity
+	if data < c.group {
+		parity = fecParity(data, float64(c.parity)/float64(c.group))
+	}
+
+	size := 0
+	for _, shard := range c.shards {
+		if len(shard) > size {
+			size = len(shard)
+		}
+	}
+
+	shards := make([][]byte, data+parity)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		if i < data {
+			copy(shards[i], c.shards[i])
+		}
+	}
+
+	id := c.id
+	c.id++
+	c.shards = nil
+
+	enc, err := c.encoder(data, parity)
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+
+	err = enc.Encode(shards)
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+
+	for i := data; i < data+parity; i++ {
+		_, err = c.conn.Write(append(createFECHeader(fecTypeParity, id, uint8(i), uint8(data), uint8(parity)), shards[i]...))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func createFECHeader(t uint8, id uint16, index, data, parity uint8) []byte {
+	header := make([]byte, fecHeaderSize)
+	header[0] = t
+	binary.BigEndian.PutUint16(header[1:3], id)
+	header[3] = index
+	header[4] = data
+	header[5] = parity
+
+	return header
+}
+
+func (c *FECConn) Close() error {
+	c.writeLock.Lock()
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.writeLock.Unlock()
+
+	return c.conn.Close()
+}
+
+// Conn returns the underlying connection.
+func (c *FECConn) Conn() net.Conn {
+	return c.conn
+}
+
+func (c *FECConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *FECConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *FECConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *FECConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *FECConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
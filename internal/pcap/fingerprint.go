@@ -0,0 +1,164 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// Fingerprint describes the OS which TCP segments imitate.
+type Fingerprint int
+
+const (
+	// FingerprintNone describes TCP segments have no options and a fixed window.
+	FingerprintNone Fingerprint = iota
+	// FingerprintLinux describes TCP segments imitate Linux.
+	FingerprintLinux
+	// FingerprintWindows describes TCP segments imitate Windows.
+	FingerprintWindows
+)
+
+func (fp Fingerprint) String() string {
+	switch fp {
+	case FingerprintNone:
+		return "None"
+	case FingerprintLinux:
+		return "Linux"
+	case FingerprintWindows:
+		return "Windows"
+	default:
+		return strconv.Itoa(int(fp))
+	}
+}
+
+// ParseFingerprint returns a fingerprint by given OS.
+func ParseFingerprint(s string) (Fingerprint, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return FingerprintNone, nil
+	case "linux":
+		return FingerprintLinux, nil
+	case "windows":
+		return FingerprintWindows, nil
+	default:
+		return FingerprintNone, fmt.Errorf("fingerprint %s not support", s)
+	}
+}
+
+// defaultHop is the hop of segments without a fingerprint.
+const defaultHop = 128
+
+// Hop returns the initial hop of segments in the fingerprint.
+func (fp Fingerprint) Hop() uint8 {
+	switch fp {
+	case FingerprintLinux:
+		return 64
+	case FingerprintWindows:
+		return 128
+	default:
+		return defaultHop
+	}
+}
+
+// HasTimestamp returns if the fingerprint uses TCP timestamps.
+func (fp Fingerprint) HasTimestamp() bool {
+	return fp == FingerprintLinux
+}
+
+// FingerprintLayers sets the options and the window of the TCP layer and the flags of the IPv4 layer in the fingerprint.
+// The timestamps will be set if the fingerprint uses timestamps, and they are negotiated or the segment is a SYN. The
+// IPv4 layer is nil in IPv6.
+func FingerprintLayers(tcpLayer *layers.TCP, ipv4Layer *layers.IPv4, fp Fingerprint, mss uint16, isTimestamp bool, tsVal, tsEcr uint32) {
+	if fp == FingerprintNone {
+		return
+	}
+
+	// Don't fragment
+	if ipv4Layer != nil {
+		FlagIPv4Layer(ipv4Layer, true, false, 0)
+	}
+
+	isTimestamp = fp.HasTimestamp() && (isTimestamp || (tcpLayer.SYN && !tcpLayer.ACK))
+
+	// Nothing to echo in SYN
+	if tcpLayer.SYN && !tcpLayer.ACK {
+		tsEcr = 0
+	}
+
+	options := make([]layers.TCPOption, 0)
+	if tcpLayer.SYN {
+		tcpLayer.Window = 64240
+
+		switch fp {
+		case FingerprintLinux:
+			options = append(options, createMSSOption(mss), createSACKPermittedOption())
+			if isTimestamp {
+				options = append(options, createTimestampOption(tsVal, tsEcr))
+			}
+			options = append(options, createNOPOption(), createWindowScaleOption(7))
+		case FingerprintWindows:
+			options = append(options,
+				createMSSOption(mss),
+				createNOPOption(),
+				createWindowScaleOption(8),
+				createNOPOption(),
+				createNOPOption(),
+				createSACKPermittedOption())
+		}
+	} else {
+		switch fp {
+		case FingerprintLinux:
+			// Scaled by 128
+			tcpLayer.Window = uint16(501 + rand.Intn(12))
+			if isTimestamp {
+				options = append(options, createNOPOption(), createNOPOption(), createTimestampOption(tsVal, tsEcr))
+			}
+		case FingerprintWindows:
+			// Scaled by 256
+			tcpLayer.Window = uint16(1020 + rand.Intn(6))
+		}
+	}
+
+	tcpLayer.Options = options
+}
+
+// ParseTimestamp returns the value of the timestamp option in the TCP layer.
+func ParseTimestamp(layer *layers.TCP) (tsVal uint32, ok bool) {
+	for _, option := range layer.Options {
+		if option.OptionType == layers.TCPOptionKindTimestamps && len(option.OptionData) == 8 {
+			return binary.BigEndian.Uint32(option.OptionData[0:4]), true
+		}
+	}
+
+	return 0, false
+}
+
+func createNOPOption() layers.TCPOption {
+	return layers.TCPOption{OptionType: layers.TCPOptionKindNop, OptionLength: 1}
+}
+
+func createMSSOption(mss uint16) layers.TCPOption {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, mss)
+
+	return layers.TCPOption{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: data}
+}
+
+func createWindowScaleOption(scale uint8) layers.TCPOption {
+	return layers.TCPOption{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{scale}}
+}
+
+func createSACKPermittedOption() layers.TCPOption {
+	return layers.TCPOption{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2}
+}
+
+func createTimestampOption(tsVal, tsEcr uint32) layers.TCPOption {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data[0:4], tsVal)
+	binary.BigEndian.PutUint32(data[4:8], tsEcr)
+
+	return layers.TCPOption{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: data}
+}
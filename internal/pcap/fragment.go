@@ -1,6 +1,7 @@
 package pcap
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/google/gopacket"
@@ -8,11 +9,21 @@
 	"github.com/google/gopacket/layers"
 	"github.com/zhxie/ikago/internal/log"
 	"sort"
+	"sync/atomic"
 	"time"
 )
 
+const ipv6FragHeaderLength = 8
+
+var ipv6FragId uint32
+
+// checksumLayer describes a transport layer whose checksum is computed with its network layer.
+type checksumLayer interface {
+	SetNetworkLayerForChecksum(gopacket.NetworkLayer) error
+}
+
 type fragFlow struct {
-	id  uint16
+	id  uint32
 	src string
 }
 
@@ -35,7 +46,7 @@ func (indicator *fragIndicator) append(ind *PacketIndicator) {
 	indicator.lastSeen = time.Now()
 
 	if ind.MoreFragments() {
-		indicator.length = indicator.length + uint16(len(ind.NetworkPayload()))
+		indicator.length = indicator.length + uint16(len(ind.fragPayload()))
 	} else {
 		// Final fragment
 		indicator.offset = ind.FragOffset()
@@ -75,6 +86,13 @@ func (indicator *fragIndicator) concatenate() (*PacketIndicator, error) {
 		newNetworkLayer = &temp
 
 		FlagIPv4Layer(newNetworkLayer.(*layers.IPv4), false, false, 0)
+	case layers.LayerTypeIPv6:
+		ipv6Layer := indicator.frags[0].IPv6Layer()
+		temp := *ipv6Layer
+		newNetworkLayer = &temp
+
+		// Remove the fragment header
+		newNetworkLayer.(*layers.IPv6).NextHeader = indicator.frags[0].IPv6FragmentLayer().NextHeader
 	default:
 		return nil, fmt.Errorf("network layer type %s not support", t)
 	}
@@ -82,7 +100,7 @@ func (indicator *fragIndicator) concatenate() (*PacketIndicator, error) {
 	// Concatenate network payloads
 	contents = make([]byte, 0)
 	for _, frag := range indicator.frags {
-		contents = append(contents, frag.NetworkPayload()...)
+		contents = append(contents, frag.fragPayload()...)
 	}
 
 	// Serialize
@@ -189,7 +207,7 @@ func (defrag *EasyDefragmenter) SetDeadline(t time.Duration) {
 	defrag.deadline = t
 }
 
-// StrictDefragmenter is a machine defragments packets which drops invalid packets.
+// StrictDefragmenter is a machine defragments packets which drops invalid packets, and supports IPv4 only.
 type StrictDefragmenter struct {
 	defragmenter *ip4defrag.IPv4Defragmenter
 	deadline     time.Duration
@@ -204,6 +222,9 @@ func (defrag *StrictDefragmenter) Append(ind *PacketIndicator) (*PacketIndicator
 	if !ind.IsFrag() {
 		return ind, nil
 	}
+	if ind.IPv4Layer() == nil {
+		return nil, errors.New("network layer type not support")
+	}
 
 	// Discard old fragments
 	if defrag.deadline > 0 {
@@ -237,20 +258,57 @@ func (defrag *StrictDefragmenter) SetDeadline(t time.Duration) {
 	defrag.deadline = t
 }
 
+// FragmentPayload returns the network payload of the fragment, whose data is cut from the network payload of the whole
+// packet by the fragment offset.
+func FragmentPayload(frag *PacketIndicator, whole []byte) ([]byte, error) {
+	networkPayload := frag.NetworkPayload()
+	fragPayload := frag.fragPayload()
+
+	offset := int(frag.FragOffset()) * 8
+	if offset+len(fragPayload) > len(whole) {
+		return nil, fmt.Errorf("fragment %d out of range", offset)
+	}
+
+	result := make([]byte, len(networkPayload))
+	n := copy(result, networkPayload[:len(networkPayload)-len(fragPayload)])
+	copy(result[n:], whole[offset:offset+len(fragPayload)])
+
+	return result, nil
+}
+
 // CreateFragmentPackets creates fragments by given layers and fragment size.
 func CreateFragmentPackets(linkLayer, networkLayer, transportLayer gopacket.Layer, payload gopacket.Payload, fragment int) ([][]byte, error) {
+	// Set network layer for transport layer, which may be parsed from other packets
+	if transportLayer != nil {
+		layer, ok := transportLayer.(checksumLayer)
+		if ok {
+			err := layer.SetNetworkLayerForChecksum(networkLayer.(gopacket.NetworkLayer))
+			if err != nil {
+				return nil, fmt.Errorf("set network layer for checksum: %w", err)
+			}
+		}
+	}
+
 	if transportLayer != nil && transportLayer.LayerType() == layers.LayerTypeTCP {
 		return CreateTCPSegmentPackets(linkLayer, networkLayer.(gopacket.NetworkLayer), transportLayer.(*layers.TCP), payload, fragment)
 	}
 
-	switch t := networkLayer.LayerType(); t {
-	case layers.LayerTypeIPv4:
-		networkPayload, err := Serialize(transportLayer.(gopacket.SerializableLayer), payload)
+	// Fragments are passed as is
+	networkPayload := []byte(payload)
+	if transportLayer != nil {
+		var err error
+
+		networkPayload, err = Serialize(transportLayer.(gopacket.SerializableLayer), payload)
 		if err != nil {
 			return nil, fmt.Errorf("serialize: %w", err)
 		}
+	}
 
+	switch t := networkLayer.LayerType(); t {
+	case layers.LayerTypeIPv4:
 		return CreateIPv4FragmentPackets(linkLayer, networkLayer.(*layers.IPv4), networkPayload, fragment)
+	case layers.LayerTypeIPv6:
+		return CreateIPv6FragmentPackets(linkLayer, networkLayer.(*layers.IPv6), networkPayload, fragment)
 	default:
 		return nil, fmt.Errorf("network layer type %s not support", t)
 	}
@@ -278,6 +336,10 @@ func CreateIPv4FragmentPackets(linkLayer gopacket.Layer, ipv4Layer *layers.IPv4,
 		temp := *ipv4Layer
 		newIPv4Layer := &temp
 
+		// Fragments are fragmented again from their offsets, and keep their flags in the last ones
+		offset := int(ipv4Layer.FragOffset) * 8
+		mf := ipv4Layer.Flags&layers.IPv4MoreFragments != 0
+
 		// Create fragments
 		for i := 0; i < len(payload); {
 			var (
@@ -302,9 +364,9 @@ func CreateIPv4FragmentPackets(linkLayer gopacket.Layer, ipv4Layer *layers.IPv4,
 			switch t := newIPv4Layer.LayerType(); t {
 			case layers.LayerTypeIPv4:
 				if remain <= 0 {
-					FlagIPv4Layer(newIPv4Layer, false, false, uint16(i/8))
+					FlagIPv4Layer(newIPv4Layer, false, mf, uint16((offset+i)/8))
 				} else {
-					FlagIPv4Layer(newIPv4Layer, false, true, uint16(i/8))
+					FlagIPv4Layer(newIPv4Layer, false, true, uint16((offset+i)/8))
 				}
 			default:
 				return nil, fmt.Errorf("network layer type %s not support", t)
@@ -346,6 +408,99 @@ func CreateIPv4FragmentPackets(linkLayer gopacket.Layer, ipv4Layer *layers.IPv4,
 	return fragments, nil
 }
 
+// CreateIPv6FragmentPackets creates IPv6 fragments by given layers and fragment size.
+func CreateIPv6FragmentPackets(linkLayer gopacket.Layer, ipv6Layer *layers.IPv6, payload gopacket.Payload, fragment int) ([][]byte, error) {
+	var (
+		err           error
+		ipv6LayerData []byte
+		fragments     [][]byte
+	)
+
+	// Serialize intermediate headers
+	ipv6LayerData, err = Serialize(ipv6Layer)
+	if err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+
+	fragments = make([][]byte, 0)
+
+	// Fragment, and fragments will not be fragmented again
+	if len(ipv6LayerData)+len(payload) > fragment && ipv6Layer.NextHeader != layers.IPProtocolIPv6Fragment {
+		// Create new IPv6 layer
+		temp := *ipv6Layer
+		newIPv6Layer := &temp
+
+		newIPv6Layer.NextHeader = layers.IPProtocolIPv6Fragment
+
+		id := atomic.AddUint32(&ipv6FragId, 1)
+
+		// Create fragments
+		for i := 0; i < len(payload); {
+			var (
+				err  error
+				data []byte
+			)
+			length := min(fragment-len(ipv6LayerData)-ipv6FragHeaderLength, len(payload)-i)
+			remain := len(payload) - i - length
+
+			// Align
+			if remain > 0 {
+				length = length / 8 * 8
+				remain = len(payload) - i - length
+			}
+
+			header := createIPv6FragHeader(ipv6Layer.NextHeader, uint16(i/8), remain > 0, id)
+
+			// Serialize layers
+			if linkLayer == nil {
+				data, err = Serialize(newIPv6Layer, header, payload[i:i+length])
+			} else {
+				data, err = Serialize(linkLayer.(gopacket.SerializableLayer), newIPv6Layer, header, payload[i:i+length])
+			}
+			if err != nil {
+				return nil, fmt.Errorf("serialize: %w", err)
+			}
+
+			fragments = append(fragments, data)
+
+			i = i + length
+		}
+	} else {
+		var (
+			err  error
+			data []byte
+		)
+
+		// Serialize layers
+		if linkLayer == nil {
+			data, err = Serialize(ipv6Layer, payload)
+		} else {
+			data, err = Serialize(linkLayer.(gopacket.SerializableLayer), ipv6Layer, payload)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("serialize: %w", err)
+		}
+
+		fragments = append(fragments, data)
+	}
+
+	return fragments, nil
+}
+
+// createIPv6FragHeader returns an IPv6 fragment header, which is not serializable in gopacket.
+func createIPv6FragHeader(nextHeader layers.IPProtocol, offset uint16, mf bool, id uint32) gopacket.Payload {
+	header := make([]byte, ipv6FragHeaderLength)
+
+	header[0] = byte(nextHeader)
+	binary.BigEndian.PutUint16(header[2:4], offset<<3)
+	if mf {
+		header[3] = header[3] | 0x1
+	}
+	binary.BigEndian.PutUint32(header[4:8], id)
+
+	return header
+}
+
 // CreateTCPSegmentPackets creates TCP segments by given layers and fragment size.
 func CreateTCPSegmentPackets(linkLayer gopacket.Layer, networkLayer gopacket.NetworkLayer, tcpLayer *layers.TCP, payload gopacket.Payload, fragment int) ([][]byte, error) {
 	var (
@@ -414,7 +569,7 @@ func CreateTCPSegmentPackets(linkLayer gopacket.Layer, networkLayer gopacket.Net
 			} else {
 				data, err = Serialize(linkLayer.(gopacket.SerializableLayer),
 					newNetworkLayer.(gopacket.SerializableLayer),
-					tcpLayer,
+					newTCPLayer,
 					payload[i:i+length])
 			}
 			if err != nil {
@@ -0,0 +1,170 @@
+package pcap
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"testing"
+)
+
+func TestCreateTCPSegmentPackets(t *testing.T) {
+	srcIP, dstIP := net.IPv4(10, 0, 0, 2).To4(), net.IPv4(10, 0, 0, 3).To4()
+	payload := bytes.Repeat([]byte("segment"), 400)
+
+	for _, isLink := range []bool{false, true} {
+		tcpLayer := &layers.TCP{SrcPort: 40000, DstPort: 8080, Seq: 1000, Ack: 2000, ACK: true, PSH: true, Window: 65535}
+		ipv4Layer, err := CreateIPv4Layer(srcIP, dstIP, 1, 64, tcpLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tcpLayer.SetNetworkLayerForChecksum(ipv4Layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var linkLayer gopacket.Layer
+		decoder := gopacket.Decoder(layers.LayerTypeIPv4)
+		if isLink {
+			linkLayer, err = CreateEthernetLayer(net.HardwareAddr{0x02, 0, 0, 0, 0, 2}, net.HardwareAddr{0x02, 0, 0, 0, 0, 3}, ipv4Layer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoder = layers.LayerTypeEthernet
+		}
+
+		segments, err := CreateTCPSegmentPackets(linkLayer, ipv4Layer, tcpLayer, payload, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segments) < 3 {
+			t.Fatalf("link %t: %d segments", isLink, len(segments))
+		}
+
+		// Segments follow each other in sequence numbers
+		seq := tcpLayer.Seq
+		result := make([]byte, 0)
+		for i, segment := range segments {
+			packet := gopacket.NewPacket(segment, decoder, gopacket.Default)
+			newTCPLayer, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+			if !ok {
+				t.Fatalf("link %t: segment %d: missing tcp layer", isLink, i)
+			}
+			if newTCPLayer.Seq != seq {
+				t.Errorf("link %t: segment %d: seq %d of %d", isLink, i, newTCPLayer.Seq, seq)
+			}
+
+			seq = seq + uint32(len(newTCPLayer.Payload))
+			result = append(result, newTCPLayer.Payload...)
+		}
+		if !bytes.Equal(result, payload) {
+			t.Errorf("link %t: payload mismatch", isLink)
+		}
+	}
+}
+
+func TestCreateIPv4FragmentPackets(t *testing.T) {
+	srcIP, dstIP := net.IPv4(10, 0, 0, 2).To4(), net.IPv4(10, 0, 0, 3).To4()
+	payload := bytes.Repeat([]byte("fragment"), 125)
+
+	// A fragment in the middle and the last one of a packet
+	for _, mf := range []bool{true, false} {
+		ipv4Layer, err := CreateIPv4Layer(srcIP, dstIP, 1, 64, &layers.UDP{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		FlagIPv4Layer(ipv4Layer, false, mf, 1000/8)
+
+		fragments, err := CreateIPv4FragmentPackets(nil, ipv4Layer, payload, 576)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fragments) < 2 {
+			t.Fatalf("mf %t: %d fragments", mf, len(fragments))
+		}
+
+		// Fragments follow each other from the offset, and the last one keeps the flag
+		offset := 1000
+		for i, fragment := range fragments {
+			packet := gopacket.NewPacket(fragment, layers.LayerTypeIPv4, gopacket.Default)
+			newIPv4Layer := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+			if int(newIPv4Layer.FragOffset)*8 != offset {
+				t.Errorf("mf %t: fragment %d: offset %d of %d", mf, i, newIPv4Layer.FragOffset*8, offset)
+			}
+			isMF := newIPv4Layer.Flags&layers.IPv4MoreFragments != 0
+			if isLast := i == len(fragments)-1; isMF != (!isLast || mf) {
+				t.Errorf("mf %t: fragment %d: more fragments %t", mf, i, isMF)
+			}
+
+			offset = offset + len(newIPv4Layer.Payload)
+		}
+		if offset != 1000+len(payload) {
+			t.Errorf("mf %t: length %d", mf, offset-1000)
+		}
+	}
+}
+
+func TestFragmentPayload(t *testing.T) {
+	payload := bytes.Repeat([]byte("fragment"), 250)
+
+	// The translated whole packet differs from the original one
+	whole := make([]byte, 8+len(payload))
+	for i := range whole {
+		whole[i] = byte(i % 251)
+	}
+
+	for _, ip := range []net.IP{net.IPv4(10, 0, 0, 2).To4(), net.ParseIP("2001:db8::2")} {
+		udpLayer := &layers.UDP{SrcPort: 40000, DstPort: 7}
+		var (
+			err          error
+			networkLayer gopacket.Layer
+		)
+		if ip.To4() != nil {
+			networkLayer, err = CreateIPv4Layer(ip, ip, 1, 64, udpLayer)
+		} else {
+			networkLayer, err = CreateIPv6Layer(ip, ip, 64, udpLayer)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fragments, err := CreateFragmentPackets(nil, networkLayer, udpLayer, payload, 576)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fragments) < 2 {
+			t.Fatalf("%s: %d fragments", ip, len(fragments))
+		}
+
+		for i, fragment := range fragments {
+			frag, err := ParseEmbPacket(fragment)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Headers before the fragment payload are kept
+			result, err := FragmentPayload(frag, whole)
+			if err != nil {
+				t.Fatalf("%s: fragment %d: %v", ip, i, err)
+			}
+			networkPayload, fragPayload := frag.NetworkPayload(), frag.fragPayload()
+			if len(result) != len(networkPayload) {
+				t.Fatalf("%s: fragment %d: length %d of %d", ip, i, len(result), len(networkPayload))
+			}
+			n := len(networkPayload) - len(fragPayload)
+			if !bytes.Equal(result[:n], networkPayload[:n]) {
+				t.Errorf("%s: fragment %d: header mismatch", ip, i)
+			}
+			offset := int(frag.FragOffset()) * 8
+			if !bytes.Equal(result[n:], whole[offset:offset+len(fragPayload)]) {
+				t.Errorf("%s: fragment %d: payload mismatch", ip, i)
+			}
+
+			// Fragments out of the whole packet are rejected
+			_, err = FragmentPayload(frag, whole[:offset])
+			if err == nil {
+				t.Errorf("%s: fragment %d: out of range accepted", ip, i)
+			}
+		}
+	}
+}
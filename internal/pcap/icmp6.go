@@ -0,0 +1,347 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/addr"
+	"net"
+)
+
+// ICMPv6Indicator indicates an ICMPv6 layer.
+type ICMPv6Indicator struct {
+	layer             *layers.ICMPv6
+	embIPv6Layer      *layers.IPv6
+	embTransportLayer gopacket.Layer
+}
+
+// ParseICMPv6Layer parses an ICMPv6 layer and returns an ICMPv6 indicator.
+func ParseICMPv6Layer(layer *layers.ICMPv6) (*ICMPv6Indicator, error) {
+	var (
+		embIPv6Layer      *layers.IPv6
+		embTransportLayer gopacket.Layer
+	)
+
+	switch t := layer.TypeCode.Type(); t {
+	case layers.ICMPv6TypeEchoRequest,
+		layers.ICMPv6TypeEchoReply,
+		layers.ICMPv6TypeRouterSolicitation,
+		layers.ICMPv6TypeRouterAdvertisement,
+		layers.ICMPv6TypeNeighborSolicitation,
+		layers.ICMPv6TypeNeighborAdvertisement,
+		layers.ICMPv6TypeRedirect:
+		// Id and sequence, or reserved bytes in neighbor discovery
+		if len(layer.Payload) < 4 {
+			return nil, errors.New("icmpv6 layer too short")
+		}
+	case layers.ICMPv6TypeDestinationUnreachable,
+		layers.ICMPv6TypePacketTooBig,
+		layers.ICMPv6TypeTimeExceeded,
+		layers.ICMPv6TypeParameterProblem:
+		if len(layer.Payload) < 4 {
+			return nil, errors.New("icmpv6 layer too short")
+		}
+
+		// Parse IPv6 header and contents after 4 bytes unused, MTU or pointer
+		packet := gopacket.NewPacket(layer.Payload[4:], layers.LayerTypeIPv6, gopacket.NoCopy)
+		if len(packet.Layers()) <= 0 {
+			return nil, errors.New("missing network layer")
+		}
+		if len(packet.Layers()) <= 1 {
+			return nil, errors.New("missing transport layer")
+		}
+
+		// Parse network layer
+		networkLayer := packet.Layers()[0]
+		if t := networkLayer.LayerType(); t != layers.LayerTypeIPv6 {
+			return nil, fmt.Errorf("network layer type %s not support", t)
+		}
+
+		embIPv6Layer = networkLayer.(*layers.IPv6)
+		if embIPv6Layer.Version != 6 {
+			return nil, errors.New("network layer type not support")
+		}
+
+		_, err := parseIPProtocol(embIPv6Layer.NextHeader)
+		if err != nil {
+			return nil, err
+		}
+
+		// Parse transport layer
+		embTransportLayer = packet.Layers()[1]
+		switch t := embTransportLayer.LayerType(); t {
+		case layers.LayerTypeTCP, layers.LayerTypeUDP:
+			break
+		case layers.LayerTypeICMPv6:
+			if len(embTransportLayer.LayerPayload()) < 4 {
+				return nil, errors.New("embedded icmpv6 layer too short")
+			}
+		default:
+			return nil, fmt.Errorf("transport layer type %s not support", t)
+		}
+	default:
+		return nil, fmt.Errorf("icmpv6 type %d not support", t)
+	}
+
+	return &ICMPv6Indicator{
+		layer:             layer,
+		embIPv6Layer:      embIPv6Layer,
+		embTransportLayer: embTransportLayer,
+	}, nil
+}
+
+// NewPureICMPv6Layer returns an new ICMPv6 layer copied from the original ICMPv6 layer without any message body.
+func (indicator *ICMPv6Indicator) NewPureICMPv6Layer() *layers.ICMPv6 {
+	return &layers.ICMPv6{
+		TypeCode: indicator.layer.TypeCode,
+	}
+}
+
+// ICMPv6Layer returns the ICMPv6 layer.
+func (indicator *ICMPv6Indicator) ICMPv6Layer() *layers.ICMPv6 {
+	return indicator.layer
+}
+
+// IsQuery returns if the ICMPv6 layer is a query.
+func (indicator *ICMPv6Indicator) IsQuery() bool {
+	return isICMPv6Query(indicator.layer)
+}
+
+// IsNeighborSolicitation returns if the ICMPv6 layer is a neighbor solicitation.
+func (indicator *ICMPv6Indicator) IsNeighborSolicitation() bool {
+	return indicator.layer.TypeCode.Type() == layers.ICMPv6TypeNeighborSolicitation
+}
+
+// IsNeighborDiscovery returns if the ICMPv6 layer is a neighbor discovery message.
+func (indicator *ICMPv6Indicator) IsNeighborDiscovery() bool {
+	t := indicator.layer.TypeCode.Type()
+
+	return t >= layers.ICMPv6TypeRouterSolicitation && t <= layers.ICMPv6TypeRedirect
+}
+
+// TargetIP returns the target address of the neighbor solicitation.
+func (indicator *ICMPv6Indicator) TargetIP() net.IP {
+	if !indicator.IsNeighborSolicitation() || len(indicator.layer.Payload) < 20 {
+		return nil
+	}
+
+	return indicator.layer.Payload[4:20]
+}
+
+// Id returns the ICMPv6 Id.
+func (indicator *ICMPv6Indicator) Id() uint16 {
+	return binary.BigEndian.Uint16(indicator.layer.Payload[0:2])
+}
+
+// QueryPayload returns a copy of the message body of the query with the given Id.
+func (indicator *ICMPv6Indicator) QueryPayload(id uint16) []byte {
+	return copyICMPv6Payload(indicator.layer, id)
+}
+
+// ErrorPayload returns the message body of the error with the given embedded packet.
+func (indicator *ICMPv6Indicator) ErrorPayload(emb []byte) []byte {
+	payload := make([]byte, 4, 4+len(emb))
+	copy(payload, indicator.layer.Payload[:4])
+
+	return append(payload, emb...)
+}
+
+// EmbIPv6Layer returns the embedded IPv6 layer.
+func (indicator *ICMPv6Indicator) EmbIPv6Layer() *layers.IPv6 {
+	return indicator.embIPv6Layer
+}
+
+// EmbSrcIP returns the embedded source IP.
+func (indicator *ICMPv6Indicator) EmbSrcIP() net.IP {
+	return indicator.embIPv6Layer.SrcIP
+}
+
+// EmbDstIP returns the embedded destination IP.
+func (indicator *ICMPv6Indicator) EmbDstIP() net.IP {
+	return indicator.embIPv6Layer.DstIP
+}
+
+// EmbTransportProtocol returns the protocol of the transport layer.
+func (indicator *ICMPv6Indicator) EmbTransportProtocol() gopacket.LayerType {
+	p, err := parseIPProtocol(indicator.EmbIPv6Layer().NextHeader)
+	if err != nil {
+		panic(err)
+	}
+
+	return p
+}
+
+// EmbTransportLayer returns the embedded transport layer.
+func (indicator *ICMPv6Indicator) EmbTransportLayer() gopacket.Layer {
+	return indicator.embTransportLayer
+}
+
+// EmbTCPLayer returns the embedded TCP layer.
+func (indicator *ICMPv6Indicator) EmbTCPLayer() *layers.TCP {
+	if indicator.EmbTransportLayer().LayerType() == layers.LayerTypeTCP {
+		return indicator.embTransportLayer.(*layers.TCP)
+	}
+
+	return nil
+}
+
+// EmbUDPLayer returns the embedded UDP layer.
+func (indicator *ICMPv6Indicator) EmbUDPLayer() *layers.UDP {
+	if indicator.EmbTransportLayer().LayerType() == layers.LayerTypeUDP {
+		return indicator.embTransportLayer.(*layers.UDP)
+	}
+
+	return nil
+}
+
+// EmbICMPv6Layer returns the embedded ICMPv6 layer.
+func (indicator *ICMPv6Indicator) EmbICMPv6Layer() *layers.ICMPv6 {
+	if indicator.EmbTransportLayer().LayerType() == layers.LayerTypeICMPv6 {
+		return indicator.embTransportLayer.(*layers.ICMPv6)
+	}
+
+	return nil
+}
+
+// EmbId returns the embedded ICMPv6 Id.
+func (indicator *ICMPv6Indicator) EmbId() uint16 {
+	switch t := indicator.EmbTransportLayer().LayerType(); t {
+	case layers.LayerTypeICMPv6:
+		return binary.BigEndian.Uint16(indicator.EmbICMPv6Layer().Payload[0:2])
+	default:
+		panic(fmt.Errorf("transport layer type %s not support", t))
+	}
+}
+
+// EmbQueryPayload returns a copy of the message body of the embedded query with the given Id.
+func (indicator *ICMPv6Indicator) EmbQueryPayload(id uint16) []byte {
+	return copyICMPv6Payload(indicator.EmbICMPv6Layer(), id)
+}
+
+// EmbSrcPort returns the embedded source port.
+func (indicator *ICMPv6Indicator) EmbSrcPort() uint16 {
+	switch t := indicator.EmbTransportLayer().LayerType(); t {
+	case layers.LayerTypeTCP:
+		return uint16(indicator.EmbTCPLayer().SrcPort)
+	case layers.LayerTypeUDP:
+		return uint16(indicator.EmbUDPLayer().SrcPort)
+	default:
+		panic(fmt.Errorf("transport layer type %s not support", t))
+	}
+}
+
+// EmbDstPort returns the embedded destination port.
+func (indicator *ICMPv6Indicator) EmbDstPort() uint16 {
+	switch t := indicator.EmbTransportLayer().LayerType(); t {
+	case layers.LayerTypeTCP:
+		return uint16(indicator.EmbTCPLayer().DstPort)
+	case layers.LayerTypeUDP:
+		return uint16(indicator.EmbUDPLayer().DstPort)
+	default:
+		panic(fmt.Errorf("transport layer type %s not support", t))
+	}
+}
+
+// IsEmbQuery returns if the embedded ICMPv6 layer is a query.
+func (indicator *ICMPv6Indicator) IsEmbQuery() bool {
+	return isICMPv6Query(indicator.EmbICMPv6Layer())
+}
+
+// EmbSrc returns the embedded source.
+func (indicator *ICMPv6Indicator) EmbSrc() net.Addr {
+	if indicator.IsQuery() {
+		panic(errors.New("icmpv6 query not support"))
+	} else {
+		// Flip source and destination
+		switch t := indicator.EmbTransportLayer().LayerType(); t {
+		case layers.LayerTypeTCP:
+			return &net.TCPAddr{
+				IP:   indicator.EmbDstIP(),
+				Port: int(indicator.EmbDstPort()),
+			}
+		case layers.LayerTypeUDP:
+			return &net.UDPAddr{
+				IP:   indicator.EmbDstIP(),
+				Port: int(indicator.EmbDstPort()),
+			}
+		case layers.LayerTypeICMPv6:
+			if indicator.IsEmbQuery() {
+				return &addr.ICMPQueryAddr{
+					IP: indicator.EmbDstIP(),
+					Id: indicator.EmbId(),
+				}
+			}
+
+			return &net.IPAddr{
+				IP: indicator.EmbDstIP(),
+			}
+		default:
+			panic(fmt.Errorf("transport layer type %s not support", t))
+		}
+	}
+}
+
+// EmbDst returns the embedded destination.
+func (indicator *ICMPv6Indicator) EmbDst() net.Addr {
+	if indicator.IsQuery() {
+		panic(errors.New("icmpv6 query not support"))
+	} else {
+		// Flip source and destination
+		switch t := indicator.EmbTransportLayer().LayerType(); t {
+		case layers.LayerTypeTCP:
+			return &net.TCPAddr{
+				IP:   indicator.EmbSrcIP(),
+				Port: int(indicator.EmbSrcPort()),
+			}
+		case layers.LayerTypeUDP:
+			return &net.UDPAddr{
+				IP:   indicator.EmbSrcIP(),
+				Port: int(indicator.EmbSrcPort()),
+			}
+		case layers.LayerTypeICMPv6:
+			if indicator.IsEmbQuery() {
+				return &addr.ICMPQueryAddr{
+					IP: indicator.EmbSrcIP(),
+					Id: indicator.EmbId(),
+				}
+			}
+
+			return &net.IPAddr{
+				IP: indicator.EmbSrcIP(),
+			}
+		default:
+			panic(fmt.Errorf("transport layer type %s not support", t))
+		}
+	}
+}
+
+func isICMPv6Query(layer *layers.ICMPv6) bool {
+	switch t := layer.TypeCode.Type(); t {
+	case layers.ICMPv6TypeEchoRequest,
+		layers.ICMPv6TypeEchoReply,
+		layers.ICMPv6TypeRouterSolicitation,
+		layers.ICMPv6TypeRouterAdvertisement,
+		layers.ICMPv6TypeNeighborSolicitation,
+		layers.ICMPv6TypeNeighborAdvertisement,
+		layers.ICMPv6TypeRedirect:
+		return true
+	case layers.ICMPv6TypeDestinationUnreachable,
+		layers.ICMPv6TypePacketTooBig,
+		layers.ICMPv6TypeTimeExceeded,
+		layers.ICMPv6TypeParameterProblem:
+		return false
+	default:
+		panic(fmt.Errorf("icmpv6 type %d not support", t))
+	}
+}
+
+// copyICMPv6Payload copies the message body of the ICMPv6 layer, and replaces its Id which is not decoded by gopacket.
+func copyICMPv6Payload(layer *layers.ICMPv6, id uint16) []byte {
+	payload := make([]byte, len(layer.Payload))
+	copy(payload, layer.Payload)
+	binary.BigEndian.PutUint16(payload[0:2], id)
+
+	return payload
+}
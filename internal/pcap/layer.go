@@ -5,6 +5,7 @@
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"net"
+	"runtime"
 )
 
 // CreateTCPLayer returns a TCP layer.
@@ -39,8 +40,18 @@ func CreateUDPLayer(srcPort, dstPort uint16) *layers.UDP {
 	}
 }
 
+// CreateICMPv4Layer returns an ICMPv4 layer.
+func CreateICMPv4Layer(t uint8, id, seq uint16) *layers.ICMPv4 {
+	return &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(t, 0),
+		Id:       id,
+		Seq:      seq,
+		// Checksum: 0,
+	}
+}
+
 // CreateIPv4Layer returns an IPv4 layer.
-func CreateIPv4Layer(srcIP, dstIP net.IP, id uint16, ttl uint8, transportLayer gopacket.TransportLayer) (*layers.IPv4, error) {
+func CreateIPv4Layer(srcIP, dstIP net.IP, id uint16, ttl uint8, transportLayer gopacket.Layer) (*layers.IPv4, error) {
 	ipv4Layer := &layers.IPv4{
 		Version: 4,
 		IHL:     5,
@@ -73,6 +84,8 @@ func CreateIPv4Layer(srcIP, dstIP net.IP, id uint16, ttl uint8, transportLayer g
 		if err != nil {
 			return nil, fmt.Errorf("set network layer for checksum: %w", err)
 		}
+	case layers.LayerTypeICMPv4:
+		ipv4Layer.Protocol = layers.IPProtocolICMPv4
 	default:
 		return nil, fmt.Errorf("transport layer type %s not support", t)
 	}
@@ -80,6 +93,53 @@ func CreateIPv4Layer(srcIP, dstIP net.IP, id uint16, ttl uint8, transportLayer g
 	return ipv4Layer, nil
 }
 
+// CreateIPv6Layer returns an IPv6 layer.
+func CreateIPv6Layer(srcIP, dstIP net.IP, hopLimit uint8, transportLayer gopacket.Layer) (*layers.IPv6, error) {
+	ipv6Layer := &layers.IPv6{
+		Version: 6,
+		// Length: 0,
+		// NextHeader: 0,
+		HopLimit: hopLimit,
+		SrcIP:    srcIP,
+		DstIP:    dstIP,
+	}
+
+	// Next header
+	switch t := transportLayer.LayerType(); t {
+	case layers.LayerTypeTCP:
+		ipv6Layer.NextHeader = layers.IPProtocolTCP
+
+		// Checksum of transport layer
+		tcpLayer := transportLayer.(*layers.TCP)
+		err := tcpLayer.SetNetworkLayerForChecksum(ipv6Layer)
+		if err != nil {
+			return nil, fmt.Errorf("set network layer for checksum: %w", err)
+		}
+	case layers.LayerTypeUDP:
+		ipv6Layer.NextHeader = layers.IPProtocolUDP
+
+		// Checksum of transport layer
+		udpLayer := transportLayer.(*layers.UDP)
+		err := udpLayer.SetNetworkLayerForChecksum(ipv6Layer)
+		if err != nil {
+			return nil, fmt.Errorf("set network layer for checksum: %w", err)
+		}
+	case layers.LayerTypeICMPv6:
+		ipv6Layer.NextHeader = layers.IPProtocolICMPv6
+
+		// Checksum of transport layer
+		icmpv6Layer := transportLayer.(*layers.ICMPv6)
+		err := icmpv6Layer.SetNetworkLayerForChecksum(ipv6Layer)
+		if err != nil {
+			return nil, fmt.Errorf("set network layer for checksum: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("transport layer type %s not support", t)
+	}
+
+	return ipv6Layer, nil
+}
+
 // FlagIPv4Layer reflags flags in an IPv4 layer.
 func FlagIPv4Layer(layer *layers.IPv4, df, mf bool, offset uint16) {
 	if df {
@@ -103,6 +163,8 @@ func CreateLoopbackLayer(networkLayer gopacket.NetworkLayer) (*layers.Loopback,
 	switch t := networkLayer.LayerType(); t {
 	case layers.LayerTypeIPv4:
 		loopbackLayer.Family = layers.ProtocolFamilyIPv4
+	case layers.LayerTypeIPv6:
+		loopbackLayer.Family = loopbackFamilyIPv6()
 	default:
 		return nil, fmt.Errorf("network layer type %s not support", t)
 	}
@@ -110,6 +172,23 @@ func CreateLoopbackLayer(networkLayer gopacket.NetworkLayer) (*layers.Loopback,
 	return loopbackLayer, nil
 }
 
+// loopbackFamilyIPv6 returns the protocol family of IPv6 in loopback, which varies by systems.
+func loopbackFamilyIPv6() layers.ProtocolFamily {
+	switch runtime.GOOS {
+	case "darwin":
+		return layers.ProtocolFamilyIPv6Darwin
+	case "freebsd":
+		return layers.ProtocolFamilyIPv6FreeBSD
+	case "linux":
+		return layers.ProtocolFamilyIPv6Linux
+	case "windows":
+		// AF_INET6 in Windows
+		return 23
+	default:
+		return layers.ProtocolFamilyIPv6BSD
+	}
+}
+
 // CreateEthernetLayer returns an Ethernet layer.
 func CreateEthernetLayer(srcMAC, dstMAC net.HardwareAddr, networkLayer gopacket.NetworkLayer) (*layers.Ethernet, error) {
 	ethernetLayer := &layers.Ethernet{
@@ -122,6 +201,8 @@ func CreateEthernetLayer(srcMAC, dstMAC net.HardwareAddr, networkLayer gopacket.
 	switch t := networkLayer.LayerType(); t {
 	case layers.LayerTypeIPv4:
 		ethernetLayer.EthernetType = layers.EthernetTypeIPv4
+	case layers.LayerTypeIPv6:
+		ethernetLayer.EthernetType = layers.EthernetTypeIPv6
 	default:
 		return nil, fmt.Errorf("network layer type %s not support", t)
 	}
@@ -158,19 +239,51 @@ func SerializeRaw(layers ...gopacket.SerializableLayer) ([]byte, error) {
 }
 
 // CreateLayers return layers of transmission between client and server.
-func CreateLayers(srcPort, dstPort uint16, seq, ack uint32, conn *RawConn, dstIP net.IP, id uint16, hop uint8,
+func CreateLayers(srcPort, dstPort uint16, seq, ack uint32, conn Endpoint, dstIP net.IP, id uint16, hop uint8,
+	dstHardwareAddr net.HardwareAddr) (transportLayer, networkLayer, linkLayer gopacket.SerializableLayer, err error) {
+	// Create transport layer
+	transportLayer = CreateTCPLayer(srcPort, dstPort, seq, ack)
+
+	networkLayer, linkLayer, err = createNetworkAndLinkLayers(transportLayer.(gopacket.Layer), conn, dstIP, id, hop, dstHardwareAddr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return transportLayer, networkLayer, linkLayer, nil
+}
+
+// CreateICMPv4Layers return layers of transmission between client and server in ICMPv4 echo.
+func CreateICMPv4Layers(t uint8, icmpId, seq uint16, conn Endpoint, dstIP net.IP, id uint16, hop uint8,
 	dstHardwareAddr net.HardwareAddr) (transportLayer, networkLayer, linkLayer gopacket.SerializableLayer, err error) {
+	// Create transport layer
+	transportLayer = CreateICMPv4Layer(t, icmpId, seq)
+
+	networkLayer, linkLayer, err = createNetworkAndLinkLayers(transportLayer.(gopacket.Layer), conn, dstIP, id, hop, dstHardwareAddr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return transportLayer, networkLayer, linkLayer, nil
+}
+
+func createNetworkAndLinkLayers(transportLayer gopacket.Layer, conn Endpoint, dstIP net.IP, id uint16, hop uint8,
+	dstHardwareAddr net.HardwareAddr) (networkLayer, linkLayer gopacket.SerializableLayer, err error) {
 	var (
 		linkLayerType gopacket.LayerType
 	)
 
-	// Create transport layer
-	transportLayer = CreateTCPLayer(srcPort, dstPort, seq, ack)
-
 	// Create new network layer
-	networkLayer, err = CreateIPv4Layer(conn.LocalDev().IPAddr().IP, dstIP, id, hop-1, transportLayer.(gopacket.TransportLayer))
+	srcIPAddr := conn.LocalDev().IPAddrTo(dstIP)
+	if srcIPAddr == nil {
+		return nil, nil, fmt.Errorf("missing address to %s", dstIP)
+	}
+	if dstIP.To4() == nil {
+		networkLayer, err = CreateIPv6Layer(srcIPAddr.IP, dstIP, hop, transportLayer)
+	} else {
+		networkLayer, err = CreateIPv4Layer(srcIPAddr.IP, dstIP, id, hop, transportLayer)
+	}
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("create network layer: %w", err)
+		return nil, nil, fmt.Errorf("create network layer: %w", err)
 	}
 
 	// Decide Loopback or Ethernet
@@ -187,11 +300,11 @@ func CreateLayers(srcPort, dstPort uint16, seq, ack uint32, conn *RawConn, dstIP
 	case layers.LayerTypeEthernet:
 		linkLayer, err = CreateEthernetLayer(conn.LocalDev().HardwareAddr(), dstHardwareAddr, networkLayer.(gopacket.NetworkLayer))
 	default:
-		return nil, nil, nil, fmt.Errorf("link layer type %s not support", linkLayerType)
+		return nil, nil, fmt.Errorf("link layer type %s not support", linkLayerType)
 	}
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("create link layer: %w", err)
+		return nil, nil, fmt.Errorf("create link layer: %w", err)
 	}
 
-	return transportLayer, networkLayer, linkLayer, nil
+	return networkLayer, linkLayer, nil
 }
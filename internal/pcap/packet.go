@@ -14,7 +14,7 @@ type ConnPacket struct {
 	// Packet is a packet.
 	Packet gopacket.Packet
 	// Conn is the connection of the packet.
-	Conn *RawConn
+	Conn Endpoint
 }
 
 // ConnBytes describes an array of bytes and its connection.
@@ -38,8 +38,10 @@ type PacketIndicator struct {
 	packet           gopacket.Packet
 	linkLayer        gopacket.Layer
 	networkLayer     gopacket.Layer
+	ipv6FragLayer    *layers.IPv6Fragment
 	transportLayer   gopacket.Layer
 	icmpv4Indicator  *ICMPv4Indicator
+	icmpv6Indicator  *ICMPv6Indicator
 	applicationLayer gopacket.ApplicationLayer
 	dnsIndicator     *DNSIndicator
 }
@@ -92,6 +94,15 @@ func (indicator *PacketIndicator) IPv4Layer() *layers.IPv4 {
 	return nil
 }
 
+// IPv6Layer returns the IPv6 layer.
+func (indicator *PacketIndicator) IPv6Layer() *layers.IPv6 {
+	if indicator.NetworkLayer().LayerType() == layers.LayerTypeIPv6 {
+		return indicator.networkLayer.(*layers.IPv6)
+	}
+
+	return nil
+}
+
 // ARPLayer returns the ARP layer.
 func (indicator *PacketIndicator) ARPLayer() *layers.ARP {
 	if indicator.NetworkLayer().LayerType() == layers.LayerTypeARP {
@@ -106,6 +117,8 @@ func (indicator *PacketIndicator) SrcIP() net.IP {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().SrcIP
+	case layers.LayerTypeIPv6:
+		return indicator.IPv6Layer().SrcIP
 	case layers.LayerTypeARP:
 		return indicator.ARPLayer().SourceProtAddress
 	default:
@@ -118,6 +131,8 @@ func (indicator *PacketIndicator) DstIP() net.IP {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().DstIP
+	case layers.LayerTypeIPv6:
+		return indicator.IPv6Layer().DstIP
 	case layers.LayerTypeARP:
 		return indicator.ARPLayer().DstProtAddress
 	default:
@@ -130,16 +145,24 @@ func (indicator *PacketIndicator) TTL() uint8 {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().TTL
+	case layers.LayerTypeIPv6:
+		return indicator.IPv6Layer().HopLimit
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
 }
 
-// Id returns the Id in the network layer.
-func (indicator *PacketIndicator) NetworkId() uint16 {
+// NetworkId returns the Id in the network layer, or the identification in the IPv6 fragment header.
+func (indicator *PacketIndicator) NetworkId() uint32 {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
-		return indicator.IPv4Layer().Id
+		return uint32(indicator.IPv4Layer().Id)
+	case layers.LayerTypeIPv6:
+		if indicator.ipv6FragLayer == nil {
+			return 0
+		}
+
+		return indicator.ipv6FragLayer.Identification
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
@@ -156,6 +179,8 @@ func (indicator *PacketIndicator) IsFrag() bool {
 		}
 
 		return ipv4Layer.FragOffset != 0
+	case layers.LayerTypeIPv6:
+		return indicator.ipv6FragLayer != nil
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
@@ -166,6 +191,12 @@ func (indicator *PacketIndicator) FragOffset() uint16 {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().FragOffset
+	case layers.LayerTypeIPv6:
+		if indicator.ipv6FragLayer == nil {
+			return 0
+		}
+
+		return indicator.ipv6FragLayer.FragmentOffset
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
@@ -176,6 +207,12 @@ func (indicator *PacketIndicator) MoreFragments() bool {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().Flags&layers.IPv4MoreFragments != 0
+	case layers.LayerTypeIPv6:
+		if indicator.ipv6FragLayer == nil {
+			return false
+		}
+
+		return indicator.ipv6FragLayer.MoreFragments
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
@@ -190,12 +227,33 @@ func (indicator *PacketIndicator) TransportProtocol() gopacket.LayerType {
 			panic(err)
 		}
 
+		return p
+	case layers.LayerTypeIPv6:
+		p, err := parseIPProtocol(indicator.ipv6Protocol())
+		if err != nil {
+			panic(err)
+		}
+
 		return p
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
 }
 
+// IPv6FragmentLayer returns the IPv6 fragment header.
+func (indicator *PacketIndicator) IPv6FragmentLayer() *layers.IPv6Fragment {
+	return indicator.ipv6FragLayer
+}
+
+// ipv6Protocol returns the protocol of the transport layer in IPv6, which may follow a fragment header.
+func (indicator *PacketIndicator) ipv6Protocol() layers.IPProtocol {
+	if indicator.ipv6FragLayer != nil {
+		return indicator.ipv6FragLayer.NextHeader
+	}
+
+	return indicator.IPv6Layer().NextHeader
+}
+
 // TransportLayer returns the transport layer.
 func (indicator *PacketIndicator) TransportLayer() gopacket.Layer {
 	return indicator.transportLayer
@@ -224,6 +282,11 @@ func (indicator *PacketIndicator) ICMPv4Indicator() *ICMPv4Indicator {
 	return indicator.icmpv4Indicator
 }
 
+// ICMPv6Indicator returns the ICMPv6 indicator.
+func (indicator *PacketIndicator) ICMPv6Indicator() *ICMPv6Indicator {
+	return indicator.icmpv6Indicator
+}
+
 // SrcPort returns the source port.
 func (indicator *PacketIndicator) SrcPort() uint16 {
 	switch t := indicator.TransportLayer().LayerType(); t {
@@ -310,6 +373,15 @@ func (indicator *PacketIndicator) NATSrc() net.Addr {
 		}
 
 		return indicator.icmpv4Indicator.EmbSrc()
+	case layers.LayerTypeICMPv6:
+		if indicator.icmpv6Indicator.IsQuery() {
+			return &addr.ICMPQueryAddr{
+				IP: indicator.SrcIP(),
+				Id: indicator.icmpv6Indicator.Id(),
+			}
+		}
+
+		return indicator.icmpv6Indicator.EmbSrc()
 	default:
 		panic(fmt.Errorf("transport layer type %s not support", t))
 	}
@@ -337,6 +409,15 @@ func (indicator *PacketIndicator) NATDst() net.Addr {
 		}
 
 		return indicator.icmpv4Indicator.EmbDst()
+	case layers.LayerTypeICMPv6:
+		if indicator.icmpv6Indicator.IsQuery() {
+			return &addr.ICMPQueryAddr{
+				IP: indicator.DstIP(),
+				Id: indicator.icmpv6Indicator.Id(),
+			}
+		}
+
+		return indicator.icmpv6Indicator.EmbDst()
 	default:
 		panic(fmt.Errorf("transport layer type %s not support", t))
 	}
@@ -353,6 +434,12 @@ func (indicator *PacketIndicator) NATProtocol() gopacket.LayerType {
 		}
 
 		return indicator.icmpv4Indicator.EmbTransportLayer().LayerType()
+	case layers.LayerTypeICMPv6:
+		if indicator.icmpv6Indicator.IsQuery() {
+			return t
+		}
+
+		return indicator.icmpv6Indicator.EmbTransportLayer().LayerType()
 	default:
 		panic(fmt.Errorf("transport layer type %s not support", t))
 	}
@@ -385,6 +472,15 @@ func (indicator *PacketIndicator) Src() net.Addr {
 			}
 		}
 
+		return &net.IPAddr{IP: indicator.SrcIP()}
+	case layers.LayerTypeICMPv6:
+		if indicator.icmpv6Indicator.IsQuery() {
+			return &addr.ICMPQueryAddr{
+				IP: indicator.SrcIP(),
+				Id: indicator.icmpv6Indicator.Id(),
+			}
+		}
+
 		return &net.IPAddr{IP: indicator.SrcIP()}
 	default:
 		panic(fmt.Errorf("transport layer type %s not support", t))
@@ -418,6 +514,15 @@ func (indicator *PacketIndicator) Dst() net.Addr {
 			}
 		}
 
+		return &net.IPAddr{IP: indicator.DstIP()}
+	case layers.LayerTypeICMPv6:
+		if indicator.icmpv6Indicator.IsQuery() {
+			return &addr.ICMPQueryAddr{
+				IP: indicator.DstIP(),
+				Id: indicator.icmpv6Indicator.Id(),
+			}
+		}
+
 		return &net.IPAddr{IP: indicator.DstIP()}
 	default:
 		panic(fmt.Errorf("transport layer type %s not support", t))
@@ -438,6 +543,15 @@ func (indicator *PacketIndicator) NetworkPayload() []byte {
 	return indicator.NetworkLayer().LayerPayload()
 }
 
+// fragPayload returns the payload of the fragment, excluding the IPv6 fragment header.
+func (indicator *PacketIndicator) fragPayload() []byte {
+	if indicator.ipv6FragLayer != nil {
+		return indicator.ipv6FragLayer.LayerPayload()
+	}
+
+	return indicator.NetworkPayload()
+}
+
 // Payload returns the payload of transport layer, or layer contents in application layer.
 func (indicator *PacketIndicator) Payload() []byte {
 	if indicator.applicationLayer == nil {
@@ -462,8 +576,10 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 	var (
 		linkLayer        gopacket.Layer
 		networkLayer     gopacket.Layer
+		ipv6FragLayer    *layers.IPv6Fragment
 		transportLayer   gopacket.Layer
 		icmpv4Indicator  *ICMPv4Indicator
+		icmpv6Indicator  *ICMPv6Indicator
 		applicationLayer gopacket.ApplicationLayer
 		dnsIndicator     *DNSIndicator
 	)
@@ -493,6 +609,10 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 	if transportLayer == nil {
 		// Guess ICMPv4
 		transportLayer = packet.Layer(layers.LayerTypeICMPv4)
+		if transportLayer == nil {
+			// Guess ICMPv6
+			transportLayer = packet.Layer(layers.LayerTypeICMPv6)
+		}
 		if transportLayer == nil {
 			// Guess fragment
 			if packet.Layer(gopacket.LayerTypeFragment) == nil {
@@ -528,6 +648,24 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 		if err != nil {
 			return nil, err
 		}
+	case layers.LayerTypeIPv6:
+		ipv6Layer := networkLayer.(*layers.IPv6)
+
+		protocol := ipv6Layer.NextHeader
+		if protocol == layers.IPProtocolIPv6Fragment {
+			layer := packet.Layer(layers.LayerTypeIPv6Fragment)
+			if layer == nil {
+				return nil, errors.New("missing fragment header")
+			}
+
+			ipv6FragLayer = layer.(*layers.IPv6Fragment)
+			protocol = ipv6FragLayer.NextHeader
+		}
+
+		_, err := parseIPProtocol(protocol)
+		if err != nil {
+			return nil, err
+		}
 	case layers.LayerTypeARP:
 		break
 	default:
@@ -545,6 +683,15 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 			if err != nil {
 				return nil, fmt.Errorf("parse icmpv4 layer: %w", err)
 			}
+		case layers.LayerTypeICMPv6:
+			var err error
+			icmpv6Indicator, err = ParseICMPv6Layer(transportLayer.(*layers.ICMPv6))
+			if err != nil {
+				return nil, fmt.Errorf("parse icmpv6 layer: %w", err)
+			}
+
+			// Message bodies are not decoded by gopacket, so regard them as payloads
+			applicationLayer = gopacket.Payload(transportLayer.LayerPayload())
 		default:
 			return nil, fmt.Errorf("transport layer type %s not support", t)
 		}
@@ -561,8 +708,10 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 		packet:           packet,
 		linkLayer:        linkLayer,
 		networkLayer:     networkLayer,
+		ipv6FragLayer:    ipv6FragLayer,
 		transportLayer:   transportLayer,
 		icmpv4Indicator:  icmpv4Indicator,
+		icmpv6Indicator:  icmpv6Indicator,
 		applicationLayer: applicationLayer,
 		dnsIndicator:     dnsIndicator,
 	}, nil
@@ -570,21 +719,24 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 
 // ParseEmbPacket parses an embedded packet used in transmission between client and server without link layer.
 func ParseEmbPacket(contents []byte) (*PacketIndicator, error) {
-	// Guess network layer type
-	packet := gopacket.NewPacket(contents, layers.LayerTypeIPv4, gopacket.NoCopy)
-	networkLayer := packet.NetworkLayer()
-	if networkLayer == nil {
+	if len(contents) <= 0 {
 		return nil, errors.New("missing network layer")
 	}
-	if networkLayer.LayerType() != layers.LayerTypeIPv4 {
-		return nil, errors.New("network layer type not support")
-	}
-	switch networkLayer.(*layers.IPv4).Version {
+
+	// Guess network layer type by version
+	var packet gopacket.Packet
+	switch contents[0] >> 4 {
 	case 4:
-		break
+		packet = gopacket.NewPacket(contents, layers.LayerTypeIPv4, gopacket.NoCopy)
+	case 6:
+		packet = gopacket.NewPacket(contents, layers.LayerTypeIPv6, gopacket.NoCopy)
 	default:
 		return nil, errors.New("network layer type not support")
 	}
+	networkLayer := packet.NetworkLayer()
+	if networkLayer == nil {
+		return nil, errors.New("missing network layer")
+	}
 
 	// Parse packet
 	indicator, err := ParsePacket(packet)
@@ -664,6 +816,8 @@ func parseIPProtocol(protocol layers.IPProtocol) (gopacket.LayerType, error) {
 		return layers.LayerTypeUDP, nil
 	case layers.IPProtocolICMPv4:
 		return layers.LayerTypeICMPv4, nil
+	case layers.IPProtocolICMPv6:
+		return layers.LayerTypeICMPv6, nil
 	default:
 		return gopacket.LayerTypeZero, fmt.Errorf("ip protocol %s not support", protocol)
 	}
@@ -673,6 +827,8 @@ func parseEthernetType(t layers.EthernetType) (gopacket.LayerType, error) {
 	switch t {
 	case layers.EthernetTypeIPv4:
 		return layers.LayerTypeIPv4, nil
+	case layers.EthernetTypeIPv6:
+		return layers.LayerTypeIPv6, nil
 	case layers.EthernetTypeARP:
 		return layers.LayerTypeARP, nil
 	default:
@@ -0,0 +1,406 @@
+package pcap
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/quic-go/quic-go"
+	"github.com/zhxie/ikago/internal/crypto"
+	"github.com/zhxie/ikago/internal/log"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// quicHeaderSize is the size of the fragment header of a datagram.
+const quicHeaderSize = 4
+
+// quicMaxDatagramSize is the max size of a datagram. QUIC packets are at least 1280 Bytes, so a datagram in this size
+// always fits in a packet with its headers.
+const quicMaxDatagramSize = 1200
+
+// quicALPN is the default application protocol negotiated in QUIC.
+const quicALPN = "ikago"
+
+// keepQUIC is the interval of QUIC PING frames sent to keep the connection alive.
+const keepQUIC = 10 * time.Second
+
+// quicFragmentTimeout is the time after which incomplete fragments will be dropped.
+const quicFragmentTimeout = 5 * time.Second
+
+type quicFragments struct {
+	chunks [][]byte
+	remain int
+	t      time.Time
+}
+
+// QUICConn is a connection which transmits packets in QUIC datagrams. Packets which are larger than a datagram will be
+// fragmented and reassembled.
+type QUICConn struct {
+	conn          *quic.Conn
+	transport     *quic.Transport
+	crypt         crypto.Crypt
+	id            uint16
+	writeLock     sync.Mutex
+	fragmentsLock sync.Mutex
+	fragments     map[uint16]*quicFragments
+	readDeadline  time.Time
+}
+
+func newQUICConn(conn *quic.Conn, transport *quic.Transport, crypt crypto.Crypt) *QUICConn {
+	return &QUICConn{
+		conn:      conn,
+		transport: transport,
+		crypt:     crypt,
+		fragments: make(map[uint16]*quicFragments),
+	}
+}
+
+func createQUICConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: establishDeadline,
+		KeepAlivePeriod:      keepQUIC,
+		EnableDatagrams:      true,
+		Allow0RTT:            true,
+	}
+}
+
+func createQUICTLSConfig(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	if len(config.NextProtos) <= 0 {
+		config.NextProtos = []string{quicALPN}
+	}
+	config.MinVersion = tls.VersionTLS13
+
+	return config
+}
+
+// DialQUIC acts like DialUDP for pcap networks in QUIC. 0-RTT will be used if the config holds a session of the server.
+func DialQUIC(dev *Device, srcPort uint16, dstAddr *net.UDPAddr, config *tls.Config, crypt crypto.Crypt) (*QUICConn, error) {
+	srcAddr := &net.UDPAddr{
+		IP:   dev.IPAddr().IP,
+		Port: int(srcPort),
+	}
+
+	conn, err := net.ListenUDP("udp4", srcAddr)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    err,
+		}
+	}
+
+	transport := &quic.Transport{Conn: conn}
+
+	log.Infof("Connect to server %s\n", dstAddr.String())
+
+	t := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), establishDeadline)
+	defer cancel()
+
+	quicConn, err := transport.DialEarly(ctx, dstAddr, createQUICTLSConfig(config), createQUICConfig())
+	if err != nil {
+		transport.Close()
+		conn.Close()
+
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    err,
+		}
+	}
+
+	duration := time.Now().Sub(t)
+
+	log.Infof("Connected to server %s in %.3f ms (RTT)\n", dstAddr.String(), float64(duration.Microseconds())/1000)
+
+	return newQUICConn(quicConn, transport, crypt), nil
+}
+
+// Read reads a packet from the connection.
+func (c *QUICConn) Read(b []byte) (n int, err error) {
+	for {
+		ctx := context.Background()
+		cancel := func() {}
+		if !c.readDeadline.IsZero() {
+			ctx, cancel = context.WithDeadline(ctx, c.readDeadline)
+		}
+
+		d, err := c.conn.ReceiveDatagram(ctx)
+		cancel()
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return 0, &timeoutError{Err: "timeout"}
+			}
+			if c.conn.Context().Err() != nil {
+				return 0, io.EOF
+			}
+
+			return 0, err
+		}
+
+		contents, err := c.reassemble(d)
+		if err != nil {
+			log.Verboseln(fmt.Errorf("read %s: %w", c.RemoteAddr(), err))
+			continue
+		}
+		if contents == nil {
+			continue
+		}
+
+		// Decrypt
+		contents, err = c.crypt.Decrypt(contents)
+		if err != nil {
+			return 0, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   c.RemoteAddr(),
+				Err:    fmt.Errorf("decrypt: %w", err),
+			}
+		}
+
+		copy(b, contents)
+
+		return len(contents), nil
+	}
+}
+
+// reassemble returns the contents of the datagram, or nil if it is a fragment of an incomplete packet.
+func (c *QUICConn) reassemble(d []byte) ([]byte, error) {
+	if len(d) < quicHeaderSize {
+		return nil, errors.New("missing header")
+	}
+
+	id := binary.BigEndian.Uint16(d[0:2])
+	index, count := int(d[2]), int(d[3])
+	if index >= count {
+		return nil, fmt.Errorf("fragment %d out of %d", index, count)
+	}
+
+	// Unfragmented
+	if count == 1 {
+		return d[quicHeaderSize:], nil
+	}
+
+	c.fragmentsLock.Lock()
+	defer c.fragmentsLock.Unlock()
+
+	fragments, ok := c.fragments[id]
+	if !ok || len(fragments.chunks) != count {
+		now := time.Now()
+
+		// Drop expired fragments
+		for id, fragments := range c.fragments {
+			if now.Sub(fragments.t) > quicFragmentTimeout {
+				delete(c.fragments, id)
+			}
+		}
+
+		fragments = &quicFragments{
+			chunks: make([][]byte, count),
+			remain: count,
+			t:      now,
+		}
+		c.fragments[id] = fragments
+	}
+	if fragments.chunks[index] != nil {
+		return nil, nil
+	}
+
+	fragments.chunks[index] = d[quicHeaderSize:]
+	fragments.remain--
+	if fragments.remain > 0 {
+		return nil, nil
+	}
+
+	delete(c.fragments, id)
+
+	contents := make([]byte, 0)
+	for _, chunk := range fragments.chunks {
+		contents = append(contents, chunk...)
+	}
+
+	return contents, nil
+}
+
+// Write writes a packet to the connection.
+func (c *QUICConn) Write(b []byte) (n int, err error) {
+	// Encrypt
+	contents, err := c.crypt.Encrypt(b)
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("encrypt: %w", err),
+		}
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	id := c.id
+	c.id++
+
+	// Fragment
+	size := quicMaxDatagramSize - quicHeaderSize
+	count := (len(contents) + size - 1) / size
+	if count > 255 {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("fragments %d exceed 255", count),
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(contents) {
+			end = len(contents)
+		}
+
+		err = c.conn.SendDatagram(append(createQUICHeader(id, uint8(i), uint8(count)), contents[i*size:end]...))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+func createQUICHeader(id uint16, index, count uint8) []byte {
+	header := make([]byte, quicHeaderSize)
+	binary.BigEndian.PutUint16(header[0:2], id)
+	header[2] = index
+	header[3] = count
+
+	return header
+}
+
+func (c *QUICConn) Close() error {
+	err := c.conn.CloseWithError(0, "")
+
+	// The transport is only owned by the client
+	if c.transport != nil {
+		c.transport.Close()
+		c.transport.Conn.Close()
+	}
+
+	return err
+}
+
+func (c *QUICConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *QUICConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *QUICConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *QUICConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline = t
+
+	return nil
+}
+
+// SetWriteDeadline does nothing because datagrams are queued without blocking.
+func (c *QUICConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// QUICListener is a listener which accepts QUIC connections.
+type QUICListener struct {
+	conn      *net.UDPConn
+	transport *quic.Transport
+	listener  *quic.EarlyListener
+	crypt     crypto.Crypt
+}
+
+// ListenQUIC acts like ListenUDP for pcap networks in QUIC.
+func ListenQUIC(dev *Device, srcPort uint16, config *tls.Config, crypt crypto.Crypt) (*QUICListener, error) {
+	srcAddr := &net.UDPAddr{
+		IP:   dev.IPAddr().IP,
+		Port: int(srcPort),
+	}
+
+	conn, err := net.ListenUDP("udp4", srcAddr)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "listen",
+			Net:    "pcap",
+			Source: srcAddr,
+			Err:    err,
+		}
+	}
+
+	transport := &quic.Transport{Conn: conn}
+
+	listener, err := transport.ListenEarly(createQUICTLSConfig(config), createQUICConfig())
+	if err != nil {
+		transport.Close()
+		conn.Close()
+
+		return nil, &net.OpError{
+			Op:     "listen",
+			Net:    "pcap",
+			Source: srcAddr,
+			Err:    err,
+		}
+	}
+
+	return &QUICListener{
+		conn:      conn,
+		transport: transport,
+		listener:  listener,
+		crypt:     crypt,
+	}, nil
+}
+
+func (l *QUICListener) Accept() (net.Conn, error) {
+	conn, err := l.listener.Accept(context.Background())
+	if err != nil {
+		return nil, &net.OpError{
+			Op:   "accept",
+			Net:  "pcap",
+			Addr: l.Addr(),
+			Err:  err,
+		}
+	}
+
+	return newQUICConn(conn, nil, l.crypt), nil
+}
+
+func (l *QUICListener) Close() error {
+	err := l.listener.Close()
+	if err != nil {
+		return err
+	}
+
+	err = l.transport.Close()
+	if err != nil {
+		return err
+	}
+
+	return l.conn.Close()
+}
+
+func (l *QUICListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
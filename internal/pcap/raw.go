@@ -2,7 +2,7 @@
 
 import (
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/layers"
 )
 
 type timeoutError struct {
@@ -27,11 +27,26 @@ func (err *timeoutError) Timeout() bool {
 // maxSnapLen is the max size of each packet in pcap raw conn.
 const maxSnapLen = 65535
 
+// rawHandle is a handle of the capture backend, which is libpcap by default and AF_PACKET with the afpacket build tag.
+type rawHandle interface {
+	ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	WritePacketData(data []byte) error
+	LinkType() layers.LinkType
+	Close()
+}
+
+// fileHandle is a handle reading packets from a capture file.
+type fileHandle interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+	Close()
+}
+
 // RawConn is a raw network connection.
 type RawConn struct {
 	srcDev *Device
 	dstDev *Device
-	handle *pcap.Handle
+	handle rawHandle
 	buffer []byte
 }
 
@@ -40,12 +55,7 @@ func newRawConn() *RawConn {
 }
 
 func createPureRawConn(dev, filter string) (*RawConn, error) {
-	handle, err := pcap.OpenLive(dev, maxSnapLen, true, pcap.BlockForever)
-	if err != nil {
-		return nil, err
-	}
-
-	err = handle.SetBPFFilter(filter)
+	handle, err := openLive(dev, filter)
 	if err != nil {
 		return nil, err
 	}
@@ -127,13 +137,13 @@ func (c *RawConn) IsLoop() bool {
 
 // Reader is a reader reads packets from a pcap file.
 type Reader struct {
-	handle *pcap.Handle
+	handle fileHandle
 	ps     *gopacket.PacketSource
 }
 
 // CreateReader creates a reader reading a pcap file.
 func CreateReader(file string) (*Reader, error) {
-	handle, err := pcap.OpenOffline(file)
+	handle, err := openOffline(file)
 	if err != nil {
 		return nil, err
 	}
@@ -166,6 +176,11 @@ func (r *Reader) ReadPacket() (gopacket.Packet, error) {
 	return packet, nil
 }
 
+// LinkType returns the link type of packets in the file.
+func (r *Reader) LinkType() layers.LinkType {
+	return r.handle.LinkType()
+}
+
 func (r *Reader) Close() error {
 	r.handle.Close()
 
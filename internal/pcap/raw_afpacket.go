@@ -0,0 +1,71 @@
+// +build afpacket
+
+package pcap
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"io"
+	"os"
+	"runtime"
+)
+
+func openLive(dev, filter string) (rawHandle, error) {
+	switch t := runtime.GOOS; t {
+	case "linux":
+		return openAFPacket(dev, filter)
+	default:
+		return nil, fmt.Errorf("os %s not support", t)
+	}
+}
+
+// pcapgoHandle is a handle reading packets from a pcap or pcapng file without libpcap.
+type pcapgoHandle struct {
+	reader interface {
+		gopacket.PacketDataSource
+		LinkType() layers.LinkType
+	}
+	file *os.File
+}
+
+func (h *pcapgoHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return h.reader.ReadPacketData()
+}
+
+func (h *pcapgoHandle) LinkType() layers.LinkType {
+	return h.reader.LinkType()
+}
+
+func (h *pcapgoHandle) Close() {
+	h.file.Close()
+}
+
+func openOffline(file string) (fileHandle, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// Try pcap first, and then pcapng
+	r, err := pcapgo.NewReader(bufio.NewReader(f))
+	if err == nil {
+		return &pcapgoHandle{reader: r, file: f}, nil
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	ngr, err := pcapgo.NewNgReader(bufio.NewReader(f), pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unknown file format: %w", err)
+	}
+
+	return &pcapgoHandle{reader: ngr, file: f}, nil
+}
@@ -0,0 +1,26 @@
+// +build !afpacket
+
+package pcap
+
+import (
+	"github.com/google/gopacket/pcap"
+)
+
+func openLive(dev, filter string) (rawHandle, error) {
+	handle, err := pcap.OpenLive(dev, maxSnapLen, true, pcap.BlockForever)
+	if err != nil {
+		return nil, err
+	}
+
+	err = handle.SetBPFFilter(filter)
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+
+	return handle, nil
+}
+
+func openOffline(file string) (fileHandle, error) {
+	return pcap.OpenOffline(file)
+}
@@ -0,0 +1,329 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/zhxie/ikago/internal/filter"
+	"golang.org/x/net/bpf"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// replayGrace is the duration waited after all packets are replayed, so packets replayed can be handled.
+const replayGrace = time.Second
+
+// Replay replays packets in a capture file to endpoints, and writes packets written in endpoints to a capture file.
+type Replay struct {
+	reader    *Reader
+	file      *os.File
+	writer    *pcapgo.Writer
+	linkType  layers.LinkType
+	conns     map[*ReplayConn]bool
+	started   bool
+	done      chan struct{}
+	closed    chan struct{}
+	routines  sync.WaitGroup
+	lock      sync.RWMutex
+	writeLock sync.Mutex
+}
+
+// OpenReplay opens a capture file for replaying. Packets in the file are replayed to endpoints in devices of the replay
+// whose filters match once the replay is started, and packets written in these endpoints are written to the output file.
+func OpenReplay(file, output string) (*Replay, error) {
+	reader, err := CreateReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", file, err)
+	}
+
+	// Packets are written in the link layers of devices
+	t := reader.LinkType()
+	if t != layers.LinkTypeEthernet {
+		reader.Close()
+		return nil, fmt.Errorf("link type %s not support", t)
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		reader.Close()
+		return nil, fmt.Errorf("create %s: %w", output, err)
+	}
+	writer := pcapgo.NewWriter(f)
+	err = writer.WriteFileHeader(maxSnapLen, t)
+	if err != nil {
+		f.Close()
+		reader.Close()
+		return nil, fmt.Errorf("write %s: %w", output, err)
+	}
+
+	return &Replay{
+		reader:   reader,
+		file:     f,
+		writer:   writer,
+		linkType: t,
+		conns:    make(map[*ReplayConn]bool),
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}, nil
+}
+
+// Devices returns copies of devices whose endpoints are on the replay instead of the devices.
+func (r *Replay) Devices(devs []*Device) []*Device {
+	result := make([]*Device, 0, len(devs))
+
+	for _, dev := range devs {
+		d := *dev
+		d.replay = r
+		result = append(result, &d)
+	}
+
+	return result
+}
+
+// Start starts replaying packets. Packets are replayed in the intervals they were captured.
+func (r *Replay) Start() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.started {
+		return
+	}
+	select {
+	case <-r.closed:
+		return
+	default:
+	}
+	r.started = true
+
+	r.routines.Add(1)
+	go func() {
+		defer r.routines.Done()
+		r.run()
+	}()
+}
+
+// Done returns a channel which is closed after all packets are replayed.
+func (r *Replay) Done() <-chan struct{} {
+	return r.done
+}
+
+// Close closes the replay and all endpoints on it.
+func (r *Replay) Close() error {
+	r.lock.Lock()
+	select {
+	case <-r.closed:
+		r.lock.Unlock()
+		return nil
+	default:
+	}
+	close(r.closed)
+	conns := r.conns
+	r.conns = make(map[*ReplayConn]bool)
+	r.lock.Unlock()
+
+	for conn := range conns {
+		conn.Close()
+	}
+
+	// Wait for replaying to exit before closing the reader
+	r.routines.Wait()
+
+	r.reader.Close()
+
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+
+	return r.file.Close()
+}
+
+func (r *Replay) createConn(srcDev, dstDev *Device, f string) (*ReplayConn, error) {
+	insts, err := filter.Compile(f, r.linkType)
+	if err != nil {
+		return nil, fmt.Errorf("compile filter: %w", err)
+	}
+	vm, err := bpf.NewVM(disassemble(insts))
+	if err != nil {
+		return nil, fmt.Errorf("load filter: %w", err)
+	}
+
+	conn := &ReplayConn{
+		replay:  r,
+		srcDev:  srcDev,
+		dstDev:  dstDev,
+		vm:      vm,
+		packets: make(chan []byte, wireQueueSize),
+		closed:  make(chan struct{}),
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	select {
+	case <-r.closed:
+		return nil, errors.New("replay closed")
+	default:
+	}
+	r.conns[conn] = true
+
+	return conn, nil
+}
+
+func (r *Replay) run() {
+	var first time.Time
+	start := time.Now()
+
+	for {
+		data, ci, err := r.reader.handle.ReadPacketData()
+		if err != nil {
+			// Malformed packets end the replay the same as the end of the file
+			break
+		}
+
+		// Replay in the interval
+		if first.IsZero() {
+			first = ci.Timestamp
+		}
+		select {
+		case <-time.After(time.Until(start.Add(ci.Timestamp.Sub(first)))):
+		case <-r.closed:
+			return
+		}
+
+		r.deliver(data)
+	}
+
+	select {
+	case <-time.After(replayGrace):
+	case <-r.closed:
+		return
+	}
+
+	close(r.done)
+}
+
+// deliver delivers the packet to endpoints whose filters match. Packets are never dropped, so delivering waits for
+// endpoints to read.
+func (r *Replay) deliver(data []byte) {
+	r.lock.RLock()
+	conns := make([]*ReplayConn, 0, len(r.conns))
+	for conn := range r.conns {
+		conns = append(conns, conn)
+	}
+	r.lock.RUnlock()
+
+	for _, conn := range conns {
+		n, err := conn.vm.Run(data)
+		if err != nil || n <= 0 {
+			continue
+		}
+
+		d := make([]byte, len(data))
+		copy(d, data)
+
+		select {
+		case conn.packets <- d:
+		case <-conn.closed:
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+func (r *Replay) write(b []byte) error {
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+
+	select {
+	case <-r.closed:
+		return errors.New("replay closed")
+	default:
+	}
+
+	return r.writer.WritePacket(gopacket.CaptureInfo{
+		Timestamp:     time.Now(),
+		CaptureLength: len(b),
+		Length:        len(b),
+	}, b)
+}
+
+func (r *Replay) removeConn(conn *ReplayConn) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.conns, conn)
+}
+
+// ReplayConn is a packet endpoint in a replay.
+type ReplayConn struct {
+	replay    *Replay
+	srcDev    *Device
+	dstDev    *Device
+	vm        *bpf.VM
+	packets   chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *ReplayConn) Read(b []byte) (n int, err error) {
+	select {
+	case d := <-c.packets:
+		copy(b, d)
+
+		return len(d), nil
+	case <-c.closed:
+		return 0, io.EOF
+	}
+}
+
+// ReadPacket reads packet from the connection.
+func (c *ReplayConn) ReadPacket() (gopacket.Packet, error) {
+	select {
+	case d := <-c.packets:
+		return gopacket.NewPacket(d, c.replay.linkType, gopacket.NoCopy), nil
+	case <-c.closed:
+		return nil, io.EOF
+	}
+}
+
+func (c *ReplayConn) Write(b []byte) (n int, err error) {
+	select {
+	case <-c.closed:
+		return 0, errors.New("closed")
+	default:
+	}
+
+	err = c.replay.write(b)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (c *ReplayConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.replay.removeConn(c)
+	})
+
+	return nil
+}
+
+// LocalDev returns the local device.
+func (c *ReplayConn) LocalDev() *Device {
+	return c.srcDev
+}
+
+// RemoteDev returns the remote device.
+func (c *ReplayConn) RemoteDev() *Device {
+	return c.dstDev
+}
+
+// IsLoop returns if the connection is to a loopback device.
+func (c *ReplayConn) IsLoop() bool {
+	return c.dstDev.IsLoop()
+}
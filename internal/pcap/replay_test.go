@@ -0,0 +1,104 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	srcIP, dstIP := net.IPv4(10, 0, 0, 2).To4(), net.IPv4(10, 0, 0, 3).To4()
+	srcMAC, dstMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}, net.HardwareAddr{0x02, 0, 0, 0, 0, 3}
+	dir := t.TempDir()
+
+	// Packets more than the queue are captured at once
+	size := 2 * wireQueueSize
+	input := filepath.Join(dir, "input.pcap")
+	f, err := os.Create(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := pcapgo.NewWriter(f)
+	err = w.WriteFileHeader(maxSnapLen, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Now()
+	for i := 0; i < size; i++ {
+		udpLayer := &layers.UDP{SrcPort: 40000, DstPort: 7}
+		ipv4Layer, err := CreateIPv4Layer(srcIP, dstIP, uint16(i), 64, udpLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ethernetLayer, err := CreateEthernetLayer(srcMAC, dstMAC, ipv4Layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, uint32(i))
+		data, err := Serialize(ethernetLayer, ipv4Layer, udpLayer, gopacket.Payload(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.WritePacket(gopacket.CaptureInfo{Timestamp: timestamp, CaptureLength: len(data), Length: len(data)}, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	r, err := OpenReplay(input, filepath.Join(dir, "output.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	dev := &Device{alias: "replay", ipAddrs: []*net.IPNet{{IP: dstIP, Mask: net.CIDRMask(24, 32)}}, hardwareAddr: dstMAC}
+	devs := r.Devices([]*Device{dev})
+	conn, err := CreateEndpoint(devs[0], devs[0], "udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// All packets are delivered in order even if the endpoint reads later
+	r.Start()
+	time.Sleep(100 * time.Millisecond)
+
+	seqs := make(chan uint32)
+	go func() {
+		for {
+			packet, err := conn.ReadPacket()
+			if err != nil {
+				close(seqs)
+				return
+			}
+			seqs <- binary.BigEndian.Uint32(packet.ApplicationLayer().Payload())
+		}
+	}()
+	for i := 0; i < size; i++ {
+		select {
+		case seq, ok := <-seqs:
+			if !ok {
+				t.Fatalf("packet %d: closed", i)
+			}
+			if seq != uint32(i) {
+				t.Fatalf("packet %d: seq %d", i, seq)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("packet %d: timeout", i)
+		}
+	}
+
+	select {
+	case <-r.Done():
+	case <-time.After(replayGrace + time.Second):
+		t.Fatal("done: timeout")
+	}
+}
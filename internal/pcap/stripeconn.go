@@ -0,0 +1,283 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stripe describes how packets are spread across connections.
+type Stripe int
+
+const (
+	// StripeRoundRobin describes packets are spread across connections in turn.
+	StripeRoundRobin Stripe = iota
+	// StripeHash describes packets of the same flow are always sent in the same connection.
+	StripeHash
+)
+
+func (s Stripe) String() string {
+	switch s {
+	case StripeRoundRobin:
+		return "Round-robin"
+	case StripeHash:
+		return "Hash"
+	default:
+		return strconv.Itoa(int(s))
+	}
+}
+
+// ParseStripe returns a stripe by given method.
+func ParseStripe(s string) (Stripe, error) {
+	switch strings.ToLower(s) {
+	case "", "roundrobin", "round-robin", "rr":
+		return StripeRoundRobin, nil
+	case "hash":
+		return StripeHash, nil
+	default:
+		return StripeRoundRobin, fmt.Errorf("stripe %s not support", s)
+	}
+}
+
+type stripeTuple struct {
+	b   []byte
+	err error
+}
+
+// StripeConn is a connection which spreads packets across multiple connections, and reads packets from all of them.
+type StripeConn struct {
+	conns        []net.Conn
+	stripe       Stripe
+	next         int
+	lock         sync.Mutex
+	ch           chan stripeTuple
+	closed       chan struct{}
+	alive        int
+	readDeadline time.Time
+}
+
+// NewStripeConn returns a connection striping over the given connections.
+func NewStripeConn(conns []net.Conn, stripe Stripe) *StripeConn {
+	c := &StripeConn{
+		conns:  conns,
+		stripe: stripe,
+		ch:     make(chan stripeTuple, len(conns)),
+		closed: make(chan struct{}),
+		alive:  len(conns),
+	}
+
+	for _, conn := range conns {
+		go c.read(conn)
+	}
+
+	return c
+}
+
+func (c *StripeConn) read(conn net.Conn) {
+	b := make([]byte, IPv4MaxSize)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			// Read deadlines are kept by the connection itself, flows are always read
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				conn.SetReadDeadline(time.Time{})
+				continue
+			}
+
+			if errors.Is(err, io.EOF) {
+				c.lock.Lock()
+				c.alive--
+				alive := c.alive
+				c.lock.Unlock()
+
+				// Report EOF after all connections are closed
+				if alive > 0 {
+					return
+				}
+			}
+
+			select {
+			case c.ch <- stripeTuple{err: err}:
+			case <-c.closed:
+				return
+			}
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			continue
+		}
+
+		newB := make([]byte, n)
+		copy(newB, b[:n])
+
+		select {
+		case c.ch <- stripeTuple{b: newB}:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// Read reads a packet from any of the connections.
+func (c *StripeConn) Read(b []byte) (n int, err error) {
+	c.lock.Lock()
+	deadline := c.readDeadline
+	c.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case t := <-c.ch:
+		if t.err != nil {
+			return 0, t.err
+		}
+
+		copy(b, t.b)
+
+		return len(t.b), nil
+	case <-timeout:
+		return 0, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    &timeoutError{Err: "timeout"},
+		}
+	case <-c.closed:
+		return 0, io.EOF
+	}
+}
+
+// Write writes a packet to one of the connections decided by the stripe.
+func (c *StripeConn) Write(b []byte) (n int, err error) {
+	var i int
+
+	switch c.stripe {
+	case StripeHash:
+		i = int(flowHash(b) % uint32(len(c.conns)))
+	default:
+		c.lock.Lock()
+		i = c.next
+		c.next = (c.next + 1) % len(c.conns)
+		c.lock.Unlock()
+	}
+
+	return c.conns[i].Write(b)
+}
+
+// flowHash returns the hash of the flow of an IPv4 packet. Ports are included only if the packet is not fragmented so
+// fragments of a packet are in the same flow.
+func flowHash(b []byte) uint32 {
+	if len(b) < 20 || b[0]>>4 != 4 {
+		return 0
+	}
+	ihl := int(b[0]&0x0f) * 4
+	if ihl < 20 || len(b) < ihl {
+		return 0
+	}
+
+	protocol := b[9]
+
+	h := fnv.New32a()
+
+	// Protocol, source and destination
+	h.Write(b[9:10])
+	h.Write(b[12:20])
+
+	isFrag := binary.BigEndian.Uint16(b[6:8])&0x3fff != 0
+	if !isFrag && (protocol == 6 || protocol == 17) && len(b) >= ihl+4 {
+		h.Write(b[ihl : ihl+4])
+	}
+
+	return h.Sum32()
+}
+
+func (c *StripeConn) Close() error {
+	var err error
+
+	select {
+	case <-c.closed:
+		return nil
+	default:
+		close(c.closed)
+	}
+
+	// Close connections concurrently for they may close gracefully
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+	)
+	for _, conn := range c.conns {
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+
+			e := conn.Close()
+			if e != nil {
+				lock.Lock()
+				if err == nil {
+					err = e
+				}
+				lock.Unlock()
+			}
+		}(conn)
+	}
+	wg.Wait()
+
+	return err
+}
+
+// Conns returns the connections of the connection.
+func (c *StripeConn) Conns() []net.Conn {
+	return c.conns
+}
+
+func (c *StripeConn) LocalAddr() net.Addr {
+	return c.conns[0].LocalAddr()
+}
+
+func (c *StripeConn) RemoteAddr() net.Addr {
+	return c.conns[0].RemoteAddr()
+}
+
+func (c *StripeConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+
+	return c.SetWriteDeadline(t)
+}
+
+func (c *StripeConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.readDeadline = t
+
+	return nil
+}
+
+func (c *StripeConn) SetWriteDeadline(t time.Time) error {
+	for _, conn := range c.conns {
+		err := conn.SetWriteDeadline(t)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package pcap
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStripeConnReadDeadline(t *testing.T) {
+	conns, peers := make([]net.Conn, 0), make([]net.Conn, 0)
+	for i := 0; i < 2; i++ {
+		conn, peer := net.Pipe()
+		conns = append(conns, conn)
+		peers = append(peers, peer)
+	}
+	c := NewStripeConn(conns, StripeRoundRobin)
+	defer c.Close()
+
+	// Reads time out in the deadline
+	err := c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, IPv4MaxSize)
+	_, err = c.Read(b)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("read: %v", err)
+	}
+
+	// Flows are still read after the deadline is cleared
+	err = c.SetReadDeadline(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go peers[1].Write([]byte("stripe"))
+	n, err := c.Read(b)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(b[:n]) != "stripe" {
+		t.Errorf("read %q", b[:n])
+	}
+}
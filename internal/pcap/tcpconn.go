@@ -1,33 +1,38 @@
 package pcap
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/zhxie/ikago/internal/crypto"
 	"github.com/zhxie/ikago/internal/log"
+	"io"
 	"net"
+	"sync"
 	"time"
 )
 
-const keepSticky = 30 * time.Second
+// recordHeaderSize is the size of the plain length header of a record.
+const recordHeaderSize = 2
 
+// TCPConn is a connection which transmits packets in length-prefixed records over a standard TCP connection.
 type TCPConn struct {
-	conn    *net.TCPConn
-	crypt   crypto.Crypt
-	buffer  []byte
-	destick *Desticker
-	stash   [][]byte
-	stashId int
+	conn      net.Conn
+	crypt     crypto.Crypt
+	header    []byte
+	buffer    []byte
+	readLock  sync.Mutex
+	writeLock sync.Mutex
+	isBroken  bool
 }
 
-func newTCPConn() *TCPConn {
-	conn := &TCPConn{
-		buffer:  make([]byte, 65535),
-		destick: NewDesticker(),
-		stash:   make([][]byte, 0),
+func newTCPConn(conn net.Conn, crypt crypto.Crypt) *TCPConn {
+	return &TCPConn{
+		conn:   conn,
+		crypt:  crypt,
+		header: make([]byte, recordHeaderSize+crypt.Cost()),
+		buffer: make([]byte, IPv4MaxSize+crypt.Cost()),
 	}
-	conn.destick.SetDeadline(keepSticky)
-
-	return conn
 }
 
 // DialTCP acts like DialTCP for pcap networks.
@@ -41,7 +46,7 @@ func DialTCP(dev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Cry
 
 	t := time.Now()
 
-	conn, err := net.DialTCP("tcp4", srcAddr, dstAddr)
+	conn, err := net.DialTCP("tcp", srcAddr, dstAddr)
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -56,62 +61,136 @@ func DialTCP(dev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Cry
 
 	log.Infof("Connected to server %s in %.3f ms (RTT)\n", dstAddr.String(), float64(duration.Microseconds())/1000)
 
-	tcpConn := newTCPConn()
-	tcpConn.conn = conn
-	tcpConn.crypt = crypt
-
-	return tcpConn, nil
+	return newTCPConn(conn, crypt), nil
 }
 
+// Read reads a whole record from the connection. Records may be split or concatenated by the TCP stream, so a record
+// will be reassembled before being decrypted.
 func (c *TCPConn) Read(b []byte) (n int, err error) {
-	// If stashed packets exist, read from stash, otherwise, read from conn
-	if c.stash == nil || len(c.stash) <= c.stashId {
-		n, err = c.conn.Read(c.buffer)
-		if err != nil {
-			return 0, err
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	// The stream cannot be recovered once a record is corrupted
+	if c.isBroken {
+		return 0, io.EOF
+	}
+
+	// Length header
+	_, err = io.ReadFull(c.conn, c.header)
+	if err != nil {
+		c.breakOnError(err)
+
+		return 0, err
+	}
+
+	header, err := c.crypt.Decrypt(c.header)
+	if err != nil {
+		c.isBroken = true
+
+		return 0, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("decrypt header: %w", err),
 		}
+	}
+	if len(header) != recordHeaderSize {
+		c.isBroken = true
 
-		dp, err := c.crypt.Decrypt(c.buffer[:n])
-		if err != nil {
-			return 0, &net.OpError{
-				Op:     "read",
-				Net:    "pcap",
-				Source: c.LocalAddr(),
-				Addr:   c.RemoteAddr(),
-				Err:    fmt.Errorf("decrypt: %w", err),
-			}
+		return 0, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("parse header: %w", errors.New("invalid size")),
 		}
+	}
+
+	// Payload
+	size := int(binary.BigEndian.Uint16(header)) + c.crypt.Cost()
+	_, err = io.ReadFull(c.conn, c.buffer[:size])
+	if err != nil {
+		c.breakOnError(err)
 
-		// Destick
-		packets, err := c.destick.Append(dp)
-		if err != nil {
-			return 0, &net.OpError{
-				Op:     "read",
-				Net:    "pcap",
-				Source: c.LocalAddr(),
-				Addr:   c.RemoteAddr(),
-				Err:    fmt.Errorf("destick: %w", err),
-			}
+		if errors.Is(err, io.EOF) {
+			return 0, io.ErrUnexpectedEOF
 		}
 
-		if len(packets) == 0 {
-			return 0, nil
+		return 0, err
+	}
+
+	contents, err := c.crypt.Decrypt(c.buffer[:size])
+	if err != nil {
+		c.isBroken = true
+
+		return 0, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("decrypt: %w", err),
 		}
+	}
 
-		c.stash = packets
-		c.stashId = 0
+	// The record is consumed even if the buffer is short, so the stream is kept in records
+	if len(b) < len(contents) {
+		return 0, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    io.ErrShortBuffer,
+		}
 	}
 
-	// Read stashed packet
-	copy(b, c.stash[c.stashId])
+	copy(b, contents)
 
-	c.stashId++
+	return len(contents), nil
+}
 
-	return len(c.stash[c.stashId-1]), nil
+// breakOnError marks the connection as broken if the error is not a timeout, so the connection will not be read again.
+func (c *TCPConn) breakOnError(err error) {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return
+	}
+
+	c.isBroken = true
 }
 
+// Write writes a record to the connection. The record is composed of an encrypted length header and the encrypted
+// data, and is written in one piece.
 func (c *TCPConn) Write(b []byte) (n int, err error) {
+	if len(b) > IPv4MaxSize {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("size %d exceeds %d", len(b), IPv4MaxSize),
+		}
+	}
+
+	// Records are encrypted and written under the lock, so a record is never interleaved with others
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
 	// Encrypt
+	header := make([]byte, recordHeaderSize)
+	binary.BigEndian.PutUint16(header, uint16(len(b)))
+
+	encryptedHeader, err := c.crypt.Encrypt(header)
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("encrypt header: %w", err),
+		}
+	}
+
 	contents, err := c.crypt.Encrypt(b)
 	if err != nil {
 		return 0, &net.OpError{
@@ -123,7 +202,12 @@ func (c *TCPConn) Write(b []byte) (n int, err error) {
 		}
 	}
 
-	return c.conn.Write(contents)
+	_, err = c.conn.Write(append(encryptedHeader, contents...))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
 }
 
 func (c *TCPConn) Close() error {
@@ -151,18 +235,36 @@ func (c *TCPConn) SetWriteDeadline(t time.Time) error {
 }
 
 type TCPListener struct {
-	listener *net.TCPListener
+	listener net.Listener
 	crypt    crypto.Crypt
 }
 
 // ListenTCP acts like ListenTCP for pcap networks.
 func ListenTCP(dev *Device, srcPort uint16, crypt crypto.Crypt) (*TCPListener, error) {
+	return listenTCP(dev.IPAddr().IP, srcPort, crypt)
+}
+
+// ListenTCP6 acts like ListenTCP for pcap networks in the IPv6 address of the device.
+func ListenTCP6(dev *Device, srcPort uint16, crypt crypto.Crypt) (*TCPListener, error) {
+	ipAddr := dev.IPv6Addr()
+	if ipAddr == nil {
+		return nil, &net.OpError{
+			Op:  "listen",
+			Net: "pcap",
+			Err: fmt.Errorf("missing ipv6 address in device %s", dev.Alias()),
+		}
+	}
+
+	return listenTCP(ipAddr.IP, srcPort, crypt)
+}
+
+func listenTCP(ip net.IP, srcPort uint16, crypt crypto.Crypt) (*TCPListener, error) {
 	srcAddr := &net.TCPAddr{
-		IP:   dev.IPAddr().IP,
+		IP:   ip,
 		Port: int(srcPort),
 	}
 
-	listener, err := net.ListenTCP("tcp4", srcAddr)
+	listener, err := net.ListenTCP("tcp", srcAddr)
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "listen",
@@ -179,16 +281,12 @@ func ListenTCP(dev *Device, srcPort uint16, crypt crypto.Crypt) (*TCPListener, e
 }
 
 func (l *TCPListener) Accept() (net.Conn, error) {
-	conn, err := l.listener.AcceptTCP()
+	conn, err := l.listener.Accept()
 	if err != nil {
 		return nil, err
 	}
 
-	tcpConn := newTCPConn()
-	tcpConn.conn = conn
-	tcpConn.crypt = l.crypt
-
-	return tcpConn, nil
+	return newTCPConn(conn, l.crypt), nil
 }
 
 func (l *TCPListener) Close() error {
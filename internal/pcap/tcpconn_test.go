@@ -0,0 +1,136 @@
+package pcap
+
+import (
+	"bytes"
+	"errors"
+	"github.com/zhxie/ikago/internal/crypto"
+	"io"
+	"net"
+	"testing"
+)
+
+// recordConn is a connection which keeps records written.
+type recordConn struct {
+	net.Conn
+	records [][]byte
+}
+
+func (c *recordConn) Write(b []byte) (n int, err error) {
+	c.records = append(c.records, append([]byte{}, b...))
+
+	return len(b), nil
+}
+
+// readTCPConn writes the stream in chunks to a connection, and returns the connection which reads records from it.
+func readTCPConn(t *testing.T, crypt crypto.Crypt, stream []byte, chunk int) *TCPConn {
+	t.Helper()
+
+	r, w := net.Pipe()
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+
+	go func() {
+		defer w.Close()
+
+		for i := 0; i < len(stream); i = i + chunk {
+			end := i + chunk
+			if end > len(stream) {
+				end = len(stream)
+			}
+			_, err := w.Write(stream[i:end])
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return newTCPConn(r, crypt)
+}
+
+func TestTCPConn(t *testing.T) {
+	key, iv := crypto.DeriveKey("ikago", 16), crypto.DeriveKey("iv", 16)
+	crypts := []struct {
+		name  string
+		crypt func() (crypto.Crypt, error)
+	}{
+		{"aes-cfb", func() (crypto.Crypt, error) { return crypto.CreateAESCFBCrypt(key, iv) }},
+		{"aes-gcm", func() (crypto.Crypt, error) { return crypto.CreateAESGCMCrypt(key) }},
+	}
+	payloads := [][]byte{[]byte("a"), bytes.Repeat([]byte("ikago"), 300), bytes.Repeat([]byte{0xff}, 1400)}
+
+	for _, c := range crypts {
+		// Stream crypts are stateful, so each side in each case has its own crypt
+		newCrypt := func() crypto.Crypt {
+			crypt, err := c.crypt()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return crypt
+		}
+		newStream := func() []byte {
+			conn := &recordConn{}
+			w := newTCPConn(conn, newCrypt())
+			for _, payload := range payloads {
+				_, err := w.Write(payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(conn.records) != len(payloads) {
+				t.Fatalf("%s: %d records written", c.name, len(conn.records))
+			}
+
+			return bytes.Join(conn.records, nil)
+		}
+
+		// Records are split across reads, or coalesced in one read
+		for _, chunk := range []int{7, 1 << 16} {
+			conn := readTCPConn(t, newCrypt(), newStream(), chunk)
+			b := make([]byte, IPv4MaxSize)
+			for i, payload := range payloads {
+				n, err := conn.Read(b)
+				if err != nil {
+					t.Fatalf("%s in chunks of %d: read %d: %v", c.name, chunk, i, err)
+				}
+				if !bytes.Equal(b[:n], payload) {
+					t.Errorf("%s in chunks of %d: record %d mismatch", c.name, chunk, i)
+				}
+			}
+		}
+
+		// Short buffers consume the record
+		conn := readTCPConn(t, newCrypt(), newStream(), 1<<16)
+		b := make([]byte, IPv4MaxSize)
+		n, err := conn.Read(b[:1])
+		if err != nil || !bytes.Equal(b[:n], payloads[0]) {
+			t.Errorf("%s: read before short buffer: %v", c.name, err)
+		}
+		_, err = conn.Read(b[:len(payloads[1])-1])
+		if !errors.Is(err, io.ErrShortBuffer) {
+			t.Errorf("%s: short buffer: %v", c.name, err)
+		}
+		n, err = conn.Read(b)
+		if err != nil || !bytes.Equal(b[:n], payloads[2]) {
+			t.Errorf("%s: read after short buffer: %v", c.name, err)
+		}
+
+		// A corrupted length header breaks the connection
+		stream := newStream()
+		stream[0] = stream[0] ^ 0xff
+		conn = readTCPConn(t, newCrypt(), stream, 1<<16)
+		_, err = conn.Read(b)
+		if err == nil {
+			t.Errorf("%s: corrupted header accepted", c.name)
+		}
+		if !conn.isBroken {
+			t.Errorf("%s: not broken", c.name)
+		}
+		_, err = conn.Read(b)
+		if err != io.EOF {
+			t.Errorf("%s: read after broken: %v", c.name, err)
+		}
+	}
+}
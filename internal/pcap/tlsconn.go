@@ -0,0 +1,169 @@
+package pcap
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/zhxie/ikago/internal/crypto"
+	"github.com/zhxie/ikago/internal/log"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+// DialTLS acts like DialTCP for pcap networks in TLS. Packets are transmitted in the same records as in TCP.
+func DialTLS(dev *Device, srcPort uint16, dstAddr *net.TCPAddr, config *tls.Config, crypt crypto.Crypt) (*TCPConn, error) {
+	srcAddr := &net.TCPAddr{
+		IP:   dev.IPAddr().IP,
+		Port: int(srcPort),
+	}
+
+	log.Infof("Connect to server %s\n", dstAddr.String())
+
+	t := time.Now()
+
+	dialer := &net.Dialer{
+		Timeout:   establishDeadline,
+		LocalAddr: srcAddr,
+	}
+
+	conn, err := tls.DialWithDialer(dialer, "tcp4", dstAddr.String(), config)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    err,
+		}
+	}
+
+	duration := time.Now().Sub(t)
+
+	log.Infof("Connected to server %s in %.3f ms (RTT)\n", dstAddr.String(), float64(duration.Microseconds())/1000)
+
+	return newTCPConn(conn, crypt), nil
+}
+
+// ListenTLS acts like ListenTCP for pcap networks in TLS.
+func ListenTLS(dev *Device, srcPort uint16, config *tls.Config, crypt crypto.Crypt) (*TCPListener, error) {
+	l, err := ListenTCP(dev, srcPort, crypt)
+	if err != nil {
+		return nil, err
+	}
+
+	l.listener = tls.NewListener(l.listener, config)
+
+	return l, nil
+}
+
+// CreateTLSClientConfig returns a TLS config for clients. The server name will be sent as SNI and be used to verify the
+// certificate of the server if it is not empty. If the pin is not empty, the certificate will be verified by its pin
+// instead of the system certificate pool, which allows self-signed certificates.
+func CreateTLSClientConfig(serverName, pin string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         serverName,
+		MinVersion:         tls.VersionTLS12,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+
+	if pin != "" {
+		b, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+		if err != nil {
+			return nil, fmt.Errorf("parse pin: %w", err)
+		}
+		if len(b) != sha256.Size {
+			return nil, fmt.Errorf("parse pin: %w", errors.New("invalid size"))
+		}
+
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(rawCerts) <= 0 {
+				return errors.New("missing certificate")
+			}
+
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return fmt.Errorf("parse certificate: %w", err)
+			}
+
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			if !bytes.Equal(sum[:], b) {
+				return fmt.Errorf("pin %s mismatched", hex.EncodeToString(sum[:]))
+			}
+
+			return nil
+		}
+	}
+
+	return config, nil
+}
+
+// CreateTLSServerConfig returns a TLS config for servers with the certificate and key in the given files, and the pin
+// of the certificate.
+func CreateTLSServerConfig(certFile, keyFile string) (*tls.Config, string, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, "", fmt.Errorf("load key pair: %w", err)
+	}
+
+	return createTLSServerConfig(cert)
+}
+
+// CreateSelfSignedTLSServerConfig returns a TLS config for servers with a newly generated self-signed certificate, and
+// the pin of the certificate.
+func CreateSelfSignedTLSServerConfig() (*tls.Config, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, "", fmt.Errorf("generate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, "", fmt.Errorf("generate serial number: %w", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, "", fmt.Errorf("create certificate: %w", err)
+	}
+
+	return createTLSServerConfig(tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	})
+}
+
+func createTLSServerConfig(cert tls.Certificate) (*tls.Config, string, error) {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, "", fmt.Errorf("parse certificate: %w", err)
+	}
+
+	sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	return config, hex.EncodeToString(sum[:]), nil
+}
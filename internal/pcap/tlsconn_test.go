@@ -0,0 +1,81 @@
+package pcap
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+)
+
+func handshakeTLS(serverConfig, clientConfig *tls.Config) error {
+	// Connections in the loopback are buffered, so the client can fail while the server is writing
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		tls.Server(conn, serverConfig).Handshake()
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return tls.Client(conn, clientConfig).Handshake()
+}
+
+func TestSelfSignedTLSServerConfig(t *testing.T) {
+	serverConfig, pin, err := CreateSelfSignedTLSServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The pin of the certificate generated is accepted
+	clientConfig, err := CreateTLSClientConfig("ikago", pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = handshakeTLS(serverConfig, clientConfig)
+	if err != nil {
+		t.Errorf("handshake with pin: %v", err)
+	}
+
+	// Other pins are rejected
+	clientConfig, err = CreateTLSClientConfig("ikago", strings.Repeat("00", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = handshakeTLS(serverConfig, clientConfig)
+	if err == nil {
+		t.Error("handshake with another pin: accepted")
+	}
+
+	// Self-signed certificates are rejected by the system certificate pool
+	clientConfig, err = CreateTLSClientConfig("ikago", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = handshakeTLS(serverConfig, clientConfig)
+	if err == nil {
+		t.Error("handshake without pin: accepted")
+	}
+
+	// Certificates are generated on every call
+	_, pin2, err := CreateSelfSignedTLSServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pin == pin2 {
+		t.Error("same pin in different certificates")
+	}
+}
@@ -0,0 +1,385 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/xtaci/kcp-go"
+	"github.com/zhxie/ikago/internal/config"
+	"github.com/zhxie/ikago/internal/crypto"
+	"github.com/zhxie/ikago/internal/log"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// udpClientQueue is the size of the queue of each client in UDP listener.
+const udpClientQueue = 1024
+
+// UDPConn is a connection which transmits packets in encrypted datagrams over a standard UDP socket.
+type UDPConn struct {
+	conn         *net.UDPConn
+	dstAddr      *net.UDPAddr
+	crypt        crypto.Crypt
+	buffer       []byte
+	listener     *UDPListener
+	queue        chan []byte
+	isClosed     bool
+	readDeadline time.Time
+	deadlineLock sync.RWMutex
+}
+
+func newUDPConn(conn *net.UDPConn, dstAddr *net.UDPAddr, crypt crypto.Crypt) *UDPConn {
+	return &UDPConn{
+		conn:    conn,
+		dstAddr: dstAddr,
+		crypt:   crypt,
+		buffer:  make([]byte, IPv4MaxSize+crypt.Cost()),
+	}
+}
+
+// DialUDP acts like DialUDP for pcap networks.
+func DialUDP(dev *Device, srcPort uint16, dstAddr *net.UDPAddr, crypt crypto.Crypt) (*UDPConn, error) {
+	srcAddr := &net.UDPAddr{
+		IP:   dev.IPAddr().IP,
+		Port: int(srcPort),
+	}
+
+	// Use an unconnected socket so the connection can also serve as a packet connection for KCP
+	conn, err := net.ListenUDP("udp4", srcAddr)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    err,
+		}
+	}
+
+	log.Infof("Connect to server %s\n", dstAddr.String())
+
+	return newUDPConn(conn, dstAddr, crypt), nil
+}
+
+// listenUDPMulticast listens for incoming packets addressed to the local address in UDP network, and packets from
+// all sources will be received.
+func listenUDPMulticast(dev *Device, srcPort uint16, crypt crypto.Crypt) (*UDPConn, error) {
+	srcAddr := &net.UDPAddr{
+		IP:   dev.IPAddr().IP,
+		Port: int(srcPort),
+	}
+
+	conn, err := net.ListenUDP("udp4", srcAddr)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "listen",
+			Net:    "pcap",
+			Source: srcAddr,
+			Err:    err,
+		}
+	}
+
+	return newUDPConn(conn, nil, crypt), nil
+}
+
+func (c *UDPConn) Read(b []byte) (n int, err error) {
+	// Read from the queue if the connection is accepted from a listener
+	if c.listener != nil {
+		c.deadlineLock.RLock()
+		deadline := c.readDeadline
+		c.deadlineLock.RUnlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timeout = time.After(deadline.Sub(time.Now()))
+		}
+
+		select {
+		case contents, ok := <-c.queue:
+			if !ok {
+				return 0, io.EOF
+			}
+
+			copy(b, contents)
+
+			return len(contents), nil
+		case <-timeout:
+			return 0, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   c.RemoteAddr(),
+				Err:    &timeoutError{Err: "timeout"},
+			}
+		}
+	}
+
+	for {
+		n, addr, err := c.ReadFrom(b)
+		if err != nil {
+			return 0, err
+		}
+
+		// Ignore datagrams from others
+		if c.dstAddr != nil && addr.String() != c.dstAddr.String() {
+			log.Verbosef("Drop datagram from %s other than %s\n", addr.String(), c.dstAddr.String())
+			continue
+		}
+
+		return n, nil
+	}
+}
+
+func (c *UDPConn) Write(b []byte) (n int, err error) {
+	return c.WriteTo(b, c.RemoteAddr())
+}
+
+// ReadFrom reads a datagram from the connection. Datagrams which cannot be decrypted will be dropped.
+func (c *UDPConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, udpAddr, err := c.conn.ReadFromUDP(c.buffer)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		contents, err := c.crypt.Decrypt(c.buffer[:n])
+		if err != nil {
+			log.Verboseln(fmt.Errorf("read from %s: %w", udpAddr.String(), fmt.Errorf("decrypt: %w", err)))
+			continue
+		}
+
+		copy(p, contents)
+
+		return len(contents), udpAddr, nil
+	}
+}
+
+func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   addr,
+			Err:    fmt.Errorf("type %T not support", addr),
+		}
+	}
+
+	// Encrypt
+	contents, err := c.crypt.Encrypt(p)
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   addr,
+			Err:    fmt.Errorf("encrypt: %w", err),
+		}
+	}
+
+	_, err = c.conn.WriteToUDP(contents, udpAddr)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *UDPConn) Close() error {
+	// Connections accepted from a listener share the socket of the listener
+	if c.listener != nil {
+		c.listener.remove(c)
+
+		return nil
+	}
+
+	return c.conn.Close()
+}
+
+func (c *UDPConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *UDPConn) RemoteAddr() net.Addr {
+	return c.dstAddr
+}
+
+func (c *UDPConn) SetDeadline(t time.Time) error {
+	if c.listener != nil {
+		return c.SetReadDeadline(t)
+	}
+
+	return c.conn.SetDeadline(t)
+}
+
+func (c *UDPConn) SetReadDeadline(t time.Time) error {
+	if c.listener != nil {
+		c.deadlineLock.Lock()
+		c.readDeadline = t
+		c.deadlineLock.Unlock()
+
+		return nil
+	}
+
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *UDPConn) SetWriteDeadline(t time.Time) error {
+	if c.listener != nil {
+		return nil
+	}
+
+	return c.conn.SetWriteDeadline(t)
+}
+
+// UDPListener is a listener which demultiplexes datagrams from a standard UDP socket by their sources.
+type UDPListener struct {
+	conn        *UDPConn
+	clientsLock sync.RWMutex
+	clients     map[string]*UDPConn
+	buffer      []byte
+}
+
+// ListenUDP acts like ListenUDP for pcap networks.
+func ListenUDP(dev *Device, srcPort uint16, crypt crypto.Crypt) (*UDPListener, error) {
+	conn, err := listenUDPMulticast(dev, srcPort, crypt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UDPListener{
+		conn:    conn,
+		clients: make(map[string]*UDPConn),
+		buffer:  make([]byte, IPv4MaxSize),
+	}, nil
+}
+
+// Accept reads datagrams from the socket and dispatches them to the corresponding connections, and returns only when
+// a datagram from a new client arrives.
+func (l *UDPListener) Accept() (net.Conn, error) {
+	for {
+		n, addr, err := l.conn.ReadFrom(l.buffer)
+		if err != nil {
+			return nil, &net.OpError{
+				Op:   "accept",
+				Net:  "pcap",
+				Addr: l.Addr(),
+				Err:  err,
+			}
+		}
+
+		contents := make([]byte, n)
+		copy(contents, l.buffer[:n])
+
+		// Datagrams are queued under the lock, so queues are never closed in sending
+		l.clientsLock.RLock()
+		conn, ok := l.clients[addr.String()]
+		if ok {
+			select {
+			case conn.queue <- contents:
+			default:
+				log.Verbosef("Drop datagram from client %s because of full queue\n", addr.String())
+			}
+		}
+		l.clientsLock.RUnlock()
+		if ok {
+			continue
+		}
+
+		// New client
+		conn = newUDPConn(l.conn.conn, addr.(*net.UDPAddr), l.conn.crypt)
+		conn.listener = l
+		conn.queue = make(chan []byte, udpClientQueue)
+		conn.queue <- contents
+
+		l.clientsLock.Lock()
+		l.clients[addr.String()] = conn
+		l.clientsLock.Unlock()
+
+		return conn, nil
+	}
+}
+
+func (l *UDPListener) remove(conn *UDPConn) {
+	l.clientsLock.Lock()
+	defer l.clientsLock.Unlock()
+
+	if conn.isClosed {
+		return
+	}
+	conn.isClosed = true
+
+	delete(l.clients, conn.RemoteAddr().String())
+	close(conn.queue)
+}
+
+func (l *UDPListener) Close() error {
+	l.clientsLock.Lock()
+	for _, conn := range l.clients {
+		conn.isClosed = true
+		close(conn.queue)
+	}
+	l.clients = make(map[string]*UDPConn)
+	l.clientsLock.Unlock()
+
+	return l.conn.Close()
+}
+
+func (l *UDPListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// DialUDPWithKCP connects to the remote address in the UDP network with KCP support.
+func DialUDPWithKCP(dev *Device, srcPort uint16, dstAddr *net.UDPAddr, crypt crypto.Crypt, config *config.KCPConfig) (*kcp.UDPSession, error) {
+	conn, err := DialUDP(dev, srcPort, dstAddr, crypt)
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := kcp.NewConn(dstAddr.String(), nil, config.DataShard, config.ParityShard, conn)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: conn.LocalAddr(),
+			Addr:   conn.RemoteAddr(),
+			Err:    fmt.Errorf("kcp: %w", err),
+		}
+	}
+
+	// Tuning
+	err = tuneKCP(sess, config)
+	if err != nil {
+		sess.Close()
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: conn.LocalAddr(),
+			Addr:   conn.RemoteAddr(),
+			Err:    fmt.Errorf("tune: %w", err),
+		}
+	}
+
+	return sess, nil
+}
+
+// ListenUDPWithKCP listens for incoming packets addressed to the local address in the UDP network with KCP support.
+func ListenUDPWithKCP(dev *Device, srcPort uint16, crypt crypto.Crypt, config *config.KCPConfig) (*kcp.Listener, error) {
+	conn, err := listenUDPMulticast(dev, srcPort, crypt)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := kcp.ServeConn(nil, config.DataShard, config.ParityShard, conn)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "listen",
+			Net:    "pcap",
+			Source: conn.LocalAddr(),
+			Err:    fmt.Errorf("kcp: %w", err),
+		}
+	}
+
+	return listener, err
+}
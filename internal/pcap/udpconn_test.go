@@ -0,0 +1,196 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/zhxie/ikago/internal/crypto"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPListenerClose(t *testing.T) {
+	dev := &Device{ipAddrs: []*net.IPNet{{IP: net.IPv4(127, 0, 0, 1).To4(), Mask: net.CIDRMask(8, 32)}}}
+
+	for i := 0; i < 20; i++ {
+		listener, err := ListenUDP(dev, 0, crypto.CreatePlainCrypt())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client, err := net.DialUDP("udp4", nil, listener.Addr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Datagrams keep arriving while the connection and the listener are closed
+		stop := make(chan struct{})
+		sent := make(chan struct{})
+		go func() {
+			defer close(sent)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				client.Write([]byte("datagram"))
+			}
+		}()
+
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted := make(chan struct{})
+		go func() {
+			defer close(accepted)
+			listener.Accept()
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+		conn.Close()
+		time.Sleep(10 * time.Millisecond)
+		listener.Close()
+
+		<-accepted
+		close(stop)
+		<-sent
+		client.Close()
+	}
+}
+
+func TestUDPListener(t *testing.T) {
+	dev := &Device{ipAddrs: []*net.IPNet{{IP: net.IPv4(127, 0, 0, 1).To4(), Mask: net.CIDRMask(8, 32)}}}
+	crypt, err := crypto.CreateAESGCMCrypt(crypto.DeriveKey("ikago", 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := ListenUDP(dev, 0, crypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	clients := make([]*UDPConn, 0)
+	conns := make(map[string]net.Conn)
+	for i := 0; i < 2; i++ {
+		client, err := DialUDP(dev, 0, listener.Addr().(*net.UDPAddr), crypt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+
+		_, err = client.Write([]byte(fmt.Sprintf("hello %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns[conn.RemoteAddr().String()] = conn
+	}
+
+	// Datagrams of known clients are dispatched while accepting
+	go func() {
+		for {
+			_, err := listener.Accept()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for i := len(clients) - 1; i >= 0; i-- {
+		_, err = clients[i].Write([]byte(fmt.Sprintf("again %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := make([]byte, IPv4MaxSize)
+	for i, client := range clients {
+		conn, ok := conns[client.LocalAddr().String()]
+		if !ok {
+			t.Fatalf("client %d: not accepted", i)
+		}
+
+		for _, expected := range []string{fmt.Sprintf("hello %d", i), fmt.Sprintf("again %d", i)} {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := conn.Read(b)
+			if err != nil {
+				t.Fatalf("client %d: read: %v", i, err)
+			}
+			if string(b[:n]) != expected {
+				t.Errorf("client %d: read %q, expected %q", i, b[:n], expected)
+			}
+		}
+
+		// Replies are sent to the client
+		_, err = conn.Write([]byte(fmt.Sprintf("reply %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := client.Read(b)
+		if err != nil {
+			t.Fatalf("client %d: read reply: %v", i, err)
+		}
+		if string(b[:n]) != fmt.Sprintf("reply %d", i) {
+			t.Errorf("client %d: read reply %q", i, b[:n])
+		}
+
+		// Reading times out in the deadline
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err = conn.Read(b)
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Errorf("client %d: read after deadline: %v", i, err)
+		}
+	}
+}
+
+func TestUDPConnForeign(t *testing.T) {
+	dev := &Device{ipAddrs: []*net.IPNet{{IP: net.IPv4(127, 0, 0, 1).To4(), Mask: net.CIDRMask(8, 32)}}}
+
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	foreign, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer foreign.Close()
+
+	conn, err := DialUDP(dev, 0, server.LocalAddr().(*net.UDPAddr), crypto.CreatePlainCrypt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Datagrams from others are ignored
+	_, err = foreign.WriteToUDP([]byte("foreign"), conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.WriteToUDP([]byte("server"), conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, IPv4MaxSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "server" {
+		t.Errorf("read %q", b[:n])
+	}
+}
@@ -0,0 +1,324 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/filter"
+	"golang.org/x/net/bpf"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// reorderDelay is the extra delay of reordered packets in a wire, so packets behind can overtake them.
+const reorderDelay = 5 * time.Millisecond
+
+// wireQueueSize is the size of the queue of each virtual connection. Packets will be dropped if the queue is full.
+const wireQueueSize = 1024
+
+// wirePacket describes a packet on the way in a wire.
+type wirePacket struct {
+	data []byte
+	src  *VirtualConn
+	at   time.Time
+}
+
+// Wire is an in-memory link which connects virtual devices. Packets written in any device are delivered to connections
+// in all devices on the wire whose filters match, with the loss, the delay and the reordering of the wire.
+type Wire struct {
+	loss    float64
+	reorder float64
+	delay   time.Duration
+	devs    []*Device
+	conns   map[*VirtualConn]bool
+	queue   chan *wirePacket
+	closed  chan struct{}
+	lock    sync.RWMutex
+}
+
+// NewWire returns a wire. Packets are lost in the probability of the loss, and are delivered after the delay. Packets
+// are reordered in the probability of the reorder by an extra delay.
+func NewWire(loss, reorder float64, delay time.Duration) (*Wire, error) {
+	if loss < 0 || loss > 1 {
+		return nil, fmt.Errorf("loss %f out of range", loss)
+	}
+	if reorder < 0 || reorder > 1 {
+		return nil, fmt.Errorf("reorder %f out of range", reorder)
+	}
+	if delay < 0 {
+		return nil, fmt.Errorf("delay %s out of range", delay)
+	}
+
+	w := &Wire{
+		loss:    loss,
+		reorder: reorder,
+		delay:   delay,
+		devs:    make([]*Device, 0),
+		conns:   make(map[*VirtualConn]bool),
+		queue:   make(chan *wirePacket, wireQueueSize),
+		closed:  make(chan struct{}),
+	}
+
+	go w.run()
+
+	return w, nil
+}
+
+// CreateDevice creates a virtual device on the wire.
+func (w *Wire) CreateDevice(alias string, ipAddrs []*net.IPNet, hardwareAddr net.HardwareAddr) *Device {
+	dev := &Device{
+		name:         alias,
+		alias:        alias,
+		ipAddrs:      ipAddrs,
+		hardwareAddr: hardwareAddr,
+		wire:         w,
+	}
+
+	w.lock.Lock()
+	w.devs = append(w.devs, dev)
+	w.lock.Unlock()
+
+	return dev
+}
+
+// FindAllDevs returns all virtual devices on the wire.
+func (w *Wire) FindAllDevs() []*Device {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	result := make([]*Device, len(w.devs))
+	copy(result, w.devs)
+
+	return result
+}
+
+// findDev returns the device on the wire with the designated IP.
+func (w *Wire) findDev(ip net.IP) *Device {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	return FindDev(w.devs, ip)
+}
+
+// findGatewayDev returns the device on the wire with the designated IP as a gateway.
+func (w *Wire) findGatewayDev(ip net.IP) (*Device, error) {
+	dev := w.findDev(ip)
+	if dev == nil {
+		return nil, fmt.Errorf("unknown address %s", ip)
+	}
+
+	addrs := append(make([]*net.IPNet, 0), &net.IPNet{IP: ip})
+
+	return &Device{alias: "Gateway", ipAddrs: addrs, hardwareAddr: dev.hardwareAddr, wire: w}, nil
+}
+
+func (w *Wire) createConn(srcDev, dstDev *Device, f string) (*VirtualConn, error) {
+	insts, err := filter.Compile(f, layers.LinkTypeEthernet)
+	if err != nil {
+		return nil, fmt.Errorf("compile filter: %w", err)
+	}
+	vm, err := bpf.NewVM(disassemble(insts))
+	if err != nil {
+		return nil, fmt.Errorf("load filter: %w", err)
+	}
+
+	conn := &VirtualConn{
+		wire:    w,
+		srcDev:  srcDev,
+		dstDev:  dstDev,
+		vm:      vm,
+		packets: make(chan []byte, wireQueueSize),
+		closed:  make(chan struct{}),
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	select {
+	case <-w.closed:
+		return nil, errors.New("wire closed")
+	default:
+	}
+	w.conns[conn] = true
+
+	return conn, nil
+}
+
+func disassemble(insts []bpf.RawInstruction) []bpf.Instruction {
+	result := make([]bpf.Instruction, 0, len(insts))
+	for _, inst := range insts {
+		result = append(result, inst.Disassemble())
+	}
+
+	return result
+}
+
+func (w *Wire) send(src *VirtualConn, b []byte) {
+	if w.loss > 0 && rand.Float64() < w.loss {
+		return
+	}
+
+	p := &wirePacket{
+		data: make([]byte, len(b)),
+		src:  src,
+		at:   time.Now().Add(w.delay),
+	}
+	copy(p.data, b)
+
+	// Reordered packets are delivered separately, and others are delivered in order
+	if w.reorder > 0 && rand.Float64() < w.reorder {
+		time.AfterFunc(w.delay+reorderDelay, func() {
+			w.deliver(p)
+		})
+		return
+	}
+	if w.delay <= 0 {
+		w.deliver(p)
+		return
+	}
+
+	select {
+	case w.queue <- p:
+	case <-w.closed:
+	default:
+		// Queue is full
+	}
+}
+
+func (w *Wire) run() {
+	for {
+		select {
+		case p := <-w.queue:
+			time.Sleep(time.Until(p.at))
+			w.deliver(p)
+		case <-w.closed:
+			return
+		}
+	}
+}
+
+func (w *Wire) deliver(p *wirePacket) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	for conn := range w.conns {
+		// The sender does not receive its own packets like pcap
+		if conn == p.src {
+			continue
+		}
+
+		n, err := conn.vm.Run(p.data)
+		if err != nil || n <= 0 {
+			continue
+		}
+
+		d := make([]byte, len(p.data))
+		copy(d, p.data)
+
+		select {
+		case conn.packets <- d:
+		default:
+			// Queue is full
+		}
+	}
+}
+
+func (w *Wire) removeConn(conn *VirtualConn) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	delete(w.conns, conn)
+}
+
+// Close closes the wire and all connections on it.
+func (w *Wire) Close() error {
+	w.lock.Lock()
+	select {
+	case <-w.closed:
+		w.lock.Unlock()
+		return nil
+	default:
+	}
+	close(w.closed)
+	conns := w.conns
+	w.conns = make(map[*VirtualConn]bool)
+	w.lock.Unlock()
+
+	for conn := range conns {
+		conn.Close()
+	}
+
+	return nil
+}
+
+// VirtualConn is a packet endpoint in a virtual device on a wire.
+type VirtualConn struct {
+	wire      *Wire
+	srcDev    *Device
+	dstDev    *Device
+	vm        *bpf.VM
+	packets   chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *VirtualConn) Read(b []byte) (n int, err error) {
+	select {
+	case d := <-c.packets:
+		copy(b, d)
+
+		return len(d), nil
+	case <-c.closed:
+		return 0, io.EOF
+	}
+}
+
+// ReadPacket reads packet from the connection.
+func (c *VirtualConn) ReadPacket() (gopacket.Packet, error) {
+	select {
+	case d := <-c.packets:
+		return gopacket.NewPacket(d, layers.LinkTypeEthernet, gopacket.NoCopy), nil
+	case <-c.closed:
+		return nil, io.EOF
+	}
+}
+
+func (c *VirtualConn) Write(b []byte) (n int, err error) {
+	select {
+	case <-c.closed:
+		return 0, errors.New("closed")
+	default:
+	}
+
+	c.wire.send(c, b)
+
+	return len(b), nil
+}
+
+func (c *VirtualConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.wire.removeConn(c)
+	})
+
+	return nil
+}
+
+// LocalDev returns the local device.
+func (c *VirtualConn) LocalDev() *Device {
+	return c.srcDev
+}
+
+// RemoteDev returns the remote device.
+func (c *VirtualConn) RemoteDev() *Device {
+	return c.dstDev
+}
+
+// IsLoop returns if the connection is to a loopback device.
+func (c *VirtualConn) IsLoop() bool {
+	return c.dstDev.IsLoop()
+}
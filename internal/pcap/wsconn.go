@@ -0,0 +1,276 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/zhxie/ikago/internal/crypto"
+	"github.com/zhxie/ikago/internal/log"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// WSConn is a connection which transmits packets in binary messages over a WebSocket connection.
+type WSConn struct {
+	conn      *websocket.Conn
+	crypt     crypto.Crypt
+	writeLock sync.Mutex
+	isBroken  bool
+}
+
+func newWSConn(conn *websocket.Conn, crypt crypto.Crypt) *WSConn {
+	return &WSConn{
+		conn:  conn,
+		crypt: crypt,
+	}
+}
+
+// DialWS acts like DialTCP for pcap networks in WebSocket. The host will be sent in the Host header if it is not
+// empty.
+func DialWS(dev *Device, srcPort uint16, dstAddr *net.TCPAddr, host, path string, crypt crypto.Crypt) (*WSConn, error) {
+	srcAddr := &net.TCPAddr{
+		IP:   dev.IPAddr().IP,
+		Port: int(srcPort),
+	}
+
+	u := url.URL{
+		Scheme: "ws",
+		Host:   dstAddr.String(),
+		Path:   path,
+	}
+	header := http.Header{}
+	if host != "" {
+		header.Set("Host", host)
+	}
+
+	dialer := &websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			dialer := &net.Dialer{LocalAddr: srcAddr}
+
+			return dialer.Dial("tcp4", addr)
+		},
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: establishDeadline,
+	}
+
+	log.Infof("Connect to server %s\n", u.String())
+
+	t := time.Now()
+
+	conn, _, err := dialer.Dial(u.String(), header)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    err,
+		}
+	}
+
+	duration := time.Now().Sub(t)
+
+	log.Infof("Connected to server %s in %.3f ms (RTT)\n", u.String(), float64(duration.Microseconds())/1000)
+
+	return newWSConn(conn, crypt), nil
+}
+
+// Read reads a message from the connection.
+func (c *WSConn) Read(b []byte) (n int, err error) {
+	// The connection cannot be recovered once an error occurs
+	if c.isBroken {
+		return 0, io.EOF
+	}
+
+	t, contents, err := c.conn.ReadMessage()
+	if err != nil {
+		c.isBroken = true
+
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, io.EOF
+		}
+
+		return 0, err
+	}
+	if t != websocket.BinaryMessage {
+		return 0, nil
+	}
+
+	// Decrypt
+	contents, err = c.crypt.Decrypt(contents)
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("decrypt: %w", err),
+		}
+	}
+
+	copy(b, contents)
+
+	return len(contents), nil
+}
+
+// Write writes a message to the connection.
+func (c *WSConn) Write(b []byte) (n int, err error) {
+	// Encrypt
+	contents, err := c.crypt.Encrypt(b)
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("encrypt: %w", err),
+		}
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	err = c.conn.WriteMessage(websocket.BinaryMessage, contents)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (c *WSConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *WSConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *WSConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *WSConn) SetDeadline(t time.Time) error {
+	err := c.conn.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *WSConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *WSConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// WSListener is a listener which accepts WebSocket connections upgraded from HTTP requests in the given path.
+type WSListener struct {
+	listener  net.Listener
+	server    *http.Server
+	crypt     crypto.Crypt
+	conns     chan net.Conn
+	err       chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// ListenWS acts like ListenTCP for pcap networks in WebSocket.
+func ListenWS(dev *Device, srcPort uint16, path string, crypt crypto.Crypt) (*WSListener, error) {
+	srcAddr := &net.TCPAddr{
+		IP:   dev.IPAddr().IP,
+		Port: int(srcPort),
+	}
+
+	listener, err := net.ListenTCP("tcp4", srcAddr)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "listen",
+			Net:    "pcap",
+			Source: srcAddr,
+			Err:    err,
+		}
+	}
+
+	l := &WSListener{
+		listener: listener,
+		crypt:    crypt,
+		conns:    make(chan net.Conn),
+		err:      make(chan error, 1),
+		closed:   make(chan struct{}),
+	}
+
+	upgrader := &websocket.Upgrader{
+		HandshakeTimeout: establishDeadline,
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		// Requests in sub paths are not accepted
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Verboseln(fmt.Errorf("upgrade %s: %w", r.RemoteAddr, err))
+			return
+		}
+
+		// Connections upgraded after closing are never accepted
+		c := newWSConn(conn, l.crypt)
+		select {
+		case l.conns <- c:
+		case <-l.closed:
+			c.Close()
+		}
+	})
+	l.server = &http.Server{Handler: mux}
+
+	go func() {
+		l.err <- l.server.Serve(listener)
+	}()
+
+	return l, nil
+}
+
+func (l *WSListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.err:
+		// Keep the error for later calls
+		l.err <- err
+
+		return nil, &net.OpError{
+			Op:   "accept",
+			Net:  "pcap",
+			Addr: l.Addr(),
+			Err:  err,
+		}
+	}
+}
+
+func (l *WSListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+
+	return l.server.Close()
+}
+
+func (l *WSListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
@@ -0,0 +1,2564 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/xtaci/kcp-go"
+	"github.com/zhxie/ikago/internal/addr"
+	"github.com/zhxie/ikago/internal/config"
+	"github.com/zhxie/ikago/internal/control"
+	"github.com/zhxie/ikago/internal/crypto"
+	"github.com/zhxie/ikago/internal/exec"
+	"github.com/zhxie/ikago/internal/log"
+	"github.com/zhxie/ikago/internal/obfs"
+	"github.com/zhxie/ikago/internal/pcap"
+	"github.com/zhxie/ikago/internal/stat"
+	"github.com/zhxie/ikago/internal/tun"
+	"hash/fnv"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type quintuple struct {
+	src      string
+	dst      string
+	protocol gopacket.LayerType
+}
+
+type natIndicator struct {
+	src    net.Addr
+	key    string
+	embSrc net.Addr
+	conns  []net.Conn
+	next   int
+	lock   sync.Mutex
+}
+
+// add records the connection as one of the flows of the client.
+func (indicator *natIndicator) add(conn net.Conn) {
+	indicator.lock.Lock()
+	defer indicator.lock.Unlock()
+
+	for _, c := range indicator.conns {
+		if c == conn {
+			return
+		}
+	}
+	indicator.conns = append(indicator.conns, conn)
+}
+
+// remove removes the connection from the flows of the client, and returns if any flows remain.
+func (indicator *natIndicator) remove(conn net.Conn) bool {
+	indicator.lock.Lock()
+	defer indicator.lock.Unlock()
+
+	for i, c := range indicator.conns {
+		if c == conn {
+			indicator.conns = append(indicator.conns[:i], indicator.conns[i+1:]...)
+			break
+		}
+	}
+
+	return len(indicator.conns) > 0
+}
+
+// replace replaces the connection with the new one of the client, and returns if the connection is replaced.
+func (indicator *natIndicator) replace(oldConn, newConn net.Conn) bool {
+	indicator.lock.Lock()
+	defer indicator.lock.Unlock()
+
+	isReplaced := false
+	for i, c := range indicator.conns {
+		if c == oldConn {
+			indicator.conns[i] = newConn
+			isReplaced = true
+		}
+	}
+	if !isReplaced {
+		return false
+	}
+
+	// Remove duplicate connections
+	conns := make([]net.Conn, 0, len(indicator.conns))
+	for _, c := range indicator.conns {
+		isDuplicate := false
+		for _, conn := range conns {
+			if conn == c {
+				isDuplicate = true
+				break
+			}
+		}
+		if !isDuplicate {
+			conns = append(conns, c)
+		}
+	}
+	indicator.conns = conns
+
+	return true
+}
+
+// conn returns the flow of the client in turn, or always the same flow if packets are striped by hash.
+func (indicator *natIndicator) conn() net.Conn {
+	indicator.lock.Lock()
+	defer indicator.lock.Unlock()
+
+	if len(indicator.conns) <= 0 {
+		return nil
+	}
+
+	if stripe == pcap.StripeHash {
+		h := fnv.New32a()
+		h.Write([]byte(indicator.embSrc.String()))
+
+		return indicator.conns[h.Sum32()%uint32(len(indicator.conns))]
+	}
+
+	indicator.next = (indicator.next + 1) % len(indicator.conns)
+
+	return indicator.conns[indicator.next]
+}
+
+func (indicator *natIndicator) embSrcIP() net.IP {
+	switch t := indicator.embSrc.(type) {
+	case *net.IPAddr:
+		return indicator.embSrc.(*net.IPAddr).IP
+	case *net.TCPAddr:
+		return indicator.embSrc.(*net.TCPAddr).IP
+	case *net.UDPAddr:
+		return indicator.embSrc.(*net.UDPAddr).IP
+	case *addr.ICMPQueryAddr:
+		return indicator.embSrc.(*addr.ICMPQueryAddr).IP
+	default:
+		panic(fmt.Errorf("type %T not support", t))
+	}
+}
+
+// sessionIndicator indicates the connection of a client in a session.
+type sessionIndicator struct {
+	conn net.Conn
+	t    time.Time
+}
+
+// heartbeatIndicator indicates the liveness of a client.
+type heartbeatIndicator struct {
+	last int64
+	rtt  int64
+	done chan struct{}
+}
+
+const name string = "IkaGo-server"
+
+const keepAlive = 30 * time.Second
+const keepFragments = 30 * time.Second
+
+// ipv6Probe is an address in the documentation prefix, which is routed to the default gateway.
+var ipv6Probe = net.ParseIP("2001:db8::1")
+
+var (
+	versionInfo string
+	startTime   time.Time
+)
+
+var (
+	tunName     string
+	fragment    int
+	port        uint16
+	listenDevs  []*pcap.Device
+	upDev       *pcap.Device
+	gatewayDev  *pcap.Device
+	upDev6      *pcap.Device
+	gatewayDev6 *pcap.Device
+	mode        string
+	crypt       crypto.Crypt
+	mtu         int
+	obfuscator  obfs.Obfuscator
+	fingerprint pcap.Fingerprint
+	fecGroup    int
+	fecRatio    float64
+	dupTimes    int
+	dupDelay    time.Duration
+	dupFilter   *pcap.DupFilter
+	hopStart    uint16
+	hopEnd      uint16
+	keepalive   time.Duration
+	misses      int
+	roam        bool
+	stripe      pcap.Stripe
+	isKCP       bool
+	kcpConfig   *config.KCPConfig
+	path        string
+	tlsConfig   *tls.Config
+)
+
+var (
+	closed        chan struct{}
+	routines      sync.WaitGroup
+	listeners     []net.Listener
+	upConn        pcap.Endpoint
+	upConn6       pcap.Endpoint
+	tunDev        *tun.Device
+	c             chan pcap.ConnBytes
+	defrag        *pcap.EasyDefragmenter
+	defrag6       *pcap.EasyDefragmenter
+	listenDefrag  *pcap.EasyDefragmenter
+	listenDefrag6 *pcap.EasyDefragmenter
+	nextTCPPort   uint16
+	tcpPortPool   []time.Time
+	nextUDPPort   uint16
+	udpPortPool   []time.Time
+	nextICMPv4Id  uint16
+	icmpv4IdPool  []time.Time
+	nextICMPv6Id  uint16
+	icmpv6IdPool  []time.Time
+	patLock       sync.Mutex
+	patMap        map[quintuple]uint16
+	clientsLock   sync.RWMutex
+	clients       map[string]net.Conn
+	heartbeats    map[net.Conn]*heartbeatIndicator
+	sessionsLock  sync.Mutex
+	sessions      map[string]*sessionIndicator
+	natLock       sync.RWMutex
+	nat           map[pcap.NATGuide]*natIndicator
+	monitor       *stat.TrafficMonitor
+	dnsLock       sync.RWMutex
+	dns           map[string]string
+)
+
+// reset resets the states of the last run.
+func reset() {
+	tunName = ""
+	fragment = 0
+	port = 0
+	listenDevs = make([]*pcap.Device, 0)
+	upDev = nil
+	gatewayDev = nil
+	upDev6 = nil
+	gatewayDev6 = nil
+	mode = ""
+	crypt = nil
+	mtu = 0
+	obfuscator = nil
+	fingerprint = 0
+	fecGroup = 0
+	fecRatio = 0
+	dupTimes = 0
+	dupDelay = 0
+	dupFilter = nil
+	hopStart = 0
+	hopEnd = 0
+	keepalive = 0
+	misses = 0
+	roam = false
+	stripe = 0
+	isKCP = false
+	kcpConfig = nil
+	path = ""
+	tlsConfig = nil
+	closed = make(chan struct{})
+	listeners = make([]net.Listener, 0)
+	upConn = nil
+	upConn6 = nil
+	tunDev = nil
+	c = make(chan pcap.ConnBytes, 1000)
+	defrag = pcap.NewEasyDefragmenter()
+	defrag.SetDeadline(keepFragments)
+	defrag6 = pcap.NewEasyDefragmenter()
+	defrag6.SetDeadline(keepFragments)
+	listenDefrag = pcap.NewEasyDefragmenter()
+	listenDefrag.SetDeadline(keepFragments)
+	listenDefrag6 = pcap.NewEasyDefragmenter()
+	listenDefrag6.SetDeadline(keepFragments)
+	nextTCPPort = 0
+	tcpPortPool = make([]time.Time, 16384)
+	nextUDPPort = 0
+	udpPortPool = make([]time.Time, 16384)
+	nextICMPv4Id = 0
+	icmpv4IdPool = make([]time.Time, 65536)
+	nextICMPv6Id = 0
+	icmpv6IdPool = make([]time.Time, 65536)
+	patMap = make(map[quintuple]uint16)
+	clients = make(map[string]net.Conn)
+	heartbeats = make(map[net.Conn]*heartbeatIndicator)
+	sessions = make(map[string]*sessionIndicator)
+	nat = make(map[pcap.NATGuide]*natIndicator)
+	monitor = nil
+	dns = make(map[string]string)
+}
+
+// isClosed returns if the server is closed.
+func isClosed() bool {
+	select {
+	case <-closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run runs the server in the configuration on the devices until it is closed. Devices in current computer are used if
+// devs is nil. The ready channel is closed once the server starts handling packets if it is not nil.
+func Run(cfg *config.Config, version string, devs []*pcap.Device, ready chan<- struct{}) error {
+	var (
+		err     error
+		gateway net.IP
+	)
+
+	versionInfo = version
+	startTime = time.Now()
+
+	reset()
+
+	// Verify parameters
+	if cfg.Gateway != "" {
+		gateway = net.ParseIP(cfg.Gateway)
+		if gateway == nil {
+			return fmt.Errorf("invalid gateway %s", cfg.Gateway)
+		}
+	}
+	if cfg.Monitor < 0 || cfg.Monitor > 65535 {
+		return fmt.Errorf("monitor port %d out of range", cfg.Monitor)
+	}
+	if cfg.MTU < 576 || cfg.MTU > pcap.MaxMTU {
+		return fmt.Errorf("mtu %d out of range", cfg.MTU)
+	}
+	if cfg.KCPConfig.MTU > 1500 {
+		return fmt.Errorf("kcp mtu %d out of range", cfg.KCPConfig.MTU)
+	}
+	if cfg.KCPConfig.SendWindow <= 0 || cfg.KCPConfig.SendWindow > math.MaxInt32 {
+		return fmt.Errorf("kcp send window %d out of range", cfg.KCPConfig.SendWindow)
+	}
+	if cfg.KCPConfig.RecvWindow <= 0 || cfg.KCPConfig.RecvWindow > math.MaxInt32 {
+		return fmt.Errorf("kcp receive window %d out of range", cfg.KCPConfig.RecvWindow)
+	}
+	if cfg.KCPConfig.DataShard < 0 {
+		return fmt.Errorf("kcp data shard %d out of range", cfg.KCPConfig.DataShard)
+	}
+	if cfg.KCPConfig.ParityShard < 0 {
+		return fmt.Errorf("kcp parity shard %d out of range", cfg.KCPConfig.ParityShard)
+	}
+	if cfg.KCPConfig.Interval < 0 {
+		return fmt.Errorf("kcp interval %d out of range", cfg.KCPConfig.Interval)
+	}
+	if cfg.KCPConfig.Resend < 0 {
+		return fmt.Errorf("kcp resend %d out of range", cfg.KCPConfig.Resend)
+	}
+	if cfg.KCPConfig.NC < 0 {
+		return fmt.Errorf("kcp nc %d out of range", cfg.KCPConfig.NC)
+	}
+	if cfg.Fragment < 576 || cfg.Fragment > pcap.MaxMTU {
+		return fmt.Errorf("fragment %d out of range", cfg.Fragment)
+	}
+	if cfg.Port == 0 {
+		return errors.New("please provide listen port by -p port")
+	}
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		return fmt.Errorf("listen port %d out of range", cfg.Port)
+	}
+
+	// Devices
+	if devs == nil {
+		devs, err = pcap.FindAllDevs()
+		if err != nil {
+			return fmt.Errorf("find all devices: %w", err)
+		}
+	}
+
+	// Find devices
+	listenDevs, err = pcap.FindListenDevs(devs, cfg.ListenDevs)
+	if err != nil {
+		return fmt.Errorf("find listen devices: %w", err)
+	}
+	if len(cfg.ListenDevs) <= 0 {
+		// Remove loopback devices by default
+		result := make([]*pcap.Device, 0)
+
+		for _, dev := range listenDevs {
+			if dev.IsLoop() {
+				continue
+			}
+			result = append(result, dev)
+		}
+
+		listenDevs = result
+	}
+	if len(listenDevs) <= 0 {
+		return errors.New("cannot determine listen device")
+	}
+
+	upDev, gatewayDev, err = pcap.FindUpstreamDevAndGatewayDev(devs, cfg.UpDev, gateway)
+	if err != nil {
+		return fmt.Errorf("find upstream device and gateway device: %w", err)
+	}
+	if upDev == nil && gatewayDev == nil {
+		return errors.New("cannot determine upstream device and gateway device")
+	}
+	if upDev == nil {
+		return errors.New("cannot determine upstream device")
+	}
+	if gatewayDev == nil {
+		return errors.New("cannot determine gateway device")
+	}
+
+	// IPv6 upstream is optional
+	upDev6, gatewayDev6, err = pcap.FindIPv6UpstreamDevAndGatewayDev(devs, cfg.UpDev, ipv6Probe)
+	if err != nil {
+		log.Verboseln(fmt.Errorf("find ipv6 upstream device and gateway device: %w", err))
+	}
+	if upDev6 == nil || gatewayDev6 == nil {
+		upDev6, gatewayDev6 = nil, nil
+		if cfg.Tun == "" {
+			log.Infoln("IPv6 upstream is unavailable, packets in IPv6 will not be redirected")
+		}
+	}
+
+	// Mode
+	switch cfg.Mode {
+	case "faketcp":
+		mode = "faketcp"
+		log.Infoln("Use FakeTCP")
+	case "tcp":
+		mode = "tcp"
+		log.Infoln("Use standard TCP")
+	case "udp":
+		mode = "udp"
+		log.Infoln("Use standard UDP")
+	case "fakeicmp":
+		mode = "fakeicmp"
+		log.Infoln("Use FakeICMP")
+	case "ws":
+		mode = "ws"
+		log.Infoln("Use WebSocket")
+	case "tls":
+		mode = "tls"
+		log.Infoln("Use TLS")
+	case "quic":
+		mode = "quic"
+		log.Infoln("Use QUIC")
+	default:
+		return fmt.Errorf("mode %s not support", cfg.Mode)
+	}
+
+	// Crypt
+	crypt, err = crypto.ParseCrypt(cfg.Method, cfg.Password)
+	if err != nil {
+		return fmt.Errorf("parse crypt: %w", err)
+	}
+	method := crypt.Method()
+	if method != crypto.MethodPlain {
+		log.Infof("Encrypt with %s\n", method)
+	}
+
+	// Add rule
+	if cfg.Rule {
+		var (
+			devs map[string]bool
+		)
+
+		devs = make(map[string]bool)
+
+		// The kernel forwards packets from TUN
+		if cfg.Tun != "" {
+			err := exec.EnableIPForwarding()
+			if err != nil {
+				return fmt.Errorf("enable ip forwarding: %w", err)
+			}
+
+			log.Infoln("Enable IP forwarding")
+		} else {
+			err := exec.DisableIPForwarding()
+			if err != nil {
+				return fmt.Errorf("disable ip forwarding: %w", err)
+			}
+
+			log.Infoln("Disable IP forwarding")
+		}
+
+		for _, dev := range listenDevs {
+			devs[dev.Alias()] = true
+		}
+		if cfg.Tun == "" {
+			devs[upDev.Alias()] = true
+		}
+
+		for dev := range devs {
+			err := exec.DisableGRO(dev)
+			if err != nil {
+				return fmt.Errorf("disable gro: %w", err)
+			}
+		}
+
+		log.Infoln("Disable GRO")
+
+		// Resets from the system break the upstream in pcap and FakeTCP listening
+		if cfg.Tun == "" || mode == "faketcp" {
+			err := exec.AddGlobalFirewallRule()
+			if err != nil {
+				return fmt.Errorf("add firewall rule: %w", err)
+			}
+
+			log.Infoln("Add firewall rule")
+
+			// IPv6 may be disabled in the system
+			err = exec.AddGlobalIPv6FirewallRule()
+			if err != nil {
+				log.Errorln(fmt.Errorf("add ipv6 firewall rule: %w", err))
+			} else {
+				log.Infoln("Add IPv6 firewall rule")
+			}
+		}
+
+		if cfg.Tun != "" {
+			upDevs := []string{upDev.Alias()}
+			if upDev6 != nil && upDev6.Alias() != upDev.Alias() {
+				upDevs = append(upDevs, upDev6.Alias())
+			}
+
+			for _, dev := range upDevs {
+				err := exec.AddMasqueradeRule(dev)
+				if err != nil {
+					return fmt.Errorf("add masquerade rule: %w", err)
+				}
+			}
+
+			log.Infoln("Add masquerade rule")
+
+			// IPv6 may be disabled in the system
+			for _, dev := range upDevs {
+				err := exec.AddIPv6MasqueradeRule(dev)
+				if err != nil {
+					log.Errorln(fmt.Errorf("add ipv6 masquerade rule: %w", err))
+				} else {
+					log.Infoln("Add IPv6 masquerade rule")
+				}
+			}
+		}
+
+		if mode == "fakeicmp" {
+			err := exec.DisableICMPEchoReply()
+			if err != nil {
+				log.Errorln(fmt.Errorf("disable icmp echo reply: %w", err))
+			} else {
+				log.Infoln("Disable ICMP echo reply")
+			}
+		}
+	}
+
+	// Monitor
+	if cfg.Monitor != 0 {
+		if cfg.Monitor == int(port) {
+			return fmt.Errorf("same monitor port with listen port")
+		}
+
+		monitor = stat.NewTrafficMonitor()
+		mux := http.NewServeMux()
+
+		// Host HTTP server
+		mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+			b, err := json.Marshal(&struct {
+				Name    string               `json:"name"`
+				Version string               `json:"version"`
+				Time    int                  `json:"time"`
+				Monitor *stat.TrafficMonitor `json:"monitor"`
+				Clients []clientStatus       `json:"clients"`
+			}{
+				Name:    name,
+				Version: versionInfo,
+				Time:    int(time.Now().Sub(startTime).Seconds()),
+				Monitor: monitor,
+				Clients: clientStatuses(),
+			})
+			if err != nil {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+				return
+			}
+
+			// Handle CORS
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+
+			_, err = io.WriteString(w, string(b))
+			if err != nil {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+			}
+		})
+		mux.HandleFunc("/dns", func(w http.ResponseWriter, req *http.Request) {
+			type IPName struct {
+				IP   string `json:"ip"`
+				Name string `json:"name"`
+			}
+
+			ipNames := make([]IPName, 0)
+			dnsLock.RLock()
+			for ip, name := range dns {
+				ipNames = append(ipNames, IPName{
+					IP:   ip,
+					Name: name,
+				})
+			}
+			dnsLock.RUnlock()
+
+			b, err := json.Marshal(ipNames)
+			if err != nil {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+				return
+			}
+
+			// Handle CORS
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+
+			_, err = io.WriteString(w, string(b))
+			if err != nil {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+			}
+		})
+		go func() {
+			err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Monitor), mux)
+			if err != nil {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+			}
+		}()
+
+		log.Infof("Monitor on :%d\n", cfg.Monitor)
+		log.Infoln("You can now observe traffic on http://ikago.ikas.ink")
+	}
+
+	// Mode-related options
+	switch mode {
+	case "faketcp":
+		// MTU
+		mtu = cfg.MTU
+		log.Infof("Set MTU to %d Bytes\n", mtu)
+
+		// Obfuscation
+		obfuscator, err = obfs.ParseObfuscator(cfg.Obfs, "", cfg.Path)
+		if err != nil {
+			return fmt.Errorf("parse obfuscator: %w", err)
+		}
+		if obfuscator.Method() != obfs.MethodPlain {
+			log.Infof("Obfuscate with %s\n", obfuscator.Method())
+		}
+
+		// Fingerprint
+		fingerprint, err = pcap.ParseFingerprint(cfg.Fingerprint)
+		if err != nil {
+			return fmt.Errorf("parse fingerprint: %w", err)
+		}
+		if fingerprint != pcap.FingerprintNone {
+			log.Infof("Imitate TCP fingerprint of %s\n", fingerprint)
+		}
+
+		// KCP
+		isKCP = cfg.KCP
+		kcpConfig = &cfg.KCPConfig
+		if isKCP {
+			log.Infoln("Enable KCP")
+		}
+
+		// Stripe
+		stripe, err = pcap.ParseStripe(cfg.Stripe)
+		if err != nil {
+			return fmt.Errorf("parse stripe: %w", err)
+		}
+		if stripe != pcap.StripeRoundRobin {
+			log.Infof("Stripe flows of clients in %s\n", stripe)
+		}
+
+		// FEC
+		if cfg.FEC != 0 {
+			if isKCP {
+				return errors.New("fec not support with KCP")
+			}
+			if cfg.FEC < 0 || cfg.FEC > 128 {
+				return fmt.Errorf("fec %d out of range", cfg.FEC)
+			}
+			if cfg.FECParity <= 0 || cfg.FECParity > 1 {
+				return fmt.Errorf("fec parity %f out of range", cfg.FECParity)
+			}
+
+			fecGroup = cfg.FEC
+			fecRatio = cfg.FECParity
+			log.Infof("Enable FEC in group of %d with parity of %.2f\n", fecGroup, fecRatio)
+		}
+
+		// Keepalive
+		if cfg.Keepalive != 0 {
+			if isKCP {
+				return errors.New("keepalive not support with KCP")
+			}
+			if cfg.Keepalive < 0 {
+				return fmt.Errorf("keepalive %d out of range", cfg.Keepalive)
+			}
+			if cfg.KeepMisses < 0 {
+				return fmt.Errorf("keepalive misses %d out of range", cfg.KeepMisses)
+			}
+
+			keepalive = time.Duration(cfg.Keepalive) * time.Second
+			misses = cfg.KeepMisses
+			if misses == 0 {
+				misses = 3
+			}
+			log.Infof("Disconnect clients missing heartbeats in %s for %d times\n", keepalive, misses)
+		}
+
+		// Roam
+		if cfg.Roam {
+			if isKCP {
+				return errors.New("roam not support with KCP")
+			}
+			// Sessions must be authenticated, or times in them can be flipped without the key
+			if crypt.Cost() <= 0 {
+				return errors.New("roam not support without AEAD")
+			}
+
+			roam = true
+			log.Infoln("Enable roaming")
+		}
+
+		// Hop
+		if cfg.Hop != "" {
+			if isKCP {
+				return errors.New("hop not support with KCP")
+			}
+
+			hopStart, hopEnd, err = addr.ParsePortRange(cfg.Hop)
+			if err != nil {
+				return fmt.Errorf("parse hop: %w", err)
+			}
+			if hopEnd >= 49152 {
+				return fmt.Errorf("hop %s overlaps ports 49152-65535 for NAT", cfg.Hop)
+			}
+
+			log.Infof("Hop in ports %d-%d\n", hopStart, hopEnd)
+		}
+	case "tcp":
+		break
+	case "udp":
+		// KCP
+		isKCP = cfg.KCP
+		kcpConfig = &cfg.KCPConfig
+		if isKCP {
+			log.Infoln("Enable KCP")
+		}
+	case "fakeicmp":
+		// MTU
+		mtu = cfg.MTU
+		log.Infof("Set MTU to %d Bytes\n", mtu)
+	case "ws":
+		// Path
+		path = cfg.Path
+		if path == "" || path[0] != '/' {
+			return fmt.Errorf("invalid path %s", path)
+		}
+	case "tls", "quic":
+		// Certificate
+		var pin string
+		if cfg.Cert == "" && cfg.Key == "" {
+			tlsConfig, pin, err = pcap.CreateSelfSignedTLSServerConfig()
+			if err != nil {
+				return fmt.Errorf("create tls config: %w", err)
+			}
+			log.Infof("Use self-signed certificate with pin %s\n", pin)
+		} else {
+			if cfg.Cert == "" {
+				return errors.New("missing certificate")
+			}
+			if cfg.Key == "" {
+				return errors.New("missing key")
+			}
+
+			tlsConfig, pin, err = pcap.CreateTLSServerConfig(cfg.Cert, cfg.Key)
+			if err != nil {
+				return fmt.Errorf("create tls config: %w", err)
+			}
+			log.Infof("Use certificate %s with pin %s\n", cfg.Cert, pin)
+		}
+
+		// ALPN
+		if mode == "quic" {
+			if cfg.ALPN == "" {
+				return errors.New("missing alpn")
+			}
+
+			tlsConfig.NextProtos = []string{cfg.ALPN}
+			log.Infof("Use ALPN %s\n", cfg.ALPN)
+		}
+	default:
+		return fmt.Errorf("mode %s not support", mode)
+	}
+
+	// Duplication
+	if cfg.Dup > 1 {
+		if mode != "faketcp" && mode != "udp" && mode != "fakeicmp" {
+			return fmt.Errorf("duplication not support in mode %s", mode)
+		}
+		if isKCP {
+			return errors.New("duplication not support with KCP")
+		}
+		if cfg.Dup > 16 {
+			return fmt.Errorf("dup %d out of range", cfg.Dup)
+		}
+		if cfg.DupDelay < 0 {
+			return fmt.Errorf("dup delay %d out of range", cfg.DupDelay)
+		}
+
+		dupFilter, err = pcap.ParseDupFilter(cfg.DupPorts)
+		if err != nil {
+			return fmt.Errorf("parse dup ports: %w", err)
+		}
+		dupTimes = cfg.Dup
+		dupDelay = time.Duration(cfg.DupDelay) * time.Millisecond
+
+		if len(cfg.DupPorts) > 0 {
+			log.Infof("Duplicate packets in ports %s in %d times\n", dupFilter, dupTimes)
+		} else {
+			log.Infof("Duplicate packets in %d times\n", dupTimes)
+		}
+	}
+
+	// Fragment
+	fragment = cfg.Fragment
+	log.Infof("Set fragment to %d Bytes\n", fragment)
+
+	// TUN
+	tunName = cfg.Tun
+
+	// Port
+	port = uint16(cfg.Port)
+
+	log.Infof("Proxy from :%d\n", cfg.Port)
+
+	// Open pcap
+	err = open(ready)
+	if err != nil {
+		return fmt.Errorf("open pcap: %w", err)
+	}
+
+	return nil
+}
+
+func open(ready chan<- struct{}) error {
+	var err error
+
+	// Verify
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("port %d out of range", port)
+	}
+	if len(listenDevs) <= 0 {
+		return errors.New("missing listen device")
+	}
+	if upDev == nil {
+		return errors.New("missing upstream device")
+	}
+	if gatewayDev == nil {
+		return errors.New("missing gateway")
+	}
+
+	if len(listenDevs) == 1 {
+		log.Infof("Listen on %s\n", listenDevs[0].String())
+	} else {
+		log.Infoln("Listen on:")
+		for _, dev := range listenDevs {
+			log.Infof("  %s\n", dev.String())
+		}
+	}
+	if tunName != "" {
+		log.Infof("Route upstream in TUN %s\n", tunName)
+	} else if !gatewayDev.IsLoop() {
+		log.Infof("Route upstream from %s to %s\n", upDev, gatewayDev)
+	} else {
+		log.Infof("Route upstream in %s\n", upDev)
+	}
+	if upDev6 != nil && tunName == "" {
+		if !gatewayDev6.IsLoop() {
+			log.Infof("Route IPv6 upstream from %s to %s\n", upDev6, gatewayDev6)
+		} else {
+			log.Infof("Route IPv6 upstream in %s\n", upDev6)
+		}
+	}
+
+	// The port is listened in the range if it is in the range
+	isInHop := hopStart != 0 && port >= hopStart && port <= hopEnd
+
+	for _, dev := range listenDevs {
+		var (
+			err      error
+			listener net.Listener
+		)
+
+		// Only FakeTCP and standard TCP are supported in IPv6
+		if dev.IPAddr().IP.To4() == nil && mode != "faketcp" && mode != "tcp" {
+			log.Verbosef("Device %s has no IPv4 address, this device will not be listened\n", dev.Alias())
+			continue
+		}
+
+		switch mode {
+		case "faketcp":
+			if dev.IsLoop() {
+				if isKCP {
+					listener, err = pcap.ListenFakeTCPWithKCP(dev, dev, port, crypt, obfuscator, fingerprint, mtu, kcpConfig)
+				} else if isInHop {
+					listener, err = pcap.ListenFakeTCPRange(dev, dev, hopStart, hopEnd, crypt, obfuscator, fingerprint, mtu)
+				} else {
+					listener, err = pcap.ListenFakeTCP(dev, dev, port, crypt, obfuscator, fingerprint, mtu)
+				}
+			} else {
+				if isKCP {
+					listener, err = pcap.ListenFakeTCPWithKCP(dev, gatewayDev, port, crypt, obfuscator, fingerprint, mtu, kcpConfig)
+				} else if isInHop {
+					listener, err = pcap.ListenFakeTCPRange(dev, gatewayDev, hopStart, hopEnd, crypt, obfuscator, fingerprint, mtu)
+				} else {
+					listener, err = pcap.ListenFakeTCP(dev, gatewayDev, port, crypt, obfuscator, fingerprint, mtu)
+				}
+			}
+		case "tcp":
+			listener, err = pcap.ListenTCP(dev, port, crypt)
+		case "udp":
+			if isKCP {
+				listener, err = pcap.ListenUDPWithKCP(dev, port, crypt, kcpConfig)
+			} else {
+				listener, err = pcap.ListenUDP(dev, port, crypt)
+			}
+		case "fakeicmp":
+			if dev.IsLoop() {
+				listener, err = pcap.ListenFakeICMP(dev, dev, crypt, mtu)
+			} else {
+				listener, err = pcap.ListenFakeICMP(dev, gatewayDev, crypt, mtu)
+			}
+		case "ws":
+			listener, err = pcap.ListenWS(dev, port, path, crypt)
+		case "tls":
+			listener, err = pcap.ListenTLS(dev, port, tlsConfig, crypt)
+		case "quic":
+			listener, err = pcap.ListenQUIC(dev, port, tlsConfig, crypt)
+		default:
+			err = fmt.Errorf("mode %s not support", mode)
+		}
+		if err != nil {
+			return fmt.Errorf("open listen device %s: %w", dev.Alias(), err)
+		}
+
+		listeners = append(listeners, listener)
+
+		// IPv6 in standard TCP
+		if mode == "tcp" && dev.IPAddr().IP.To4() != nil && dev.IPv6Addr() != nil {
+			listener, err = pcap.ListenTCP6(dev, port, crypt)
+			if err != nil {
+				return fmt.Errorf("open listen device %s: %w", dev.Alias(), err)
+			}
+
+			listeners = append(listeners, listener)
+		}
+
+		// Hop
+		if mode == "faketcp" && hopStart != 0 && !isInHop {
+			if dev.IsLoop() {
+				listener, err = pcap.ListenFakeTCPRange(dev, dev, hopStart, hopEnd, crypt, obfuscator, fingerprint, mtu)
+			} else {
+				listener, err = pcap.ListenFakeTCPRange(dev, gatewayDev, hopStart, hopEnd, crypt, obfuscator, fingerprint, mtu)
+			}
+			if err != nil {
+				return fmt.Errorf("open listen device %s: %w", dev.Alias(), err)
+			}
+
+			listeners = append(listeners, listener)
+		}
+	}
+
+	// Handles for routing upstream
+	if tunName != "" {
+		tunDev, err = tun.Create(tunName, fragment)
+		if err != nil {
+			return fmt.Errorf("create tun %s: %w", tunName, err)
+		}
+	} else {
+		icmpFilter := "icmp"
+		if mode == "fakeicmp" {
+			// Echo requests from clients
+			icmpFilter = "(icmp && icmp[icmptype] != icmp-echo)"
+		}
+		portFilter := fmt.Sprintf("not dst port %d", port)
+		if hopStart != 0 {
+			portFilter = fmt.Sprintf("%s && not dst portrange %d-%d", portFilter, hopStart, hopEnd)
+		}
+		upConn, err = pcap.CreateEndpoint(upDev, gatewayDev, fmt.Sprintf("ip && (((tcp || udp) && %s) || %s || (ip[6:2] & 0x1fff) != 0)", portFilter, icmpFilter))
+		if err != nil {
+			return fmt.Errorf("open upstream device %s: %w", upDev.Alias(), err)
+		}
+		if upDev6 != nil {
+			// Neighbor discovery is left to the system
+			upConn6, err = pcap.CreateEndpoint(upDev6, gatewayDev6, fmt.Sprintf("ip6 && (((tcp || udp) && %s) || (icmp6 && (ip6[40] < 133 || ip6[40] > 137)) || ip6[6] = 44)", portFilter))
+			if err != nil {
+				return fmt.Errorf("open ipv6 upstream device %s: %w", upDev6.Alias(), err)
+			}
+		}
+	}
+
+	// Start handling
+	for i := 0; i < len(listeners); i++ {
+		listener := listeners[i]
+		routines.Add(1)
+		go func() {
+			defer routines.Done()
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					if isClosed() {
+						return
+					}
+					log.Errorln(fmt.Errorf("accept: %w", err))
+					continue
+				}
+				if conn == nil {
+					continue
+				}
+
+				// Tune
+				switch conn.(type) {
+				case *kcp.UDPSession:
+					err := pcap.TuneKCP(conn.(*kcp.UDPSession), kcpConfig)
+					if err != nil {
+						conn.Close()
+						log.Errorln(fmt.Errorf("tune: %w", err))
+						continue
+					}
+				case *pcap.FakeTCPConn:
+					if fecGroup > 0 {
+						fecConn, err := pcap.NewFECConn(conn, fecGroup, fecRatio)
+						if err != nil {
+							conn.Close()
+							log.Errorln(fmt.Errorf("fec: %w", err))
+							continue
+						}
+						conn = fecConn
+					}
+				default:
+					break
+				}
+
+				// Duplicate
+				switch unwrap(conn).(type) {
+				case *pcap.FakeTCPConn, *pcap.UDPConn, *pcap.FakeICMPConn:
+					if dupTimes > 1 {
+						dupConn, err := pcap.NewDupConn(conn, dupTimes, dupDelay, dupFilter, true)
+						if err != nil {
+							conn.Close()
+							log.Errorln(fmt.Errorf("duplicate: %w", err))
+							continue
+						}
+						conn = dupConn
+					}
+				default:
+					break
+				}
+
+				// Roam
+				if roam {
+					err := roamSession(conn)
+					if err != nil {
+						go conn.Close()
+						log.Errorln(fmt.Errorf("roam: %w", err))
+						continue
+					}
+				}
+
+				log.Infof("Connect from client %s\n", conn.RemoteAddr().String())
+
+				hi := &heartbeatIndicator{
+					last: time.Now().UnixNano(),
+					rtt:  -1,
+					done: make(chan struct{}),
+				}
+
+				clientsLock.Lock()
+				clients[conn.RemoteAddr().String()] = conn
+				heartbeats[conn] = hi
+				clientsLock.Unlock()
+
+				// Heartbeat
+				if keepalive > 0 {
+					routines.Add(1)
+					go func() {
+						defer routines.Done()
+						watch(conn, hi)
+					}()
+				}
+
+				routines.Add(1)
+				go func() {
+					defer routines.Done()
+					b := make([]byte, pcap.IPv4MaxSize)
+					for {
+						n, err := conn.Read(b)
+						if err != nil {
+							if isClosed() {
+								return
+							}
+							if errors.Is(err, io.EOF) {
+								log.Infof("Disconnect from client %s\n", conn.RemoteAddr())
+								removeNAT(conn)
+
+								clientsLock.Lock()
+								if clients[conn.RemoteAddr().String()] == conn {
+									delete(clients, conn.RemoteAddr().String())
+								}
+								delete(heartbeats, conn)
+								clientsLock.Unlock()
+								close(hi.done)
+
+								sessionsLock.Lock()
+								for session, si := range sessions {
+									if si.conn == conn {
+										delete(sessions, session)
+									}
+								}
+								sessionsLock.Unlock()
+								return
+							}
+							log.Errorln(fmt.Errorf("read listen: %w", err))
+							continue
+						}
+
+						atomic.StoreInt64(&hi.last, time.Now().UnixNano())
+
+						newB := make([]byte, n)
+						copy(newB, b[:n])
+						select {
+						case <-closed:
+							return
+						case c <- pcap.ConnBytes{Bytes: newB, Conn: conn}:
+						}
+					}
+				}()
+			}
+		}()
+	}
+
+	routines.Add(1)
+	go func() {
+		defer routines.Done()
+		for {
+			var cab pcap.ConnBytes
+			select {
+			case <-closed:
+				return
+			case cab = <-c:
+			}
+
+			err := handleListen(cab.Bytes, cab.Conn)
+			if err != nil {
+				log.Errorln(fmt.Errorf("handle listen in address %s: %w", cab.Conn.LocalAddr().String(), err))
+				log.Verbosef("Source: %s\nSize: %d Bytes\n\n", cab.Conn.RemoteAddr().String(), len(cab.Bytes))
+				continue
+			}
+		}
+	}()
+
+	if upConn6 != nil {
+		routines.Add(1)
+		go func() {
+			defer routines.Done()
+			for {
+				packet, err := upConn6.ReadPacket()
+				if err != nil {
+					if isClosed() {
+						return
+					}
+					log.Errorln(fmt.Errorf("read upstream in device %s: %w", upConn6.LocalDev().Alias(), err))
+					continue
+				}
+
+				err = handleUpstream(packet)
+				if err != nil {
+					log.Errorln(fmt.Errorf("handle upstream in device %s: %w", upConn6.LocalDev().Alias(), err))
+					log.Verboseln(packet)
+					continue
+				}
+			}
+		}()
+	}
+
+	if ready != nil {
+		close(ready)
+	}
+
+	if tunDev != nil {
+		b := make([]byte, pcap.IPv4MaxSize)
+		for {
+			n, err := tunDev.Read(b)
+			if err != nil {
+				if isClosed() {
+					return nil
+				}
+				log.Errorln(fmt.Errorf("read tun %s: %w", tunDev.Name(), err))
+				continue
+			}
+
+			err = handleTun(b[:n])
+			if err != nil {
+				log.Errorln(fmt.Errorf("handle tun %s: %w", tunDev.Name(), err))
+				log.Verbosef("Size: %d Bytes\n\n", n)
+				continue
+			}
+		}
+	}
+
+	for {
+		packet, err := upConn.ReadPacket()
+		if err != nil {
+			if isClosed() {
+				return nil
+			}
+			log.Errorln(fmt.Errorf("read upstream in device %s: %w", upConn.LocalDev().Alias(), err))
+			continue
+		}
+
+		err = handleUpstream(packet)
+		if err != nil {
+			log.Errorln(fmt.Errorf("handle upstream in device %s: %w", upConn.LocalDev().Alias(), err))
+			log.Verboseln(packet)
+			continue
+		}
+	}
+}
+
+// Close closes the server, and waits for its routines.
+func Close() {
+	if closed == nil || isClosed() {
+		return
+	}
+	close(closed)
+
+	// Close clients gracefully
+	var wg sync.WaitGroup
+	clientsLock.RLock()
+	for _, conn := range clients {
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			conn.Close()
+		}(conn)
+	}
+	clientsLock.RUnlock()
+	wg.Wait()
+
+	for _, handle := range listeners {
+		if handle != nil {
+			handle.Close()
+		}
+	}
+	if upConn != nil {
+		upConn.Close()
+	}
+	if upConn6 != nil {
+		upConn6.Close()
+	}
+	if tunDev != nil {
+		err := tunDev.Close()
+		if err != nil {
+			log.Errorln(fmt.Errorf("close tun %s: %w", tunDev.Name(), err))
+		}
+	}
+	routines.Wait()
+
+	// Restore rules
+	err := exec.RestoreIPForwarding()
+	if err != nil {
+		log.Errorln(fmt.Errorf("restore ip forwarding: %w", err))
+	}
+	err = exec.RestoreICMPEchoReply()
+	if err != nil {
+		log.Errorln(fmt.Errorf("restore icmp echo reply: %w", err))
+	}
+}
+
+func handleListen(contents []byte, conn net.Conn) error {
+	var (
+		err               error
+		embIndicator      *pcap.PacketIndicator
+		upstreamConn      pcap.Endpoint
+		upValue           uint16
+		newTransportLayer gopacket.Layer
+		payload           []byte
+		newNetworkLayer   gopacket.NetworkLayer
+		upIP              net.IP
+		newLinkLayerType  gopacket.LayerType
+		newLinkLayer      gopacket.Layer
+		fragments         [][]byte
+	)
+
+	// Empty payload
+	if len(contents) <= 0 {
+		// return errors.New("empty payload")
+		return nil
+	}
+
+	// Control message
+	if control.IsControl(contents) {
+		err := handleControl(contents, conn)
+		if err != nil {
+			return fmt.Errorf("handle control: %w", err)
+		}
+		return nil
+	}
+
+	pcap.CaptureInner(false, pcap.RoleClient, conn, contents)
+
+	// Parse embedded packet
+	embIndicator, err = pcap.ParseEmbPacket(contents)
+	if err != nil {
+		return fmt.Errorf("parse embedded packet: %w", err)
+	}
+
+	// Kernel routes and translates packets from TUN
+	if tunDev != nil {
+		err = redirectTun(contents, embIndicator, conn)
+		if err != nil {
+			return fmt.Errorf("redirect tun: %w", err)
+		}
+		return nil
+	}
+
+	// Decide upstream by the family
+	upstreamConn = upConn
+	if embIndicator.IPv6Layer() != nil {
+		if upConn6 == nil {
+			return errors.New("missing ipv6 upstream")
+		}
+		upstreamConn = upConn6
+	}
+
+	// Fragments are reassembled for PAT, for the transport layer is only in the first fragment and its checksum covers
+	// the whole packet
+	if embIndicator.IsFrag() {
+		if embIndicator.IPv6Layer() != nil {
+			embIndicator, err = listenDefrag6.Append(embIndicator)
+		} else {
+			embIndicator, err = listenDefrag.Append(embIndicator)
+		}
+		if err != nil {
+			return fmt.Errorf("defrag: %w", err)
+		}
+		if embIndicator == nil {
+			return nil
+		}
+	}
+
+	// Distribute port/Id by source and client address and protocol
+	if !embIndicator.IsFrag() {
+		var ok bool
+
+		// Flows from the same client share the same port/Id
+		q := quintuple{
+			src:      embIndicator.NATSrc().String(),
+			dst:      clientKey(conn),
+			protocol: embIndicator.NATProtocol(),
+		}
+		patLock.Lock()
+		upValue, ok = patMap[q]
+		if !ok {
+			// if ICMPv4 or ICMPv6 error is not in NAT, drop it
+			if t := embIndicator.TransportLayer().LayerType(); t == layers.LayerTypeICMPv4 && !embIndicator.ICMPv4Indicator().IsQuery() {
+				patLock.Unlock()
+				return errors.New("missing nat")
+			}
+			if t := embIndicator.TransportLayer().LayerType(); t == layers.LayerTypeICMPv6 && !embIndicator.ICMPv6Indicator().IsQuery() {
+				patLock.Unlock()
+				return errors.New("missing nat")
+			}
+
+			upValue, err = dist(embIndicator.TransportLayer().LayerType())
+			if err != nil {
+				patLock.Unlock()
+				return fmt.Errorf("distribute: %w", err)
+			}
+
+			patMap[q] = upValue
+		}
+		patLock.Unlock()
+	}
+
+	// Fragments are redirected with their network payloads
+	payload = embIndicator.Payload()
+	if embIndicator.TransportLayer() == nil {
+		payload = embIndicator.NetworkPayload()
+	}
+
+	// Create new transport layer
+	if embIndicator.TransportLayer() != nil {
+		switch t := embIndicator.TransportLayer().LayerType(); t {
+		case layers.LayerTypeTCP:
+			tcpLayer := embIndicator.TCPLayer()
+			temp := *tcpLayer
+			newTransportLayer = &temp
+
+			newTCPLayer := newTransportLayer.(*layers.TCP)
+
+			newTCPLayer.SrcPort = layers.TCPPort(upValue)
+		case layers.LayerTypeUDP:
+			udpLayer := embIndicator.UDPLayer()
+			temp := *udpLayer
+			newTransportLayer = &temp
+
+			newUDPLayer := newTransportLayer.(*layers.UDP)
+
+			newUDPLayer.SrcPort = layers.UDPPort(upValue)
+		case layers.LayerTypeICMPv4:
+			if embIndicator.ICMPv4Indicator().IsQuery() {
+				temp := *embIndicator.ICMPv4Indicator().ICMPv4Layer()
+				newTransportLayer = &temp
+
+				newICMPv4Layer := newTransportLayer.(*layers.ICMPv4)
+
+				newICMPv4Layer.Id = upValue
+			} else {
+				newTransportLayer = embIndicator.ICMPv4Indicator().NewPureICMPv4Layer()
+
+				newICMPv4Layer := newTransportLayer.(*layers.ICMPv4)
+
+				temp := *embIndicator.ICMPv4Indicator().EmbIPv4Layer()
+				newEmbIPv4Layer := &temp
+
+				newEmbIPv4Layer.DstIP = upstreamConn.LocalDev().IPAddr().IP
+
+				var (
+					err                  error
+					newEmbTransportLayer gopacket.Layer
+				)
+
+				embTransportLayerType := embIndicator.ICMPv4Indicator().EmbTransportLayer().LayerType()
+				switch embTransportLayerType {
+				case layers.LayerTypeTCP:
+					temp := *embIndicator.ICMPv4Indicator().EmbTCPLayer()
+					newEmbTransportLayer = &temp
+
+					newEmbTCPLayer := newEmbTransportLayer.(*layers.TCP)
+
+					newEmbTCPLayer.DstPort = layers.TCPPort(upValue)
+
+					err = newEmbTCPLayer.SetNetworkLayerForChecksum(newEmbIPv4Layer)
+				case layers.LayerTypeUDP:
+					temp := *embIndicator.ICMPv4Indicator().EmbUDPLayer()
+					newEmbTransportLayer = &temp
+
+					newEmbUDPLayer := newEmbTransportLayer.(*layers.UDP)
+
+					newEmbUDPLayer.DstPort = layers.UDPPort(upValue)
+
+					err = newEmbUDPLayer.SetNetworkLayerForChecksum(newEmbIPv4Layer)
+				case layers.LayerTypeICMPv4:
+					temp := *embIndicator.ICMPv4Indicator().EmbICMPv4Layer()
+					newEmbTransportLayer = &temp
+
+					if embIndicator.ICMPv4Indicator().IsEmbQuery() {
+						newEmbICMPv4Layer := newEmbTransportLayer.(*layers.ICMPv4)
+
+						newEmbICMPv4Layer.Id = upValue
+					}
+				default:
+					return fmt.Errorf("create transport layer: %w", fmt.Errorf("transport layer type %s not support", embTransportLayerType))
+				}
+				if err != nil {
+					return fmt.Errorf("create transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
+				}
+
+				payload, err := pcap.Serialize(newEmbIPv4Layer, newEmbTransportLayer.(gopacket.SerializableLayer))
+				if err != nil {
+					return fmt.Errorf("create transport layer: %w", fmt.Errorf("serialize: %w", err))
+				}
+
+				newICMPv4Layer.Payload = payload
+			}
+		case layers.LayerTypeICMPv6:
+			newTransportLayer = embIndicator.ICMPv6Indicator().NewPureICMPv6Layer()
+
+			if embIndicator.ICMPv6Indicator().IsQuery() {
+				payload = embIndicator.ICMPv6Indicator().QueryPayload(upValue)
+			} else {
+				temp := *embIndicator.ICMPv6Indicator().EmbIPv6Layer()
+				newEmbIPv6Layer := &temp
+
+				newEmbIPv6Layer.DstIP = upstreamConn.LocalDev().IPAddr().IP
+
+				var (
+					err                  error
+					newEmbTransportLayer gopacket.Layer
+					embPayload           []byte
+				)
+
+				embTransportLayerType := embIndicator.ICMPv6Indicator().EmbTransportLayer().LayerType()
+				switch embTransportLayerType {
+				case layers.LayerTypeTCP:
+					temp := *embIndicator.ICMPv6Indicator().EmbTCPLayer()
+					newEmbTransportLayer = &temp
+
+					newEmbTCPLayer := newEmbTransportLayer.(*layers.TCP)
+
+					newEmbTCPLayer.DstPort = layers.TCPPort(upValue)
+
+					err = newEmbTCPLayer.SetNetworkLayerForChecksum(newEmbIPv6Layer)
+				case layers.LayerTypeUDP:
+					temp := *embIndicator.ICMPv6Indicator().EmbUDPLayer()
+					newEmbTransportLayer = &temp
+
+					newEmbUDPLayer := newEmbTransportLayer.(*layers.UDP)
+
+					newEmbUDPLayer.DstPort = layers.UDPPort(upValue)
+
+					err = newEmbUDPLayer.SetNetworkLayerForChecksum(newEmbIPv6Layer)
+				case layers.LayerTypeICMPv6:
+					temp := *embIndicator.ICMPv6Indicator().EmbICMPv6Layer()
+					newEmbTransportLayer = &temp
+
+					newEmbICMPv6Layer := newEmbTransportLayer.(*layers.ICMPv6)
+
+					if embIndicator.ICMPv6Indicator().IsEmbQuery() {
+						embPayload = embIndicator.ICMPv6Indicator().EmbQueryPayload(upValue)
+					} else {
+						embPayload = newEmbICMPv6Layer.Payload
+					}
+
+					err = newEmbICMPv6Layer.SetNetworkLayerForChecksum(newEmbIPv6Layer)
+				default:
+					return fmt.Errorf("create transport layer: %w", fmt.Errorf("transport layer type %s not support", embTransportLayerType))
+				}
+				if err != nil {
+					return fmt.Errorf("create transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
+				}
+
+				data, err := pcap.Serialize(newEmbIPv6Layer, newEmbTransportLayer.(gopacket.SerializableLayer), gopacket.Payload(embPayload))
+				if err != nil {
+					return fmt.Errorf("create transport layer: %w", fmt.Errorf("serialize: %w", err))
+				}
+
+				payload = embIndicator.ICMPv6Indicator().ErrorPayload(data)
+			}
+		default:
+			return fmt.Errorf("transport layer type %s not support", t)
+		}
+	}
+
+	// Create new network layer
+	switch t := embIndicator.NetworkLayer().LayerType(); t {
+	case layers.LayerTypeIPv4:
+		ipv4Layer := embIndicator.NetworkLayer().(*layers.IPv4)
+		temp := *ipv4Layer
+		newNetworkLayer = &temp
+
+		newIPv4Layer := newNetworkLayer.(*layers.IPv4)
+
+		newIPv4Layer.SrcIP = upstreamConn.LocalDev().IPAddr().IP
+		upIP = newIPv4Layer.SrcIP
+	case layers.LayerTypeIPv6:
+		ipv6Layer := embIndicator.NetworkLayer().(*layers.IPv6)
+		temp := *ipv6Layer
+		newNetworkLayer = &temp
+
+		newIPv6Layer := newNetworkLayer.(*layers.IPv6)
+
+		newIPv6Layer.SrcIP = upstreamConn.LocalDev().IPAddr().IP
+		upIP = newIPv6Layer.SrcIP
+	default:
+		return fmt.Errorf("network layer type %s not support", t)
+	}
+
+	// Set network layer for transport layer
+	if newTransportLayer != nil {
+		switch t := newTransportLayer.LayerType(); t {
+		case layers.LayerTypeTCP:
+			tcpLayer := newTransportLayer.(*layers.TCP)
+
+			err = tcpLayer.SetNetworkLayerForChecksum(newNetworkLayer)
+		case layers.LayerTypeUDP:
+			udpLayer := newTransportLayer.(*layers.UDP)
+
+			err = udpLayer.SetNetworkLayerForChecksum(newNetworkLayer)
+		case layers.LayerTypeICMPv4:
+			break
+		case layers.LayerTypeICMPv6:
+			icmpv6Layer := newTransportLayer.(*layers.ICMPv6)
+
+			err = icmpv6Layer.SetNetworkLayerForChecksum(newNetworkLayer)
+		default:
+			return fmt.Errorf("transport layer type %s not support", t)
+		}
+		if err != nil {
+			return fmt.Errorf("set network layer for checksum: %w", err)
+		}
+	}
+
+	// Decide Loopback or Ethernet
+	if upstreamConn.IsLoop() {
+		newLinkLayerType = layers.LayerTypeLoopback
+	} else {
+		newLinkLayerType = layers.LayerTypeEthernet
+	}
+
+	// Create new link layer
+	switch newLinkLayerType {
+	case layers.LayerTypeLoopback:
+		newLinkLayer, err = pcap.CreateLoopbackLayer(newNetworkLayer)
+	case layers.LayerTypeEthernet:
+		newLinkLayer, err = pcap.CreateEthernetLayer(upstreamConn.LocalDev().HardwareAddr(), upstreamConn.RemoteDev().HardwareAddr(), newNetworkLayer)
+	default:
+		return fmt.Errorf("link layer type %s not support", newLinkLayerType)
+	}
+	if err != nil {
+		return fmt.Errorf("create link layer: %w", err)
+	}
+
+	// Fragment
+	fragments, err = pcap.CreateFragmentPackets(newLinkLayer, newNetworkLayer, newTransportLayer, payload, fragment)
+	if err != nil {
+		return fmt.Errorf("fragment: %w", err)
+	}
+
+	// Write packet data
+	for i, fragment := range fragments {
+		_, err = upstreamConn.Write(fragment)
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+		pcap.CaptureDevice(upstreamConn, pcap.RoleClient, conn, fragment)
+
+		if i == len(fragment)-1 {
+			log.Verbosef("Redirect an inbound %s packet: %s -> %s -> %s (%d Bytes)\n",
+				embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String(), embIndicator.Size())
+		} else {
+			log.Verbosef("Redirect an inbound %s packet: %s -> %s -> %s (...)\n",
+				embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String())
+		}
+	}
+
+	// NAT
+	if embIndicator.TransportLayer() != nil {
+		// Record the source and the source device of the packet
+		var (
+			guide  pcap.NATGuide
+			addNAT bool
+		)
+
+		switch t := embIndicator.TransportLayer().LayerType(); t {
+		case layers.LayerTypeTCP:
+			a := net.TCPAddr{
+				IP:   upIP,
+				Port: int(upValue),
+			}
+			guide = pcap.NATGuide{
+				Src:      a.String(),
+				Protocol: t,
+			}
+			addNAT = true
+		case layers.LayerTypeUDP:
+			a := net.UDPAddr{
+				IP:   upIP,
+				Port: int(upValue),
+			}
+			guide = pcap.NATGuide{
+				Src:      a.String(),
+				Protocol: t,
+			}
+			addNAT = true
+		case layers.LayerTypeICMPv4:
+			if embIndicator.ICMPv4Indicator().IsQuery() {
+				guide = pcap.NATGuide{
+					Src: addr.ICMPQueryAddr{
+						IP: upIP,
+						Id: upValue,
+					}.String(),
+					Protocol: t,
+				}
+				addNAT = true
+			}
+		case layers.LayerTypeICMPv6:
+			if embIndicator.ICMPv6Indicator().IsQuery() {
+				guide = pcap.NATGuide{
+					Src: addr.ICMPQueryAddr{
+						IP: upIP,
+						Id: upValue,
+					}.String(),
+					Protocol: t,
+				}
+				addNAT = true
+			}
+		default:
+			return fmt.Errorf("transport layer type %s not support", t)
+		}
+		if addNAT {
+			key := clientKey(conn)
+			natLock.Lock()
+			ni, ok := nat[guide]
+			if ok && ni.embSrc.String() == embIndicator.NATSrc().String() && ni.key == key {
+				ni.add(conn)
+			} else {
+				nat[guide] = &natIndicator{
+					src:    conn.RemoteAddr(),
+					key:    key,
+					embSrc: embIndicator.NATSrc(),
+					conns:  []net.Conn{conn},
+				}
+			}
+			natLock.Unlock()
+		}
+
+		// Keep alive
+		err = touch(embIndicator.NATProtocol(), upValue)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Statistics
+	if monitor != nil {
+		monitor.Add(conn.RemoteAddr().String(), stat.DirectionOut, uint(embIndicator.Size()))
+	}
+
+	return nil
+}
+
+func handleControl(contents []byte, conn net.Conn) error {
+	message, err := control.Parse(contents)
+	if err != nil {
+		return fmt.Errorf("parse: %w", err)
+	}
+
+	switch message.Type {
+	case control.TypeHop:
+		p, err := message.Port()
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", message.Type, err)
+		}
+
+		// The client hops from the connection in the same IP
+		a := &net.TCPAddr{
+			IP:   clientIP(conn.RemoteAddr()),
+			Port: int(p),
+		}
+		clientsLock.RLock()
+		old, ok := clients[a.String()]
+		clientsLock.RUnlock()
+		if !ok {
+			// The client has been migrated in its session
+			if roam {
+				return nil
+			}
+			return fmt.Errorf("missing client %s", a)
+		}
+
+		// Migrate NAT
+		natLock.Lock()
+		for _, ni := range nat {
+			ni.replace(old, conn)
+		}
+		natLock.Unlock()
+
+		// Closing may wait for the client
+		go old.Close()
+
+		log.Infof("Client %s hops to %s\n", a, conn.RemoteAddr())
+	case control.TypeHeartbeat:
+		t, err := message.Time()
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", message.Type, err)
+		}
+		rtt, err := message.RTT()
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", message.Type, err)
+		}
+
+		clientsLock.RLock()
+		hi, ok := heartbeats[conn]
+		clientsLock.RUnlock()
+		if ok {
+			atomic.StoreInt64(&hi.rtt, int64(rtt))
+		}
+
+		_, err = conn.Write(control.NewHeartbeatAck(t).Serialize())
+		if err != nil {
+			return fmt.Errorf("reply %s: %w", message.Type, err)
+		}
+
+		log.Verbosef("Receive heartbeat from client %s\n", conn.RemoteAddr())
+	default:
+		return fmt.Errorf("type %s not support", message.Type)
+	}
+
+	return nil
+}
+
+func handleUpstream(packet gopacket.Packet) error {
+	var (
+		err       error
+		indicator *pcap.PacketIndicator
+		frags     []*pcap.PacketIndicator
+		ni        *natIndicator
+		data      []byte
+	)
+
+	// Parse packet
+	indicator, err = pcap.ParsePacket(packet)
+	if err != nil {
+		return fmt.Errorf("parse packet: %w", err)
+	}
+
+	// Handle fragments
+	if indicator.IPv6Layer() != nil {
+		indicator, frags, err = defrag6.AppendOriginal(indicator)
+	} else {
+		indicator, frags, err = defrag.AppendOriginal(indicator)
+	}
+	if err != nil {
+		return fmt.Errorf("defrag: %w", err)
+	}
+	if indicator == nil {
+		return nil
+	}
+
+	// NAT
+	guide := pcap.NATGuide{
+		Src:      indicator.NATDst().String(),
+		Protocol: indicator.TransportLayer().LayerType(),
+	}
+	natLock.RLock()
+	ni, ok := nat[guide]
+	natLock.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	// Keep alive
+	var value uint16
+	switch indicator.NATProtocol() {
+	case layers.LayerTypeICMPv4:
+		value = indicator.ICMPv4Indicator().Id()
+	case layers.LayerTypeICMPv6:
+		value = indicator.ICMPv6Indicator().Id()
+	default:
+		value = indicator.DstPort()
+	}
+	err = touch(indicator.NATProtocol(), value)
+	if err != nil {
+		return err
+	}
+
+	// The transport layer is only in the first fragment, and its checksum covers the whole packet, so fragments are cut
+	// from the translated whole packet
+	var whole []byte
+	if len(frags) > 1 {
+		data, err = createUpstreamEmbPacket(indicator, ni, nil)
+		if err != nil {
+			return err
+		}
+
+		embIndicator, err := pcap.ParseEmbPacket(data)
+		if err != nil {
+			return fmt.Errorf("parse embedded packet: %w", err)
+		}
+		whole = embIndicator.NetworkPayload()
+	}
+
+	for _, frag := range frags {
+		data, err = createUpstreamEmbPacket(frag, ni, whole)
+		if err != nil {
+			return err
+		}
+
+		// Write packet data
+		conn := ni.conn()
+		if conn == nil {
+			return errors.New("missing connection")
+		}
+
+		_, err = conn.Write(data)
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+		pcap.CaptureInner(true, pcap.RoleClient, conn, data)
+
+		// Statistics
+		size := frag.MTU()
+		if monitor != nil {
+			monitor.Add(conn.RemoteAddr().String(), stat.DirectionIn, uint(size))
+		}
+
+		log.Verbosef("Redirect an outbound %s packet: %s <- %s <- %s (%d Bytes)\n",
+			frag.TransportProtocol(), ni.embSrc.String(), ni.src.String(), frag.Src(), size)
+	}
+
+	// Record DNS
+	if monitor != nil {
+		if indicator.DNSIndicator() != nil {
+			if indicator.DNSIndicator().IsResponse() {
+				name, ips := indicator.DNSIndicator().Answers()
+				if name != "" && len(ips) > 0 {
+					dnsLock.Lock()
+					for _, ip := range ips {
+						dns[ip.String()] = name
+						log.Verbosef("Record DNS record %s = %s\n", name, ip)
+					}
+					dnsLock.Unlock()
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// createUpstreamEmbPacket creates the embedded packet from the packet from upstream by the NAT. The fragment is cut from
+// the whole packet if it is given.
+func createUpstreamEmbPacket(frag *pcap.PacketIndicator, ni *natIndicator, whole []byte) ([]byte, error) {
+	var (
+		err               error
+		embTransportLayer gopacket.Layer
+		embNetworkLayer   gopacket.NetworkLayer
+		payload           []byte
+		data              []byte
+	)
+
+	// Fragments are redirected with their network payloads
+	payload = frag.Payload()
+	if frag.TransportLayer() == nil {
+		payload = frag.NetworkPayload()
+		if whole != nil {
+			payload, err = pcap.FragmentPayload(frag, whole)
+			if err != nil {
+				return nil, fmt.Errorf("cut fragment: %w", err)
+			}
+		}
+	}
+
+	// Create embedded transport layer
+	if frag.TransportLayer() != nil {
+		switch t := frag.TransportLayer().LayerType(); t {
+		case layers.LayerTypeTCP:
+			embTCPLayer := frag.TCPLayer()
+			temp := *embTCPLayer
+			embTransportLayer = &temp
+
+			newEmbTCPLayer := embTransportLayer.(*layers.TCP)
+
+			newEmbTCPLayer.DstPort = layers.TCPPort(ni.embSrc.(*net.TCPAddr).Port)
+		case layers.LayerTypeUDP:
+			embUDPLayer := frag.UDPLayer()
+			temp := *embUDPLayer
+			embTransportLayer = &temp
+
+			newEmbUDPLayer := embTransportLayer.(*layers.UDP)
+
+			newEmbUDPLayer.DstPort = layers.UDPPort(ni.embSrc.(*net.UDPAddr).Port)
+		case layers.LayerTypeICMPv4:
+			if frag.ICMPv4Indicator().IsQuery() {
+				embICMPv4Layer := frag.ICMPv4Indicator().ICMPv4Layer()
+				temp := *embICMPv4Layer
+				embTransportLayer = &temp
+
+				newEmbICMPv4Layer := embTransportLayer.(*layers.ICMPv4)
+
+				newEmbICMPv4Layer.Id = ni.embSrc.(*addr.ICMPQueryAddr).Id
+			} else {
+				embTransportLayer = frag.ICMPv4Indicator().NewPureICMPv4Layer()
+
+				newEmbICMPv4Layer := embTransportLayer.(*layers.ICMPv4)
+
+				temp := *frag.ICMPv4Indicator().EmbIPv4Layer()
+				newEmbEmbIPv4Layer := &temp
+
+				newEmbEmbIPv4Layer.SrcIP = ni.embSrcIP()
+
+				var (
+					err                     error
+					newEmbEmbTransportLayer gopacket.Layer
+				)
+
+				switch t := frag.ICMPv4Indicator().EmbTransportLayer().LayerType(); t {
+				case layers.LayerTypeTCP:
+					temp := *frag.ICMPv4Indicator().EmbTCPLayer()
+					newEmbEmbTransportLayer = &temp
+
+					newEmbEmbTCPLayer := newEmbEmbTransportLayer.(*layers.TCP)
+
+					newEmbEmbTCPLayer.SrcPort = layers.TCPPort(ni.embSrc.(*net.TCPAddr).Port)
+
+					err = newEmbEmbTCPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv4Layer)
+				case layers.LayerTypeUDP:
+					temp := *frag.ICMPv4Indicator().EmbUDPLayer()
+					newEmbEmbTransportLayer = &temp
+
+					newEmbEmbUDPLayer := newEmbEmbTransportLayer.(*layers.UDP)
+
+					newEmbEmbUDPLayer.SrcPort = layers.UDPPort(ni.embSrc.(*net.UDPAddr).Port)
+
+					err = newEmbEmbUDPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv4Layer)
+				case layers.LayerTypeICMPv4:
+					temp := *frag.ICMPv4Indicator().EmbICMPv4Layer()
+					newEmbEmbTransportLayer = &temp
+
+					if frag.ICMPv4Indicator().IsEmbQuery() {
+						newEmbEmbICMPv4Layer := newEmbEmbTransportLayer.(*layers.ICMPv4)
+
+						newEmbEmbICMPv4Layer.Id = ni.embSrc.(*addr.ICMPQueryAddr).Id
+					}
+				default:
+					return nil, fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("transport layer type %s not support", t))
+				}
+				if err != nil {
+					return nil, fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
+				}
+
+				payload, err := pcap.Serialize(newEmbEmbIPv4Layer, newEmbEmbTransportLayer.(gopacket.SerializableLayer))
+				if err != nil {
+					return nil, fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("serialize: %w", err))
+				}
+
+				newEmbICMPv4Layer.Payload = payload
+			}
+		case layers.LayerTypeICMPv6:
+			embTransportLayer = frag.ICMPv6Indicator().NewPureICMPv6Layer()
+
+			if frag.ICMPv6Indicator().IsQuery() {
+				payload = frag.ICMPv6Indicator().QueryPayload(ni.embSrc.(*addr.ICMPQueryAddr).Id)
+			} else {
+				temp := *frag.ICMPv6Indicator().EmbIPv6Layer()
+				newEmbEmbIPv6Layer := &temp
+
+				newEmbEmbIPv6Layer.SrcIP = ni.embSrcIP()
+
+				var (
+					err                     error
+					newEmbEmbTransportLayer gopacket.Layer
+					embEmbPayload           []byte
+				)
+
+				switch t := frag.ICMPv6Indicator().EmbTransportLayer().LayerType(); t {
+				case layers.LayerTypeTCP:
+					temp := *frag.ICMPv6Indicator().EmbTCPLayer()
+					newEmbEmbTransportLayer = &temp
+
+					newEmbEmbTCPLayer := newEmbEmbTransportLayer.(*layers.TCP)
+
+					newEmbEmbTCPLayer.SrcPort = layers.TCPPort(ni.embSrc.(*net.TCPAddr).Port)
+
+					err = newEmbEmbTCPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv6Layer)
+				case layers.LayerTypeUDP:
+					temp := *frag.ICMPv6Indicator().EmbUDPLayer()
+					newEmbEmbTransportLayer = &temp
+
+					newEmbEmbUDPLayer := newEmbEmbTransportLayer.(*layers.UDP)
+
+					newEmbEmbUDPLayer.SrcPort = layers.UDPPort(ni.embSrc.(*net.UDPAddr).Port)
+
+					err = newEmbEmbUDPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv6Layer)
+				case layers.LayerTypeICMPv6:
+					temp := *frag.ICMPv6Indicator().EmbICMPv6Layer()
+					newEmbEmbTransportLayer = &temp
+
+					newEmbEmbICMPv6Layer := newEmbEmbTransportLayer.(*layers.ICMPv6)
+
+					if frag.ICMPv6Indicator().IsEmbQuery() {
+						embEmbPayload = frag.ICMPv6Indicator().EmbQueryPayload(ni.embSrc.(*addr.ICMPQueryAddr).Id)
+					} else {
+						embEmbPayload = newEmbEmbICMPv6Layer.Payload
+					}
+
+					err = newEmbEmbICMPv6Layer.SetNetworkLayerForChecksum(newEmbEmbIPv6Layer)
+				default:
+					return nil, fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("transport layer type %s not support", t))
+				}
+				if err != nil {
+					return nil, fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
+				}
+
+				data, err := pcap.Serialize(newEmbEmbIPv6Layer, newEmbEmbTransportLayer.(gopacket.SerializableLayer), gopacket.Payload(embEmbPayload))
+				if err != nil {
+					return nil, fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("serialize: %w", err))
+				}
+
+				payload = frag.ICMPv6Indicator().ErrorPayload(data)
+			}
+		default:
+			return nil, fmt.Errorf("embedded transport layer type %s not support", t)
+		}
+	}
+
+	// Create embedded network layer
+	switch t := frag.NetworkLayer().LayerType(); t {
+	case layers.LayerTypeIPv4:
+		embIPv4Layer := frag.IPv4Layer()
+		temp := *embIPv4Layer
+		embNetworkLayer = &temp
+
+		newEmbIPv4Layer := embNetworkLayer.(*layers.IPv4)
+
+		newEmbIPv4Layer.DstIP = ni.embSrcIP()
+	case layers.LayerTypeIPv6:
+		embIPv6Layer := frag.IPv6Layer()
+		temp := *embIPv6Layer
+		embNetworkLayer = &temp
+
+		newEmbIPv6Layer := embNetworkLayer.(*layers.IPv6)
+
+		newEmbIPv6Layer.DstIP = ni.embSrcIP()
+	default:
+		return nil, fmt.Errorf("embedded network layer type %s not support", t)
+	}
+
+	// Set network layer for transport layer
+	if embTransportLayer != nil {
+		switch t := embTransportLayer.LayerType(); t {
+		case layers.LayerTypeTCP:
+			embTCPLayer := embTransportLayer.(*layers.TCP)
+
+			err = embTCPLayer.SetNetworkLayerForChecksum(embNetworkLayer)
+		case layers.LayerTypeUDP:
+			embUDPLayer := embTransportLayer.(*layers.UDP)
+
+			err = embUDPLayer.SetNetworkLayerForChecksum(embNetworkLayer)
+		case layers.LayerTypeICMPv4:
+			break
+		case layers.LayerTypeICMPv6:
+			embICMPv6Layer := embTransportLayer.(*layers.ICMPv6)
+
+			err = embICMPv6Layer.SetNetworkLayerForChecksum(embNetworkLayer)
+		default:
+			return nil, fmt.Errorf("embedded transport layer type %s not support", t)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("set embedded network layer for checksum: %w", err)
+		}
+	}
+
+	// Serialize layers
+	if embTransportLayer == nil {
+		data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
+			gopacket.Payload(payload))
+	} else {
+		data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
+			embTransportLayer.(gopacket.SerializableLayer),
+			gopacket.Payload(payload))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+
+	return data, nil
+}
+
+// redirectTun writes the packet from the client to the TUN device, and records the client by the source address of it.
+func redirectTun(contents []byte, embIndicator *pcap.PacketIndicator, conn net.Conn) error {
+	// NAT, which is guided by the source IP and the network layer in TUN
+	guide := pcap.NATGuide{
+		Src:      embIndicator.SrcIP().String(),
+		Protocol: embIndicator.NetworkLayer().LayerType(),
+	}
+	key := clientKey(conn)
+	natLock.Lock()
+	ni, ok := nat[guide]
+	if ok {
+		// The source may be used by only one client, or replies will be sent to another one
+		if ni.key != key {
+			natLock.Unlock()
+			return fmt.Errorf("source %s used by %s", guide.Src, ni.src)
+		}
+		ni.add(conn)
+	} else {
+		nat[guide] = &natIndicator{
+			src:    conn.RemoteAddr(),
+			key:    key,
+			embSrc: &net.IPAddr{IP: embIndicator.SrcIP()},
+			conns:  []net.Conn{conn},
+		}
+	}
+	natLock.Unlock()
+
+	// Route packets back to the source into TUN before any reply
+	if !ok {
+		err := tunDev.AddRoute(embIndicator.SrcIP())
+		if err != nil {
+			return fmt.Errorf("add route: %w", err)
+		}
+	}
+
+	_, err := tunDev.Write(contents)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	pcap.CaptureTun(tunDev.Name(), pcap.RoleClient, conn, contents)
+
+	log.Verbosef("Redirect an inbound %s packet: %s -> %s -> %s (%d Bytes)\n",
+		embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String(), embIndicator.Size())
+
+	// Statistics
+	if monitor != nil {
+		monitor.Add(conn.RemoteAddr().String(), stat.DirectionOut, uint(embIndicator.Size()))
+	}
+
+	return nil
+}
+
+func handleTun(contents []byte) error {
+	var (
+		err       error
+		indicator *pcap.PacketIndicator
+	)
+
+	// Parse packet
+	indicator, err = pcap.ParseEmbPacket(contents)
+	if err != nil {
+		return fmt.Errorf("parse packet: %w", err)
+	}
+
+	// Router solicitations and neighbor discoveries of the device itself
+	if t := indicator.TransportLayer(); t != nil && t.LayerType() == layers.LayerTypeICMPv6 {
+		if indicator.ICMPv6Indicator().IsNeighborDiscovery() {
+			return nil
+		}
+	}
+
+	// NAT
+	guide := pcap.NATGuide{
+		Src:      indicator.DstIP().String(),
+		Protocol: indicator.NetworkLayer().LayerType(),
+	}
+	natLock.RLock()
+	ni, ok := nat[guide]
+	natLock.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	// Write packet data
+	conn := ni.conn()
+	if conn == nil {
+		return errors.New("missing connection")
+	}
+
+	_, err = conn.Write(contents)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	pcap.CaptureInner(true, pcap.RoleClient, conn, contents)
+
+	// Statistics
+	size := indicator.Size()
+	if monitor != nil {
+		monitor.Add(conn.RemoteAddr().String(), stat.DirectionIn, uint(size))
+	}
+
+	log.Verbosef("Redirect an outbound %s packet: %s <- %s <- %s (%d Bytes)\n",
+		indicator.TransportProtocol(), indicator.Dst(), ni.src.String(), indicator.Src(), size)
+
+	// Record DNS
+	if monitor != nil {
+		if indicator.DNSIndicator() != nil {
+			if indicator.DNSIndicator().IsResponse() {
+				name, ips := indicator.DNSIndicator().Answers()
+				if name != "" && len(ips) > 0 {
+					dnsLock.Lock()
+					for _, ip := range ips {
+						dns[ip.String()] = name
+						log.Verbosef("Record DNS record %s = %s\n", name, ip)
+					}
+					dnsLock.Unlock()
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// clientIP returns the IP of the client in the address, which is shared by all flows of the client.
+func clientIP(a net.Addr) net.IP {
+	switch t := a.(type) {
+	case *net.TCPAddr:
+		return t.IP
+	case *net.UDPAddr:
+		return t.IP
+	case *net.IPAddr:
+		return t.IP
+	case *addr.ICMPQueryAddr:
+		return t.IP
+	default:
+		host, _, err := net.SplitHostPort(a.String())
+		if err != nil {
+			return net.ParseIP(a.String())
+		}
+		return net.ParseIP(host)
+	}
+}
+
+// clientKey returns the key of the client of the connection, which is shared by all flows of the client. Flows are
+// identified by their sessions, or by their own addresses if they are not in sessions.
+func clientKey(conn net.Conn) string {
+	fakeTCPConn, ok := unwrap(conn).(*pcap.FakeTCPConn)
+	if !ok {
+		return conn.RemoteAddr().String()
+	}
+
+	session, _ := fakeTCPConn.Session()
+	if session == nil {
+		return conn.RemoteAddr().String()
+	}
+
+	// Sessions of flows of a client differ only in the last byte
+	key := hex.EncodeToString(session[:len(session)-1])
+
+	// Sessions are bound to the IP of the client unless it roams
+	if !roam {
+		key = fmt.Sprintf("%s/%s", clientIP(conn.RemoteAddr()), key)
+	}
+
+	return key
+}
+
+// roamSession migrates the client in the same session from its last connection to the connection, if the address of
+// the client changes.
+func roamSession(conn net.Conn) error {
+	fakeTCPConn, ok := unwrap(conn).(*pcap.FakeTCPConn)
+	if !ok {
+		return nil
+	}
+
+	session, t := fakeTCPConn.Session()
+	if session == nil {
+		return nil
+	}
+
+	sessionsLock.Lock()
+	si, ok := sessions[string(session)]
+	if ok && !t.After(si.t) {
+		sessionsLock.Unlock()
+		return fmt.Errorf("replayed session from %s", conn.RemoteAddr())
+	}
+	sessions[string(session)] = &sessionIndicator{conn: conn, t: t}
+	sessionsLock.Unlock()
+
+	if !ok || si.conn.RemoteAddr().String() == conn.RemoteAddr().String() {
+		return nil
+	}
+	old := si.conn
+
+	// Migrate NAT
+	natLock.Lock()
+	for _, ni := range nat {
+		if ni.replace(old, conn) {
+			ni.src = conn.RemoteAddr()
+		}
+	}
+	natLock.Unlock()
+
+	// PAT needs no migration, for it is distributed by the session
+	// Closing may wait for the client
+	go old.Close()
+
+	log.Infof("Client %s roams to %s\n", old.RemoteAddr(), conn.RemoteAddr())
+
+	return nil
+}
+
+// watch disconnects the client if nothing is received from it for missed heartbeats.
+func watch(conn net.Conn, hi *heartbeatIndicator) {
+	timeout := keepalive * time.Duration(misses)
+
+	for {
+		select {
+		case <-hi.done:
+			return
+		case <-closed:
+			return
+		case <-time.After(keepalive):
+		}
+		if isClosed() {
+			return
+		}
+
+		idle := time.Now().Sub(time.Unix(0, atomic.LoadInt64(&hi.last)))
+		if idle > timeout {
+			log.Errorf("Client %s misses heartbeats in %.0f seconds, disconnect\n", conn.RemoteAddr(), idle.Seconds())
+
+			// The connection will be cleaned up after it is closed
+			conn.Close()
+			return
+		}
+	}
+}
+
+type clientStatus struct {
+	Address string `json:"address"`
+	RTT     int64  `json:"rtt"`
+	Idle    int    `json:"idle"`
+}
+
+// clientStatuses returns the liveness of clients.
+func clientStatuses() []clientStatus {
+	statuses := make([]clientStatus, 0)
+
+	clientsLock.RLock()
+	defer clientsLock.RUnlock()
+
+	for conn, hi := range heartbeats {
+		rtt := atomic.LoadInt64(&hi.rtt)
+		if rtt >= 0 {
+			rtt = time.Duration(rtt).Milliseconds()
+		}
+
+		statuses = append(statuses, clientStatus{
+			Address: conn.RemoteAddr().String(),
+			RTT:     rtt,
+			Idle:    int(time.Now().Sub(time.Unix(0, atomic.LoadInt64(&hi.last))).Seconds()),
+		})
+	}
+
+	return statuses
+}
+
+// removeNAT removes the connection from the NAT, and removes the NAT records which have no connections, with their
+// routes into TUN.
+func removeNAT(conn net.Conn) {
+	ips := make([]net.IP, 0)
+
+	natLock.Lock()
+	for guide, ni := range nat {
+		if !ni.remove(conn) {
+			delete(nat, guide)
+			if ip, ok := ni.embSrc.(*net.IPAddr); ok {
+				ips = append(ips, ip.IP)
+			}
+		}
+	}
+	natLock.Unlock()
+
+	if tunDev == nil {
+		return
+	}
+	for _, ip := range ips {
+		err := tunDev.DeleteRoute(ip)
+		if err != nil {
+			log.Errorln(fmt.Errorf("delete route: %w", err))
+		}
+	}
+}
+
+// touch keeps the port or the Id of the transport layer type alive.
+func touch(t gopacket.LayerType, value uint16) error {
+	patLock.Lock()
+	defer patLock.Unlock()
+
+	switch t {
+	case layers.LayerTypeTCP:
+		tcpPortPool[convertFromPort(value)] = time.Now()
+	case layers.LayerTypeUDP:
+		udpPortPool[convertFromPort(value)] = time.Now()
+	case layers.LayerTypeICMPv4:
+		icmpv4IdPool[value] = time.Now()
+	case layers.LayerTypeICMPv6:
+		icmpv6IdPool[value] = time.Now()
+	default:
+		return fmt.Errorf("transport layer type %s not support", t)
+	}
+
+	return nil
+}
+
+// dist distributes a port or an Id of the transport layer type. It must be called with the PAT locked.
+func dist(t gopacket.LayerType) (uint16, error) {
+	now := time.Now()
+
+	switch t {
+	case layers.LayerTypeTCP:
+		for i := 0; i < 16384; i++ {
+			s := nextTCPPort % 16384
+
+			// Point to next port
+			nextTCPPort++
+
+			// Check if the port is alive
+			last := tcpPortPool[s]
+			if now.Sub(last) > keepAlive {
+				if !last.IsZero() {
+					log.Verbosef("Recycle %s port %d\n", t, 49152+s)
+				}
+				return 49152 + s, nil
+			}
+		}
+	case layers.LayerTypeUDP:
+		for i := 0; i < 16384; i++ {
+			s := nextUDPPort % 16384
+
+			// Point to next port
+			nextUDPPort++
+
+			// Check if the port is alive
+			last := udpPortPool[s]
+			if now.Sub(last) > keepAlive {
+				if !last.IsZero() {
+					log.Verbosef("Recycle %s port %d\n", t, 49152+s)
+				}
+				return 49152 + s, nil
+			}
+		}
+	case layers.LayerTypeICMPv4:
+		for i := 0; i < 65536; i++ {
+			s := nextICMPv4Id
+
+			// Point to next Id
+			nextICMPv4Id++
+
+			// Check if the Id is alive
+			last := icmpv4IdPool[s]
+			if now.Sub(last) > keepAlive {
+				if !last.IsZero() {
+					log.Verbosef("Recycle %s ID %d\n", t, s)
+				}
+				return s, nil
+			}
+		}
+	case layers.LayerTypeICMPv6:
+		for i := 0; i < 65536; i++ {
+			s := nextICMPv6Id
+
+			// Point to next Id
+			nextICMPv6Id++
+
+			// Check if the Id is alive
+			last := icmpv6IdPool[s]
+			if now.Sub(last) > keepAlive {
+				if !last.IsZero() {
+					log.Verbosef("Recycle %s ID %d\n", t, s)
+				}
+				return s, nil
+			}
+		}
+	default:
+		return 0, fmt.Errorf("transport layer type %s not support", t)
+	}
+
+	return 0, fmt.Errorf("%s pool empty", t)
+}
+
+func convertFromPort(port uint16) uint16 {
+	return port - 49152
+}
+
+// unwrap returns the underlying connection of FEC and duplication.
+func unwrap(conn net.Conn) net.Conn {
+	for {
+		switch conn.(type) {
+		case *pcap.FECConn:
+			conn = conn.(*pcap.FECConn).Conn()
+		case *pcap.DupConn:
+			conn = conn.(*pcap.DupConn).Conn()
+		default:
+			return conn
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package tun
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// Device describes a TUN device, which reads and writes packets without link layers.
+type Device struct {
+	name       string
+	file       *os.File
+	routesLock sync.Mutex
+	routes     map[string]net.IP
+}
+
+// Create creates a TUN device in the name and brings it up with the MTU.
+func Create(name string, mtu int) (*Device, error) {
+	switch t := runtime.GOOS; t {
+	case "linux":
+		return create(name, mtu)
+	default:
+		return nil, fmt.Errorf("os %s not support", t)
+	}
+}
+
+// AddRoute routes packets to the IP into the device. Routes are deleted when the device is closed.
+func (dev *Device) AddRoute(ip net.IP) error {
+	var err error
+
+	switch t := runtime.GOOS; t {
+	case "linux":
+		err = addRoute(dev.name, ip)
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+	if err != nil {
+		return err
+	}
+
+	dev.routesLock.Lock()
+	dev.routes[ip.String()] = ip
+	dev.routesLock.Unlock()
+
+	return nil
+}
+
+// DeleteRoute deletes the route to the IP added before.
+func (dev *Device) DeleteRoute(ip net.IP) error {
+	dev.routesLock.Lock()
+	_, ok := dev.routes[ip.String()]
+	delete(dev.routes, ip.String())
+	dev.routesLock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	switch t := runtime.GOOS; t {
+	case "linux":
+		return deleteRoute(dev.name, ip)
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+}
+
+// Read reads a packet from the device.
+func (dev *Device) Read(b []byte) (int, error) {
+	return dev.file.Read(b)
+}
+
+// Write writes a packet to the device.
+func (dev *Device) Write(b []byte) (int, error) {
+	return dev.file.Write(b)
+}
+
+// Close deletes routes into the device and closes it.
+func (dev *Device) Close() error {
+	dev.routesLock.Lock()
+	routes := dev.routes
+	dev.routes = make(map[string]net.IP)
+	dev.routesLock.Unlock()
+
+	// Keep closing in case of failure
+	var routeErr error
+	for _, ip := range routes {
+		if runtime.GOOS != "linux" {
+			break
+		}
+		err := deleteRoute(dev.name, ip)
+		if err != nil {
+			routeErr = fmt.Errorf("delete route %s: %w", ip, err)
+		}
+	}
+
+	err := dev.file.Close()
+	if err != nil {
+		return err
+	}
+
+	return routeErr
+}
+
+// Name returns the name of the device.
+func (dev *Device) Name() string {
+	return dev.name
+}
+
+func (dev *Device) String() string {
+	return dev.name
+}
@@ -0,0 +1,81 @@
+package tun
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	iffTUN    = 0x0001
+	iffNoPI   = 0x1000
+	tunSetIFF = 0x400454ca
+)
+
+type ifReq struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+func create(name string, mtu int) (*Device, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+
+	// Packets are read and written without packet information
+	req := ifReq{flags: iffTUN | iffNoPI}
+	copy(req.name[:syscall.IFNAMSIZ-1], name)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunSetIFF, uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("ioctl: %w", errno)
+	}
+	name = string(bytes.TrimRight(req.name[:], "\x00"))
+
+	// Non-blocking file can be closed while reading
+	err = syscall.SetNonblock(fd, true)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("set nonblock: %w", err)
+	}
+
+	routeCmd := exec.Command("ip", "link", "set", "dev", name, "mtu", strconv.Itoa(mtu), "up")
+	_, err = routeCmd.CombinedOutput()
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("exec ip: %w", err)
+	}
+
+	return &Device{
+		name:   name,
+		file:   os.NewFile(uintptr(fd), "/dev/net/tun"),
+		routes: make(map[string]net.IP),
+	}, nil
+}
+
+func addRoute(name string, ip net.IP) error {
+	routeCmd := exec.Command("ip", "route", "replace", ip.String(), "dev", name)
+	_, err := routeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec ip: %w", err)
+	}
+
+	return nil
+}
+
+func deleteRoute(name string, ip net.IP) error {
+	routeCmd := exec.Command("ip", "route", "del", ip.String(), "dev", name)
+	_, err := routeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec ip: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,20 @@
+// +build !linux
+
+package tun
+
+import (
+	"errors"
+	"net"
+)
+
+func create(_ string, _ int) (*Device, error) {
+	return nil, errors.New("not support")
+}
+
+func addRoute(_ string, _ net.IP) error {
+	return errors.New("not support")
+}
+
+func deleteRoute(_ string, _ net.IP) error {
+	return errors.New("not support")
+}